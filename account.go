@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ChangeOwnPassword replaces the user's password after checking the current
+// one. Every other session is logged out.
+func (app *App) ChangeOwnPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "ChangeOwnPassword")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	var message struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+		ConfirmPassword string `json:"confirmPassword"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil || message.NewPassword == "" {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if message.NewPassword != message.ConfirmPassword {
+		BR(w, r, errors.New("Passwords do not match."), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if !user.CheckPassword(message.CurrentPassword) {
+		BR(w, r, errors.New(PASSWORD_INCORRECT_ERROR), http.StatusUnauthorized)
+		return
+	}
+
+	errM = app.ChangePassword(user, message.NewPassword)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.Email).Info("User changed password.")
+
+	errM = app.RevokeUserSessions(user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	app.SetToken(w, r, user)
+}
+
+// RequestEmailChange sends a confirmation link to the new address. The
+// address only changes once the link is followed, see Verify.
+func (app *App) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "RequestEmailChange")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	var message struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	address, err := mail.ParseAddress(message.Email)
+	if err != nil {
+		BR(w, r, errors.New(EMAIL_INVALID_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.Password != "" && !user.CheckPassword(message.Password) {
+		BR(w, r, errors.New(PASSWORD_INCORRECT_ERROR), http.StatusUnauthorized)
+		return
+	}
+
+	if strings.EqualFold(address.Address, user.Email) {
+		BR(w, r, errors.New(EMAIL_UNCHANGED_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if _, errM = app.Users.FindByEmail(address.Address); errM == nil {
+		BR(w, r, errors.New(EMAIL_TAKEN_ERROR), http.StatusConflict)
+		return
+	}
+
+	errM = app.SendEmailChangeMail(user, NormalizeEmail(address.Address))
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.Email).Info("User requested an e-mail change.")
+
+	ServeJSON(w, r, &Response{"status": fmt.Sprintf("A confirmation link has been sent to %s.", address.Address)},
+		http.StatusOK)
+}
+
+// DeleteSelf deletes the user's account. Users with a password have to enter
+// it, others have to type their e-mail address.
+func (app *App) DeleteSelf(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "DeleteSelf")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	var message struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.Password != "" && !user.CheckPassword(message.Password) {
+		BR(w, r, errors.New(PASSWORD_INCORRECT_ERROR), http.StatusUnauthorized)
+		return
+	} else if user.Password == "" && !strings.EqualFold(message.Email, user.Email) {
+		BR(w, r, errors.New(DELETE_CONFIRM_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	errM = app.DeleteUser(user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.ID.Hex()).Info("User deleted their account.")
+
+	ServeJSON(w, r, &Response{"status": "Your account has been deleted."}, http.StatusOK)
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if u.Password == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+// ChangeEmail switches the user to a confirmed new address. Confirming an
+// address also verifies the account.
+func (app *App) ChangeEmail(u *User, email string) *Error {
+	old := u.Email
+
+	email = NormalizeEmail(email)
+	u.Email = email
+	if u.Status == UNCONFIRMED.String() {
+		u.Status = UNREGISTERED.String()
+	}
+	errM := app.Users.Save(u)
+	if errM != nil {
+		u.Email = old
+		if errM.Code == http.StatusConflict {
+			return &Error{Reason: errors.New(EMAIL_TAKEN_ERROR), Code: http.StatusConflict}
+		}
+		return errM
+	}
+
+	// Bonus question answers are recorded by address.
+	return app.Questions.RenameRespondent(old, email)
+}
+
+// DeleteUser removes the user with their participants and scorecards, past
+// registrations, sessions and codes. Bonus question answers, audit entries
+// and sent mail are kept without the address, so statistics and the audit
+// trail still add up. Everything is removed in one transaction.
+func (app *App) DeleteUser(u *User) *Error {
+	anonymous := "deleted-user-" + u.ID.Hex()
+
+	return app.Atomically(func(app *App) *Error {
+		errM := app.Questions.RenameRespondent(u.Email, anonymous)
+		if errM != nil {
+			return errM
+		}
+
+		// The audit log, exports and outbox are only kept in a database.
+		if db, errM := app.DB(); errM == nil {
+			errM = removeUserRecords(db, u, anonymous)
+			if errM != nil {
+				return errM
+			}
+		}
+
+		errM = app.Globals.RemoveUserRegistrations(u.ID)
+		if errM != nil {
+			return errM
+		}
+
+		errM = app.Sessions.RemoveUser(u.ID)
+		if errM != nil {
+			return errM
+		}
+
+		errM = app.UserCodes.RemoveUser(u.ID)
+		if errM != nil {
+			return errM
+		}
+
+		return app.Users.Remove(u.ID)
+	})
+}
+
+// removeUserRecords anonymizes the user's audit entries and sent mail and
+// removes their data exports and the mail still waiting for them. Entries
+// about the user lose their changes, which hold the user's data.
+func removeUserRecords(db mongoDB, u *User, anonymous string) *Error {
+	_, err := db.C("audit").UpdateMany(db.ctx, bson.M{"actorId": u.ID}, bson.M{"$set": bson.M{"actor": anonymous}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error anonymizing audit entries: %s\n", err), Internal: true}
+	}
+
+	// Addresses were recorded as typed before they were stored in lower case.
+	email := bson.Regex{Pattern: "^" + regexp.QuoteMeta(u.Email) + "$", Options: "i"}
+	_, err = db.C("audit").UpdateMany(db.ctx, bson.M{"target": bson.M{"$in": []interface{}{email, u.ID.Hex()}}},
+		bson.M{"$set": bson.M{"target": anonymous}, "$unset": bson.M{"changes": ""}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error anonymizing audit entries: %s\n", err), Internal: true}
+	}
+
+	removals := []struct {
+		collection string
+		query      bson.M
+	}{
+		{"exports", bson.M{"user": u.ID}},
+		{"outbox", bson.M{"recipient": email, "status": bson.M{"$in": []string{OUTBOX_QUEUED, OUTBOX_FAILED}}}},
+	}
+	for _, removal := range removals {
+		_, err = db.C(removal.collection).DeleteMany(db.ctx, removal.query)
+		if err != nil {
+			return &Error{Reason: fmt.Errorf("Error removing user's %s: %s\n", removal.collection, err), Internal: true}
+		}
+	}
+
+	// Sent mail still counts towards its campaign.
+	_, err = db.C("outbox").UpdateMany(db.ctx, bson.M{"recipient": email},
+		bson.M{"$set": bson.M{"recipient": anonymous}, "$unset": bson.M{"body": "", "text": "", "lastError": ""}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error anonymizing user's mail: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
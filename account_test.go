@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDeleteUserAnonymizesAnswers(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	user := &User{ID: bson.NewObjectID(), Email: "jane@example.com",
+		Participants: []Participant{{ID: 1, FirstName: "Jane", Scorecard: [][]int{{1}}}}}
+	if errM := app.Users.Save(user); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	question := bson.M{"_id": bson.NewObjectID(), "respondents": []Respondent{
+		{User: "jane@example.com", AnsweredCorrectly: true},
+		{User: "john@example.com"},
+	}}
+	db.C("questions").InsertOne(db.ctx, question)
+	db.C("registrations").InsertOne(db.ctx, bson.M{"_id": bson.NewObjectID(), "user": user.ID})
+
+	if errM := app.DeleteUser(user); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	if n, _ := db.C("users").CountDocuments(db.ctx, bson.M{"_id": user.ID}); n != 0 {
+		t.Errorf("expected user to be removed")
+	}
+	if n, _ := db.C("registrations").CountDocuments(db.ctx, bson.M{"user": user.ID}); n != 0 {
+		t.Errorf("expected registrations to be removed")
+	}
+
+	var stored Question
+	db.C("questions").FindOne(db.ctx, bson.M{"_id": question["_id"]}).Decode(&stored)
+	if len(stored.Respondents) != 2 || stored.Respondents[0].User == "jane@example.com" || !stored.Respondents[0].AnsweredCorrectly {
+		t.Errorf("expected answer to be kept without the address got %+v", stored.Respondents)
+	}
+}
+
+func TestDeleteUserScrubsAuditAndMail(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	user := &User{ID: bson.NewObjectID(), Email: "jane@example.com"}
+	if errM := app.Users.Save(user); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	db.C("audit").InsertOne(db.ctx, AuditEntry{ID: bson.NewObjectID(), Actor: "admin@example.com",
+		Entity: "users", Target: "Jane@Example.com", Changes: []AuditField{{Field: "lastName", Before: "Doe", After: "Roe"}}})
+	db.C("outbox").InsertOne(db.ctx, OutboxMessage{ID: bson.NewObjectID(), Recipient: "jane@example.com",
+		Subject: "Welcome", Body: "Hi Jane", Status: OUTBOX_SENT})
+	db.C("outbox").InsertOne(db.ctx, OutboxMessage{ID: bson.NewObjectID(), Recipient: "jane@example.com",
+		Subject: "Welcome", Body: "Hi Jane", Status: OUTBOX_QUEUED})
+
+	if errM := app.DeleteUser(user); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	var entry AuditEntry
+	db.C("audit").FindOne(db.ctx, bson.M{}).Decode(&entry)
+	if entry.Target == "Jane@Example.com" || len(entry.Changes) != 0 {
+		t.Errorf("expected audit entry about the user to be scrubbed got %+v", entry)
+	}
+
+	var messages []OutboxMessage
+	db.findAll("outbox", bson.M{}, &messages)
+	if len(messages) != 1 || messages[0].Recipient == "jane@example.com" || messages[0].Body != "" {
+		t.Errorf("expected sent mail to be kept without the address and body got %+v", messages)
+	}
+}
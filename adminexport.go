@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportColumn is a column admins can pick for a spreadsheet export. Users
+// refer to their organization by ID, so Value is given the names.
+type exportColumn struct {
+	Name   string
+	Header string
+	Value  func(u *User, p *Participant, orgs OrganizationNames) interface{}
+}
+
+var userExportColumns = []exportColumn{
+	{"email", "E-Mail", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Email }},
+	{"firstName", "First Name", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.FirstName }},
+	{"lastName", "Last Name", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.LastName }},
+	{"organization", "Organization", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return orgs[u.Organization] }},
+	{"team", "Team", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Team }},
+	{"family", "Family", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Family }},
+	{"role", "Role", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Role }},
+	{"status", "Status", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Status }},
+	{"referral", "Referral", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Referral }},
+	{"comment", "Comment", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Comment }},
+	{"participants", "Participants", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return len(u.Participants) }},
+	{"points", "Points", func(u *User, p *Participant, orgs OrganizationNames) interface{} {
+		points := 0
+		for _, participant := range u.Participants {
+			points += participant.Points
+		}
+		return points
+	}},
+	{"createdOn", "Created", func(u *User, p *Participant, orgs OrganizationNames) interface{} {
+		return formatExportTime(u.CreatedOn)
+	}},
+	{"lastLogin", "Last Login", func(u *User, p *Participant, orgs OrganizationNames) interface{} {
+		return formatExportTime(u.LastLogin)
+	}},
+}
+
+// participantExportColumns has one completion column per week of the
+// challenge, so it is built when needed.
+func participantExportColumns() []exportColumn {
+	columns := []exportColumn{
+		{"email", "E-Mail", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Email }},
+		{"firstName", "First Name", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return p.FirstName }},
+		{"lastName", "Last Name", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return p.LastName }},
+		{"ageRange", "Age Range", func(u *User, p *Participant, orgs OrganizationNames) interface{} {
+			return fmt.Sprintf("%d-%d", p.AgeRange[0], p.AgeRange[1])
+		}},
+		{"category", "Category", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return p.Category }},
+		{"commitment", "Commitment", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return p.Commitment }},
+		{"organization", "Organization", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return orgs[u.Organization] }},
+		{"team", "Team", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Team }},
+		{"family", "Family", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return u.Family }},
+		{"points", "Points", func(u *User, p *Participant, orgs OrganizationNames) interface{} { return p.Points }},
+	}
+
+	for week := range GenerateScorecard() {
+		week := week
+		columns = append(columns, exportColumn{fmt.Sprintf("week%d", week+1), fmt.Sprintf("Week %d", week+1),
+			func(u *User, p *Participant, orgs OrganizationNames) interface{} {
+				done := 0
+				if week < len(p.Scorecard) {
+					for _, day := range p.Scorecard[week] {
+						done += day
+					}
+				}
+				return done
+			}})
+	}
+
+	return columns
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ExportUsers streams the users the admin may see as a spreadsheet.
+func (app *App) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	app.exportSpreadsheet(w, r, "users", userExportColumns, LimitedUsersQuery, false)
+}
+
+// ExportParticipants streams the participants the admin may see as a
+// spreadsheet, one row per participant.
+func (app *App) ExportParticipants(w http.ResponseWriter, r *http.Request) {
+	app.exportSpreadsheet(w, r, "participants", participantExportColumns(), ParticipantsQuery, true)
+}
+
+func (app *App) exportSpreadsheet(w http.ResponseWriter, r *http.Request, name string, available []exportColumn,
+	scope func(u *User) (UserFilter, bool), perParticipant bool) {
+	ctx := logger.WithField("method", "exportSpreadsheet").WithField("export", name)
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	sheetFormat, ok := sheetFormats[format]
+	if !ok {
+		BR(w, r, errors.New(EXPORT_FORMAT_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	columns, err := SelectExportColumns(available, r.URL.Query().Get("columns"))
+	if err != nil {
+		BR(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	w.Header().Set("Content-Type", sheetFormat.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.%s\"", name,
+		time.Now().Format("2006-01-02"), format))
+
+	sheet, err := sheetFormat.New(w, strings.Title(name))
+	if err != nil {
+		ctx.WithError(err).Error("Failed to start spreadsheet.")
+		return
+	}
+
+	errM = app.WriteExport(sheet, user, columns, scope, perParticipant)
+	if errM != nil {
+		// The status is already sent, so the download just ends early.
+		ctx.WithError(errM.Reason).Error("Failed to write spreadsheet.")
+		return
+	}
+
+	ctx.WithField("user", user.Email).Info("Admin exported spreadsheet.")
+}
+
+// SelectExportColumns returns the named columns in the given order, or all of
+// them if none are named.
+func SelectExportColumns(available []exportColumn, names string) ([]exportColumn, error) {
+	if names == "" {
+		return available, nil
+	}
+
+	var columns []exportColumn
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, column := range available {
+			if column.Name == strings.TrimSpace(name) {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			valid := make([]string, len(available))
+			for i, column := range available {
+				valid[i] = column.Name
+			}
+			return nil, fmt.Errorf(EXPORT_COLUMN_ERROR, name, strings.Join(valid, ", "))
+		}
+	}
+
+	return columns, nil
+}
+
+// WriteExport writes the header and a row for each user or participant in
+// the admin's scope, reading users one at a time.
+func (app *App) WriteExport(sheet SheetWriter, admin *User, columns []exportColumn,
+	scope func(u *User) (UserFilter, bool), perParticipant bool) *Error {
+	organizations, errM := app.FindOrganizationNames()
+	if errM != nil {
+		return errM
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column.Header
+	}
+	err := sheet.WriteRow(header)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error writing spreadsheet: %s\n", err), Internal: true}
+	}
+
+	row := func(u *User, p *Participant) error {
+		values := make([]interface{}, len(columns))
+		for i, column := range columns {
+			values[i] = column.Value(u, p, organizations)
+		}
+		return sheet.WriteRow(values)
+	}
+
+	filter, ok := scope(admin)
+	if ok {
+		err = app.Users.Each(filter, func(u *User) error {
+			if !perParticipant {
+				return row(u, nil)
+			}
+
+			for i := range u.Participants {
+				if err := row(u, &u.Participants[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return &Error{Reason: fmt.Errorf("Error writing spreadsheet: %s\n", err), Internal: true}
+		}
+	}
+
+	err = sheet.Close()
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error writing spreadsheet: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
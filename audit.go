@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Admin requests are capped at maxAdminBody, which leaves room for imports.
+// Only bodies up to maxAuditBody are kept for the log.
+const (
+	defaultAuditLimit = 100
+	maxAuditBody      = 1 << 20
+	maxAdminBody      = 16 << 20
+)
+
+// auditHiddenWords mark request fields that are never logged, since the body
+// fallback has no JSON tags to hide them.
+var auditHiddenWords = []string{"password", "secret", "token", "code"}
+
+// AuditEntry records a single admin request that changed shared data.
+type AuditEntry struct {
+	ID      bson.ObjectID `bson:"_id" json:"id"`
+	Time    time.Time     `bson:"time" json:"time"`
+	ActorID bson.ObjectID `bson:"actorId" json:"actorId"`
+	Actor   string        `bson:"actor" json:"actor"`
+	Action  string        `bson:"action" json:"action"`
+	Entity  string        `bson:"entity" json:"entity"`
+	Target  string        `bson:"target,omitempty" json:"target,omitempty"`
+	Status  int           `bson:"status" json:"status"`
+	Changes []AuditField  `bson:"changes,omitempty" json:"changes,omitempty"`
+
+	// Request body, used as the new state when the handler records nothing better.
+	body []byte
+}
+
+// AuditField is a top-level field whose value differs before and after the request.
+type AuditField struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty" json:"after,omitempty"`
+}
+
+// AuditMiddleware writes an audit entry for every authenticated request that
+// changes admin data, so new admin endpoints are audited without extra work.
+// Handlers can add detail to the entry with AuditChange. Without a database
+// nothing is audited.
+func AuditMiddleware(app *App) negroni.Handler {
+	ctx := logger.WithField("method", "AuditMiddleware")
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		entity, ok := AuditedEntity(r)
+		token, hasToken := context.GetOk(r, "token")
+		if !ok || !hasToken {
+			next(w, r)
+			return
+		}
+
+		db, errM := app.DB()
+		if errM != nil {
+			next(w, r)
+			return
+		}
+
+		entry := &AuditEntry{
+			ID:      bson.NewObjectID(),
+			Time:    time.Now(),
+			ActorID: ObjectIDHex(token.(*jwt.Token).Claims["ID"].(string)),
+			Action:  r.Method + " " + r.URL.Path,
+			Entity:  entity,
+		}
+
+		// Keep a copy of a small body for the log and hand the handler the
+		// whole body again. Larger bodies are streamed without a copy.
+		r.Body = http.MaxBytesReader(w, r.Body, maxAdminBody)
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+		if err != nil {
+			BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if len(body) <= maxAuditBody {
+			entry.body = body
+		}
+
+		// The router clears the request context once it is done, so the
+		// entry is shared by pointer rather than read back afterwards.
+		context.Set(r, "audit", entry)
+		next(w, r)
+
+		if rw, ok := w.(negroni.ResponseWriter); ok {
+			entry.Status = rw.Status()
+		}
+
+		if actor, errM := app.Users.FindByID(entry.ActorID); errM == nil {
+			entry.Actor = actor.Email
+		}
+
+		errM = entry.Save(db)
+		if errM != nil {
+			ctx.WithError(errM.Reason).WithField("action", entry.Action).Error("Failed to write audit entry.")
+		}
+	})
+}
+
+// AuditedEntity reports whether a request changes admin data and, if so,
+// which kind of entity it touches.
+func AuditedEntity(r *http.Request) (string, bool) {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return "", false
+	}
+
+	if r.URL.Path == "/api/globals" {
+		return "globals", true
+	}
+
+	// Previews render a draft without changing anything.
+	if strings.HasSuffix(r.URL.Path, "/preview") {
+		return "", false
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/admin/"), "/")
+		return parts[0], true
+	}
+
+	return "", false
+}
+
+// AuditChange records what an admin request changed. Either state may be nil
+// when an entity is created or deleted. It does nothing for requests that
+// are not audited.
+func AuditChange(r *http.Request, target string, before, after interface{}) {
+	entry, ok := context.GetOk(r, "audit")
+	if !ok {
+		return
+	}
+
+	entry.(*AuditEntry).Target = target
+	entry.(*AuditEntry).Changes = AuditDiff(before, after)
+}
+
+func (app *App) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := bson.M{}
+	if actor := r.Form.Get("actor"); actor != "" {
+		query["actor"] = actor
+	}
+
+	if entity := r.Form.Get("entity"); entity != "" {
+		query["entity"] = entity
+	}
+
+	period := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if v := r.Form.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				BR(w, r, fmt.Errorf("The %s date must look like 2017-02-01T00:00:00Z.", param), http.StatusBadRequest)
+				return
+			}
+			period[operator] = t
+		}
+	}
+	if len(period) > 0 {
+		query["time"] = period
+	}
+
+	limit := defaultAuditLimit
+	if l := r.Form.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			BR(w, r, errors.New(BAD_CHOICE_ERROR), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	db, errM := app.DB()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	entries, errM := FindAuditEntries(db, query, limit)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(entries)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+func (e *AuditEntry) Save(db mongoDB) *Error {
+	// Fall back to the request body when the handler did not describe the
+	// change, leaving out fields that may hold secrets.
+	if e.Changes == nil && len(e.body) > 0 {
+		var after interface{}
+		if json.Unmarshal(e.body, &after) == nil {
+			for _, change := range AuditDiff(nil, after) {
+				if !auditHidden(change.Field) {
+					e.Changes = append(e.Changes, change)
+				}
+			}
+		}
+	}
+
+	_, err := db.C("audit").InsertOne(db.ctx, e)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error saving audit entry: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func FindAuditEntries(db mongoDB, query bson.M, limit int) (entries []AuditEntry, errM *Error) {
+	err := db.findAll("audit", query, &entries, sortBy("-time").SetLimit(int64(limit)))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving audit log: %s\n", err), Internal: true}
+		return
+	}
+
+	return
+}
+
+func auditHidden(field string) bool {
+	field = strings.ToLower(field)
+	for _, word := range auditHiddenWords {
+		if strings.Contains(field, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditDiff compares the JSON form of two states field by field, so fields
+// hidden from JSON such as passwords never end up in the log.
+func AuditDiff(before, after interface{}) (changes []AuditField) {
+	b, a := auditSnapshot(before), auditSnapshot(after)
+
+	var fields []string
+	for field := range b {
+		fields = append(fields, field)
+	}
+	for field := range a {
+		if _, ok := b[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		if !reflect.DeepEqual(b[field], a[field]) {
+			changes = append(changes, AuditField{Field: field, Before: b[field], After: a[field]})
+		}
+	}
+
+	return
+}
+
+func auditSnapshot(state interface{}) map[string]interface{} {
+	if state == nil {
+		return nil
+	}
+
+	var snapshot interface{}
+	b, err := json.Marshal(state)
+	if err != nil || json.Unmarshal(b, &snapshot) != nil || snapshot == nil {
+		return nil
+	}
+
+	if fields, ok := snapshot.(map[string]interface{}); ok {
+		return fields
+	}
+
+	return map[string]interface{}{"value": snapshot}
+}
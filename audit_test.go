@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuditedEntity(t *testing.T) {
+	for _, c := range []struct {
+		method, path, entity string
+		audited              bool
+	}{
+		{"POST", "/api/admin/news", "news", true},
+		{"PUT", "/api/admin/organizations/merge", "organizations", true},
+		{"POST", "/api/globals", "globals", true},
+		{"GET", "/api/admin/news", "", false},
+		{"POST", "/api/admin/email-templates/registration/preview", "", false},
+		{"POST", "/api/registration", "", false},
+	} {
+		r, _ := http.NewRequest(c.method, c.path, nil)
+		if entity, audited := AuditedEntity(r); entity != c.entity || audited != c.audited {
+			t.Errorf("%s %s: expected %q, %v got %q, %v", c.method, c.path, c.entity, c.audited, entity, audited)
+		}
+	}
+}
+
+func TestAuditDiffLeavesOutHiddenFields(t *testing.T) {
+	before := &User{Email: "jane@example.com", Password: "old", FirstName: "Jane"}
+	after := &User{Email: "jane@example.com", Password: "new", FirstName: "Janet"}
+
+	changes := AuditDiff(before, after)
+	if len(changes) != 1 || changes[0].Field != "firstName" || changes[0].Before != "Jane" || changes[0].After != "Janet" {
+		t.Errorf("expected only the first name to change got %+v", changes)
+	}
+
+	if changes := AuditDiff(nil, Response{"name": "Sample Gym"}); len(changes) != 1 || changes[0].Before != nil {
+		t.Errorf("expected a created entity to have no before got %+v", changes)
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	s := newAppTestServer(t, NewMongoApp(db))
+	admin := s.admin(GLOBAL_ADMIN)
+
+	// Handlers that describe nothing are logged from the body, without secrets.
+	code := s.do("POST", "/api/admin/faq", admin, Response{"question": "Why?", "answer": "Because.",
+		"category": "General", "adminPassword": "secret"}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("add faq: expected status 200 got %d", code)
+	}
+	s.do("POST", "/api/admin/news", admin, Response{"subject": "Hello", "body": "World"}, nil)
+
+	var entries []AuditEntry
+	if code := s.do("GET", "/api/admin/audit?entity=faq", admin, nil, &entries); code != http.StatusOK {
+		t.Fatalf("audit log: expected status 200 got %d", code)
+	}
+	if len(entries) != 1 || entries[0].Status != http.StatusOK || entries[0].Action != "POST /api/admin/faq" {
+		t.Fatalf("expected one faq entry got %+v", entries)
+	}
+	for _, change := range entries[0].Changes {
+		if change.Field == "adminPassword" {
+			t.Errorf("expected secret field to be left out of the log")
+		}
+	}
+	if len(entries[0].Changes) != 3 || !strings.HasSuffix(entries[0].Actor, "@example.com") {
+		t.Errorf("expected the actor and the body's other fields got %+v", entries[0])
+	}
+
+	if s.do("GET", "/api/admin/audit?limit=1", admin, nil, &entries); len(entries) != 1 || entries[0].Entity != "news" {
+		t.Errorf("expected the newest entry only got %+v", entries)
+	}
+	if s.do("GET", "/api/admin/audit?actor=nobody@example.com", admin, nil, &entries); len(entries) != 0 {
+		t.Errorf("expected no entries for another actor got %+v", entries)
+	}
+	if code := s.do("GET", "/api/admin/audit?from=yesterday", admin, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected a bad date to be rejected got %d", code)
+	}
+
+	// Bodies over the cap are refused before they are read whole.
+	big := Response{"question": strings.Repeat("x", maxAdminBody), "answer": "A", "category": "General"}
+	if code := s.do("POST", "/api/admin/faq", admin, big, nil); code == http.StatusOK {
+		t.Errorf("expected a body over the cap to be rejected")
+	}
+}
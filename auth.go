@@ -5,13 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-func Login(w http.ResponseWriter, r *http.Request) {
+func (app *App) Login(w http.ResponseWriter, r *http.Request) {
 	type UserData struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -30,18 +29,16 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-
-	user, errM := AuthUser(db, userData.Email, userData.Password)
+	user, errM := app.AuthUser(userData.Email, userData.Password)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	SetToken(w, r, user)
+	app.SetToken(w, r, user)
 }
 
-func SignUp(w http.ResponseWriter, r *http.Request) {
+func (app *App) SignUp(w http.ResponseWriter, r *http.Request) {
 	ctx := logger.WithField("method", "SignUp")
 
 	type UserData struct {
@@ -64,32 +61,23 @@ func SignUp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate confirmation code.
-	confirmationCode, errM := GenerateConfirmationCode()
-	if errM != nil {
-		HandleModelError(w, r, errM)
-		return
-	}
-
-	db := GetDB(w, r)
 	user := &User{FirstName: userData.FirstName, LastName: userData.LastName, Email: userData.Email,
-		Password: userData.Password, Status: UNCONFIRMED.String(), Role: USER.String(),
-		Code: confirmationCode}
-	errM = CreateUser(db, user)
+		Password: userData.Password, Status: UNCONFIRMED.String(), Role: USER.String()}
+	errM := app.CreateUser(user)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
 	// Send confirmation e-mail if all went well.
-	go SendVerificationMail(user)
+	app.SendVerificationMail(user)
 
 	ctx.WithField("user", user.Email).Info("User signed up but needs confirmation.")
 
-	SetToken(w, r, user)
+	app.SetToken(w, r, user)
 }
 
-func Verify(w http.ResponseWriter, r *http.Request) {
+func (app *App) Verify(w http.ResponseWriter, r *http.Request) {
 	ctx := logger.WithField("method", "Verify")
 
 	type Message struct {
@@ -104,14 +92,18 @@ func Verify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := FindUserByCode(db, message.Code)
+	user, userCode, errM := app.UseUserCode(message.Code, VERIFY_PURPOSE, EMAIL_PURPOSE)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	errM = user.Verify(db)
+	if userCode.Purpose == EMAIL_PURPOSE {
+		errM = app.ChangeEmail(user, userCode.Email)
+	} else {
+		user.Status = UNREGISTERED.String()
+		errM = app.Users.Save(user)
+	}
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -120,7 +112,7 @@ func Verify(w http.ResponseWriter, r *http.Request) {
 	ctx.WithField("user", user.Email).Info("User successfully verified.")
 
 	if !IsTokenSet(r) {
-		SetToken(w, r, user)
+		app.SetToken(w, r, user)
 		return
 	}
 
@@ -128,19 +120,17 @@ func Verify(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func ResendVerify(w http.ResponseWriter, r *http.Request) {
+func (app *App) ResendVerify(w http.ResponseWriter, r *http.Request) {
 	if IsTokenSet(r) {
 
 		tokenData := GetToken(w, r)
-		db := GetDB(w, r)
-
-		user, errM := GetUserFromToken(db, tokenData)
+		user, errM := app.GetUserFromToken(tokenData)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
 		}
 
-		errM = SendVerificationMail(user)
+		errM = app.SendVerificationMail(user)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
@@ -155,7 +145,7 @@ func ResendVerify(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+func (app *App) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	type Message struct {
 		Email string `json:"email"`
 	}
@@ -168,28 +158,18 @@ func ForgotPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := FindUserByEmail(db, message.Email)
+	user, errM := app.Users.FindByEmail(message.Email)
 	if errM != nil {
 		ServeJSON(w, r, &Response{"status": "ok"}, http.StatusOK)
 		return
 	}
 
-	// Generate code and save in DB. Then send email to user.
-	code, _ := GenerateConfirmationCode()
-	user.ResetCode = code
-	errM = user.Save(db)
-	if errM != nil {
-		ServeJSON(w, r, &Response{"status": "ok"}, http.StatusOK)
-		return
-	}
-
-	go SendResetPasswordMail(user)
+	app.SendResetPasswordMail(user)
 
 	ServeJSON(w, r, &Response{"status": "ok"}, http.StatusOK)
 }
 
-func ResetPassword(w http.ResponseWriter, r *http.Request) {
+func (app *App) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	ctx := logger.WithField("method", "ResetPassword")
 
 	type Message struct {
@@ -206,21 +186,20 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := FindUserByResetCode(db, message.Code)
-	if errM != nil {
-		HandleModelError(w, r, errM)
+	// Make sure passwords match before the code is used up.
+	if message.NewPassword != message.ConfirmPassword {
+		BR(w, r, errors.New("Passwords do not match."), http.StatusBadRequest)
 		return
 	}
 
-	// Make sure passwords match.
-	if message.NewPassword != message.ConfirmPassword {
-		BR(w, r, errors.New("Passwords do not match."), http.StatusBadRequest)
+	user, _, errM := app.UseUserCode(message.Code, RESET_PURPOSE)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
 	// Update user.
-	errM = ChangePassword(db, user, message.NewPassword)
+	errM = app.ChangePassword(user, message.NewPassword)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -228,38 +207,76 @@ func ResetPassword(w http.ResponseWriter, r *http.Request) {
 
 	ctx.WithField("user", user.Email).Info("User successfully changed password.")
 
-	if !IsTokenSet(r) {
-		SetToken(w, r, user)
+	// Log out every other session and hand this one a fresh token.
+	errM = app.RevokeUserSessions(user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
-	ServeJSON(w, r, &Response{"status": "ok"}, http.StatusOK)
-	return
+	app.SetToken(w, r, user)
 }
 
-func SetToken(w http.ResponseWriter, r *http.Request, user *User) {
-	ctx := logger.WithField("method", "SetToken")
+// SetToken logs the user in. Users with two-factor authentication, or who
+// have to enroll in it, get a challenge to complete instead of a session.
+func (app *App) SetToken(w http.ResponseWriter, r *http.Request, user *User) {
 
-	t := jwt.New(jwt.GetSigningMethod("RS256"))
-	t.Claims["ID"] = user.ID.Hex()
-	t.Claims["iat"] = time.Now().Unix()
-	t.Claims["exp"] = time.Now().Add(time.Minute * 60 * 24 * 14).Unix()
-	tokenString, err := t.SignedString(signKey)
-	if err != nil {
-		ISR(w, r, err)
+	if user.TOTPEnabled || user.TwoFactorRequired() {
+		challenge, errM := app.CreateChallenge(user)
+		if errM != nil {
+			HandleModelError(w, r, errM)
+			return
+		}
+
+		if user.TOTPEnabled {
+			ServeJSON(w, r, &Response{"twoFactorRequired": true, "challenge": challenge}, http.StatusOK)
+		} else {
+			ServeJSON(w, r, &Response{"twoFactorEnrollmentRequired": true, "challenge": challenge}, http.StatusOK)
+		}
 		return
 	}
 
-	db := GetDB(w, r)
+	response, errM := app.StartSession(r, user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, response, http.StatusOK)
+}
+
+// StartSession creates a session for the user and returns a short-lived
+// access token and the refresh token to get the next one with.
+func (app *App) StartSession(r *http.Request, user *User) (*Response, *Error) {
+	ctx := logger.WithField("method", "StartSession")
+
+	session, refreshToken, errM := app.CreateSession(user, r.UserAgent())
+	if errM != nil {
+		return nil, errM
+	}
+
+	tokenString, err := NewAccessToken(user, session)
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error signing token: %s\n", err), Internal: true}
+	}
+
+	// Only the login time is written. The user was loaded before a second
+	// factor was used up, so saving all of it would bring the code back.
 	user.LastLogin = time.Now()
-	user.Save(db)
+	app.Users.Update(user.ID, bson.M{"lastLogin": user.LastLogin})
+
+	// A pending login challenge has served its purpose.
+	if user.Challenge != "" {
+		app.Users.Update(user.ID, nil, "challenge", "challengeExpires")
+	}
+
 	ctx.WithField("user", user.Email).Debug("User token set.")
 
-	ServeJSON(w, r, &Response{"token": tokenString}, http.StatusOK)
-	return
+	return &Response{"token": tokenString, "refreshToken": refreshToken,
+		"expiresIn": int(accessTokenLifetime.Seconds())}, nil
 }
 
-func GetAuthStatus(w http.ResponseWriter, r *http.Request) {
+func (app *App) GetAuthStatus(w http.ResponseWriter, r *http.Request) {
 	if IsTokenSet(r) {
 		type UserData struct {
 			Email        string `json:"email"`
@@ -269,12 +286,12 @@ func GetAuthStatus(w http.ResponseWriter, r *http.Request) {
 			Picture      string `json:"picture,omitempty"`
 			Role         string `json:"role,omitempty"`
 			Status       string `json:"status,omitempty"`
+
+			TwoFactorEnabled bool `json:"twoFactorEnabled,omitempty"`
 		}
 
 		tokenData := GetToken(w, r)
-		db := GetDB(w, r)
-
-		user, errM := GetUserFromToken(db, tokenData)
+		user, errM := app.GetUserFromToken(tokenData)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
@@ -292,27 +309,3 @@ func GetAuthStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
-
-func IsAuthorized(w http.ResponseWriter, r *http.Request, role string) bool {
-	if IsTokenSet(r) {
-		tokenData := GetToken(w, r)
-		db := GetDB(w, r)
-
-		user, errM := GetUserFromToken(db, tokenData)
-		if errM != nil {
-			HandleModelError(w, r, errM)
-			return false
-		}
-
-		if strings.Contains(user.Role, role) {
-			return true
-		} else {
-			BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
-			return false
-		}
-
-	} else {
-		BR(w, r, errors.New(MISSING_TOKEN_ERROR), http.StatusUnauthorized)
-		return false
-	}
-}
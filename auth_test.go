@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Handler tests need a throwaway MongoDB, given by MONGODB_TEST_URL.
+func testDB(t *testing.T) mongoDB {
+	url := os.Getenv("MONGODB_TEST_URL")
+	if url == "" {
+		t.Skip("MONGODB_TEST_URL is not set.")
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatalf("could not connect to test database: %s", err)
+	}
+
+	db := newMongoDB(client.Database("nhc_test"))
+	if err := db.Drop(db.ctx); err != nil {
+		t.Fatalf("could not clear test database: %s", err)
+	}
+
+	return db
+}
+
+func TestSignUpSendsVerificationMail(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	logger = logrus.New()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	mailer, _ := NewCaptureMailer("")
+	MAILER = mailer
+
+	body := `{"firstName":"Jane","lastName":"Doe","email":"jane@example.com","password":"secret"}`
+	r, _ := http.NewRequest("POST", "/auth/signup", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	app.SignUp(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	user, errM := app.Users.FindByEmail("jane@example.com")
+	if errM != nil {
+		t.Fatalf("expected user to be created got %s", errM.Reason)
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 mail got %d", len(sent))
+	}
+
+	if sent[0].To != "jane@example.com" {
+		t.Errorf("expected mail to jane@example.com got %s", sent[0].To)
+	}
+
+	// Only the hash is stored, so take the code from the link in the mail.
+	i := strings.Index(sent[0].Text, "/verify/")
+	if i < 0 {
+		t.Fatalf("expected mail to contain a verification link")
+	}
+	code := strings.Fields(sent[0].Text[i+len("/verify/"):])[0]
+
+	verified, _, errM := app.UseUserCode(code, VERIFY_PURPOSE)
+	if errM != nil || verified.ID != user.ID {
+		t.Fatalf("expected code to belong to the new user")
+	}
+}
+
+func TestUserCodesAreSingleUseAndExpire(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	user := &User{ID: bson.NewObjectID(), Email: "jane@example.com"}
+
+	code, errM := app.IssueUserCode(user, RESET_PURPOSE)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	if _, _, errM = app.UseUserCode(code, VERIFY_PURPOSE); errM == nil || errM.Reason.Error() != CODE_INVALID_ERROR {
+		t.Errorf("expected code to only work for its purpose")
+	}
+
+	// A new code replaces the old one.
+	newCode, _ := app.IssueUserCode(user, RESET_PURPOSE)
+	if _, _, errM = app.UseUserCode(code, RESET_PURPOSE); errM == nil || errM.Reason.Error() != CODE_INVALID_ERROR {
+		t.Errorf("expected replaced code to be invalid")
+	}
+
+	db.C("users").InsertOne(db.ctx, user)
+	if _, _, errM = app.UseUserCode(newCode, RESET_PURPOSE); errM != nil {
+		t.Errorf("expected code to work got %s", errM.Reason)
+	}
+	if _, _, errM = app.UseUserCode(newCode, RESET_PURPOSE); errM == nil || errM.Reason.Error() != CODE_INVALID_ERROR {
+		t.Errorf("expected used code to be invalid")
+	}
+
+	expired, _ := app.IssueUserCode(user, VERIFY_PURPOSE)
+	db.C("user_codes").UpdateOne(db.ctx, bson.M{"hash": HashToken(expired)}, bson.M{"$set": bson.M{"expiresOn": time.Now()}})
+	if _, _, errM = app.UseUserCode(expired, VERIFY_PURPOSE); errM == nil || errM.Reason.Error() != CODE_EXPIRED_ERROR {
+		t.Errorf("expected expired code to be reported as expired")
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// command is a subcommand of the binary. Admin commands work on the database
+// through the same model functions as the API, so they need no tokens.
+type command struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(args []string) error
+}
+
+// commands is filled in by init, since the commands' usage refers back to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[-port port]", "Serve the API. This is the default.", runServe},
+		{"init", "", "Load the initial organizations, commitments and season.", runInit},
+		{"migrate", "[up|status|dry-run]", "Apply pending migrations, list all migrations or list what up would apply.", runMigrate},
+		{"reset-users", "", "Archive the current season's registrations and reset users to unregistered.", runResetUsers},
+		{"import", "[-dry-run] kind:path", "Import a CSV file of organizations, commitments or users, e.g. users:roster.csv.", runImport},
+		{"create-admin", "[-first-name name] [-last-name name] email", "Make a user a super global admin, creating it if needed, and mail a password reset link.", runCreateAdmin},
+		{"set-role", "email role", "Change a user's role and log the user out.", runSetRole},
+		{"list-orgs", "[-requests]", "List the approved organizations, or the requested ones.", runListOrgs},
+		{"merge-orgs", "[-name name] org org...", "Merge organizations, given by ID or name, into the first one.", runMergeOrgs},
+		{"send-test-mail", "[-template name] address", "Send an e-mail template with sample data, to check the mail transport.", runSendTestMail},
+		{"export", "[-format csv|xlsx] [-columns a,b] [-o file] users|participants", "Export users or participants as a spreadsheet.", runExport},
+	}
+}
+
+// RunCommand runs the named command. No name serves the API.
+func RunCommand(args []string) error {
+	if len(args) == 0 {
+		return runServe(nil)
+	}
+
+	for _, c := range commands {
+		if c.Name == args[0] {
+			return c.Run(args[1:])
+		}
+	}
+
+	if args[0] != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %s.\n\n", args[0])
+	}
+	usage()
+	return flag.ErrHelp
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: nhc-api [flags] <command> [arguments]\n\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.Name, c.Summary)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// newFlagSet returns the flags of a command. Its usage names the command's
+// arguments.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.Name == name {
+				fmt.Fprintf(os.Stderr, "Usage: nhc-api %s %s\n\n%s\n", c.Name, c.Args, c.Summary)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// openDatabase connects to the database and loads the current season, which
+// most of the model depends on. Pending migrations are applied first unless
+// the command manages them itself.
+func openDatabase(migrate bool) (mongoDB, error) {
+	return prepareDatabase(DBOpen(DBConnect(MONGODB_URL)), migrate)
+}
+
+func prepareDatabase(db mongoDB, migrate bool) (mongoDB, error) {
+	ctx := logger.WithField("method", "prepareDatabase")
+
+	err := DBEnsureIndices(db)
+	if err != nil {
+		return db, fmt.Errorf("Error ensuring DB indices: %s\n", err)
+	}
+
+	SEASON, err = EnsureCurrentSeason(db)
+	if err != nil {
+		return db, err
+	}
+	GLOBALS = &SEASON.Globals
+
+	// Migrations have to run after globals are loaded.
+	if !migrate {
+		return db, nil
+	}
+
+	applied, err := Migrate(db, false)
+	if err != nil {
+		return db, fmt.Errorf("Error applying migrations: %s\n", err)
+	}
+	for _, m := range applied {
+		ctx.WithField("version", m.Version).Info("Applied migration: " + m.Description)
+	}
+
+	return db, nil
+}
+
+func runInit(args []string) error {
+	fs := newFlagSet("init")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Initializing comes first, since it creates the season the rest needs.
+	db := DBOpen(DBConnect(MONGODB_URL))
+	err := DBInit(db)
+	if err != nil {
+		return fmt.Errorf("Failed to initialize DB: %s\n", err)
+	}
+
+	db, err = prepareDatabase(db, true)
+	if err != nil {
+		return err
+	}
+
+	return EnsureEmailTemplates(db)
+}
+
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	mode := "up"
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	} else if fs.NArg() == 1 {
+		mode = fs.Arg(0)
+	}
+
+	// Only up writes. Status and dry runs just read what was applied, so they
+	// skip the indices and season that opening the database ensures.
+	if mode != "up" {
+		return RunMigrations(DBOpen(DBConnect(MONGODB_URL)), mode)
+	}
+
+	db, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+
+	return RunMigrations(db, mode)
+}
+
+func runResetUsers(args []string) error {
+	fs := newFlagSet("reset-users")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	return ResetUsers(db)
+}
+
+func runImport(args []string) error {
+	fs := newFlagSet("import")
+	dryRun := fs.Bool("dry-run", false, "Only check the file?")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	return ImportFile(db, fs.Arg(0), *dryRun)
+}
+
+func runCreateAdmin(args []string) error {
+	fs := newFlagSet("create-admin")
+	firstName := fs.String("first-name", "", "First name of a new admin.")
+	lastName := fs.String("last-name", "", "Last name of a new admin.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	app, err := openMailingApp()
+	if err != nil {
+		return err
+	}
+
+	user, errM := app.CreateAdmin(fs.Arg(0), *firstName, *lastName)
+	if errM != nil {
+		return errM.Reason
+	}
+
+	logger.WithField("method", "runCreateAdmin").WithField("user", user.Email).
+		Info("Made user a super global admin and sent a password reset link.")
+	return nil
+}
+
+func runSetRole(args []string) error {
+	fs := newFlagSet("set-role")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	user, errM := NewMongoApp(db).SetUserRole(fs.Arg(0), fs.Arg(1))
+	if errM != nil {
+		return errM.Reason
+	}
+
+	logger.WithField("method", "runSetRole").WithField("user", user.Email).WithField("role", user.Role).
+		Info("Changed user's role.")
+	return nil
+}
+
+func runListOrgs(args []string) error {
+	fs := newFlagSet("list-orgs")
+	requests := fs.Bool("requests", false, "List the organizations waiting for approval instead?")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	app := NewMongoApp(db)
+	find := app.Organizations.FindAll
+	if *requests {
+		find = app.Organizations.FindRequests
+	}
+
+	orgs, errM := find()
+	if errM != nil {
+		return errM.Reason
+	}
+
+	return WriteOrganizations(os.Stdout, orgs, *requests)
+}
+
+// WriteOrganizations lists organizations as a table, with who requested them
+// if asked.
+func WriteOrganizations(out io.Writer, orgs []Organization, requesters bool) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if requesters {
+		fmt.Fprintln(w, "ID\tNAME\tTIME ZONE\tREQUESTED BY")
+	} else {
+		fmt.Fprintln(w, "ID\tNAME\tTIME ZONE")
+	}
+
+	for _, org := range orgs {
+		if requesters {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", org.ID.Hex(), org.Name, org.TimeZone, strings.Join(org.Requesters, ", "))
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", org.ID.Hex(), org.Name, org.TimeZone)
+		}
+	}
+
+	return w.Flush()
+}
+
+func runMergeOrgs(args []string) error {
+	fs := newFlagSet("merge-orgs")
+	name := fs.String("name", "", "Name of the merged organization. Defaults to the first one's.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	app := NewMongoApp(db)
+	orgs, errM := app.FindOrganizationsByRef(fs.Args())
+	if errM != nil {
+		return errM.Reason
+	}
+
+	if *name == "" {
+		*name = orgs[0].Name
+	}
+
+	errM = app.MergeOrgs(orgs, *name)
+	if errM != nil {
+		return errM.Reason
+	}
+
+	logger.WithField("method", "runMergeOrgs").WithField("count", len(orgs)).WithField("name", *name).
+		Info("Merged organizations.")
+	return nil
+}
+
+func runSendTestMail(args []string) error {
+	fs := newFlagSet("send-test-mail")
+	template := fs.String("template", VERIFICATION_TEMPLATE, "Name of the e-mail template to send.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	kind, ok := emailTemplateKinds[*template]
+	if !ok {
+		return fmt.Errorf("Unknown e-mail template %s.", *template)
+	}
+
+	app, err := openMailingApp()
+	if err != nil {
+		return err
+	}
+
+	errM := app.SendTemplateMail(*template, []string{fs.Arg(0)}, kind.Samples[0])
+	if errM != nil {
+		return errM.Reason
+	}
+
+	logger.WithField("method", "runSendTestMail").WithField("template", *template).WithField("to", fs.Arg(0)).
+		Info("Sent test e-mail.")
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := newFlagSet("export")
+	format := fs.String("format", "csv", "Spreadsheet format: csv or xlsx.")
+	names := fs.String("columns", "", "Comma-separated columns to export, in order. Defaults to all of them.")
+	output := fs.String("o", "", "File to write to. Defaults to standard output.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	available, scope, perParticipant := userExportColumns, LimitedUsersQuery, false
+	switch fs.Arg(0) {
+	case "users":
+	case "participants":
+		available, scope, perParticipant = participantExportColumns(), ParticipantsQuery, true
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	sheetFormat, ok := sheetFormats[*format]
+	if !ok {
+		return errors.New(EXPORT_FORMAT_ERROR)
+	}
+
+	columns, err := SelectExportColumns(available, *names)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("Failed to create export file: %s\n", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	sheet, err := sheetFormat.New(out, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// The export sees what a super global admin would.
+	admin := &User{Role: GLOBAL_SUPER_ADMIN.String()}
+	errM := NewMongoApp(db).WriteExport(sheet, admin, columns, scope, perParticipant)
+	if errM != nil {
+		return errM.Reason
+	}
+
+	return nil
+}
+
+// openMailingApp opens the database for a command that sends e-mail. Without
+// an outbox, mail is sent right away.
+func openMailingApp() (*App, error) {
+	db, err := openDatabase(true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = EnsureEmailTemplates(db)
+	if err != nil {
+		return nil, fmt.Errorf("Error storing default e-mail templates: %s\n", err)
+	}
+
+	MAILER, err = NewMailer()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set up mail transport: %s\n", err)
+	}
+
+	return NewMongoApp(db), nil
+}
+
+// CreateAdmin makes the user with the address a super global admin, creating
+// a confirmed user if there is none, and mails a link to set a password. It
+// bootstraps the first admin of a new database.
+func (app *App) CreateAdmin(email, firstName, lastName string) (*User, *Error) {
+	user, errM := app.Users.FindByEmail(email)
+	if errM != nil && errM.Internal {
+		return nil, errM
+	} else if errM != nil {
+		// The password is never told to anyone. The admin sets one through
+		// the reset link.
+		user = &User{FirstName: firstName, LastName: lastName, Email: email, Password: RandToken(),
+			Status: UNREGISTERED.String(), Role: GLOBAL_SUPER_ADMIN.String()}
+		errM = app.CreateUser(user)
+		if errM != nil {
+			return nil, errM
+		}
+	} else if user.Role != GLOBAL_SUPER_ADMIN.String() {
+		user, errM = app.SetUserRole(email, GLOBAL_SUPER_ADMIN.String())
+		if errM != nil {
+			return nil, errM
+		}
+	}
+
+	errM = app.SendResetPasswordMail(user)
+	if errM != nil {
+		return nil, errM
+	}
+
+	return user, nil
+}
+
+// SetUserRole changes the role of the user with the address. The user has to
+// log in again to pick it up.
+func (app *App) SetUserRole(email, role string) (*User, *Error) {
+	if _, ok := ParseRole(role); !ok {
+		return nil, &Error{Reason: fmt.Errorf("Unknown role %s, expected one of %s.", role,
+			strings.Join(roles[:], ", ")), Code: http.StatusBadRequest}
+	}
+
+	user, errM := app.Users.FindByEmail(email)
+	if errM != nil {
+		return nil, errM
+	}
+
+	errM = app.Users.Update(user.ID, bson.M{"role": role})
+	if errM != nil {
+		return nil, errM
+	}
+	user.Role = role
+
+	errM = app.RevokeUserSessions(user)
+	if errM != nil {
+		return nil, errM
+	}
+
+	return user, nil
+}
+
+// FindOrganizationsByRef returns organizations given by ID or by name, in
+// order.
+func (app *App) FindOrganizationsByRef(refs []string) ([]Organization, *Error) {
+	var orgs []Organization
+	for _, ref := range refs {
+		var org *Organization
+		var errM *Error
+		if id, err := bson.ObjectIDFromHex(ref); err == nil {
+			org, errM = app.Organizations.FindByID(id)
+		} else {
+			org, errM = app.Organizations.FindByName(ref)
+		}
+		if errM != nil {
+			return nil, &Error{Reason: fmt.Errorf("Organization %s not found: %s", ref, errM.Reason),
+				Internal: errM.Internal, Code: errM.Code}
+		}
+
+		orgs = append(orgs, *org)
+	}
+
+	return orgs, nil
+}
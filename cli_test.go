@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCreateAdmin(t *testing.T) {
+	s := newTestServer(t)
+
+	admin, errM := s.app.CreateAdmin("jane@example.com", "Jane", "Doe")
+	if errM != nil {
+		t.Fatalf("expected admin to be created: %v", errM.Reason)
+	}
+	if admin.Role != GLOBAL_SUPER_ADMIN.String() || admin.Status != UNREGISTERED.String() {
+		t.Errorf("expected confirmed super global admin got %+v", admin)
+	}
+	if sent := s.mailer.Sent(); len(sent) != 1 || sent[0].To != "jane@example.com" {
+		t.Errorf("expected a password reset mail got %+v", sent)
+	}
+
+	s.app.CreateUser(&User{Email: "john@example.com", Password: "secret", Status: REGISTERED.String(),
+		Role: USER.String()})
+	promoted, errM := s.app.CreateAdmin("john@example.com", "", "")
+	if errM != nil || promoted.Status != REGISTERED.String() {
+		t.Fatalf("expected existing user to be kept got %+v: %v", promoted, errM)
+	}
+	stored, _ := s.app.Users.FindByEmail("john@example.com")
+	if stored.Role != GLOBAL_SUPER_ADMIN.String() {
+		t.Errorf("expected existing user to be promoted got %s", stored.Role)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	s := newTestServer(t)
+	s.app.CreateUser(&User{Email: "jane@example.com", Password: "secret", Role: USER.String()})
+
+	if _, errM := s.app.SetUserRole("jane@example.com", "owner"); errM == nil {
+		t.Errorf("expected unknown role to be rejected")
+	}
+	if _, errM := s.app.SetUserRole("nobody@example.com", GLOBAL_ADMIN.String()); errM == nil {
+		t.Errorf("expected missing user to be rejected")
+	}
+
+	_, errM := s.app.SetUserRole("jane@example.com", GLOBAL_ADMIN.String())
+	if errM != nil {
+		t.Fatalf("expected role to be set: %v", errM.Reason)
+	}
+	user, _ := s.app.Users.FindByEmail("jane@example.com")
+	if user.Role != GLOBAL_ADMIN.String() {
+		t.Errorf("expected global admin got %s", user.Role)
+	}
+}
+
+func TestFindOrganizationsByRef(t *testing.T) {
+	s := newTestServer(t)
+	s.app.Organizations.Create("Sample Gym", false)
+	s.app.Organizations.Create("Other Gym", false)
+	other, _ := s.app.Organizations.FindByName("Other Gym")
+
+	orgs, errM := s.app.FindOrganizationsByRef([]string{other.ID.Hex(), "Sample Gym"})
+	if errM != nil || len(orgs) != 2 || orgs[0].Name != "Other Gym" || orgs[1].Name != "Sample Gym" {
+		t.Fatalf("expected organizations in order got %+v: %v", orgs, errM)
+	}
+
+	if _, errM := s.app.FindOrganizationsByRef([]string{"Sample Gym", "Nowhere"}); errM == nil {
+		t.Errorf("expected missing organization to be rejected")
+	}
+
+	var out bytes.Buffer
+	WriteOrganizations(&out, orgs, false)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 ||
+		!strings.HasPrefix(lines[1], other.ID.Hex()) {
+		t.Errorf("expected a header and a row per organization got %q", out.String())
+	}
+}
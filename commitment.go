@@ -2,16 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"net/http"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Commitment struct {
-	ID    bson.ObjectId `bson:"_id" json:"-"`
+	ID    bson.ObjectID `bson:"_id" json:"-"`
 	Name  string        `bson:"name" json:"name"`
 	Links []struct {
 		Url   string `bson:"url,omitempty" json:"url,omitempty"`
@@ -20,9 +17,8 @@ type Commitment struct {
 	Commitments []string `bson:"commitments,omitempty" json:"commitments,omitempty"`
 }
 
-func GetCommitments(w http.ResponseWriter, r *http.Request) {
-	db := GetDB(w, r)
-	commitments, errM := FindCommitments(db)
+func (app *App) GetCommitments(w http.ResponseWriter, r *http.Request) {
+	commitments, errM := app.Commitments.FindAll()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -31,14 +27,3 @@ func GetCommitments(w http.ResponseWriter, r *http.Request) {
 	b, _ := json.Marshal(commitments)
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
-
-func FindCommitments(db *mgo.Database) (commitments []Commitment, errM *Error) {
-	c := db.C("commitments")
-	err := c.Find(nil).All(&commitments)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving commitments from DB: %s", err)), Internal: true}
-		return
-	}
-
-	return
-}
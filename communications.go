@@ -3,11 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type Message struct {
@@ -17,11 +13,7 @@ type Message struct {
 	Roles   []string `json:"roles"`
 }
 
-func SendMessage(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "admin") {
-		return
-	}
-
+func (app *App) SendMessage(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var message Message
 	err := decoder.Decode(&message)
@@ -35,8 +27,7 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -45,43 +36,57 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 	// If status selector, body or subject are empty, return an error.
 	if len(message.Status) == 0 || message.Body == "" || message.Subject == "" {
 		BR(w, r, errors.New(BAD_MESSAGE_ERROR), http.StatusBadRequest)
+		return
 	}
 
-	// Create main query.
-	query := bson.M{"status": bson.M{"$in": message.Status}}
+	// Create main filter.
+	filter := UserFilter{Statuses: message.Status}
 
-	// If user is a global admin, include the role selector, error out if it is empty.
-	if user.Role == GLOBAL_ADMIN.String() || user.Role == GLOBAL_SUPER_ADMIN.String() {
+	switch user.Scope(MESSAGES_SEND) {
+	case GLOBAL_SCOPE:
+		// Global admins pick the roles to send to, error out if there are none.
 		if len(message.Roles) == 0 {
 			BR(w, r, errors.New(BAD_MESSAGE_ERROR), http.StatusBadRequest)
+			return
 		}
-		query["role"] = bson.M{"$in": message.Roles}
+		filter.Roles = message.Roles
+	case ORG_SCOPE:
+		// Org admins only send to members of their org, org admins and below.
+		if user.Organization.IsZero() {
+			BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
+			return
+		}
+		filter.Organization = user.Organization
+		filter.Roles = []string{USER.String(), ORG_SUPER_ADMIN.String(), ORG_ADMIN.String()}
 	}
 
-	// If user is an org admin, limit to members in same org and only send to org admins and below.
-	if user.Role == ORG_ADMIN.String() || user.Role == ORG_SUPER_ADMIN.String() {
-		query["organization"] = user.Organization
-		query["role"] = bson.M{"$in": []string{USER.String(), ORG_SUPER_ADMIN.String(), ORG_ADMIN.String()}}
+	recipients, errM := app.GetRecipients(filter)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
 
-	recipients, errM := GetRecipients(db, query)
+	db, errM := app.DB()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	go SendBulkMail(recipients, message.Subject, message.Body)
+	campaign, errM := CreateCampaign(db, user, message.Subject, message.Body, recipients)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
 
-	ServeJSON(w, r, &Response{"status": "Messages sent."}, http.StatusOK)
+	AuditChange(r, campaign.ID.Hex(), nil, Response{"message": message, "recipients": len(recipients)})
+
+	ServeJSON(w, r, &Response{"status": "Messages queued.", "campaign": campaign.ID}, http.StatusOK)
 }
 
-func GetRecipients(db *mgo.Database, query bson.M) (recipients []string, errM *Error) {
-	c := db.C("users")
-	var users []User
-	err := c.Find(query).All(&users)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error finding recipient list: %s\n", err)),
-			Internal: true}
+func (app *App) GetRecipients(filter UserFilter) (recipients []string, errM *Error) {
+	users, errM := app.Users.Find(filter)
+	if errM != nil {
+		return
 	}
 
 	for _, u := range users {
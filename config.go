@@ -5,6 +5,9 @@ import "os"
 type Configuration struct {
 	FACEBOOK_SECRET string
 	GOOGLE_SECRET   string
+
+	// FACEBOOK_PAGE is the page mails point people to, if any.
+	FACEBOOK_PAGE string
 }
 
 var config *Configuration
@@ -13,5 +16,6 @@ func init() {
 	config = &Configuration{
 		FACEBOOK_SECRET: os.Getenv("FACEBOOK_SECRET"),
 		GOOGLE_SECRET:   os.Getenv("GOOGLE_SECRET"),
+		FACEBOOK_PAGE:   os.Getenv("FACEBOOK_PAGE"),
 	}
 }
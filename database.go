@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,90 +9,103 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-func DBConnect(address string) *mgo.Session {
+func DBConnect(address string) *mongo.Client {
 	ctx := logger.WithField("method", "DBConnect")
 	ctx.WithField("address", address).Info("Attempting to connect to mongodb server.")
-	session, err := mgo.Dial(address)
+
+	// mgo took bare host names, the driver wants a connection string.
+	if !strings.Contains(address, "://") {
+		address = "mongodb://" + address
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(address))
+	if err != nil {
+		panic(err)
+	}
+
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = client.Ping(timeout, nil)
 	if err != nil {
 		panic(err)
 	}
-	// Optional. Switch the session to a monotonic behavior.
-	session.SetMode(mgo.Monotonic, true)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for sig := range c {
 			ctx.WithField("signal", sig).Info("Signal captured - Closing database connection.")
-			session.Close()
+			client.Disconnect(context.Background())
 			os.Exit(1)
 		}
 	}()
 
-	return session
+	return client
 }
 
-func DBEnsureIndices(s *mgo.Session) (err error) {
-	i := mgo.Index{
-		Key:        []string{"email"},
-		Unique:     true,
-		Background: true,
-		Name:       "email",
-	}
-	err = s.DB(DBNAME).C("users").EnsureIndex(i)
-	if err != nil {
-		return
-	}
-
-	i = mgo.Index{
-		Key:        []string{"name"},
-		Unique:     true,
-		Background: true,
-		Name:       "name",
-	}
-
-	err = s.DB(DBNAME).C("organizations").EnsureIndex(i)
-	if err != nil {
-		return
-	}
-
-	i = mgo.Index{
-		Key:        []string{"name"},
-		Unique:     true,
-		Background: true,
-		Name:       "name",
-	}
+// DBOpen returns the application's database. Its queries are not bound to a
+// request.
+func DBOpen(client *mongo.Client) mongoDB {
+	return newMongoDB(client.Database(DBNAME))
+}
 
-	err = s.DB(DBNAME).C("commitments").EnsureIndex(i)
-	if err != nil {
-		return
-	}
+type index struct {
+	collection string
+	model      mongo.IndexModel
+}
 
-	i = mgo.Index{
-		Key:        []string{"code"},
-		Unique:     true,
-		Background: true,
-		Name:       "code",
-	}
+var indices = []index{
+	{"users", mongo.IndexModel{Keys: orderBy("email"), Options: options.Index().SetUnique(true).SetName("email")}},
+	{"users", mongo.IndexModel{Keys: orderBy("identities.provider", "identities.subject"),
+		Options: options.Index().SetUnique(true).SetSparse(true).SetName("identities")}},
+	{"users", mongo.IndexModel{Keys: orderBy("organization"), Options: options.Index().SetName("organization")}},
+	{"organizations", mongo.IndexModel{Keys: orderBy("name"), Options: options.Index().SetUnique(true).SetName("name")}},
+	{"commitments", mongo.IndexModel{Keys: orderBy("name"), Options: options.Index().SetUnique(true).SetName("name")}},
+	{"families", mongo.IndexModel{Keys: orderBy("code"), Options: options.Index().SetUnique(true).SetName("code")}},
+	{"seasons", mongo.IndexModel{Keys: orderBy("name"), Options: options.Index().SetUnique(true).SetName("name")}},
+	{"registrations", mongo.IndexModel{Keys: orderBy("season", "user"), Options: options.Index().SetUnique(true).SetName("season_user")}},
+	{"audit", mongo.IndexModel{Keys: orderBy("-time"), Options: options.Index().SetName("time")}},
+	{"audit", mongo.IndexModel{Keys: orderBy("actor", "-time"), Options: options.Index().SetName("actor_time")}},
+	{"email_templates", mongo.IndexModel{Keys: orderBy("name"), Options: options.Index().SetUnique(true).SetName("name")}},
+	{"sessions", mongo.IndexModel{Keys: orderBy("tokenHash"), Options: options.Index().SetName("tokenHash")}},
+	{"sessions", mongo.IndexModel{Keys: orderBy("previousHash"), Options: options.Index().SetSparse(true).SetName("previousHash")}},
+	{"sessions", mongo.IndexModel{Keys: orderBy("user"), Options: options.Index().SetName("user")}},
+	// Expired sessions are removed by Mongo a day after they run out.
+	{"sessions", mongo.IndexModel{Keys: orderBy("expiresOn"),
+		Options: options.Index().SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())).SetName("expiresOn")}},
+	{"rate_limits", mongo.IndexModel{Keys: orderBy("key"), Options: options.Index().SetName("key")}},
+	{"rate_limits", mongo.IndexModel{Keys: orderBy("expiresOn"), Options: options.Index().SetExpireAfterSeconds(1).SetName("expiresOn")}},
+	{"exports", mongo.IndexModel{Keys: orderBy("user"), Options: options.Index().SetName("user")}},
+	// Exports are removed as soon as their download link expires.
+	{"exports", mongo.IndexModel{Keys: orderBy("expiresOn"), Options: options.Index().SetExpireAfterSeconds(1).SetName("expiresOn")}},
+	{"user_codes", mongo.IndexModel{Keys: orderBy("hash"), Options: options.Index().SetUnique(true).SetName("hash")}},
+	{"user_codes", mongo.IndexModel{Keys: orderBy("user", "purpose"), Options: options.Index().SetName("user_purpose")}},
+	{"outbox", mongo.IndexModel{Keys: orderBy("status", "nextAttempt"), Options: options.Index().SetName("status_nextAttempt")}},
+	{"outbox", mongo.IndexModel{Keys: orderBy("campaign", "status"), Options: options.Index().SetName("campaign_status")}},
+}
 
-	err = s.DB(DBNAME).C("families").EnsureIndex(i)
-	if err != nil {
-		return
+func DBEnsureIndices(db mongoDB) error {
+	for _, i := range indices {
+		_, err := db.C(i.collection).Indexes().CreateOne(db.ctx, i.model)
+		if err != nil {
+			return fmt.Errorf("Error creating index on %s: %s", i.collection, err)
+		}
 	}
 
-	return
+	return nil
 }
 
-func DBInit(s *mgo.Session) error {
+func DBInit(db mongoDB) error {
 	ctx := logger.WithField("method", "DBInit")
 	ctx.Println("*** Performing Database initialization. ***")
-	db := s.DB(DBNAME)
 
 	// Import Organizations
 	organizations, err := ioutil.ReadFile(path.Join(APP_DIR, "organizations.json"))
@@ -105,15 +119,13 @@ func DBInit(s *mgo.Session) error {
 		return errors.New(fmt.Sprintf("Error unmarshalling orgs to JSON: %s\n", err))
 	}
 
-	uC := db.C("organizations")
-	err = uC.DropCollection()
-	if err != nil {
-		return fmt.Errorf("failed to drop organizations: %s", err)
-	}
+	// Organizations are added or approved rather than replaced, since users
+	// refer to them by ID.
+	app := NewMongoApp(db)
 	for _, org := range orgs {
-		err = uC.Insert(bson.M{"name": org, "needsApproval": false})
-		if err != nil {
-			return errors.New(fmt.Sprintf("Failed to write organizations to DB: %s\n", err))
+		errM := app.Organizations.Import(org, "")
+		if errM != nil {
+			return errors.New(fmt.Sprintf("Failed to write organizations to DB: %s\n", errM.Reason))
 		}
 	}
 
@@ -129,29 +141,32 @@ func DBInit(s *mgo.Session) error {
 		return errors.New(fmt.Sprintf("Error unmarshalling commitments to JSON: %s\n", err))
 	}
 
-	uC = db.C("commitments")
-	uC.DropCollection()
 	for _, commit := range commits {
-		commit.ID = bson.NewObjectId()
-		err = uC.Insert(commit)
+		_, err = db.C("commitments").UpdateOne(db.ctx, bson.M{"name": commit.Name},
+			bson.M{"$set": bson.M{"links": commit.Links, "commitments": commit.Commitments}}, upsert)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Failed to write commitments to DB: %s\n", err))
 		}
 	}
 
-	// Initialize Globals
-	globals := &Globals{}
-	globals.ChallengeStart = time.Date(2016, time.February, 01, 0, 0, 0, 0, time.Local)
-	globals.ChallengeEnd = time.Date(2016, time.February, 29, 0, 0, 0, 0, time.Local)
-	globals.ChallengeLength = globals.ChallengeEnd.YearDay() - globals.ChallengeStart.YearDay() + 1
-	globals.RegistrationOpen = true
-	globals.ScorecardEnabled = false
-
-	c := db.C("globals")
-	c.DropCollection()
-	err = c.Insert(globals)
+	// Initialize the first season. Existing seasons are kept so that their history survives.
+	count, err := db.C("seasons").CountDocuments(db.ctx, bson.M{})
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to write globals to DB: %s\n", err))
+		return fmt.Errorf("Failed to count seasons: %s\n", err)
+	}
+
+	if count == 0 {
+		season := &Season{ID: bson.NewObjectID(), Name: "NHC 2016", Current: true, CreatedOn: time.Now()}
+		season.ChallengeStart = time.Date(2016, time.February, 01, 0, 0, 0, 0, time.Local)
+		season.ChallengeEnd = time.Date(2016, time.February, 29, 0, 0, 0, 0, time.Local)
+		season.ChallengeLength = season.ChallengeDays()
+		season.RegistrationOpen = true
+		season.ScorecardEnabled = false
+
+		errM := app.Globals.SaveSeason(season)
+		if errM != nil {
+			return fmt.Errorf("Failed to write season to DB: %s\n", errM.Reason)
+		}
 	}
 
 	ctx.Println("*** Database initialization complete. ***")
@@ -160,70 +175,64 @@ func DBInit(s *mgo.Session) error {
 	// TODO: Import Resources
 }
 
-// Basic data integrity checks and clean-up.
-func DBEnsureIntegrity(s *mgo.Session) error {
+// DBEnsureIntegrity checks for and fixes inconsistencies that can come up
+// while running. Changes that are needed once are migrations instead.
+func DBEnsureIntegrity(db mongoDB) error {
 	ctx := logger.WithField("method", "DBEnsureIntegrity")
 	ctx.Println("*** Performing Database integrity checks. ***")
-	db := s.DB(DBNAME)
 
-	c := db.C("users")
-	// Set all pending users to registered.
-	change := mgo.Change{
-		Update:    bson.M{"$set": bson.M{"status": "registered"}},
-		ReturnNew: true,
-	}
-	changeInfo, err := c.Find(bson.M{"status": "pending"}).Apply(change, nil)
-	if err != nil && err != mgo.ErrNotFound {
-		return errors.New(fmt.Sprintf("Error setting pending users to registered: %s\n", err))
+	err := removeOrphanedOrganizations(db)
+	if err != nil {
+		return err
 	}
 
-	if changeInfo != nil {
-		ctx.WithField("updated", changeInfo.Updated).Info("Updated users from pending to registered.")
-	} else {
-		ctx.Println("No users updated from pending to registered.")
-	}
-	// Ensure every participant has a scorecard.
-	var registeredUsers []User
-	err = c.Find(bson.M{"status": "registered"}).All(&registeredUsers)
+	ctx.Println("*** Database integrity checks complete. ***")
+	return nil
+}
+
+// removeOrphanedOrganizations leaves users of organizations that no longer
+// exist without one. A merge or delete that failed halfway without a
+// transaction can leave them behind.
+func removeOrphanedOrganizations(db mongoDB) error {
+	ctx := logger.WithField("method", "removeOrphanedOrganizations")
+	c := db.C("users")
+
+	var ids []bson.ObjectID
+	err := c.Distinct(db.ctx, "organization", bson.M{"organization": bson.M{"$type": "objectId"}}).Decode(&ids)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error retrieving registered users: %s\n", err))
+		return fmt.Errorf("Error retrieving organizations of users: %s\n", err)
 	}
-	for _, user := range registeredUsers {
-		for index, _ := range user.Participants {
-			if user.Participants[index].Scorecard == nil {
-				user.Participants[index].Scorecard = GenerateScorecard()
-			}
+
+	for _, id := range ids {
+		count, err := db.C("organizations").CountDocuments(db.ctx, bson.M{"_id": id})
+		if err != nil {
+			return fmt.Errorf("Error counting organizations: %s\n", err)
+		} else if count > 0 {
+			continue
 		}
-		errM := user.Save(db)
-		if errM != nil {
-			return errM.Reason
+
+		result, err := c.UpdateMany(db.ctx, bson.M{"organization": id}, bson.M{"$unset": bson.M{"organization": ""}})
+		if err != nil {
+			return fmt.Errorf("Error updating users of organization %s: %s\n", id.Hex(), err)
 		}
+
+		ctx.WithField("organization", id.Hex()).WithField("updated", result.ModifiedCount).Warn("Removed references to a missing organization.")
 	}
 
-	ctx.Println("*** Database integrity checks complete. ***")
 	return nil
 }
 
-// ResetUsers sets all registered users to unregistered.
-func ResetUsers(s *mgo.Session) error {
+// ResetUsers archives the current season's registrations and sets all
+// registered users to unregistered.
+func ResetUsers(db mongoDB) error {
 	ctx := logger.WithField("method", "ResetUsers")
-	db := s.DB(DBNAME)
-
-	c := db.C("users")
-	var registeredUsers []User
-	err := c.Find(bson.M{"status": "registered"}).All(&registeredUsers)
-	if err != nil {
-		return fmt.Errorf("Error retrieving registered users: %s\n", err)
-	}
-	for _, user := range registeredUsers {
-		user.Status = UNREGISTERED.String()
-		errM := user.Save(db)
-		if errM != nil {
-			return errM.Reason
-		}
+	app := NewMongoApp(db)
+	errM := app.Atomically(func(app *App) *Error { return app.ArchiveRegistrations(SEASON) })
+	if errM != nil {
+		return errM.Reason
 	}
 
-	ctx.WithField("count", len(registeredUsers)).Info("Set all registered users to unregistered.")
+	ctx.WithField("season", SEASON.Name).Info("Set all registered users to unregistered.")
 
 	return nil
 }
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"reflect"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// The e-mails the API sends on its own. Each one is stored in the
+// email_templates collection under its name.
+const (
+	VERIFICATION_TEMPLATE         = "verification"
+	REGISTRATION_TEMPLATE         = "registration"
+	RESET_PASSWORD_TEMPLATE       = "reset-password"
+	EMAIL_CHANGE_TEMPLATE         = "email-change"
+	DATA_EXPORT_TEMPLATE          = "data-export"
+	ORGANIZATION_REQUEST_TEMPLATE = "organization-request"
+)
+
+type EmailTemplate struct {
+	ID        bson.ObjectID `bson:"_id" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Subject   string        `bson:"subject" json:"subject"`
+	HTML      string        `bson:"html" json:"html"`
+	Text      string        `bson:"text" json:"text"`
+	UpdatedOn time.Time     `bson:"updatedOn" json:"updatedOn"`
+	Variables []string      `bson:"-" json:"variables"`
+}
+
+// emailTemplateKind describes what a template is rendered with. Templates are
+// validated against every sample, so each branch a template may take should
+// be covered by one of them. The first sample is used for previews.
+type emailTemplateKind struct {
+	Default EmailTemplate
+	Samples []interface{}
+}
+
+var emailTemplateKinds = map[string]emailTemplateKind{
+	VERIFICATION_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: E-Mail Verification Required",
+			HTML: verificationEmail, Text: verificationText},
+		Samples: []interface{}{&VerificationTemplate{FirstName: "Jane", Code: "SAMPLECODE"}},
+	},
+	REGISTRATION_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: Registration Confirmation",
+			HTML: registrationEmail, Text: registrationText},
+		Samples: []interface{}{
+			&RegistrationConfirmationTemplate{FirstName: "Jane", Season: "2017", Family: "SAMPLEFAMILY", Donation: "ysb",
+				Facebook: "https://facebook.com/SAMPLEPAGE"},
+			&RegistrationConfirmationTemplate{FirstName: "Jane", Season: "2017", Donation: "cvim"},
+			&RegistrationConfirmationTemplate{FirstName: "Jane", Season: "2017"},
+		},
+	},
+	RESET_PASSWORD_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: Reset Password Request",
+			HTML: resetPasswordEmail, Text: resetPasswordText},
+		Samples: []interface{}{&ResetPasswordTemplate{FirstName: "Jane", Code: "SAMPLECODE"}},
+	},
+	EMAIL_CHANGE_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: Confirm Your New E-Mail Address",
+			HTML: emailChangeEmail, Text: emailChangeText},
+		Samples: []interface{}{&EmailChangeTemplate{FirstName: "Jane", Email: "jane@example.com", Code: "SAMPLECODE"}},
+	},
+	DATA_EXPORT_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: Your Data Export",
+			HTML: dataExportEmail, Text: dataExportText},
+		Samples: []interface{}{&DataExportTemplate{FirstName: "Jane",
+			Link: "https://api.nutritionhabitchallenge.com/api/user/export/SAMPLE", Expires: "March 1, 2017"}},
+	},
+	ORGANIZATION_REQUEST_TEMPLATE: {
+		Default: EmailTemplate{Subject: "Nutrition Habit Challenge: Organization Request",
+			HTML: organizationRequestEmail, Text: organizationRequestText},
+		Samples: []interface{}{
+			&OrganizationRequestTemplate{Organization: "Sample Gym", Outcome: "approved"},
+			&OrganizationRequestTemplate{Organization: "Sample Gym", Outcome: "merged", MergedInto: "Sample Fitness"},
+			&OrganizationRequestTemplate{Organization: "Sample Gym", Outcome: "rejected"},
+		},
+	},
+}
+
+func (app *App) GetEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, errM := app.FindEmailTemplates()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(templates)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+func (app *App) AddEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var t EmailTemplate
+	err := decoder.Decode(&t)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	err = t.Validate()
+	if err != nil {
+		BR(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	_, errM := app.FindEmailTemplate(t.Name)
+	if errM == nil {
+		BR(w, r, errors.New(EMAIL_TEMPLATE_EXISTS_ERROR), http.StatusConflict)
+		return
+	} else if errM.Code != http.StatusNotFound {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	t.ID = bson.NewObjectID()
+	errM = app.EmailTemplates.Save(&t)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	AuditChange(r, t.Name, nil, t)
+
+	ServeJSON(w, r, &Response{"emailTemplate": t}, http.StatusCreated)
+}
+
+func (app *App) EditEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var t EmailTemplate
+	err := decoder.Decode(&t)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+	t.Name = mux.Vars(r)["name"]
+
+	err = t.Validate()
+	if err != nil {
+		BR(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	old, errM := app.FindEmailTemplate(t.Name)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	t.ID = old.ID
+	errM = app.EmailTemplates.Save(&t)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	AuditChange(r, t.Name, old, t)
+
+	ServeJSON(w, r, &Response{"emailTemplate": t}, http.StatusOK)
+}
+
+// DeleteEmailTemplate removes a stored template, so the built-in default is
+// used until a new one is added.
+func (app *App) DeleteEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	old, errM := app.FindEmailTemplate(mux.Vars(r)["name"])
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	errM = app.EmailTemplates.Remove(old.Name)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	AuditChange(r, old.Name, old, nil)
+
+	ServeJSON(w, r, &Response{"status": "Template removed, the default will be used."}, http.StatusOK)
+}
+
+// PreviewEmailTemplate renders a template with sample data. A template sent
+// in the body is previewed instead of the stored one, so edits can be checked
+// before they are saved.
+func (app *App) PreviewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	kind, ok := emailTemplateKinds[name]
+	if !ok {
+		BR(w, r, errors.New(EMAIL_TEMPLATE_UNKNOWN_ERROR), http.StatusNotFound)
+		return
+	}
+
+	var t *EmailTemplate
+	if r.Method == "POST" {
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&t)
+		if err != nil {
+			BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+			return
+		}
+		t.Name = name
+
+		err = t.Validate()
+		if err != nil {
+			BR(w, r, err, http.StatusBadRequest)
+			return
+		}
+	} else {
+		var errM *Error
+		t, errM = app.FindEmailTemplateOrDefault(name)
+		if errM != nil {
+			HandleModelError(w, r, errM)
+			return
+		}
+	}
+
+	subject, body, text, err := t.Render(kind.Samples[0])
+	if err != nil {
+		BR(w, r, fmt.Errorf("%s %s", EMAIL_TEMPLATE_ERROR, err), http.StatusBadRequest)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"subject": subject, "html": body, "text": text}, http.StatusOK)
+}
+
+// Validate checks that the template belongs to a known e-mail and renders
+// with every sample of that e-mail, which catches unknown {{.Field}}s.
+func (t *EmailTemplate) Validate() error {
+	kind, ok := emailTemplateKinds[t.Name]
+	if !ok {
+		return errors.New(EMAIL_TEMPLATE_UNKNOWN_ERROR)
+	}
+
+	if t.Subject == "" || t.HTML == "" || t.Text == "" {
+		return errors.New(EMAIL_TEMPLATE_MISSING_ERROR)
+	}
+
+	for _, sample := range kind.Samples {
+		_, _, _, err := t.Render(sample)
+		if err != nil {
+			return fmt.Errorf("%s %s", EMAIL_TEMPLATE_ERROR, err)
+		}
+	}
+
+	return nil
+}
+
+// Render executes the subject, HTML and text parts of the template. Only the
+// HTML part is escaped.
+func (t *EmailTemplate) Render(data interface{}) (subject string, body string, text string, err error) {
+	execute := func(tmpl interface {
+		Execute(io.Writer, interface{}) error
+	}, parseErr error) (string, error) {
+		if parseErr != nil {
+			return "", parseErr
+		}
+
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+
+	subjectTmpl, err := template.New("subject").Option("missingkey=error").Parse(t.Subject)
+	if subject, err = execute(subjectTmpl, err); err != nil {
+		return
+	}
+
+	htmlTmpl, err := htmltemplate.New("html").Option("missingkey=error").Parse(t.HTML)
+	if body, err = execute(htmlTmpl, err); err != nil {
+		return
+	}
+
+	textTmpl, err := template.New("text").Option("missingkey=error").Parse(t.Text)
+	text, err = execute(textTmpl, err)
+
+	return
+}
+
+func (app *App) FindEmailTemplates() (templates []EmailTemplate, errM *Error) {
+	templates, errM = app.EmailTemplates.FindAll()
+	if errM != nil {
+		return
+	}
+
+	for i := range templates {
+		templates[i].Variables = EmailTemplateVariables(templates[i].Name)
+	}
+
+	return
+}
+
+func (app *App) FindEmailTemplate(name string) (*EmailTemplate, *Error) {
+	t, errM := app.EmailTemplates.FindByName(name)
+	if errM != nil {
+		return nil, errM
+	}
+
+	t.Variables = EmailTemplateVariables(t.Name)
+
+	return t, nil
+}
+
+// FindEmailTemplateOrDefault falls back to the built-in template when none is stored.
+func (app *App) FindEmailTemplateOrDefault(name string) (*EmailTemplate, *Error) {
+	t, errM := app.FindEmailTemplate(name)
+	if errM == nil || errM.Code != http.StatusNotFound {
+		return t, errM
+	}
+
+	kind, ok := emailTemplateKinds[name]
+	if !ok {
+		return nil, &Error{Reason: errors.New(EMAIL_TEMPLATE_UNKNOWN_ERROR), Code: http.StatusNotFound}
+	}
+
+	t = &kind.Default
+	t.Name = name
+	t.Variables = EmailTemplateVariables(name)
+
+	return t, nil
+}
+
+// RenderEmail renders the named template for sending.
+func (app *App) RenderEmail(name string, data interface{}) (subject string, body string, text string, errM *Error) {
+	t, errM := app.FindEmailTemplateOrDefault(name)
+	if errM != nil {
+		return
+	}
+
+	subject, body, text, err := t.Render(data)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error executing template %s: %s\n", name, err), Internal: true}
+	}
+
+	return
+}
+
+// EnsureEmailTemplates stores the built-in templates that are not in the
+// database yet, so admins have something to edit.
+func EnsureEmailTemplates(db mongoDB) error {
+	c := db.C("email_templates")
+	for name, kind := range emailTemplateKinds {
+		t := kind.Default
+		t.ID = bson.NewObjectID()
+		t.Name = name
+		t.UpdatedOn = time.Now()
+
+		_, err := c.UpdateOne(db.ctx, bson.M{"name": name}, bson.M{"$setOnInsert": t}, upsert)
+		if err != nil {
+			return fmt.Errorf("Error storing default e-mail template %s: %s\n", name, err)
+		}
+	}
+
+	return nil
+}
+
+// EmailTemplateVariables lists the fields a template can use.
+func EmailTemplateVariables(name string) (variables []string) {
+	kind, ok := emailTemplateKinds[name]
+	if !ok {
+		return
+	}
+
+	t := reflect.TypeOf(kind.Samples[0]).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		variables = append(variables, "."+t.Field(i).Name)
+	}
+
+	return
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestEmailTemplateValidate(t *testing.T) {
+	for name, kind := range emailTemplateKinds {
+		tmpl := kind.Default
+		tmpl.Name = name
+		if err := tmpl.Validate(); err != nil {
+			t.Errorf("expected default %s template to be valid got %s", name, err)
+		}
+	}
+
+	tmpl := emailTemplateKinds[REGISTRATION_TEMPLATE].Default
+	tmpl.Name = REGISTRATION_TEMPLATE
+	tmpl.Text = "Hi {{.FirstName}}, your code is {{.Code}}."
+	if err := tmpl.Validate(); err == nil {
+		t.Errorf("expected template with unknown field to be rejected")
+	}
+
+	tmpl = emailTemplateKinds[ORGANIZATION_REQUEST_TEMPLATE].Default
+	tmpl.Name = ORGANIZATION_REQUEST_TEMPLATE
+	tmpl.HTML = `{{if eq .Outcome "merged"}}{{.MergedInto.Name}}{{end}}`
+	if err := tmpl.Validate(); err == nil {
+		t.Errorf("expected template with a broken branch to be rejected")
+	}
+}
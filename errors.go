@@ -1,17 +1,76 @@
 package main
 
 const (
-	REQUIRED_ERROR       = "This is a required input."
-	PROFANITY_ERROR      = "Please don't use profanity. You're gooder than that."
-	BAD_CHOICE_ERROR     = "That is not a valid choice, please select from the available options."
-	INTERNAL_ERROR       = "Uh oh, something went wrong on our end. Please try again."
-	FAMILY_ERROR         = "The Family Code you entered does not exist. If you did not receive an existing code, leave this field blank."
-	ORGANIZATION_ERROR   = "The Organization you entered does not exist, please select from the available options."
-	FORBIDDEN_ERROR      = "You are not authorized to access this function."
-	MISSING_TOKEN_ERROR  = "Missing Token. Please log in to continue."
-	PARSE_ERROR          = "Failed to parse request."
-	BAD_MESSAGE_ERROR    = "Message is missing required fields."
-	MISSING_FIELDS_ERROR = "Your submissions was missing required fields."
+	REQUIRED_ERROR              = "This is a required input."
+	PROFANITY_ERROR             = "Please don't use profanity. You're gooder than that."
+	BAD_CHOICE_ERROR            = "That is not a valid choice, please select from the available options."
+	INTERNAL_ERROR              = "Uh oh, something went wrong on our end. Please try again."
+	FAMILY_ERROR                = "The Family Code you entered does not exist. If you did not receive an existing code, leave this field blank."
+	ORGANIZATION_ERROR          = "The Organization you entered does not exist, please select from the available options."
+	ORGANIZATION_REQUEST_ERROR  = "That organization request does not exist."
+	MERGE_DUPLICATE_ERROR       = "An organization cannot be merged into itself."
+	MERGE_NAME_ERROR            = "The merged organization needs a name."
+	SEASON_NOT_FOUND_ERROR      = "Season not found."
+	SEASON_EXISTS_ERROR         = "A season with that name already exists."
+	NO_DATABASE_ERROR           = "This feature is not available without a database."
+	FORBIDDEN_ERROR             = "You are not authorized to access this function."
+	MISSING_TOKEN_ERROR         = "Missing Token. Please log in to continue."
+	PARSE_ERROR                 = "Failed to parse request."
+	BAD_MESSAGE_ERROR           = "Message is missing required fields."
+	MISSING_FIELDS_ERROR        = "Your submissions was missing required fields."
+	TIMEZONE_ERROR              = "That is not a valid time zone."
+	CHALLENGE_DATES_ERROR       = "The challenge must end after it starts."
+	SCORECARD_DISABLED_ERROR    = "The scorecard is not open right now."
+	SCORECARD_SHAPE_ERROR       = "That scorecard does not match the challenge."
+	CHECKIN_DATE_ERROR          = "That date is not part of the challenge."
+	CHECKIN_FUTURE_ERROR        = "You can't check in for a day that hasn't happened yet."
+	CHECKIN_LOCKED_ERROR        = "That day is locked and can no longer be changed."
+	PARTICIPANT_NOT_FOUND_ERROR = "That participant does not exist."
+	LEADERBOARDS_DISABLED_ERROR = "Leaderboards are not available right now."
+	SESSION_INVALID_ERROR       = "Your session has expired. Please log in again."
+	RATE_LIMITED_ERROR          = "Too many attempts. Please wait a while and try again."
+	TWO_FACTOR_CODE_ERROR       = "That code is not valid."
+	TWO_FACTOR_SETUP_ERROR      = "Two-factor authentication has not been set up."
+	TWO_FACTOR_ENABLED_ERROR    = "Two-factor authentication is already enabled."
+	TWO_FACTOR_REQUIRED_ERROR   = "Admins must keep two-factor authentication enabled."
+	CHALLENGE_INVALID_ERROR     = "Your login has expired. Please log in again."
+	CODE_INVALID_ERROR          = "That link is not valid. It may have been used already."
+	CODE_EXPIRED_ERROR          = "That link has expired. Please request a new one."
+	PROVIDER_UNKNOWN_ERROR      = "That login provider is not supported."
+	PROVIDER_LOGIN_ERROR        = "The login could not be completed. Please try again."
+	PROVIDER_EMAIL_ERROR        = "You cannot sign up without sharing your email with NHC."
+	PROVIDER_LINKED_ERROR       = "There is already a %s account that belongs to a user."
+	PROVIDER_UNVERIFIED_ERROR   = "An account with this e-mail already exists. Log in with it to link your %s account."
+	IDENTITY_EXISTS_ERROR       = "You have already linked a %s account. Unlink it first to link another."
+	IDENTITY_NOT_FOUND_ERROR    = "That login provider is not linked to your account."
+	IDENTITY_LAST_ERROR         = "You cannot unlink your only way to log in. Set a password first."
+	PASSWORD_SET_ERROR          = "Your account already has a password."
+	PASSWORD_INCORRECT_ERROR    = "The password you entered is incorrect."
+	EMAIL_INVALID_ERROR         = "That is not a valid e-mail address."
+	EMAIL_UNCHANGED_ERROR       = "That is already your e-mail address."
+	EMAIL_TAKEN_ERROR           = "Another account already uses that e-mail address."
+	DELETE_CONFIRM_ERROR        = "Please type your e-mail address to confirm deleting your account."
+	EXPORT_NOT_FOUND_ERROR      = "That download link is not valid or has expired."
+	EXPORT_FORMAT_ERROR         = "Exports are available as csv or xlsx."
+	EXPORT_COLUMN_ERROR         = "Unknown column %q. Choose from: %s."
+	IMPORT_KIND_ERROR           = "You can import organizations, commitments or users."
+	IMPORT_PARSE_ERROR          = "That is not a valid CSV file: %s"
+	IMPORT_EMPTY_ERROR          = "The file is empty."
+	IMPORT_COLUMN_ERROR         = "Unknown column. Columns are: %s."
+	IMPORT_MISSING_COLUMN_ERROR = "This column is required."
+	IMPORT_REQUIRED_ERROR       = "This field is required."
+	IMPORT_DUPLICATE_ERROR      = "Same as row %d."
+	IMPORT_ORGANIZATION_ERROR   = "There is no such organization."
+	IMPORT_ROLE_ERROR           = "There is no such role."
+	IMPORT_ROLE_DENIED_ERROR    = "You can only give out roles below your own, to users below you."
+	IMPORT_USER_DENIED_ERROR    = "You can only change users below you."
+	ACCOUNT_LOCKED_ERROR        = "This account is locked after too many failed logins. Please try again later or reset your password."
+
+	EMAIL_TEMPLATE_ERROR           = "The e-mail template could not be rendered:"
+	EMAIL_TEMPLATE_UNKNOWN_ERROR   = "There is no e-mail with that name."
+	EMAIL_TEMPLATE_MISSING_ERROR   = "An e-mail template needs a subject, an HTML body and a text body."
+	EMAIL_TEMPLATE_EXISTS_ERROR    = "That e-mail template already exists."
+	EMAIL_TEMPLATE_NOT_FOUND_ERROR = "That e-mail template does not exist."
 )
 
 var (
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Data export states.
+const (
+	EXPORT_PENDING = "pending"
+	EXPORT_READY   = "ready"
+	EXPORT_FAILED  = "failed"
+)
+
+// Download links work this long; Mongo removes the archive afterwards.
+const exportLifetime = 48 * time.Hour
+
+// DataExport is an archive of everything stored about a user. It is built in
+// the background and downloaded with a link e-mailed to the user.
+type DataExport struct {
+	ID        bson.ObjectID `bson:"_id" json:"id"`
+	User      bson.ObjectID `bson:"user" json:"-"`
+	Status    string        `bson:"status" json:"status"`
+	TokenHash string        `bson:"tokenHash" json:"-"`
+	Archive   []byte        `bson:"archive,omitempty" json:"-"`
+	CreatedOn time.Time     `bson:"createdOn" json:"createdOn"`
+	ExpiresOn time.Time     `bson:"expiresOn" json:"expiresOn"`
+}
+
+// ExportedProfile is the user with the name of their organization in place
+// of its ID.
+type ExportedProfile struct {
+	*User
+	Organization string `json:"organization,omitempty"`
+}
+
+type ExportedAnswer struct {
+	Question          string `json:"question"`
+	AnsweredCorrectly bool   `json:"answeredCorrectly"`
+}
+
+type ExportedEmail struct {
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text,omitempty"`
+	Status    string    `json:"status"`
+	CreatedOn time.Time `json:"createdOn"`
+	SentOn    time.Time `json:"sentOn,omitempty"`
+}
+
+// RequestExport starts building the user's data export. The download link is
+// e-mailed once it is ready.
+func (app *App) RequestExport(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "RequestExport")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	db, errM := app.DB()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	export, token, errM := CreateExport(db, user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// The export outlives the request, so it must not be cancelled with it.
+	go func() {
+		app := app.WithContext(context.Background())
+		db, _ := app.DB()
+		errM := app.CompleteExport(db, user, export, token)
+		if errM != nil {
+			ctx.WithError(errM.Reason).WithField("user", user.Email).Error("Failed to export user data.")
+		}
+	}()
+
+	ServeJSON(w, r, &Response{"status": fmt.Sprintf("Your data is being exported. We will e-mail a download link to %s.",
+		user.Email)}, http.StatusAccepted)
+}
+
+// DownloadExport serves a finished export to whoever has the link.
+func (app *App) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !IsObjectIDHex(id) {
+		BR(w, r, errors.New(EXPORT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	db, errM := app.DB()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	export, errM := FindExport(db, ObjectIDHex(id), r.URL.Query().Get("token"))
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"nhc-data-%s.zip\"",
+		export.CreatedOn.Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Archive)
+}
+
+// CreateExport records a pending export and returns it with the token for
+// its download link.
+func CreateExport(db mongoDB, u *User) (*DataExport, string, *Error) {
+	token := RandToken()
+
+	now := time.Now()
+	export := &DataExport{ID: bson.NewObjectID(), User: u.ID, Status: EXPORT_PENDING, TokenHash: HashToken(token),
+		CreatedOn: now, ExpiresOn: now.Add(exportLifetime)}
+	_, err := db.C("exports").InsertOne(db.ctx, export)
+	if err != nil {
+		return nil, "", &Error{Reason: fmt.Errorf("Error creating export: %s\n", err), Internal: true}
+	}
+
+	return export, token, nil
+}
+
+// CompleteExport builds the archive, stores it and mails the download link.
+func (app *App) CompleteExport(db mongoDB, u *User, export *DataExport, token string) *Error {
+	archive, errM := app.BuildExportArchive(db, u)
+	if errM != nil {
+		db.C("exports").UpdateOne(db.ctx, bson.M{"_id": export.ID}, bson.M{"$set": bson.M{"status": EXPORT_FAILED}})
+		return errM
+	}
+
+	_, err := db.C("exports").UpdateOne(db.ctx, bson.M{"_id": export.ID},
+		bson.M{"$set": bson.M{"status": EXPORT_READY, "archive": archive}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error storing export: %s\n", err), Internal: true}
+	}
+
+	link := fmt.Sprintf("https://%s/api/user/export/%s?token=%s", URL, export.ID.Hex(), token)
+	return app.SendTemplateMail(DATA_EXPORT_TEMPLATE, []string{u.Email},
+		&DataExportTemplate{FirstName: u.FirstName, Link: link, Expires: export.ExpiresOn.Format("January 2, 2006")})
+}
+
+func FindExport(db mongoDB, id bson.ObjectID, token string) (*DataExport, *Error) {
+	var export DataExport
+	err := db.C("exports").FindOne(db.ctx, bson.M{"_id": id, "tokenHash": HashToken(token), "status": EXPORT_READY,
+		"expiresOn": bson.M{"$gt": time.Now()}}).Decode(&export)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(EXPORT_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error finding export: %s\n", err), Internal: true}
+	}
+
+	return &export, nil
+}
+
+// BuildExportArchive zips one JSON file for each kind of data stored about
+// the user.
+func (app *App) BuildExportArchive(db mongoDB, u *User) ([]byte, *Error) {
+	// Read the user again so the export is current.
+	user, errM := app.Users.FindByID(u.ID)
+	if errM != nil {
+		return nil, errM
+	}
+
+	profile := &ExportedProfile{User: user}
+	if !user.Organization.IsZero() {
+		org, errM := app.Organizations.FindByID(user.Organization)
+		if errM != nil && errM.Internal {
+			return nil, errM
+		} else if errM == nil {
+			profile.Organization = org.Name
+		}
+	}
+
+	registrations, errM := app.Globals.FindUserRegistrations(user.ID)
+	if errM != nil {
+		return nil, errM
+	}
+
+	questions, errM := app.Questions.FindByRespondent(user.Email)
+	if errM != nil {
+		return nil, errM
+	}
+	answers := []ExportedAnswer{}
+	for _, question := range questions {
+		for _, respondent := range question.Respondents {
+			if respondent.User == user.Email {
+				answers = append(answers, ExportedAnswer{Question: question.Text,
+					AnsweredCorrectly: respondent.AnsweredCorrectly})
+			}
+		}
+	}
+
+	var messages []OutboxMessage
+	err := db.findAll("outbox", bson.M{"recipient": user.Email}, &messages, sortBy("createdOn"))
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving e-mails: %s\n", err), Internal: true}
+	}
+	emails := []ExportedEmail{}
+	for _, message := range messages {
+		emails = append(emails, ExportedEmail{Subject: message.Subject, Text: message.Text, Status: message.Status,
+			CreatedOn: message.CreatedOn, SentOn: message.SentOn})
+	}
+
+	sessions, errM := app.Sessions.FindByUser(user.ID)
+	if errM != nil {
+		return nil, errM
+	}
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", profile},
+		{"participants.json", user.Participants},
+		{"past-registrations.json", registrations},
+		{"bonus-question-answers.json", answers},
+		{"emails.json", emails},
+		{"sessions.json", sessions},
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return nil, &Error{Reason: fmt.Errorf("Error creating export archive: %s\n", err), Internal: true}
+		}
+
+		b, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return nil, &Error{Reason: fmt.Errorf("Error encoding %s: %s\n", file.name, err), Internal: true}
+		}
+		f.Write(b)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error creating export archive: %s\n", err), Internal: true}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDataExport(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	s := newAppTestServer(t, NewMongoApp(db))
+
+	s.app.Organizations.Create("Sample Gym", false)
+	gym, _ := s.app.Organizations.FindByName("Sample Gym")
+	token := s.signUp("jane@example.com")
+	jane, _ := s.app.Users.FindByEmail("jane@example.com")
+	s.app.Users.Update(jane.ID, bson.M{"organization": gym.ID})
+
+	if code := s.do("GET", "/api/user/export", token, nil, nil); code != http.StatusAccepted {
+		t.Fatalf("expected status 202 got %d", code)
+	}
+
+	// The archive is built in the background and its link mailed once ready.
+	var link string
+	for deadline := time.Now().Add(5 * time.Second); link == "" && time.Now().Before(deadline); {
+		for _, m := range s.mailer.Sent() {
+			if i := strings.Index(m.Text, "/api/user/export/"); i >= 0 {
+				link = strings.Fields(m.Text[i:])[0]
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if link == "" {
+		t.Fatalf("expected the download link to be mailed")
+	}
+
+	download := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := download(link)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: expected status 200 got %d", w.Code)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("expected a zip archive: %s", err)
+	}
+
+	var names []string
+	var profile struct {
+		Email        string `json:"email"`
+		Organization string `json:"organization"`
+	}
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		if f.Name == "profile.json" {
+			in, _ := f.Open()
+			json.NewDecoder(in).Decode(&profile)
+			in.Close()
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"bonus-question-answers.json", "emails.json", "participants.json",
+		"past-registrations.json", "profile.json", "sessions.json"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected files %v got %v", expected, names)
+	}
+	if profile.Email != "jane@example.com" || profile.Organization != "Sample Gym" {
+		t.Errorf("expected profile with the organization's name got %+v", profile)
+	}
+
+	i := strings.Index(link, "?token=")
+	if w := download(link[:i] + "?token=wrong"); w.Code != http.StatusNotFound {
+		t.Errorf("expected wrong token to be not found got %d", w.Code)
+	}
+
+	id := ObjectIDHex(strings.TrimPrefix(link[:i], "/api/user/export/"))
+	db.C("exports").UpdateOne(db.ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"expiresOn": time.Now()}})
+	if w := download(link); w.Code != http.StatusNotFound {
+		t.Errorf("expected expired export to be not found got %d", w.Code)
+	}
+}
@@ -3,25 +3,22 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type FAQ struct {
-	ID       bson.ObjectId `bson:"_id" json:"id"`
+	ID       bson.ObjectID `bson:"_id" json:"id"`
 	Question string        `bson:"question" json:"question"`
 	Answer   string        `bson:"answer" json:"answer"`
 	Category string        `bson:"category" json:"category"`
 }
 
 // GetFaqs gets and returns all frequently asked questions
-func GetFaqs(w http.ResponseWriter, r *http.Request) {
-	db := GetDB(w, r)
-	faqs, errM := FindAllFaqs(db)
+func (app *App) GetFaqs(w http.ResponseWriter, r *http.Request) {
+	faqs, errM := app.FAQs.FindAll()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -32,11 +29,7 @@ func GetFaqs(w http.ResponseWriter, r *http.Request) {
 }
 
 // AddFaq /admin creates a new frequently asked question
-func AddFaq(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
+func (app *App) AddFaq(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var faq FAQ
 	err := decoder.Decode(&faq)
@@ -53,9 +46,8 @@ func AddFaq(w http.ResponseWriter, r *http.Request) {
 
 	// Create faq before saving?
 	// Save faq
-	db := GetDB(w, r)
-	faq.ID = bson.NewObjectId()
-	errM := faq.Save(db)
+	faq.ID = bson.NewObjectID()
+	errM := app.FAQs.Save(&faq)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -65,11 +57,7 @@ func AddFaq(w http.ResponseWriter, r *http.Request) {
 }
 
 // EditFaq /admin updates an existing frequently asked question
-func EditFaq(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
+func (app *App) EditFaq(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var faq FAQ
 	err := decoder.Decode(&faq)
@@ -78,8 +66,7 @@ func EditFaq(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	errM := UpdateFaq(db, faq)
+	errM := app.FAQs.Update(&faq)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -89,15 +76,10 @@ func EditFaq(w http.ResponseWriter, r *http.Request) {
 }
 
 // DeleteFaq /admin deletes an existing frequently asked question
-func DeleteFaq(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
+func (app *App) DeleteFaq(w http.ResponseWriter, r *http.Request) {
+	faqID := ObjectIDHex(mux.Vars(r)["id"])
 
-	faqID := bson.ObjectIdHex(mux.Vars(r)["id"])
-
-	db := GetDB(w, r)
-	errM := RemoveFaq(db, faqID)
+	errM := app.FAQs.Remove(faqID)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -105,61 +87,3 @@ func DeleteFaq(w http.ResponseWriter, r *http.Request) {
 
 	ServeJSON(w, r, &Response{"status": "FAQ deleted."}, http.StatusOK)
 }
-
-// FindAllFaqs finds and returns all faqs to GetFaqs()
-func FindAllFaqs(db *mgo.Database) (faqs []FAQ, errM *Error) {
-	return FindFaqsByQuery(db, nil)
-}
-
-// FindFaqsByQuery queries the DB and returns faqs collection to FindAllFaqs()
-func FindFaqsByQuery(db *mgo.Database, query bson.M) (faqs []FAQ, errM *Error) {
-	c := db.C("faqs")
-	err := c.Find(query).All(&faqs)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving faqs: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
-
-func (f *FAQ) Save(db *mgo.Database) *Error {
-	c := db.C("faqs")
-	_, err := c.UpsertId(f.ID, bson.M{"$set": f})
-	if err != nil {
-		return &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Error saving faq: %s\n",
-			err))}
-	}
-
-	return nil
-}
-
-func UpdateFaq(db *mgo.Database, faq FAQ) *Error {
-	c := db.C("faqs")
-
-	// Get old faq
-	var oldFaq FAQ
-	err := c.FindId(faq.ID).One(&oldFaq)
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("The faq you are trying to update does not exist: %s\n", err)), Internal: true}
-	}
-
-	// Update faq
-	_, err = c.UpsertId(faq.ID, faq)
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error updating faq: %s\n", err)), Internal: true}
-	}
-
-	return nil
-}
-
-func RemoveFaq(db *mgo.Database, id bson.ObjectId) (errM *Error) {
-	c := db.C("faqs")
-	err := c.RemoveId(id)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error removing FAQ: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
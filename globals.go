@@ -7,70 +7,173 @@ import (
 	"net/http"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Globals struct {
 	ChallengeStart      time.Time `bson:"challengeStart,omitempty" json:"challengeStart,omitempty"`
 	ChallengeEnd        time.Time `bson:"challengeEnd,omitempty" json:"challengeEnd,omitempty"`
 	ChallengeLength     int       `bson:"challengeLength,omitempty" json:"challengeLength,omitempty"`
+	RegistrationStart   time.Time `bson:"registrationStart,omitempty" json:"registrationStart,omitempty"`
+	RegistrationEnd     time.Time `bson:"registrationEnd,omitempty" json:"registrationEnd,omitempty"`
 	RegistrationOpen    bool      `bson:"registrationOpen,omitempty" json:"registrationOpen,omitempty"`
 	ScorecardEnabled    bool      `bson:"scorecardEnabled,omitempty" json:"scorecardEnabled,omitempty"`
-	LeaderboardsEnabled bool      `bson:"leaderboardsEnabled,omitempty" json:"leaderboardsEmpty,omitempy"`
+	LeaderboardsEnabled bool      `bson:"leaderboardsEnabled,omitempty" json:"leaderboardsEnabled,omitempty"`
 	WelcomeMessage      string    `bson:"welcomeMessage,omitempty" json:"welcomeMessage,omitempty"`
+	TimeZone            string    `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
+	CheckinGraceDays    int       `bson:"checkinGraceDays,omitempty" json:"checkinGraceDays,omitempty"`
 }
 
+// Time zone used for check-ins when neither the user, their organization nor
+// the season picked one.
+const defaultTimeZone = "America/New_York"
+
+// CalendarDate strips the time of day from t, keeping the date it has in its
+// own location. Challenge dates are calendar dates, so comparing them as UTC
+// midnights avoids any trouble with daylight saving or year boundaries.
+func CalendarDate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// DaysBetween returns the number of calendar days from start to end.
+func DaysBetween(start, end time.Time) int {
+	return int(CalendarDate(end).Sub(CalendarDate(start)).Hours() / 24)
+}
+
+// ChallengeDays returns the number of days in the challenge, counting both
+// the first and the last day.
+func (g *Globals) ChallengeDays() int {
+	return DaysBetween(g.ChallengeStart.UTC(), g.ChallengeEnd.UTC()) + 1
+}
+
+// DayIndex returns the zero-based day of the challenge that date falls on and
+// whether that day is part of the challenge at all.
+func (g *Globals) DayIndex(date time.Time) (int, bool) {
+	day := DaysBetween(g.ChallengeStart.UTC(), date)
+	return day, day >= 0 && day < g.ChallengeLength
+}
+
+// DayIsLocked reports whether a challenge day can no longer be changed
+// because the grace period after it has passed. A grace period of zero
+// never locks anything.
+func (g *Globals) DayIsLocked(day, today int) bool {
+	return g.CheckinGraceDays > 0 && today-day > g.CheckinGraceDays
+}
+
+// Location resolves the time zone check-ins are judged in, preferring the
+// user's own time zone over their organization's and the season's.
+func (g *Globals) Location(zones ...string) *time.Location {
+	zones = append(zones, g.TimeZone, defaultTimeZone)
+	for _, zone := range zones {
+		if zone == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(zone); err == nil {
+			return loc
+		}
+	}
+
+	return time.UTC
+}
+
+// Validate checks settings before they are saved. Scorecards are as long as
+// the challenge, so it has to have both dates and end after it starts.
+func (g *Globals) Validate() *Error {
+	if g.ChallengeStart.IsZero() || g.ChallengeEnd.IsZero() {
+		return &Error{Reason: errors.New(MISSING_FIELDS_ERROR), Code: http.StatusBadRequest}
+	}
+
+	if !g.ChallengeEnd.After(g.ChallengeStart) {
+		return &Error{Reason: errors.New(CHALLENGE_DATES_ERROR), Code: http.StatusBadRequest}
+	}
+
+	if g.TimeZone != "" {
+		if _, err := time.LoadLocation(g.TimeZone); err != nil {
+			return &Error{Reason: errors.New(TIMEZONE_ERROR), Code: http.StatusBadRequest}
+		}
+	}
+
+	return nil
+}
+
+// RegistrationIsOpen reports whether registration is switched on and, if a
+// registration window is set, whether t falls inside it.
+func (g *Globals) RegistrationIsOpen(t time.Time) bool {
+	if !g.RegistrationOpen {
+		return false
+	}
+
+	if !g.RegistrationStart.IsZero() && t.Before(g.RegistrationStart) {
+		return false
+	}
+
+	if !g.RegistrationEnd.IsZero() && t.After(g.RegistrationEnd) {
+		return false
+	}
+
+	return true
+}
+
+// GetGlobals returns the settings of the current season.
 func GetGlobals(w http.ResponseWriter, r *http.Request) {
-	b, _ := json.Marshal(GLOBALS)
+	b, _ := json.Marshal(SEASON)
 	parse := &Response{}
 	json.Unmarshal(b, parse)
 	ServeJSON(w, r, parse, http.StatusOK)
 }
 
-func SaveGlobals(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
+func (app *App) SaveGlobals(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var globals Globals
 	err := decoder.Decode(&globals)
 	if err != nil {
 		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+	if errM := globals.Validate(); errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
-	globals.ChallengeLength = globals.ChallengeEnd.YearDay() - globals.ChallengeStart.YearDay() + 1
+	globals.ChallengeLength = globals.ChallengeDays()
 
-	db := GetDB(w, r)
-	errM := UpdateGlobals(db, &globals)
+	season, errM := app.UpdateGlobals(&globals)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	GLOBALS = &globals
+	AuditChange(r, season.ID.Hex(), SEASON, season)
+
+	SEASON = season
+	GLOBALS = &SEASON.Globals
 
-	b, _ := json.Marshal(GLOBALS)
+	b, _ := json.Marshal(SEASON)
 	parse := &Response{}
 	json.Unmarshal(b, parse)
 	ServeJSON(w, r, parse, http.StatusOK)
 }
 
-func UpdateGlobals(db *mgo.Database, globals *Globals) (errM *Error) {
-	c := db.C("globals")
-	err := c.Update(nil, bson.M{"$set": globals})
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error updating globals: %s\n", err))}
-		return
+// UpdateGlobals replaces the settings of the current season.
+func (app *App) UpdateGlobals(globals *Globals) (*Season, *Error) {
+	season, errM := app.Globals.FindCurrentSeason()
+	if errM != nil {
+		return nil, &Error{Reason: errM.Reason, Internal: true}
+	}
+
+	season.Globals = *globals
+	errM = app.Globals.SaveSeason(season)
+	if errM != nil {
+		return nil, errM
 	}
 
-	return
+	return season, nil
 }
 
-func FindGlobals(db *mgo.Database) (*Globals, error) {
-	c := db.C("globals")
+// FindGlobals reads the legacy globals document used before seasons existed.
+func FindGlobals(db mongoDB) (*Globals, error) {
 	var globals Globals
-	err := c.Find(nil).One(&globals)
+	err := db.C("globals").FindOne(db.ctx, bson.M{}).Decode(&globals)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error retrieving globals from database: %s\n", err))
 	}
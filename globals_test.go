@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayIndexAcrossYearBoundary(t *testing.T) {
+	globals := &Globals{
+		ChallengeStart: time.Date(2016, time.December, 25, 0, 0, 0, 0, time.UTC),
+		ChallengeEnd:   time.Date(2017, time.January, 7, 0, 0, 0, 0, time.UTC),
+	}
+	globals.ChallengeLength = globals.ChallengeDays()
+
+	if globals.ChallengeLength != 14 {
+		t.Errorf("expected challenge length 14 got %d", globals.ChallengeLength)
+	}
+
+	day, ok := globals.DayIndex(time.Date(2017, time.January, 2, 0, 0, 0, 0, time.UTC))
+	if !ok || day != 8 {
+		t.Errorf("expected day 8 in challenge got %d (%t)", day, ok)
+	}
+
+	_, ok = globals.DayIndex(time.Date(2017, time.January, 8, 0, 0, 0, 0, time.UTC))
+	if ok {
+		t.Errorf("expected day after challenge end to be outside the challenge")
+	}
+}
+
+func TestDayIsLocked(t *testing.T) {
+	globals := &Globals{CheckinGraceDays: 2}
+
+	if globals.DayIsLocked(3, 5) {
+		t.Errorf("expected day within grace period to be open")
+	}
+
+	if !globals.DayIsLocked(2, 5) {
+		t.Errorf("expected day past grace period to be locked")
+	}
+
+	globals.CheckinGraceDays = 0
+	if globals.DayIsLocked(0, 20) {
+		t.Errorf("expected no locking without a grace period")
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/negroni"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// testServer runs the API on an App in memory, so handler tests need no
+// database.
+type testServer struct {
+	t       *testing.T
+	app     *App
+	handler http.Handler
+	mailer  *CaptureMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	return newAppTestServer(t, NewMemoryApp())
+}
+
+// newAppTestServer runs the API on the given App, for the features that need
+// a database.
+func newAppTestServer(t *testing.T, app *App) *testServer {
+	logger = logrus.New()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	verifyKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	mailer, _ := NewCaptureMailer("")
+	MAILER = mailer
+	OUTBOX = nil
+	LIMITER = nil
+
+	start := CalendarDate(time.Now()).AddDate(0, 0, -3)
+	SEASON = &Season{ID: bson.NewObjectID(), Name: "Test Season", Current: true, Globals: Globals{
+		ChallengeStart:   start,
+		ChallengeLength:  28,
+		RegistrationOpen: true,
+		ScorecardEnabled: true,
+		TimeZone:         "UTC",
+	}}
+	GLOBALS = &SEASON.Globals
+
+	app.Globals.SaveSeason(SEASON)
+
+	n := negroni.New(JWTMiddleware(app), AuditMiddleware(app), ParseFormMiddleware())
+	n.UseHandler(NewRouter(app))
+
+	return &testServer{t: t, app: app, handler: n, mailer: mailer}
+}
+
+// do sends a request with an optional JSON body and access token and decodes
+// the response into out, if given.
+func (s *testServer) do(method, path, token string, body interface{}, out interface{}) int {
+	var payload string
+	if body != nil {
+		b, _ := json.Marshal(body)
+		payload = string(b)
+	}
+
+	r, _ := http.NewRequest(method, path, strings.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			s.t.Fatalf("%s %s: could not decode response %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// signUp creates a verified user through the API and returns its token.
+func (s *testServer) signUp(email string) string {
+	var session struct {
+		Token string `json:"token"`
+	}
+	code := s.do("POST", "/auth/signup", "", Response{"firstName": "Jane", "lastName": "Doe",
+		"email": email, "password": "secret"}, &session)
+	if code != http.StatusOK || session.Token == "" {
+		s.t.Fatalf("sign up: expected status 200 and a token got %d", code)
+	}
+
+	sent := s.mailer.Sent()
+	text := sent[len(sent)-1].Text
+	i := strings.Index(text, "/verify/")
+	if i < 0 {
+		s.t.Fatalf("expected mail to contain a verification link")
+	}
+
+	verification := strings.Fields(text[i+len("/verify/"):])[0]
+	if code := s.do("POST", "/auth/verify", session.Token, Response{"code": verification}, nil); code != http.StatusOK {
+		s.t.Fatalf("verify: expected status 200 got %d", code)
+	}
+
+	return session.Token
+}
+
+// admin creates a user with the given role and returns its token.
+func (s *testServer) admin(role Role) string {
+	token := s.signUp(role.String() + "@example.com")
+
+	user, _ := s.app.Users.FindByEmail(role.String() + "@example.com")
+	s.app.Users.Update(user.ID, bson.M{"role": role.String()})
+
+	return token
+}
+
+func TestSignUpVerifyLoginAndRefresh(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp("jane@example.com")
+
+	var status struct {
+		Email  string `json:"email"`
+		Status string `json:"status"`
+	}
+	if code := s.do("GET", "/auth/", token, nil, &status); code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", code)
+	}
+	if status.Email != "jane@example.com" || status.Status != UNREGISTERED.String() {
+		t.Errorf("expected verified user to be unregistered got %+v", status)
+	}
+
+	if code := s.do("POST", "/auth/login", "", Response{"email": "jane@example.com", "password": "wrong"}, nil); code == http.StatusOK {
+		t.Errorf("expected login with a wrong password to fail")
+	}
+
+	var session struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	if code := s.do("POST", "/auth/login", "", Response{"email": "jane@example.com", "password": "secret"}, &session); code != http.StatusOK {
+		t.Fatalf("login: expected status 200 got %d", code)
+	}
+
+	var refreshed struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	if code := s.do("POST", "/auth/refresh", "", Response{"refreshToken": session.RefreshToken}, &refreshed); code != http.StatusOK {
+		t.Fatalf("refresh: expected status 200 got %d", code)
+	}
+	if refreshed.Token == "" || refreshed.RefreshToken == session.RefreshToken {
+		t.Errorf("expected a new token pair")
+	}
+
+	// Refresh tokens rotate, so the old one is spent.
+	if code := s.do("POST", "/auth/refresh", "", Response{"refreshToken": session.RefreshToken}, nil); code == http.StatusOK {
+		t.Errorf("expected used refresh token to be rejected")
+	}
+}
+
+func TestSignUpRejectsDuplicateEmail(t *testing.T) {
+	s := newTestServer(t)
+	s.signUp("jane@example.com")
+
+	code := s.do("POST", "/auth/signup", "", Response{"email": "jane@example.com", "password": "other"}, nil)
+	if code == http.StatusOK {
+		t.Errorf("expected second sign up with the same address to fail")
+	}
+}
+
+func TestEmailAddressesIgnoreCase(t *testing.T) {
+	s := newTestServer(t)
+	s.signUp("Jane@Example.com")
+
+	if code := s.do("POST", "/auth/signup", "", Response{"email": "jane@example.com", "password": "other"}, nil); code == http.StatusOK {
+		t.Errorf("expected sign up with the same address in other case to fail")
+	}
+	if code := s.do("POST", "/auth/login", "", Response{"email": "JANE@example.com", "password": "secret"}, nil); code != http.StatusOK {
+		t.Errorf("login: expected status 200 got %d", code)
+	}
+
+	before := len(s.mailer.Sent())
+	s.do("POST", "/auth/password/forgot", "", Response{"email": "jane@EXAMPLE.com"}, nil)
+	if sent := s.mailer.Sent(); len(sent) != before+1 || sent[len(sent)-1].To != "jane@example.com" {
+		t.Errorf("expected a password reset mail to the stored address got %+v", sent)
+	}
+
+	result, errM := s.app.ImportCSV(nil, "users", strings.NewReader("email,team\nJANE@example.com,Lions\n"), false)
+	if errM != nil || result.Updated != 1 || result.Created != 0 {
+		t.Errorf("expected roster row to update the signed up user got %+v: %v", result, errM)
+	}
+}
+
+func TestRegisterAndCheckIn(t *testing.T) {
+	s := newTestServer(t)
+	s.app.Commitments.Add("Water", "Drink 8 glasses a day")
+	s.app.Organizations.Create("Sample Gym", false)
+	token := s.signUp("jane@example.com")
+
+	participant := Response{"firstName": "Jane", "ageRange": []int{30, 39}, "category": "Water",
+		"commitment": "Drink 8 glasses a day"}
+
+	var validation struct {
+		Donation []string `json:"donation"`
+	}
+	code := s.do("POST", "/api/registration", token, Response{"organization": "Sample Gym",
+		"participants": []Response{participant}}, &validation)
+	if code != http.StatusBadRequest || len(validation.Donation) == 0 {
+		t.Fatalf("expected missing donation to be reported got %d", code)
+	}
+
+	code = s.do("POST", "/api/registration", token, Response{"organization": "Sample Gym", "donation": "none",
+		"participants": []Response{participant}}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("register: expected status 200 got %d", code)
+	}
+
+	gym, _ := s.app.Organizations.FindByName("Sample Gym")
+	user, _ := s.app.Users.FindByEmail("jane@example.com")
+	if user.Status != REGISTERED.String() || user.Organization != gym.ID || len(user.Participants) != 1 {
+		t.Fatalf("expected user to be registered with one participant got %+v", user)
+	}
+	sent := s.mailer.Sent()
+	season := fmt.Sprintf("Nutrition Habit Challenge %d.", GLOBALS.ChallengeStart.Year())
+	if text := sent[len(sent)-1].Text; !strings.Contains(text, season) {
+		t.Errorf("expected confirmation to name the season's year got %q", text)
+	} else if config.FACEBOOK_PAGE == "" && strings.Contains(text, "facebook.com") {
+		t.Errorf("expected no Facebook page without one configured got %q", text)
+	}
+
+	if code := s.do("POST", "/api/registration", token, Response{"donation": "none"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected second registration to be forbidden got %d", code)
+	}
+
+	today := CalendarDate(time.Now().UTC())
+	if code := s.do("POST", "/api/participant/0/checkin", token, Response{"date": today.Format("2006-01-02"), "done": true}, nil); code != http.StatusOK {
+		t.Fatalf("check in: expected status 200 got %d", code)
+	}
+
+	tomorrow := today.AddDate(0, 0, 1).Format("2006-01-02")
+	if code := s.do("POST", "/api/participant/0/checkin", token, Response{"date": tomorrow, "done": true}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected check-in for tomorrow to be rejected got %d", code)
+	}
+
+	if code := s.do("POST", "/api/participant/1/checkin", token, Response{"date": today.Format("2006-01-02"), "done": true}, nil); code != http.StatusNotFound {
+		t.Errorf("expected check-in for an unknown participant to be not found got %d", code)
+	}
+
+	user, _ = s.app.Users.FindByEmail("jane@example.com")
+	day, _ := GLOBALS.DayIndex(today)
+	if user.Participants[0].Scorecard[day/7][day%7] != 1 {
+		t.Errorf("expected day %d to be checked in", day)
+	}
+}
+
+func TestUpdateScorecardCountsEachDayOnce(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp("jane@example.com")
+	jane, _ := s.app.Users.FindByEmail("jane@example.com")
+	s.app.Users.Update(jane.ID, bson.M{"status": REGISTERED.String(),
+		"participants": []Participant{{ID: 0, FirstName: "Jane", Scorecard: GenerateScorecard()}}})
+
+	full := func(weeks, days int) [][]int {
+		grid := make([][]int, weeks)
+		for i := range grid {
+			grid[i] = make([]int, days)
+			for j := range grid[i] {
+				grid[i][j] = 1
+			}
+		}
+		return grid
+	}
+
+	// Weeks of 14 days would count the next week's days again.
+	if code := s.do("PUT", "/api/participant/scorecard", token, Response{"id": 0, "scorecard": full(4, 14)}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected a scorecard of the wrong shape to be rejected got %d", code)
+	}
+
+	if code := s.do("PUT", "/api/participant/scorecard", token, Response{"id": 0, "scorecard": full(4, 7)}, nil); code != http.StatusOK {
+		t.Fatalf("update: expected status 200 got %d", code)
+	}
+	jane, _ = s.app.Users.FindByEmail("jane@example.com")
+	today, _ := GLOBALS.DayIndex(CalendarDate(time.Now().UTC()))
+	if points := jane.Participants[0].Points; points != today+1 {
+		t.Errorf("expected only the days so far to count got %d points", points)
+	}
+
+	GLOBALS.ScorecardEnabled = false
+	if code := s.do("PUT", "/api/participant/scorecard", token, Response{"id": 0, "scorecard": full(4, 7)}, nil); code != http.StatusForbidden {
+		t.Errorf("expected closed scorecard to be rejected got %d", code)
+	}
+}
+
+func TestNewsIsPublishedByAdmins(t *testing.T) {
+	s := newTestServer(t)
+	user := s.signUp("jane@example.com")
+	admin := s.admin(GLOBAL_ADMIN)
+
+	if code := s.do("POST", "/api/admin/news", user, Response{"subject": "Hello", "body": "World"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected users to be forbidden from adding news got %d", code)
+	}
+
+	if code := s.do("POST", "/api/admin/news", admin, Response{"subject": "Hello", "body": "World"}, nil); code != http.StatusOK {
+		t.Fatalf("add news: expected status 200 got %d", code)
+	}
+
+	var news []News
+	s.do("GET", "/api/news", user, nil, &news)
+	if len(news) != 0 {
+		t.Errorf("expected unpublished news to be hidden got %d items", len(news))
+	}
+
+	s.do("GET", "/api/admin/news", admin, nil, &news)
+	if len(news) != 1 {
+		t.Fatalf("expected admins to see 1 item got %d", len(news))
+	}
+
+	if code := s.do("PUT", "/api/admin/news/"+news[0].ID.Hex()+"/publish", admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("publish: expected status 200 got %d", code)
+	}
+
+	s.do("GET", "/api/news", user, nil, &news)
+	if len(news) != 1 || news[0].Subject != "Hello" {
+		t.Errorf("expected published news to be listed got %+v", news)
+	}
+}
+
+func TestBonusQuestionIsAnsweredOnce(t *testing.T) {
+	s := newTestServer(t)
+	user := s.signUp("jane@example.com")
+	admin := s.admin(GLOBAL_ADMIN)
+
+	question := Response{"text": "Which is a vegetable?", "answers": []string{"Kale", "Candy"}, "correctAnswer": "Kale"}
+	if code := s.do("POST", "/api/admin/bonus-question", admin, question, nil); code != http.StatusOK {
+		t.Fatalf("create question: expected status 200 got %d", code)
+	}
+
+	var questions []Question
+	s.do("GET", "/api/admin/bonus-question", admin, nil, &questions)
+	if len(questions) != 1 {
+		t.Fatalf("expected 1 question got %d", len(questions))
+	}
+
+	if code := s.do("PUT", "/api/admin/bonus-question/"+questions[0].ID.Hex()+"/enable", admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("enable question: expected status 200 got %d", code)
+	}
+
+	var fetched struct {
+		Enabled bool `json:"enabled"`
+	}
+	s.do("GET", "/api/bonus-question", user, nil, &fetched)
+	if !fetched.Enabled {
+		t.Fatalf("expected enabled question to be served")
+	}
+
+	if code := s.do("POST", "/api/bonus-question", user, Response{"answer": "Kale"}, nil); code != http.StatusOK {
+		t.Fatalf("answer: expected status 200 got %d", code)
+	}
+
+	if code := s.do("POST", "/api/bonus-question", user, Response{"answer": "Kale"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected second answer to be forbidden got %d", code)
+	}
+
+	s.do("GET", "/api/bonus-question", user, nil, &fetched)
+	if fetched.Enabled {
+		t.Errorf("expected answered question to be hidden")
+	}
+
+	answered, _ := s.app.Questions.FindByID(questions[0].ID)
+	if len(answered.Respondents) != 1 || !answered.Respondents[0].AnsweredCorrectly {
+		t.Errorf("expected one correct answer got %+v", answered.Respondents)
+	}
+}
+
+func TestFAQs(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin(GLOBAL_ADMIN)
+
+	if code := s.do("POST", "/api/admin/faq", admin, Response{"question": "When?", "answer": "Soon.", "category": "General"}, nil); code != http.StatusOK {
+		t.Fatalf("add faq: expected status 200 got %d", code)
+	}
+
+	var faqs []FAQ
+	if code := s.do("GET", "/api/faq", "", nil, &faqs); code != http.StatusOK || len(faqs) != 1 {
+		t.Fatalf("expected 1 faq for anyone got %d items with status %d", len(faqs), code)
+	}
+
+	faqs[0].Answer = "Now."
+	if code := s.do("PUT", "/api/admin/faq", admin, faqs[0], nil); code != http.StatusOK {
+		t.Fatalf("edit faq: expected status 200 got %d", code)
+	}
+
+	if code := s.do("DELETE", "/api/admin/faq/"+faqs[0].ID.Hex(), admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete faq: expected status 200 got %d", code)
+	}
+
+	s.do("GET", "/api/faq", "", nil, &faqs)
+	if len(faqs) != 0 {
+		t.Errorf("expected faq to be deleted got %d items", len(faqs))
+	}
+}
+
+func TestOrganizationRequestIsApproved(t *testing.T) {
+	s := newTestServer(t)
+	user := s.signUp("jane@example.com")
+	admin := s.admin(GLOBAL_ADMIN)
+
+	if code := s.do("POST", "/api/organizations/requests", user, Response{"name": "New Gym"}, nil); code != http.StatusOK {
+		t.Fatalf("request: expected status 200 got %d", code)
+	}
+
+	var requests []Organization
+	s.do("GET", "/api/admin/organizations/requests", admin, nil, &requests)
+	if len(requests) != 1 || requests[0].Name != "New Gym" {
+		t.Fatalf("expected the request to be listed got %+v", requests)
+	}
+
+	if code := s.do("PUT", "/api/admin/organizations/requests/"+requests[0].ID.Hex()+"/approve", admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("approve: expected status 200 got %d", code)
+	}
+
+	var organizations []Organization
+	s.do("GET", "/api/organizations", "", nil, &organizations)
+	if len(organizations) != 1 || organizations[0].NeedsApproval {
+		t.Errorf("expected approved organization to be listed got %+v", organizations)
+	}
+
+	sent := s.mailer.Sent()
+	if last := sent[len(sent)-1]; last.To != "jane@example.com" {
+		t.Errorf("expected requester to be told got mail to %s", last.To)
+	}
+}
+
+func TestMergeAndDeleteOrganizations(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin(GLOBAL_ADMIN)
+	for _, name := range []string{"Sample Gym", "Sample Fitness", "Other Gym"} {
+		s.app.Organizations.Create(name, false)
+	}
+	gym, _ := s.app.Organizations.FindByName("Sample Gym")
+	fitness, _ := s.app.Organizations.FindByName("Sample Fitness")
+	other, _ := s.app.Organizations.FindByName("Other Gym")
+
+	s.signUp("jane@example.com")
+	s.signUp("john@example.com")
+	jane, _ := s.app.Users.FindByEmail("jane@example.com")
+	john, _ := s.app.Users.FindByEmail("john@example.com")
+	s.app.Users.Update(jane.ID, bson.M{"organization": fitness.ID})
+	s.app.Users.Update(john.ID, bson.M{"organization": other.ID})
+
+	// Merges that would remove the organization they merge into are refused.
+	for _, body := range []Response{
+		{"organizations": []Organization{*gym, *gym}, "newName": "Sample Gym"},
+		{"organizations": []Organization{*gym, *fitness, *gym}, "newName": "Sample Gym"},
+		{"organizations": []Organization{{}, *gym}, "newName": "Sample Gym"},
+		{"organizations": []Organization{*gym, *fitness}, "newName": " "},
+	} {
+		if code := s.do("POST", "/api/admin/organizations/merge", admin, body, nil); code == http.StatusOK {
+			t.Errorf("expected merge of %v to be rejected", body)
+		}
+	}
+	if _, errM := s.app.Organizations.FindByID(gym.ID); errM != nil {
+		t.Fatalf("expected rejected merges to keep the organization")
+	}
+
+	// The merged organization may keep the name of one that is removed.
+	code := s.do("POST", "/api/admin/organizations/merge", admin, Response{
+		"organizations": []Organization{*gym, *fitness}, "newName": "Sample Fitness"}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("merge: expected status 200 got %d", code)
+	}
+
+	jane, _ = s.app.Users.FindByEmail("jane@example.com")
+	if jane.Organization != gym.ID {
+		t.Errorf("expected user to be moved to the merged organization")
+	}
+	if merged, errM := s.app.Organizations.FindByID(gym.ID); errM != nil || merged.Name != "Sample Fitness" {
+		t.Errorf("expected merged organization to be renamed got %+v", merged)
+	}
+	if _, errM := s.app.Organizations.FindByID(fitness.ID); errM == nil {
+		t.Errorf("expected merged organization to be removed")
+	}
+
+	if code := s.do("DELETE", "/api/admin/organizations/"+other.ID.Hex(), admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete: expected status 200 got %d", code)
+	}
+
+	john, _ = s.app.Users.FindByEmail("john@example.com")
+	if !john.Organization.IsZero() {
+		t.Errorf("expected user to be left without an organization")
+	}
+}
+
+func TestEditUserKeepsAdminsWithinTheirReach(t *testing.T) {
+	s := newTestServer(t)
+	global := s.admin(GLOBAL_ADMIN)
+	org := s.admin(ORG_ADMIN)
+	s.app.Organizations.Create("Sample Gym", false)
+	s.app.Organizations.Create("Other Gym", false)
+	gym, _ := s.app.Organizations.FindByName("Sample Gym")
+	other, _ := s.app.Organizations.FindByName("Other Gym")
+
+	s.signUp("jane@example.com")
+	jane, _ := s.app.Users.FindByEmail("jane@example.com")
+	orgAdmin, _ := s.app.Users.FindByEmail(ORG_ADMIN.String() + "@example.com")
+	s.app.Users.Update(jane.ID, bson.M{"organization": gym.ID})
+	s.app.Users.Update(orgAdmin.ID, bson.M{"organization": gym.ID})
+
+	code := s.do("PUT", "/api/admin/user", global, Response{"email": GLOBAL_ADMIN.String() + "@example.com",
+		"role": GLOBAL_SUPER_ADMIN.String()}, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("expected admin raising their own role to be forbidden got %d", code)
+	}
+	if self, _ := s.app.Users.FindByEmail(GLOBAL_ADMIN.String() + "@example.com"); self.Role != GLOBAL_ADMIN.String() {
+		t.Errorf("expected role to be kept got %s", self.Role)
+	}
+
+	code = s.do("PUT", "/api/admin/user", org, Response{"email": "jane@example.com", "organization": other.ID}, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("expected org admin moving a user to another organization to be forbidden got %d", code)
+	}
+	if jane, _ = s.app.Users.FindByEmail("jane@example.com"); jane.Organization != gym.ID {
+		t.Errorf("expected user to stay in the organization")
+	}
+
+	code = s.do("PUT", "/api/admin/user", global, Response{"email": "jane@example.com", "role": GLOBAL_ADMIN.String()}, nil)
+	if code != http.StatusOK {
+		t.Errorf("expected admin to grant their own role got %d", code)
+	}
+}
+
+func TestLeaderboardHidesFamilyCodes(t *testing.T) {
+	checkLeaderboards(t, newTestServer(t))
+}
+
+func TestMongoLeaderboard(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	checkLeaderboards(t, newAppTestServer(t, NewMongoApp(db)))
+}
+
+// checkLeaderboards runs the leaderboard checks on either user store.
+func checkLeaderboards(t *testing.T, s *testServer) {
+	GLOBALS.LeaderboardsEnabled = true
+	s.app.Organizations.Create("Sample Gym", false)
+	gym, _ := s.app.Organizations.FindByName("Sample Gym")
+
+	created := time.Now()
+	for i, u := range []User{
+		{Email: "emile@example.com", LastName: "Émond", Family: "ÉMOND1234", Sharing: "everyone"},
+		{Email: "jane@example.com", LastName: "Doe", Family: "ÉMOND1234", Sharing: "everyone", Organization: gym.ID},
+		{Email: "john@example.com", LastName: "Roe", Team: "Lions", Sharing: "organization", Organization: gym.ID},
+	} {
+		u.ID = bson.NewObjectID()
+		u.Status = REGISTERED.String()
+		u.Season = SEASON.ID
+		u.CreatedOn = created.Add(time.Duration(i) * time.Minute)
+		u.Participants = []Participant{{ID: 1, FirstName: "Kid", LastName: u.LastName, Points: 3 + 7*(i/2)}}
+		s.app.Users.Save(&u)
+	}
+
+	var families []LeaderboardEntry
+	if code := s.do("GET", "/api/leaderboard/families", "", nil, &families); code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", code)
+	}
+	if len(families) != 1 || families[0].Name != "Émond" || families[0].Participants != 2 || families[0].Total != 6 {
+		t.Errorf("expected one family named after its first member got %+v", families)
+	}
+
+	// Anonymous visitors only see what is shared with everyone.
+	var individuals []LeaderboardEntry
+	s.do("GET", "/api/leaderboard/individuals", "", nil, &individuals)
+	if len(individuals) != 2 || individuals[1].Name != "Kid É" {
+		t.Errorf("expected last initials to keep whole letters got %+v", individuals)
+	}
+
+	viewer := s.signUp("viewer@example.com")
+	user, _ := s.app.Users.FindByEmail("viewer@example.com")
+	s.app.Users.Update(user.ID, bson.M{"organization": gym.ID})
+
+	s.do("GET", "/api/leaderboard/individuals", viewer, nil, &individuals)
+	if len(individuals) != 3 || individuals[0].Name != "Kid R" || individuals[0].Rank != 1 ||
+		individuals[1].Rank != 2 || individuals[2].Rank != 2 || individuals[0].Organization != "Sample Gym" {
+		t.Errorf("expected the organization's shared entries ranked with ties got %+v", individuals)
+	}
+
+	var teams []LeaderboardEntry
+	s.do("GET", "/api/leaderboard/teams", viewer, nil, &teams)
+	if len(teams) != 1 || teams[0].Name != "Lions" || teams[0].Organization != "Sample Gym" {
+		t.Errorf("expected one team of the organization got %+v", teams)
+	}
+
+	if s.do("GET", "/api/leaderboard/individuals?limit=1", viewer, nil, &individuals); len(individuals) != 1 {
+		t.Errorf("expected the limit to be kept got %d entries", len(individuals))
+	}
+	if code := s.do("GET", "/api/leaderboard/individuals?limit=100000", viewer, nil, &individuals); code != http.StatusOK || len(individuals) != 3 {
+		t.Errorf("expected a large limit to be capped got %d", code)
+	}
+}
+
+func TestParticipantIDsAreNotReused(t *testing.T) {
+	s := newTestServer(t)
+	s.app.Commitments.Add("Water", "Drink 8 glasses a day")
+	token := s.signUp("jane@example.com")
+
+	participant := Response{"firstName": "Jane", "lastName": "Doe", "ageRange": []int{30, 39},
+		"category": "Water", "commitment": "Drink 8 glasses a day"}
+	code := s.do("POST", "/api/registration", token, Response{"donation": "none",
+		"participants": []Response{participant}}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("register: expected status 200 got %d", code)
+	}
+
+	var added struct {
+		ID int `json:"id"`
+	}
+	if code := s.do("POST", "/api/participant", token, participant, &added); code != http.StatusOK || added.ID != 1 {
+		t.Fatalf("expected participant 1 to be added got %d, %d", code, added.ID)
+	}
+	if code := s.do("DELETE", "/api/participant/1", token, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete: expected status 200 got %d", code)
+	}
+
+	if s.do("POST", "/api/participant", token, participant, &added); added.ID != 2 {
+		t.Errorf("expected the removed participant's ID to stay unused got %d", added.ID)
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp("jane@example.com")
+
+	var other struct {
+		Token string `json:"token"`
+	}
+	if code := s.do("POST", "/auth/login", "", Response{"email": "jane@example.com", "password": "secret"}, &other); code != http.StatusOK {
+		t.Fatalf("login: expected status 200 got %d", code)
+	}
+
+	if code := s.do("POST", "/auth/logout", token, Response{}, nil); code != http.StatusOK {
+		t.Fatalf("logout: expected status 200 got %d", code)
+	}
+	if code := s.do("GET", "/api/participant", token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected access token of the ended session to be rejected got %d", code)
+	}
+	if code := s.do("GET", "/api/participant", other.Token, nil, nil); code == http.StatusUnauthorized {
+		t.Errorf("expected other sessions to stay logged in")
+	}
+}
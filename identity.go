@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// GetIdentities lists the login providers linked to the user and whether the
+// user can also log in with a password.
+func (app *App) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	identities := user.Identities
+	if identities == nil {
+		identities = []Identity{}
+	}
+
+	ServeJSON(w, r, &Response{"identities": identities, "hasPassword": user.Password != ""}, http.StatusOK)
+}
+
+// UnlinkIdentity removes a login provider from the user.
+func (app *App) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "UnlinkIdentity")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	provider := mux.Vars(r)["provider"]
+	errM = app.RemoveIdentity(user, provider)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.Email).WithField("provider", provider).Info("User unlinked login provider.")
+
+	ServeJSON(w, r, &Response{"status": "Login provider unlinked."}, http.StatusOK)
+}
+
+// SetPassword gives a user who has only logged in with providers a password.
+func (app *App) SetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "SetPassword")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	var message struct {
+		NewPassword     string `json:"newPassword"`
+		ConfirmPassword string `json:"confirmPassword"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil || message.NewPassword == "" {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if message.NewPassword != message.ConfirmPassword {
+		BR(w, r, errors.New("Passwords do not match."), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.Password != "" {
+		BR(w, r, errors.New(PASSWORD_SET_ERROR), http.StatusConflict)
+		return
+	}
+
+	errM = app.ChangePassword(user, message.NewPassword)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.Email).Info("User set a password.")
+
+	ServeJSON(w, r, &Response{"status": "Your password has been set."}, http.StatusOK)
+}
+
+// RemoveIdentity unlinks the provider unless the user would be left with no
+// way to log in.
+func (app *App) RemoveIdentity(u *User, provider string) *Error {
+	if !u.HasIdentity(provider) {
+		return &Error{Reason: errors.New(IDENTITY_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	}
+
+	removed, errM := app.Users.RemoveIdentity(u.ID, provider)
+	if errM != nil {
+		return errM
+	} else if !removed {
+		return &Error{Reason: errors.New(IDENTITY_LAST_ERROR), Code: http.StatusConflict}
+	}
+
+	identities := u.Identities[:0]
+	for _, identity := range u.Identities {
+		if identity.Provider != provider {
+			identities = append(identities, identity)
+		}
+	}
+	u.Identities = identities
+
+	return nil
+}
+
+func (u *User) HasIdentity(provider string) bool {
+	for _, identity := range u.Identities {
+		if identity.Provider == provider {
+			return true
+		}
+	}
+	return false
+}
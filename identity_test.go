@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRemoveIdentityKeepsAWayToLogIn(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	user := &User{ID: bson.NewObjectID(), Email: "jane@example.com", Identities: []Identity{
+		{Provider: "google", Subject: "1"},
+		{Provider: "facebook", Subject: "2"},
+	}}
+	if errM := app.Users.Save(user); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	if errM := app.RemoveIdentity(user, "github"); errM == nil || errM.Reason.Error() != IDENTITY_NOT_FOUND_ERROR {
+		t.Errorf("expected unknown provider to be reported")
+	}
+
+	if errM := app.RemoveIdentity(user, "google"); errM != nil {
+		t.Fatalf("expected google to be unlinked got %s", errM.Reason)
+	}
+
+	if errM := app.RemoveIdentity(user, "facebook"); errM == nil || errM.Reason.Error() != IDENTITY_LAST_ERROR {
+		t.Errorf("expected the last identity to stay without a password")
+	}
+
+	if errM := app.ChangePassword(user, "secret"); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if errM := app.RemoveIdentity(user, "facebook"); errM != nil {
+		t.Errorf("expected facebook to be unlinked once there is a password got %s", errM.Reason)
+	}
+
+	stored, _ := app.Users.FindByID(user.ID)
+	if len(stored.Identities) != 0 {
+		t.Errorf("expected no identities left got %d", len(stored.Identities))
+	}
+}
+
+func TestProviderLoginClaimsUnconfirmedUser(t *testing.T) {
+	s := newTestServer(t)
+
+	// Someone signs up with an address they cannot confirm.
+	var session struct {
+		Token string `json:"token"`
+	}
+	s.do("POST", "/auth/signup", "", Response{"email": "jane@example.com", "password": "attacker"}, &session)
+
+	claims := &OIDCClaims{Subject: "1", Email: "jane@example.com", EmailVerified: true}
+	user, errM := s.app.FindOrCreateProviderUser("google", claims)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if user.Password != "" || user.Status != UNREGISTERED.String() || !user.HasIdentity("google") {
+		t.Errorf("expected the owner to get the user without the password got %+v", user)
+	}
+
+	if code := s.do("POST", "/auth/login", "", Response{"email": "jane@example.com", "password": "attacker"}, nil); code == http.StatusOK {
+		t.Errorf("expected the old password to stop working")
+	}
+	if code := s.do("GET", "/auth/", session.Token, nil, nil); code == http.StatusOK {
+		t.Errorf("expected the old session to be logged out")
+	}
+
+	// Confirmed users keep their password.
+	s.signUp("john@example.com")
+	claims = &OIDCClaims{Subject: "2", Email: "john@example.com", EmailVerified: true}
+	if john, errM := s.app.FindOrCreateProviderUser("google", claims); errM != nil || john.Password == "" {
+		t.Errorf("expected confirmed user to be linked as is got %+v: %v", john, errM)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ImportResult reports what an import did, or would do on a dry run. Nothing
+// is written if any row has errors.
+type ImportResult struct {
+	Kind    string        `json:"kind"`
+	DryRun  bool          `json:"dryRun"`
+	Rows    int           `json:"rows"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// ImportError is a problem with one row of an import. Row numbers count the
+// header as row 1, as spreadsheet programs do.
+type ImportError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportRow map[string]string
+
+// importKind describes the CSV layout of one kind of import. Check validates
+// a row and reports whether it updates an existing record; Apply writes it.
+type importKind struct {
+	Columns  []string
+	Required []string
+	Key      func(row ImportRow) string
+	Check    func(im *importer, row ImportRow) bool
+	Apply    func(app *App, row ImportRow) *Error
+}
+
+var importKinds = map[string]importKind{
+	"organizations": {
+		Columns:  []string{"name", "timeZone"},
+		Required: []string{"name"},
+		Key:      func(row ImportRow) string { return strings.ToLower(row["name"]) },
+		Check:    checkOrganizationRow,
+		Apply:    applyOrganizationRow,
+	},
+	"commitments": {
+		Columns:  []string{"category", "commitment"},
+		Required: []string{"category", "commitment"},
+		Key:      func(row ImportRow) string { return strings.ToLower(row["category"] + "\n" + row["commitment"]) },
+		Check:    checkCommitmentRow,
+		Apply:    applyCommitmentRow,
+	},
+	"users": {
+		Columns:  []string{"email", "firstName", "lastName", "organization", "team", "family", "role"},
+		Required: []string{"email"},
+		Key:      func(row ImportRow) string { return NormalizeEmail(row["email"]) },
+		Check:    checkUserRow,
+		Apply:    applyUserRow,
+	},
+}
+
+// importer carries the state of one import while rows are checked.
+type importer struct {
+	app    *App
+	admin  *User
+	result *ImportResult
+	row    int
+}
+
+func (im *importer) fail(column, message string) {
+	im.result.Errors = append(im.result.Errors, ImportError{Row: im.row, Column: column, Message: message})
+}
+
+// ImportData upserts organizations, commitments or users from a CSV upload,
+// sent either as the request body or as the "file" field of a form. With
+// ?dryRun=true the file is only checked.
+func (app *App) ImportData(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "ImportData")
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	kind := mux.Vars(r)["kind"]
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	in := io.Reader(r.Body)
+	if strings.Contains(r.Header.Get("Content-Type"), "multipart") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	result, errM := app.ImportCSV(user, kind, in, dryRun)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	code := http.StatusOK
+	if len(result.Errors) > 0 && !dryRun {
+		code = http.StatusUnprocessableEntity
+	} else if !dryRun {
+		ctx.WithField("user", user.Email).WithField("kind", kind).WithField("rows", result.Rows).Info("Admin imported data.")
+		AuditChange(r, kind, nil, Response{"created": result.Created, "updated": result.Updated})
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		ISR(w, r, fmt.Errorf("Failed to marshal import result: %s", err))
+		return
+	}
+	ServeJSONArray(w, r, string(b), code)
+}
+
+// ImportCSV checks every row of the file and, unless this is a dry run or a
+// row has errors, writes them all. The admin limits which roles users can be
+// given; it is nil for imports from the command line.
+func (app *App) ImportCSV(admin *User, kind string, in io.Reader, dryRun bool) (*ImportResult, *Error) {
+	k, ok := importKinds[kind]
+	if !ok {
+		return nil, &Error{Reason: errors.New(IMPORT_KIND_ERROR), Code: http.StatusNotFound}
+	}
+
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf(IMPORT_PARSE_ERROR, err), Code: http.StatusBadRequest}
+	}
+
+	if len(records) == 0 {
+		return nil, &Error{Reason: errors.New(IMPORT_EMPTY_ERROR), Code: http.StatusBadRequest}
+	}
+
+	result := &ImportResult{Kind: kind, DryRun: dryRun, Errors: []ImportError{}}
+	im := &importer{app: app, admin: admin, result: result, row: 1}
+
+	// Map header names to columns. Spreadsheet programs like to start the
+	// file with a byte order mark.
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		found := false
+		for _, column := range k.Columns {
+			if strings.EqualFold(name, column) {
+				columns[column] = i
+				found = true
+			}
+		}
+		if !found {
+			im.fail(name, fmt.Sprintf(IMPORT_COLUMN_ERROR, strings.Join(k.Columns, ", ")))
+		}
+	}
+	for _, column := range k.Required {
+		if _, ok := columns[column]; !ok {
+			im.fail(column, IMPORT_MISSING_COLUMN_ERROR)
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	var rows []ImportRow
+	seen := map[string]int{}
+	for i, record := range records[1:] {
+		im.row = i + 2
+
+		row := ImportRow{}
+		blank := true
+		for column, index := range columns {
+			if index < len(record) {
+				row[column] = strings.TrimSpace(record[index])
+			}
+			if row[column] != "" {
+				blank = false
+			}
+		}
+		if blank {
+			continue
+		}
+		result.Rows++
+
+		missing := false
+		for _, column := range k.Required {
+			if row[column] == "" {
+				im.fail(column, IMPORT_REQUIRED_ERROR)
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+
+		key := k.Key(row)
+		if first, ok := seen[key]; ok {
+			im.fail("", fmt.Sprintf(IMPORT_DUPLICATE_ERROR, first))
+			continue
+		}
+		seen[key] = im.row
+
+		if k.Check(im, row) {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+		rows = append(rows, row)
+	}
+
+	if dryRun || len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	// A file is imported whole or not at all.
+	errM := app.Atomically(func(app *App) *Error {
+		for _, row := range rows {
+			errM := k.Apply(app, row)
+			if errM != nil {
+				return errM
+			}
+		}
+		return nil
+	})
+	if errM != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error importing %s: %s\n", kind, errM.Reason), Internal: true}
+	}
+
+	return result, nil
+}
+
+// ImportFile imports a CSV file given as kind:path from the command line and
+// logs every row error.
+func ImportFile(db mongoDB, spec string, dryRun bool) error {
+	ctx := logger.WithField("method", "ImportFile")
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("Expected the import as kind:path, e.g. users:roster.csv.")
+	}
+
+	f, err := os.Open(parts[1])
+	if err != nil {
+		return fmt.Errorf("Failed to open import file: %s\n", err)
+	}
+	defer f.Close()
+
+	result, errM := NewMongoApp(db).ImportCSV(nil, parts[0], f, dryRun)
+	if errM != nil {
+		return errM.Reason
+	}
+
+	for _, e := range result.Errors {
+		ctx.WithField("row", e.Row).WithField("column", e.Column).Warn(e.Message)
+	}
+	ctx.WithFields(logrus.Fields{"kind": result.Kind, "dryRun": dryRun, "rows": result.Rows,
+		"created": result.Created, "updated": result.Updated}).Info("*** Import complete. ***")
+
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("Found %d errors, nothing was imported.", len(result.Errors))
+	}
+
+	return nil
+}
+
+func checkOrganizationRow(im *importer, row ImportRow) bool {
+	if HasProfanity(row["name"]) {
+		im.fail("name", PROFANITY_ERROR)
+	}
+	if row["timeZone"] != "" {
+		if _, err := time.LoadLocation(row["timeZone"]); err != nil {
+			im.fail("timeZone", TIMEZONE_ERROR)
+		}
+	}
+
+	org, _ := im.app.Organizations.FindByName(row["name"])
+	return org != nil
+}
+
+// Imported organizations are approved, even if someone requested them before.
+func applyOrganizationRow(app *App, row ImportRow) *Error {
+	return app.Organizations.Import(row["name"], row["timeZone"])
+}
+
+func checkCommitmentRow(im *importer, row ImportRow) bool {
+	if HasProfanity(row["category"]) {
+		im.fail("category", PROFANITY_ERROR)
+	}
+	if HasProfanity(row["commitment"]) {
+		im.fail("commitment", PROFANITY_ERROR)
+	}
+
+	commitment, _ := im.app.Commitments.FindByName(row["category"])
+	return commitment != nil && Contains(commitment.Commitments, row["commitment"])
+}
+
+func applyCommitmentRow(app *App, row ImportRow) *Error {
+	return app.Commitments.Add(row["category"], row["commitment"])
+}
+
+// checkUserRow also replaces the e-mail column with the address users are
+// stored and looked up by.
+func checkUserRow(im *importer, row ImportRow) bool {
+	if _, err := mail.ParseAddress(row["email"]); err != nil {
+		im.fail("email", EMAIL_INVALID_ERROR)
+	}
+	row["email"] = NormalizeEmail(row["email"])
+
+	for _, column := range []string{"firstName", "lastName", "team", "family"} {
+		if HasProfanity(row[column]) {
+			im.fail(column, PROFANITY_ERROR)
+		}
+	}
+
+	if row["organization"] != "" {
+		org, _ := im.app.Organizations.FindByName(row["organization"])
+		if org == nil || org.NeedsApproval {
+			im.fail("organization", IMPORT_ORGANIZATION_ERROR)
+		}
+	}
+
+	existing, errM := im.app.Users.FindByEmail(row["email"])
+	if errM != nil {
+		existing = nil
+	}
+
+	// Admins only change users below them, whatever columns are filled in.
+	if im.admin != nil && existing != nil && !im.admin.Outranks(existing) {
+		im.fail("email", IMPORT_USER_DENIED_ERROR)
+	}
+
+	if row["role"] != "" {
+		role, ok := ParseRole(row["role"])
+		if !ok {
+			im.fail("role", IMPORT_ROLE_ERROR)
+		} else if im.admin != nil && !im.admin.Outranks(&User{Role: role.String()}) {
+			im.fail("role", IMPORT_ROLE_DENIED_ERROR)
+		}
+	}
+
+	return existing != nil
+}
+
+// New users are created without a password. They can set one with a password
+// reset or log in with a provider that confirms the address.
+func applyUserRow(app *App, row ImportRow) *Error {
+	set := bson.M{}
+	for _, column := range []string{"firstName", "lastName", "team", "family", "role"} {
+		if row[column] != "" {
+			set[column] = row[column]
+		}
+	}
+
+	// Organizations are given by name and stored by ID.
+	var organization bson.ObjectID
+	if row["organization"] != "" {
+		org, errM := app.Organizations.FindByName(row["organization"])
+		if errM != nil {
+			return errM
+		}
+		organization = org.ID
+		set["organization"] = organization
+	}
+
+	existing, errM := app.Users.FindByEmail(row["email"])
+	if errM == nil {
+		if len(set) == 0 {
+			return nil
+		}
+		return app.Users.Update(existing.ID, set)
+	}
+
+	user := NewUser()
+	user.Email = row["email"]
+	user.FirstName = row["firstName"]
+	user.LastName = row["lastName"]
+	user.Organization = organization
+	user.Team = row["team"]
+	user.Family = row["family"]
+	user.Role = USER.String()
+	if row["role"] != "" {
+		user.Role = row["role"]
+	}
+	user.Status = UNREGISTERED.String()
+	user.CreatedOn = time.Now()
+	return app.Users.Create(user)
+}
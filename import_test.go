@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestImportUsersDryRun(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	app := NewMongoApp(db)
+
+	app.Organizations.Create("Sample Gym", false)
+
+	file := "Email,First Name,organization\n" +
+		"jane@example.com,Jane,Sample Gym\n"
+	result, errM := app.ImportCSV(nil, "users", strings.NewReader(file), true)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Column != "First Name" {
+		t.Fatalf("expected unknown column to be reported got %+v", result.Errors)
+	}
+
+	file = "email,firstName,organization\n" +
+		"jane@example.com,Jane,Sample Gym\n" +
+		"JANE@example.com,Janet,Sample Gym\n" +
+		"john@example.com,John,Nowhere\n" +
+		"\n" +
+		"jim@example.com,Jim,\n"
+	result, errM = app.ImportCSV(nil, "users", strings.NewReader(file), true)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if result.Rows != 4 || len(result.Errors) != 2 {
+		t.Fatalf("expected 4 rows with 2 errors got %+v", result)
+	}
+	if result.Errors[0].Row != 3 || result.Errors[1].Row != 4 || result.Errors[1].Column != "organization" {
+		t.Errorf("expected duplicate on row 3 and unknown organization on row 4 got %+v", result.Errors)
+	}
+	if n, _ := db.C("users").CountDocuments(db.ctx, bson.M{}); n != 0 {
+		t.Errorf("expected dry run not to write users got %d", n)
+	}
+
+	// Files with errors are not imported at all.
+	result, _ = app.ImportCSV(nil, "users", strings.NewReader(file), false)
+	if n, _ := db.C("users").CountDocuments(db.ctx, bson.M{}); n != 0 || len(result.Errors) == 0 {
+		t.Errorf("expected nothing to be imported got %d users", n)
+	}
+
+	file = "email,firstName,organization\n" +
+		"jane@example.com,Jane,Sample Gym\n" +
+		"jim@example.com,Jim,\n"
+	result, errM = app.ImportCSV(nil, "users", strings.NewReader(file), false)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if result.Created != 2 || len(result.Errors) != 0 {
+		t.Fatalf("expected 2 users to be created got %+v", result)
+	}
+
+	gym, _ := app.Organizations.FindByName("Sample Gym")
+	user, errM := app.Users.FindByEmail("jane@example.com")
+	if errM != nil || user.Organization != gym.ID || user.Status != UNREGISTERED.String() || user.Role != USER.String() {
+		t.Errorf("expected imported user got %+v", user)
+	}
+}
+
+func TestImportUsersMatchesAddresses(t *testing.T) {
+	app := NewMemoryApp()
+	app.Users.Create(&User{ID: bson.NewObjectID(), Email: "jane@example.com", Role: USER.String()})
+
+	file := "email,firstName\n" +
+		"Jane Doe <JANE@example.com>,Jane\n" +
+		"John@Example.com,John\n"
+	result, errM := app.ImportCSV(nil, "users", strings.NewReader(file), false)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if result.Updated != 1 || result.Created != 1 || len(result.Errors) != 0 {
+		t.Fatalf("expected 1 user to be updated and 1 created got %+v", result)
+	}
+
+	if jane, _ := app.Users.FindByEmail("jane@example.com"); jane == nil || jane.FirstName != "Jane" {
+		t.Errorf("expected existing user to be updated got %+v", jane)
+	}
+	if john, _ := app.Users.FindByEmail("john@example.com"); john == nil {
+		t.Errorf("expected new user to be stored by the bare address in lower case")
+	}
+	if users, _ := app.Users.Find(UserFilter{}); len(users) != 2 {
+		t.Errorf("expected 2 users got %d", len(users))
+	}
+}
+
+func TestImportUsersKeepsAdminsWithinTheirReach(t *testing.T) {
+	app := NewMemoryApp()
+	admin := &User{ID: bson.NewObjectID(), Email: "admin@example.com", Role: GLOBAL_ADMIN.String()}
+	app.Users.Create(admin)
+	app.Users.Create(&User{ID: bson.NewObjectID(), Email: "boss@example.com", Role: GLOBAL_SUPER_ADMIN.String()})
+
+	// Rows without a role still change the user they name.
+	result, errM := app.ImportCSV(admin, "users", strings.NewReader("email,lastName\nboss@example.com,Doe\n"), false)
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Column != "email" {
+		t.Fatalf("expected user above the admin to be rejected got %+v", result)
+	}
+	if boss, _ := app.Users.FindByEmail("boss@example.com"); boss.LastName != "" {
+		t.Errorf("expected user above the admin to be left alone got %+v", boss)
+	}
+}
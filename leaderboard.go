@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	defaultLeaderboardLimit = 50
+	maxLeaderboardLimit     = 500
+)
+
+// The field each leaderboard groups participants by. Individuals are not
+// grouped at all.
+var leaderboards = map[string]bson.M{
+	"individuals":   nil,
+	"teams":         bson.M{"organization": "$organization", "name": "$team"},
+	"families":      bson.M{"name": "$family"},
+	"organizations": bson.M{"name": "$organization"},
+}
+
+// Family codes let people join a family, so family entries are named after
+// the last name of the family's first member instead of the code.
+var leaderboardLabels = map[string]string{
+	"families": "$lastName",
+}
+
+type LeaderboardEntry struct {
+	Rank         int     `bson:"-" json:"rank"`
+	Name         string  `bson:"name" json:"name"`
+	Organization string  `bson:"organization,omitempty" json:"organization,omitempty"`
+	Participants int     `bson:"participants" json:"participants"`
+	Total        int     `bson:"total" json:"total"`
+	Average      float64 `bson:"average" json:"average"`
+}
+
+func (app *App) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if !GLOBALS.LeaderboardsEnabled {
+		BR(w, r, errors.New(LEADERBOARDS_DISABLED_ERROR), http.StatusNotFound)
+		return
+	}
+
+	board := mux.Vars(r)["board"]
+	if _, ok := leaderboards[board]; !ok {
+		BR(w, r, errors.New("That leaderboard does not exist."), http.StatusNotFound)
+		return
+	}
+
+	sortBy := r.Form.Get("sort")
+	if sortBy == "" {
+		sortBy = "total"
+	} else if sortBy != "total" && sortBy != "average" {
+		BR(w, r, errors.New(BAD_CHOICE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultLeaderboardLimit
+	if l := r.Form.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			BR(w, r, errors.New(BAD_CHOICE_ERROR), http.StatusBadRequest)
+			return
+		}
+		limit = n
+		if limit > maxLeaderboardLimit {
+			limit = maxLeaderboardLimit
+		}
+	}
+
+	// Anonymous visitors only see what is shared with everyone.
+	var viewer *User
+	if IsTokenSet(r) {
+		user, errM := app.GetUserFromToken(GetToken(w, r))
+		if errM != nil {
+			HandleModelError(w, r, errM)
+			return
+		}
+		viewer = user
+	}
+
+	entries, errM := app.FindLeaderboard(viewer, board, sortBy, limit)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(entries)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+// FindLeaderboard ranks the participants of the current season on a
+// leaderboard. Users who share with nobody are left out and users who share
+// with their organization (or never chose) only count for viewers from the
+// same organization.
+func (app *App) FindLeaderboard(viewer *User, board string, sortBy string, limit int) ([]LeaderboardEntry, *Error) {
+	entries, errM := app.Users.Leaderboard(LeaderboardQuery{Season: SEASON.ID, Viewer: viewer, Board: board,
+		SortBy: sortBy, Limit: limit})
+	if errM != nil {
+		return nil, errM
+	}
+
+	RankLeaderboard(entries, sortBy)
+
+	return entries, nil
+}
+
+// RankLeaderboard numbers sorted entries, giving tied entries the same rank.
+func RankLeaderboard(entries []LeaderboardEntry, sortBy string) {
+	score := func(e LeaderboardEntry) float64 {
+		if sortBy == "average" {
+			return e.Average
+		}
+		return float64(e.Total)
+	}
+
+	for i := range entries {
+		if i > 0 && score(entries[i]) == score(entries[i-1]) {
+			entries[i].Rank = entries[i-1].Rank
+		} else {
+			entries[i].Rank = i + 1
+		}
+	}
+}
@@ -1,14 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"html/template"
+	"strconv"
 	"time"
-
-	"gopkg.in/gomail.v2"
 )
 
 const maxRetries = 5
@@ -27,24 +23,113 @@ To do so, just click this link or paste the URL into your browser:<a href="https
 The NHC Team</p>
 `
 
+const verificationText = `Hi {{.FirstName}},
+
+Thank you for creating an account at https://www.nutritionhabitchallenge.com!
+
+Before you can register, you need to verify your e-mail address. To do so, open this link in your browser:
+https://www.nutritionhabitchallenge.com/verify/{{.Code}}
+
+Sincerely,
+The NHC Team
+`
+
 type RegistrationConfirmationTemplate struct {
 	FirstName string
+	Season    string // The year of the challenge, as in "Nutrition Habit Challenge 2017".
 	Family    string
 	Donation  string
+	Facebook  string // The Facebook page, left out when none is configured.
 }
 
 const registrationEmail = `
 <p>Hi {{.FirstName}},</p>
-<p>Congratulations! You are now registered for the Nutrition Habit Challenge 2016. Your participation benefits both you and our community.</p>
+<p>Congratulations! You are now registered for the Nutrition Habit Challenge {{.Season}}. Your participation benefits both you and our community.</p>
 {{with .Family}}<p>Here is your family code to share with members of your family, they'll need it when they register: <strong>{{.}}</strong></p>{{end}}
 <p>We’ll be sending you an email as we get closer to the event. In the meantime, check out the <a href="https://www.nutritionhabitchallenge.com/resources">Resource Page</a> for great information and insights to help you be successful with the Challenge.</p>
-<p>Stay connected with us and be "in-the-know" about special NHC promotional events by following us on <a href="https://facebook.com/NHC2017">Facebook</a>.</p>
+{{with .Facebook}}<p>Stay connected with us and be "in-the-know" about special NHC promotional events by following us on <a href="{{.}}">Facebook</a>.</p>{{end}}
 {{if eq .Donation "ysb"}}<p>To donate to the Youth Service Bureau, follow <strong><a href="http://ccysb.com/?page_id=1197" target="_blank">this link</a></strong>.</p>
 {{else if eq .Donation "cvim"}}<p>To donate to the Centre Volunteers in Medicine, follow <a href="https://cvim.ejoinme.org/MyPages/CVIMNHC/tabid/524126/Default.aspx" target="_blank">this link</a>.</p>{{end}}
 <p><small>If you would like a physical scorecard to track your challenge progress with, download and print the <a href="https://www.nutritionhabitchallenge.com/downloads/scorecard.pdf">PDF scorecard.</a></small></p>
 <p>Sincerely,<br />The NHC Team</p>
 `
 
+const registrationText = `Hi {{.FirstName}},
+
+Congratulations! You are now registered for the Nutrition Habit Challenge {{.Season}}. Your participation benefits both you and our community.
+{{with .Family}}
+Here is your family code to share with members of your family, they'll need it when they register: {{.}}
+{{end}}
+We'll be sending you an email as we get closer to the event. In the meantime, check out the Resource Page at https://www.nutritionhabitchallenge.com/resources for great information and insights to help you be successful with the Challenge.
+{{with .Facebook}}
+Stay connected with us and be "in-the-know" about special NHC promotional events by following us on Facebook: {{.}}
+{{end}}{{if eq .Donation "ysb"}}
+To donate to the Youth Service Bureau, go to http://ccysb.com/?page_id=1197
+{{else if eq .Donation "cvim"}}
+To donate to the Centre Volunteers in Medicine, go to https://cvim.ejoinme.org/MyPages/CVIMNHC/tabid/524126/Default.aspx
+{{end}}
+If you would like a physical scorecard to track your challenge progress with, download and print the PDF scorecard: https://www.nutritionhabitchallenge.com/downloads/scorecard.pdf
+
+Sincerely,
+The NHC Team
+`
+
+type EmailChangeTemplate struct {
+	FirstName string
+	Email     string
+	Code      string
+}
+
+const emailChangeEmail = `
+<p>Hi {{.FirstName}},<p>
+<p>We received a request to change the e-mail address of your account at <a href="https://www.nutritionhabitchallenge.com">https://www.nutritionhabitchallenge.com</a> to {{.Email}}.<p>
+<p>To confirm the change, just click this link or paste the URL into your browser: <a href="https://www.nutritionhabitchallenge.com/verify/{{.Code}}">https://www.nutritionhabitchallenge.com/verify/{{.Code}}</a></p>
+<p>If you did not make this request, please ignore this e-mail.</p>
+<p>Sincerely,<br />
+The NHC Team</p>
+`
+
+const emailChangeText = `Hi {{.FirstName}},
+
+We received a request to change the e-mail address of your account at https://www.nutritionhabitchallenge.com to {{.Email}}.
+
+To confirm the change, open this link in your browser:
+https://www.nutritionhabitchallenge.com/verify/{{.Code}}
+
+If you did not make this request, please ignore this e-mail.
+
+Sincerely,
+The NHC Team
+`
+
+type DataExportTemplate struct {
+	FirstName string
+	Link      string
+	Expires   string
+}
+
+const dataExportEmail = `
+<p>Hi {{.FirstName}},<p>
+<p>The copy of your data you asked for is ready. You can download it here until {{.Expires}}: <a href="{{.Link}}">{{.Link}}</a></p>
+<p>The archive contains a JSON file for each kind of information we store about you and your participants.</p>
+<p>If you did not make this request, please let us know.</p>
+<p>Sincerely,<br />
+The NHC Team</p>
+`
+
+const dataExportText = `Hi {{.FirstName}},
+
+The copy of your data you asked for is ready. You can download it here until {{.Expires}}:
+{{.Link}}
+
+The archive contains a JSON file for each kind of information we store about you and your participants.
+
+If you did not make this request, please let us know.
+
+Sincerely,
+The NHC Team
+`
+
 type ResetPasswordTemplate struct {
 	FirstName string
 	Code      string
@@ -59,98 +144,151 @@ const resetPasswordEmail = `
 The NHC Team</p>
 `
 
-func SendBulkMail(recipients []string, subject string, body string) (errM *Error) {
-	ctx := logger.WithField("method", "SendBulkMail")
+const resetPasswordText = `Hi {{.FirstName}},
 
-	var errCount int
-	for _, recipient := range recipients {
-		if errM := SendMail(recipient, subject, body); errM != nil {
-			errCount++
-		}
-		time.Sleep(250 * time.Millisecond)
-	}
+We received a request to reset the password on this account at https://www.nutritionhabitchallenge.com
 
-	ctx.WithField("errors", errCount).WithField("recipients", len(recipients)).
-		WithField("subject", subject).Info("Finished sending bulk e-mail.")
+To reset your password, open this link in your browser:
+https://www.nutritionhabitchallenge.com/reset-password/{{.Code}}
 
-	return nil
-}
+If you did not make this request, please ignore this e-mail.
 
-func SendMail(recipient string, subject string, body string) (errM *Error) {
-	ctx := logger.WithField("method", "SendMail")
+Sincerely,
+The NHC Team
+`
 
-	var retryCount int
+type OrganizationRequestTemplate struct {
+	Organization string
+	Outcome      string
+	MergedInto   string
+}
 
-	m := gomail.NewMessage()
-	m.SetHeader("From", "info@nutritionhabitchallenge.com")
-	m.SetHeader("To", recipient)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
+const organizationRequestEmail = `
+<p>Hi,</p>
+{{if eq .Outcome "approved"}}<p>Good news! The organization you asked us to add, <strong>{{.Organization}}</strong>, has been approved and is now available to everyone at <a href="https://www.nutritionhabitchallenge.com">https://www.nutritionhabitchallenge.com</a>.</p>
+{{else if eq .Outcome "merged"}}<p>The organization you asked us to add, <strong>{{.Organization}}</strong>, is already part of the challenge as <strong>{{.MergedInto}}</strong>. Anyone who picked your organization has been moved over to it.</p>
+{{else}}<p>Unfortunately we could not add the organization you asked for, <strong>{{.Organization}}</strong>. You can pick one of the available organizations from your profile at any time.</p>{{end}}
+<p>Sincerely,<br />
+The NHC Team</p>
+`
 
-	d := gomail.Dialer{
-		Host:     SMTPHost,
-		Port:     SMTPPort,
-		Username: SMTPUsername,
-		Password: SMTPPassword,
-	}
-send:
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	if err := d.DialAndSend(m); err != nil {
-		retryCount++
-		if retryCount >= maxRetries {
-			ctx.WithError(err).WithField("recipient", recipient).Error("Error sending mail.")
-			errM = &Error{Internal: true, Reason: fmt.Errorf("Error sending mail: %s\n", err)}
-			return
-		}
-		goto send
+const organizationRequestText = `Hi,
+{{if eq .Outcome "approved"}}
+Good news! The organization you asked us to add, {{.Organization}}, has been approved and is now available to everyone at https://www.nutritionhabitchallenge.com.
+{{else if eq .Outcome "merged"}}
+The organization you asked us to add, {{.Organization}}, is already part of the challenge as {{.MergedInto}}. Anyone who picked your organization has been moved over to it.
+{{else}}
+Unfortunately we could not add the organization you asked for, {{.Organization}}. You can pick one of the available organizations from your profile at any time.
+{{end}}
+Sincerely,
+The NHC Team
+`
+
+// SendBulkMail queues the same message for every recipient. The text body
+// may be empty for HTML-only mail.
+func SendBulkMail(recipients []string, subject string, body string, text string) (errM *Error) {
+	var messages []OutboxMessage
+	for _, recipient := range recipients {
+		messages = append(messages, OutboxMessage{Recipient: recipient, Subject: subject, Body: body, Text: text})
 	}
 
-	ctx.WithField("recipient", recipient).WithField("subject", subject).Info("Successfully sent mail.")
+	return QueueMail(messages...)
+}
 
-	return nil
+// SendMail queues a message; the outbox workers deliver it.
+func SendMail(recipient string, subject string, body string, text string) (errM *Error) {
+	return QueueMail(OutboxMessage{Recipient: recipient, Subject: subject, Body: body, Text: text})
 }
 
-func SendVerificationMail(user *User) (errM *Error) {
-	var body bytes.Buffer
+// QueueMail hands messages to the outbox. Without an outbox, as in tests and
+// one-off commands, they are delivered right away instead.
+func QueueMail(messages ...OutboxMessage) (errM *Error) {
+	ctx := logger.WithField("method", "QueueMail")
 
-	confirmation := VerificationTemplate{FirstName: user.FirstName, Code: user.Code}
-	template := template.Must(template.New("e-mail").Parse(verificationEmail))
-	err := template.Execute(&body, &confirmation)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error executing template: %s\n", err)), Internal: true}
+	if OUTBOX == nil {
+		for _, m := range messages {
+			err := DeliverMail(m.Recipient, m.Subject, m.Body, m.Text)
+			if err != nil {
+				ctx.WithError(err).WithField("recipient", m.Recipient).Error("Error sending mail.")
+				errM = &Error{Internal: true, Reason: fmt.Errorf("Error sending mail: %s\n", err)}
+			}
+		}
 		return
 	}
 
-	return SendMail(user.Email, "Nutrition Habit Challenge: E-Mail Verification Required",
-		string(body.Bytes()))
+	errM = OUTBOX.Enqueue(messages...)
+	if errM != nil {
+		ctx.WithError(errM.Reason).WithField("messages", len(messages)).Error("Error queueing mail.")
+	}
+
+	return
 }
 
-func SendRegistrationConfirmation(user *User) (errM *Error) {
-	var body bytes.Buffer
+// DeliverMail makes a single attempt to send a message through MAILER.
+func DeliverMail(recipient string, subject string, body string, text string) error {
+	if MAILER == nil {
+		return errors.New("No mail transport has been configured.")
+	}
+
+	return MAILER.Send(&Mail{From: mailSender, To: recipient, Subject: subject, Body: body, Text: text,
+		SentOn: time.Now()})
+}
 
-	confirmation := RegistrationConfirmationTemplate{FirstName: user.FirstName, Family: user.Family, Donation: user.Donation}
-	template := template.Must(template.New("e-mail").Parse(registrationEmail))
-	err := template.Execute(&body, &confirmation)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error executing template: %s\n", err)), Internal: true}
+// SendTemplateMail renders the named e-mail template and queues it for every
+// recipient. Failures are logged, so callers that do not want to fail the
+// request over an e-mail can ignore them.
+func (app *App) SendTemplateMail(name string, recipients []string, data interface{}) (errM *Error) {
+	ctx := logger.WithField("method", "SendTemplateMail")
+
+	subject, body, text, errM := app.RenderEmail(name, data)
+	if errM != nil {
+		ctx.WithError(errM.Reason).WithField("template", name).Error("Error rendering e-mail.")
 		return
 	}
 
-	return SendMail(user.Email, "Nutrition Habit Challenge: Registration Confirmation",
-		string(body.Bytes()))
+	return SendBulkMail(recipients, subject, body, text)
 }
 
-func SendResetPasswordMail(user *User) (errM *Error) {
-	var body bytes.Buffer
+// SendVerificationMail sends the user a new verification code. Codes sent
+// before stop working.
+func (app *App) SendVerificationMail(user *User) (errM *Error) {
+	code, errM := app.IssueUserCode(user, VERIFY_PURPOSE)
+	if errM != nil {
+		return errM
+	}
 
-	resetPassword := ResetPasswordTemplate{FirstName: user.FirstName, Code: user.ResetCode}
-	template := template.Must(template.New("e-mail").Parse(resetPasswordEmail))
-	err := template.Execute(&body, &resetPassword)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error executing template: %s\n", err)), Internal: true}
-		return
+	return app.SendTemplateMail(VERIFICATION_TEMPLATE, []string{user.Email},
+		&VerificationTemplate{FirstName: user.FirstName, Code: code})
+}
+
+func (app *App) SendRegistrationConfirmation(user *User) (errM *Error) {
+	return app.SendTemplateMail(REGISTRATION_TEMPLATE, []string{user.Email},
+		&RegistrationConfirmationTemplate{FirstName: user.FirstName, Season: strconv.Itoa(SEASON.ChallengeStart.Year()), Family: user.Family,
+			Donation: user.Donation, Facebook: config.FACEBOOK_PAGE})
+}
+
+// SendEmailChangeMail asks the user to confirm a new address from that address.
+func (app *App) SendEmailChangeMail(user *User, email string) (errM *Error) {
+	code, errM := app.IssueEmailChangeCode(user, email)
+	if errM != nil {
+		return errM
 	}
 
-	return SendMail(user.Email, "Nutrition Habit Challenge: Reset Password Request",
-		string(body.Bytes()))
+	return app.SendTemplateMail(EMAIL_CHANGE_TEMPLATE, []string{email},
+		&EmailChangeTemplate{FirstName: user.FirstName, Email: email, Code: code})
+}
+
+func (app *App) SendResetPasswordMail(user *User) (errM *Error) {
+	code, errM := app.IssueUserCode(user, RESET_PURPOSE)
+	if errM != nil {
+		return errM
+	}
+
+	return app.SendTemplateMail(RESET_PASSWORD_TEMPLATE, []string{user.Email},
+		&ResetPasswordTemplate{FirstName: user.FirstName, Code: code})
+}
+
+func (app *App) SendOrganizationRequestMail(recipients []string, organization string, outcome string, mergedInto string) (errM *Error) {
+	return app.SendTemplateMail(ORGANIZATION_REQUEST_TEMPLATE, recipients,
+		&OrganizationRequestTemplate{Organization: organization, Outcome: outcome, MergedInto: mergedInto})
 }
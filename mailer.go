@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	mailSender      = "info@nutritionhabitchallenge.com"
+	captureBoundary = "nhc-captured-mail"
+)
+
+// MAILER is the transport outgoing mail is delivered through.
+var MAILER Mailer
+
+type Mail struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Text    string    `json:"text,omitempty"`
+	SentOn  time.Time `json:"sentOn"`
+}
+
+// Mailer delivers a single message. Implementations must be safe to use from
+// several goroutines.
+type Mailer interface {
+	Send(m *Mail) error
+}
+
+// NewMailer builds the transport named by MAIL_TRANSPORT: "smtp" (the
+// default) or "capture", which keeps messages in memory and also writes them
+// to MAIL_CAPTURE_DIR when that is set.
+func NewMailer() (Mailer, error) {
+	switch transport := os.Getenv("MAIL_TRANSPORT"); transport {
+	case "", "smtp":
+		return &SMTPMailer{Host: SMTPHost, Port: SMTPPort, Username: SMTPUsername, Password: SMTPPassword}, nil
+	case "capture":
+		return NewCaptureMailer(os.Getenv("MAIL_CAPTURE_DIR"))
+	default:
+		return nil, fmt.Errorf("Unknown mail transport: %s", transport)
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (s *SMTPMailer) Send(m *Mail) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.From)
+	msg.SetHeader("To", m.To)
+	msg.SetHeader("Subject", m.Subject)
+	if m.Text != "" {
+		msg.SetBody("text/plain", m.Text)
+		msg.AddAlternative("text/html", m.Body)
+	} else {
+		msg.SetBody("text/html", m.Body)
+	}
+
+	d := gomail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	d.TLSConfig = &tls.Config{ServerName: s.Host}
+
+	return d.DialAndSend(msg)
+}
+
+// CaptureMailer never sends anything. It is meant for development and tests.
+type CaptureMailer struct {
+	Dir string
+
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func NewCaptureMailer(dir string) (*CaptureMailer, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating mail capture directory: %s", err)
+		}
+	}
+
+	return &CaptureMailer{Dir: dir}, nil
+}
+
+func (c *CaptureMailer) Send(m *Mail) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Dir != "" {
+		name := fmt.Sprintf("%s-%03d-%s.eml", m.SentOn.Format("20060102T150405"), len(c.sent),
+			strings.Map(safeFileRune, m.To))
+		content := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n",
+			m.From, m.To, m.Subject, m.SentOn.Format(time.RFC1123Z))
+		if m.Text != "" {
+			content += "Content-Type: multipart/alternative; boundary=" + captureBoundary + "\r\n\r\n" +
+				"--" + captureBoundary + "\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" + m.Text + "\r\n" +
+				"--" + captureBoundary + "\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n" + m.Body + "\r\n" +
+				"--" + captureBoundary + "--\r\n"
+		} else {
+			content += "Content-Type: text/html; charset=UTF-8\r\n\r\n" + m.Body
+		}
+		err := ioutil.WriteFile(filepath.Join(c.Dir, name), []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("Error capturing mail: %s", err)
+		}
+	}
+
+	c.sent = append(c.sent, *m)
+
+	return nil
+}
+
+// Sent returns the captured messages, oldest first.
+func (c *CaptureMailer) Sent() []Mail {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Mail(nil), c.sent...)
+}
+
+func safeFileRune(r rune) rune {
+	if r == '/' || r == '\\' || r == os.PathSeparator {
+		return '_'
+	}
+	return r
+}
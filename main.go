@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -10,7 +11,6 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/bshuster-repo/logrus-logstash-hook"
 	"github.com/codegangsta/negroni"
-	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
@@ -25,18 +25,18 @@ var (
 	SMTPPort     int
 	SMTPUsername string
 	SMTPPassword string
+	MailWorkers  = 2
 	PORT         string
 	MONGODB_URL  = "localhost"
 	ENV          string
-	INIT         bool
 	APP_DIR      string
 	URL          string
 	GLOBALS      *Globals
+	SEASON       *Season
 	verifyKey    []byte
 	signKey      []byte
 	sslCertData  []byte
 	sslKeyData   []byte
-	resetUsers   bool
 )
 
 func main() {
@@ -69,21 +69,29 @@ func main() {
 	SMTPUsername = os.Getenv("SMTP_USERNAME")
 	SMTPPassword = os.Getenv("SMTP_PASSWORD")
 
-	verifyKey, err = loadPEMBlockFromEnv("JWT_PUB_KEY")
-	if err != nil {
-		ctx.WithError(err).Fatal("Failed to load JWT Verification key.")
+	RequireAdminTwoFactor = os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+
+	if s := os.Getenv("MAIL_WORKERS"); s != "" {
+		workers, err := strconv.Atoi(s)
+		if err != nil || workers < 1 {
+			ctx.Fatalln("Could not read Mail Workers from environment.")
+		}
+		MailWorkers = workers
 	}
 
-	signKey, err = loadPEMBlockFromEnv("JWT_PRIV_KEY")
-	if err != nil {
-		ctx.WithError(err).Fatal("Failed to load JWT Signing key.")
+	for purpose, name := range map[string]string{VERIFY_PURPOSE: "CODE_TTL_VERIFY", RESET_PURPOSE: "CODE_TTL_RESET"} {
+		if s := os.Getenv(name); s != "" {
+			ttl, err := time.ParseDuration(s)
+			if err != nil || ttl <= 0 {
+				ctx.Fatalf("Could not read %s from environment.", name)
+			}
+			codeTTLs[purpose] = ttl
+		}
 	}
 
-	flag.StringVar(&PORT, "port", "8443", "Port to run on.")
 	flag.StringVar(&ENV, "env", "prod", "Environment to deploy to. Options: prod, test, or dev")
-	flag.BoolVar(&INIT, "init", false, "Initialize the database on startup?")
 	flag.StringVar(&APP_DIR, "dir", "/etc/nhc-api/", "Application directory")
-	flag.BoolVar(&resetUsers, "reset-users", false, "Reset users to unregistered?")
+	flag.Usage = usage
 	flag.Parse()
 
 	if ENV == "prod" {
@@ -94,38 +102,70 @@ func main() {
 		URL = "localhost"
 	}
 
-	dbSession := DBConnect(MONGODB_URL)
+	err = RunCommand(flag.Args())
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		ctx.WithError(err).Fatal("Command failed.")
+	}
+}
+
+// runServe serves the API until the server fails.
+func runServe(args []string) error {
+	ctx := logger.WithField("method", "runServe")
 
-	if INIT {
-		err := DBInit(dbSession)
-		if err != nil {
-			ctx.WithError(err).Fatal("Failed to initialize DB.")
-		}
+	fs := newFlagSet("serve")
+	fs.StringVar(&PORT, "port", "8443", "Port to run on.")
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
-	err = DBEnsureIndices(dbSession)
+	err := LoadProviders()
 	if err != nil {
-		ctx.WithError(err).Fatalf("Error ensuring DB indices.")
+		return fmt.Errorf("Failed to load login providers: %s\n", err)
 	}
 
-	GLOBALS, err = FindGlobals(dbSession.DB(DBNAME))
+	verifyKey, err = loadPEMBlockFromEnv("JWT_PUB_KEY")
 	if err != nil {
-		ctx.Fatalln(err)
+		return fmt.Errorf("Failed to load JWT Verification key: %s\n", err)
 	}
 
-	// This has to happen after globals are loaded.
-	err = DBEnsureIntegrity(dbSession)
+	signKey, err = loadPEMBlockFromEnv("JWT_PRIV_KEY")
 	if err != nil {
-		ctx.WithError(err).Fatalf("Error ensuring DB integrity.")
+		return fmt.Errorf("Failed to load JWT Signing key: %s\n", err)
 	}
 
-	if resetUsers {
-		err = ResetUsers(dbSession)
-		if err != nil {
-			ctx.WithError(err).Fatal("Error reseting users to unregistered.")
-		}
+	db, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+
+	err = DBEnsureIntegrity(db)
+	if err != nil {
+		return fmt.Errorf("Error ensuring DB integrity: %s\n", err)
 	}
 
+	err = EnsureEmailTemplates(db)
+	if err != nil {
+		return fmt.Errorf("Error storing default e-mail templates: %s\n", err)
+	}
+
+	MAILER, err = NewMailer()
+	if err != nil {
+		return fmt.Errorf("Failed to set up mail transport: %s\n", err)
+	}
+
+	LIMITER, err = NewRateLimiter(db)
+	if err != nil {
+		return fmt.Errorf("Failed to set up rate limiting: %s\n", err)
+	}
+
+	OUTBOX = NewOutbox(db)
+	OUTBOX.Start(MailWorkers)
+
+	app := NewMongoApp(db)
+	StartUserCodeCleanup(app)
+
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins: []string{
 			"http://localhost:9000",
@@ -137,67 +177,14 @@ func main() {
 		AllowedHeaders:   []string{"*"},
 	})
 
-	router := mux.NewRouter().StrictSlash(true)
-
-	api := router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/globals", GetGlobals).Methods("GET")
-	api.HandleFunc("/globals", SaveGlobals).Methods("POST")
-
-	api.HandleFunc("/commitments", GetCommitments).Methods("GET")
-
-	api.HandleFunc("/organizations", GetOrganizations).Methods("GET")
-	api.HandleFunc("/admin/organizations", AddOrganization).Methods("POST")
-	api.HandleFunc("/admin/organizations", EditOrganization).Methods("PUT")
-	api.HandleFunc("/admin/organizations/{id}", DeleteOrganization).Methods("DELETE")
-	api.HandleFunc("/admin/organizations/merge", MergeOrganizations).Methods("POST")
-
-	api.HandleFunc("/registration", RegisterUser).Methods("POST")
-
-	api.HandleFunc("/user", UpdateSelf).Methods("PUT")
-	api.HandleFunc("/admin/user", GetUsers).Methods("GET")
-	api.HandleFunc("/admin/user", EditUser).Methods("PUT")
-
-	api.HandleFunc("/admin/message", SendMessage).Methods("POST")
-
-	api.HandleFunc("/news", FetchNews).Methods("GET")
-	api.HandleFunc("/admin/news", ListNews).Methods("GET")
-	api.HandleFunc("/admin/news", AddNews).Methods("POST")
-	api.HandleFunc("/admin/news/{id}", DeleteNews).Methods("DELETE")
-	api.HandleFunc("/admin/news/{id}/publish", PublishNews).Methods("PUT")
-	api.HandleFunc("/admin/news/{id}/unpublish", UnpublishNews).Methods("PUT")
-
-	api.HandleFunc("/bonus-question", FetchQuestion).Methods("GET")
-	api.HandleFunc("/bonus-question", AnswerQuestion).Methods("POST")
-	api.HandleFunc("/admin/bonus-question", GetQuestions).Methods("GET")
-	api.HandleFunc("/admin/bonus-question", CreateQuestion).Methods("POST")
-	api.HandleFunc("/admin/bonus-question/{id}", DeleteQuestion).Methods("DELETE")
-	api.HandleFunc("/admin/bonus-question/{id}/enable", EnableQuestion).Methods("PUT")
-	api.HandleFunc("/admin/bonus-question/disable", DisableQuestion).Methods("PUT")
-
-	api.HandleFunc("/participant", GetParticipants).Methods("GET")
-	api.HandleFunc("/participant/scorecard", UpdateScorecard).Methods("PUT")
-	api.HandleFunc("/admin/participant", GetParticipantsAdmin).Methods("GET")
-
-	api.HandleFunc("/faq", GetFaqs).Methods("GET")
-	api.HandleFunc("/admin/faq", AddFaq).Methods("POST")
-	api.HandleFunc("/admin/faq", EditFaq).Methods("PUT")
-	api.HandleFunc("/admin/faq/{id}", DeleteFaq).Methods("DELETE")
-
-	authAPI := router.PathPrefix("/auth").Subrouter()
-	authAPI.HandleFunc("/", GetAuthStatus).Methods("GET")
-	authAPI.HandleFunc("/login", Login).Methods("POST")
-	authAPI.HandleFunc("/signup", SignUp).Methods("POST")
-	authAPI.HandleFunc("/verify", Verify).Methods("POST")
-	authAPI.HandleFunc("/verify", ResendVerify).Methods("GET")
-	authAPI.HandleFunc("/facebook", LoginWithFacebook).Methods("POST")
-	authAPI.HandleFunc("/google", LoginWithGoogle).Methods("POST")
-	authAPI.HandleFunc("/password/forgot", ForgotPassword).Methods("POST")
-	authAPI.HandleFunc("/password/reset", ResetPassword).Methods("POST")
+	router := NewRouter(app)
 
 	n := negroni.Classic()
 	n.Use(HeaderMiddleware())
-	n.Use(JWTMiddleware())
-	n.Use(DBMiddleware(dbSession))
+	n.Use(TimeoutMiddleware(requestTimeout))
+	n.Use(JWTMiddleware(app))
+	n.Use(RateLimitMiddleware(LIMITER))
+	n.Use(AuditMiddleware(app))
 	n.Use(ParseFormMiddleware())
 	n.Use(corsMiddleware)
 	n.UseHandler(router)
@@ -206,8 +193,8 @@ func main() {
 	s := &http.Server{
 		Addr:           ":" + PORT,
 		Handler:        n,
-		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
+		ReadTimeout:    requestTimeout,
+		WriteTimeout:   requestTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -215,23 +202,23 @@ func main() {
 		// Load SSL Files
 		sslCertData, err = loadPEMBlockFromEnv("SSL_CERT")
 		if err != nil {
-			ctx.WithError(err).Fatal("Failed to load SSL Certificate.")
+			return fmt.Errorf("Failed to load SSL Certificate: %s\n", err)
 		}
 
 		sslKeyData, err = loadPEMBlockFromEnv("SSL_KEY")
 		if err != nil {
-			ctx.WithError(err).Fatal("Failed to load SSL Key.")
+			return fmt.Errorf("Failed to load SSL Key: %s\n", err)
 		}
 
 		sslCertFile, sslKeyFile, err := loadSSLFiles()
 		if err != nil {
-			ctx.WithError(err).Fatalf("Failed to load SSL files.")
+			return fmt.Errorf("Failed to load SSL files: %s\n", err)
 		}
 
 		ctx.WithField("port", PORT).Info("Starting NHC-API server with HTTPS enabled.")
-		ctx.Fatal(s.ListenAndServeTLS(sslCertFile, sslKeyFile))
+		return s.ListenAndServeTLS(sslCertFile, sslKeyFile)
 	} else {
 		ctx.WithField("port", PORT).Info("Starting NHC-API server without HTTPS enabled.")
-		ctx.Fatal(s.ListenAndServe())
+		return s.ListenAndServe()
 	}
 }
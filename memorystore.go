@@ -0,0 +1,1256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// The memory stores keep documents the way Mongo would: every read and write
+// goes through bson, so callers never share memory with the store and fields
+// left out by omitempty are left alone by Save, as with $set.
+
+func toM(v interface{}) bson.M {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	m := bson.M{}
+	bson.Unmarshal(b, &m)
+	return m
+}
+
+func fromM(m bson.M, out interface{}) {
+	b, err := bson.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	bson.Unmarshal(b, out)
+}
+
+// merge sets the fields of set on doc and removes the unset ones.
+func merge(doc bson.M, set interface{}, unset ...string) bson.M {
+	if set != nil {
+		for k, v := range toM(set) {
+			doc[k] = v
+		}
+	}
+	for _, field := range unset {
+		delete(doc, field)
+	}
+	return doc
+}
+
+type MemoryUserStore struct {
+	mu    sync.Mutex
+	users map[bson.ObjectID]bson.M
+	// Leaderboards look up the names of organizations here.
+	orgs *MemoryOrganizationStore
+}
+
+func NewMemoryUserStore(orgs *MemoryOrganizationStore) *MemoryUserStore {
+	return &MemoryUserStore{users: map[bson.ObjectID]bson.M{}, orgs: orgs}
+}
+
+func (m *MemoryUserStore) user(doc bson.M) *User {
+	u := &User{}
+	fromM(doc, u)
+	return u
+}
+
+func (m *MemoryUserStore) find(match func(u *User) bool) *User {
+	for _, doc := range m.users {
+		if u := m.user(doc); match(u) {
+			return u
+		}
+	}
+	return nil
+}
+
+// taken reports whether another user has the address or one of the identities.
+func (m *MemoryUserStore) taken(u *User) bool {
+	return m.find(func(other *User) bool {
+		if other.ID == u.ID {
+			return false
+		}
+		if other.Email == u.Email {
+			return true
+		}
+		for _, a := range other.Identities {
+			for _, b := range u.Identities {
+				if a.Provider == b.Provider && a.Subject == b.Subject {
+					return true
+				}
+			}
+		}
+		return false
+	}) != nil
+}
+
+func (m *MemoryUserStore) FindByID(id bson.ObjectID) (*User, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.users[id]
+	if !ok {
+		return nil, userNotFound
+	}
+	return m.user(doc), nil
+}
+
+func (m *MemoryUserStore) FindByEmail(email string) (*User, *Error) {
+	email = NormalizeEmail(email)
+	return m.findOne(func(u *User) bool { return u.Email == email })
+}
+
+func (m *MemoryUserStore) FindByProvider(provider, subject string) (*User, *Error) {
+	return m.findOne(func(u *User) bool {
+		for _, identity := range u.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *MemoryUserStore) findOne(match func(u *User) bool) (*User, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.find(match)
+	if u == nil {
+		return nil, &Error{Reason: errors.New("No user found."), Internal: false, Code: http.StatusNotFound}
+	}
+	return u, nil
+}
+
+func (m *MemoryUserStore) FindByChallenge(hash string) (*User, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	u := m.find(func(u *User) bool { return u.Challenge == hash && u.ChallengeExpires.After(now) })
+	if u == nil {
+		return nil, &Error{Reason: errors.New(CHALLENGE_INVALID_ERROR), Code: http.StatusUnauthorized}
+	}
+	return u, nil
+}
+
+func (m *MemoryUserStore) Find(filter UserFilter) ([]User, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []User
+	for _, doc := range m.users {
+		if u := m.user(doc); filter.Matches(u) {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].FirstName < users[j].FirstName
+	})
+	return users, nil
+}
+
+// Each works on a snapshot, so fn may use the store.
+func (m *MemoryUserStore) Each(filter UserFilter, fn func(u *User) error) error {
+	users, _ := m.Find(filter)
+	for i := range users {
+		err := fn(&users[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) Create(u *User) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[u.ID]; ok || m.taken(u) {
+		return &Error{Reason: errors.New("User already exists. Please log in instead."), Internal: false, Code: 409}
+	}
+	m.users[u.ID] = toM(u)
+	return nil
+}
+
+func (m *MemoryUserStore) Save(u *User) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.users[u.ID]
+	if !ok {
+		doc = bson.M{"_id": u.ID}
+	}
+	doc = merge(doc, u)
+	if m.taken(m.user(doc)) {
+		return &Error{Internal: false, Reason: errors.New("That user already exists. Please login first."), Code: http.StatusConflict}
+	}
+	m.users[u.ID] = doc
+	return nil
+}
+
+// Update only sets top-level fields.
+func (m *MemoryUserStore) Update(id bson.ObjectID, set interface{}, unset ...string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.users[id]
+	if !ok {
+		return userNotFound
+	}
+	doc = merge(doc, set, unset...)
+	if m.taken(m.user(doc)) {
+		return &Error{Reason: errors.New("Error updating user: duplicate key"), Internal: true}
+	}
+	m.users[id] = doc
+	return nil
+}
+
+func (m *MemoryUserStore) Remove(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, id)
+	return nil
+}
+
+func (m *MemoryUserStore) MoveOrganization(from, to bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, doc := range m.users {
+		if doc["organization"] != from {
+			continue
+		}
+		if to.IsZero() {
+			delete(doc, "organization")
+		} else {
+			doc["organization"] = to
+		}
+	}
+	return nil
+}
+
+// change applies fn to a user and saves the user if fn reports a change.
+func (m *MemoryUserStore) change(id bson.ObjectID, fn func(u *User) bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.users[id]
+	if !ok {
+		return false
+	}
+	u := m.user(doc)
+	if !fn(u) {
+		return false
+	}
+	m.users[id] = toM(u)
+	return true
+}
+
+func (m *MemoryUserStore) UseTOTPStep(id bson.ObjectID, step int64) (bool, *Error) {
+	return m.change(id, func(u *User) bool {
+		if u.TOTPLastStep >= step {
+			return false
+		}
+		u.TOTPLastStep = step
+		return true
+	}), nil
+}
+
+func (m *MemoryUserStore) UseBackupCode(id bson.ObjectID, hash string) (bool, *Error) {
+	return m.change(id, func(u *User) bool {
+		for i, code := range u.BackupCodes {
+			if code == hash {
+				u.BackupCodes = append(u.BackupCodes[:i], u.BackupCodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (m *MemoryUserStore) RemoveIdentity(id bson.ObjectID, provider string) (bool, *Error) {
+	return m.change(id, func(u *User) bool {
+		var kept []Identity
+		for _, identity := range u.Identities {
+			if identity.Provider != provider {
+				kept = append(kept, identity)
+			}
+		}
+		if u.Password == "" && len(kept) == 0 {
+			return false
+		}
+		u.Identities = kept
+		return true
+	}), nil
+}
+
+func (m *MemoryUserStore) AddParticipant(id bson.ObjectID, p *Participant) (bool, *Error) {
+	return m.change(id, func(u *User) bool {
+		if u.NextParticipantID > p.ID {
+			return false
+		}
+		for _, other := range u.Participants {
+			if other.ID == p.ID {
+				return false
+			}
+		}
+		u.Participants = append(u.Participants, *p)
+		u.NextParticipantID = p.ID + 1
+		return true
+	}), nil
+}
+
+func (m *MemoryUserStore) UpdateParticipant(id bson.ObjectID, p *Participant) *Error {
+	found := m.change(id, func(u *User) bool {
+		for i := range u.Participants {
+			if u.Participants[i].ID == p.ID {
+				old := &u.Participants[i]
+				old.FirstName, old.LastName, old.AgeRange = p.FirstName, p.LastName, p.AgeRange
+				old.Category, old.Commitment, old.CustomCommitment = p.Category, p.Commitment, p.CustomCommitment
+				return true
+			}
+		}
+		return false
+	})
+	if !found {
+		return &Error{Reason: errors.New(PARTICIPANT_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) RemoveParticipant(id bson.ObjectID, participant int) *Error {
+	m.change(id, func(u *User) bool {
+		var kept []Participant
+		for _, p := range u.Participants {
+			if p.ID != participant {
+				kept = append(kept, p)
+			}
+		}
+		u.Participants = kept
+		return true
+	})
+	return nil
+}
+
+func (m *MemoryUserStore) SetScorecardDay(id bson.ObjectID, participant, day int, done bool) *Error {
+	m.change(id, func(u *User) bool {
+		for i := range u.Participants {
+			p := &u.Participants[i]
+			if p.ID != participant || day/7 >= len(p.Scorecard) || day%7 >= len(p.Scorecard[day/7]) {
+				continue
+			}
+			current := &p.Scorecard[day/7][day%7]
+			if done && *current != 1 {
+				*current = 1
+				p.Points++
+				return true
+			} else if !done && *current == 1 {
+				*current = 0
+				p.Points--
+				return true
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// Leaderboard follows the aggregation pipeline of MongoUserStore.
+func (m *MemoryUserStore) Leaderboard(q LeaderboardQuery) ([]LeaderboardEntry, *Error) {
+	users, _ := m.Find(UserFilter{Statuses: []string{REGISTERED.String()}})
+	groupBy := leaderboards[q.Board]
+
+	visible := func(u *User) bool {
+		if u.Sharing == "everyone" {
+			return true
+		}
+		return q.Viewer != nil && !q.Viewer.Organization.IsZero() && u.Organization == q.Viewer.Organization &&
+			(u.Sharing == "organization" || u.Sharing == "")
+	}
+	field := func(u *User, path interface{}) string {
+		if path == "$organization" {
+			return m.orgs.name(u.Organization)
+		}
+		value, _ := toM(u)[path.(string)[1:]].(string)
+		return value
+	}
+
+	var entries []LeaderboardEntry
+	groups := map[LeaderboardEntry]int{}
+	label, labeled := leaderboardLabels[q.Board]
+	labels := map[int]*User{}
+	for i := range users {
+		u := &users[i]
+		if u.Season != q.Season || !visible(u) {
+			continue
+		}
+		for _, p := range u.Participants {
+			if groupBy == nil {
+				initial := p.LastName
+				if r := []rune(initial); len(r) > 1 {
+					initial = string(r[:1])
+				}
+				entries = append(entries, LeaderboardEntry{Name: p.FirstName + " " + initial,
+					Organization: m.orgs.name(u.Organization), Participants: 1, Total: p.Points, Average: float64(p.Points)})
+				continue
+			}
+
+			key := LeaderboardEntry{Name: field(u, groupBy["name"])}
+			if key.Name == "" {
+				continue
+			}
+			if org, ok := groupBy["organization"]; ok {
+				key.Organization = field(u, org)
+			}
+			i, ok := groups[key]
+			if !ok {
+				i = len(entries)
+				groups[key] = i
+				entries = append(entries, key)
+			}
+			if first := labels[i]; labeled && (first == nil || u.CreatedOn.Before(first.CreatedOn)) {
+				labels[i] = u
+			}
+			entries[i].Participants++
+			entries[i].Total += p.Points
+			entries[i].Average = float64(entries[i].Total) / float64(entries[i].Participants)
+		}
+	}
+
+	for i, u := range labels {
+		entries[i].Name = field(u, label)
+	}
+
+	score := func(e LeaderboardEntry) float64 {
+		if q.SortBy == "average" {
+			return e.Average
+		}
+		return float64(e.Total)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if score(entries[i]) != score(entries[j]) {
+			return score(entries[i]) > score(entries[j])
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+
+	return entries, nil
+}
+
+type MemoryOrganizationStore struct {
+	mu   sync.Mutex
+	orgs map[bson.ObjectID]Organization
+}
+
+func NewMemoryOrganizationStore() *MemoryOrganizationStore {
+	return &MemoryOrganizationStore{orgs: map[bson.ObjectID]Organization{}}
+}
+
+func (m *MemoryOrganizationStore) find(match func(org *Organization) bool) []Organization {
+	var orgs []Organization
+	for _, org := range m.orgs {
+		if match(&org) {
+			org.Requesters = append([]string(nil), org.Requesters...)
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].ID.Hex() < orgs[j].ID.Hex() })
+	return orgs
+}
+
+// name returns the name of an organization, or nothing if there is none.
+func (m *MemoryOrganizationStore) name(id bson.ObjectID) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.orgs[id].Name
+}
+
+func (m *MemoryOrganizationStore) findOne(match func(org *Organization) bool) (*Organization, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orgs := m.find(match)
+	if len(orgs) == 0 {
+		return nil, &Error{Reason: errors.New(ORGANIZATION_ERROR), Code: http.StatusNotFound}
+	}
+	return &orgs[0], nil
+}
+
+func (m *MemoryOrganizationStore) FindAll() ([]Organization, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.find(func(org *Organization) bool { return !org.NeedsApproval }), nil
+}
+
+func (m *MemoryOrganizationStore) FindByID(id bson.ObjectID) (*Organization, *Error) {
+	return m.findOne(func(org *Organization) bool { return org.ID == id })
+}
+
+func (m *MemoryOrganizationStore) FindByName(name string) (*Organization, *Error) {
+	return m.findOne(func(org *Organization) bool { return org.Name == name })
+}
+
+func (m *MemoryOrganizationStore) FindRequests() ([]Organization, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orgs := m.find(func(org *Organization) bool { return org.NeedsApproval })
+	sort.SliceStable(orgs, func(i, j int) bool { return orgs[i].RequestedOn.Before(orgs[j].RequestedOn) })
+	return orgs, nil
+}
+
+func (m *MemoryOrganizationStore) FindRequest(id bson.ObjectID) (*Organization, *Error) {
+	org, errM := m.findOne(func(org *Organization) bool { return org.ID == id && org.NeedsApproval })
+	if errM != nil {
+		return nil, &Error{Reason: errors.New(ORGANIZATION_REQUEST_ERROR), Code: http.StatusNotFound}
+	}
+	return org, nil
+}
+
+func (m *MemoryOrganizationStore) byName(name string) *Organization {
+	for id, org := range m.orgs {
+		if org.Name == name {
+			org := m.orgs[id]
+			return &org
+		}
+	}
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Create(name string, needsApproval bool) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.byName(name) == nil {
+		id := bson.NewObjectID()
+		m.orgs[id] = Organization{ID: id, Name: name, NeedsApproval: needsApproval}
+	}
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Request(name, email string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	org := m.byName(name)
+	if org == nil {
+		org = &Organization{ID: bson.NewObjectID(), Name: name, NeedsApproval: true, RequestedOn: time.Now()}
+	}
+	if !Contains(org.Requesters, email) {
+		org.Requesters = append(append([]string(nil), org.Requesters...), email)
+	}
+	m.orgs[org.ID] = *org
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Approve(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if org, ok := m.orgs[id]; ok {
+		org.NeedsApproval = false
+		org.Requesters = nil
+		org.RequestedOn = time.Time{}
+		m.orgs[id] = org
+	}
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Import(name, timeZone string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	org := m.byName(name)
+	if org == nil {
+		org = &Organization{ID: bson.NewObjectID(), Name: name}
+	}
+	org.NeedsApproval = false
+	if timeZone != "" {
+		org.TimeZone = timeZone
+	}
+	m.orgs[org.ID] = *org
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Save(org *Organization) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if other := m.byName(org.Name); other != nil && other.ID != org.ID {
+		return &Error{Reason: errors.New("Error updating org: duplicate key"), Internal: true}
+	}
+	saved := *org
+	saved.Requesters = append([]string(nil), org.Requesters...)
+	m.orgs[org.ID] = saved
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Rename(id bson.ObjectID, name string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	org, ok := m.orgs[id]
+	if !ok {
+		return &Error{Reason: errors.New(ORGANIZATION_ERROR), Code: http.StatusNotFound}
+	}
+
+	org.Name = name
+	m.orgs[id] = org
+	return nil
+}
+
+func (m *MemoryOrganizationStore) Remove(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.orgs, id)
+	return nil
+}
+
+type MemoryNewsStore struct {
+	mu   sync.Mutex
+	news map[bson.ObjectID]bson.M
+}
+
+func NewMemoryNewsStore() *MemoryNewsStore {
+	return &MemoryNewsStore{news: map[bson.ObjectID]bson.M{}}
+}
+
+func (m *MemoryNewsStore) find(match func(n *News) bool) []News {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var news []News
+	for _, doc := range m.news {
+		var n News
+		fromM(doc, &n)
+		if match(&n) {
+			news = append(news, n)
+		}
+	}
+	sort.Slice(news, func(i, j int) bool { return news[i].ID.Hex() < news[j].ID.Hex() })
+	return news
+}
+
+func (m *MemoryNewsStore) FindPublished(adminNews bool) ([]News, *Error) {
+	return m.find(func(n *News) bool { return n.Published && (adminNews || !n.AdminOnly) }), nil
+}
+
+func (m *MemoryNewsStore) FindAll() ([]News, *Error) {
+	return m.find(func(n *News) bool { return true }), nil
+}
+
+func (m *MemoryNewsStore) FindByID(id bson.ObjectID) (*News, *Error) {
+	news := m.find(func(n *News) bool { return n.ID == id })
+	if len(news) == 0 {
+		return nil, &Error{Reason: errors.New("Error retrieving news item: not found"), Internal: true}
+	}
+	return &news[0], nil
+}
+
+func (m *MemoryNewsStore) Save(n *News) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.news[n.ID]
+	if !ok {
+		doc = bson.M{}
+	}
+	m.news[n.ID] = merge(doc, n)
+	return nil
+}
+
+func (m *MemoryNewsStore) Remove(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.news, id)
+	return nil
+}
+
+type MemoryQuestionStore struct {
+	mu        sync.Mutex
+	questions map[bson.ObjectID]bson.M
+}
+
+func NewMemoryQuestionStore() *MemoryQuestionStore {
+	return &MemoryQuestionStore{questions: map[bson.ObjectID]bson.M{}}
+}
+
+func (m *MemoryQuestionStore) find(match func(q *Question) bool) []Question {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var questions []Question
+	for _, doc := range m.questions {
+		var q Question
+		fromM(doc, &q)
+		if match(&q) {
+			questions = append(questions, q)
+		}
+	}
+	sort.Slice(questions, func(i, j int) bool { return questions[i].ID.Hex() < questions[j].ID.Hex() })
+	return questions
+}
+
+func (m *MemoryQuestionStore) FindEnabled(season bson.ObjectID) (*Question, *Error) {
+	questions := m.find(func(q *Question) bool { return q.Enabled && q.Season == season })
+	if len(questions) == 0 {
+		return nil, nil
+	}
+	return &questions[0], nil
+}
+
+func (m *MemoryQuestionStore) FindByID(id bson.ObjectID) (*Question, *Error) {
+	questions := m.find(func(q *Question) bool { return q.ID == id })
+	if len(questions) == 0 {
+		return nil, &Error{Reason: errors.New("Question not found."), Code: http.StatusNotFound}
+	}
+	return &questions[0], nil
+}
+
+func (m *MemoryQuestionStore) FindAll() ([]Question, *Error) {
+	return m.find(func(q *Question) bool { return true }), nil
+}
+
+func (m *MemoryQuestionStore) FindBySeason(season bson.ObjectID) ([]Question, *Error) {
+	return m.find(func(q *Question) bool { return q.Season == season }), nil
+}
+
+func (m *MemoryQuestionStore) FindByRespondent(email string) ([]Question, *Error) {
+	return m.find(func(q *Question) bool {
+		for _, r := range q.Respondents {
+			if r.User == email {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (m *MemoryQuestionStore) Save(q *Question) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.questions[q.ID]
+	if !ok {
+		doc = bson.M{}
+	}
+	m.questions[q.ID] = merge(doc, q)
+	return nil
+}
+
+func (m *MemoryQuestionStore) Remove(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.questions, id)
+	return nil
+}
+
+func (m *MemoryQuestionStore) Enable(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.questions[id]
+	if !ok {
+		return &Error{Reason: errors.New("Question not found."), Code: http.StatusNotFound}
+	}
+	doc["enabled"] = true
+	return nil
+}
+
+func (m *MemoryQuestionStore) RenameRespondent(old, email string) *Error {
+	questions, _ := m.FindByRespondent(old)
+	for i := range questions {
+		q := &questions[i]
+		for j := range q.Respondents {
+			if q.Respondents[j].User == old {
+				q.Respondents[j].User = email
+				break
+			}
+		}
+		m.Save(q)
+	}
+	return nil
+}
+
+type MemoryFAQStore struct {
+	mu   sync.Mutex
+	faqs map[bson.ObjectID]bson.M
+}
+
+func NewMemoryFAQStore() *MemoryFAQStore {
+	return &MemoryFAQStore{faqs: map[bson.ObjectID]bson.M{}}
+}
+
+func (m *MemoryFAQStore) FindAll() ([]FAQ, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var faqs []FAQ
+	for _, doc := range m.faqs {
+		var f FAQ
+		fromM(doc, &f)
+		faqs = append(faqs, f)
+	}
+	sort.Slice(faqs, func(i, j int) bool { return faqs[i].ID.Hex() < faqs[j].ID.Hex() })
+	return faqs, nil
+}
+
+func (m *MemoryFAQStore) Save(f *FAQ) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, ok := m.faqs[f.ID]
+	if !ok {
+		doc = bson.M{}
+	}
+	m.faqs[f.ID] = merge(doc, f)
+	return nil
+}
+
+func (m *MemoryFAQStore) Update(f *FAQ) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.faqs[f.ID]; !ok {
+		return &Error{Reason: errors.New("The faq you are trying to update does not exist: not found"), Internal: true}
+	}
+	m.faqs[f.ID] = toM(f)
+	return nil
+}
+
+func (m *MemoryFAQStore) Remove(id bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.faqs, id)
+	return nil
+}
+
+type MemoryGlobalsStore struct {
+	mu            sync.Mutex
+	seasons       map[bson.ObjectID]bson.M
+	registrations map[bson.ObjectID]bson.M
+}
+
+func NewMemoryGlobalsStore() *MemoryGlobalsStore {
+	return &MemoryGlobalsStore{seasons: map[bson.ObjectID]bson.M{}, registrations: map[bson.ObjectID]bson.M{}}
+}
+
+func (m *MemoryGlobalsStore) findSeasons(match func(s *Season) bool) []Season {
+	var seasons []Season
+	for _, doc := range m.seasons {
+		var s Season
+		fromM(doc, &s)
+		if match(&s) {
+			seasons = append(seasons, s)
+		}
+	}
+	sort.Slice(seasons, func(i, j int) bool { return seasons[i].ChallengeStart.After(seasons[j].ChallengeStart) })
+	return seasons
+}
+
+func (m *MemoryGlobalsStore) findSeason(match func(s *Season) bool) (*Season, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seasons := m.findSeasons(match)
+	if len(seasons) == 0 {
+		return nil, &Error{Reason: errors.New(SEASON_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	}
+	return &seasons[0], nil
+}
+
+func (m *MemoryGlobalsStore) FindSeasons() ([]Season, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.findSeasons(func(s *Season) bool { return true }), nil
+}
+
+func (m *MemoryGlobalsStore) FindSeasonByID(id bson.ObjectID) (*Season, *Error) {
+	return m.findSeason(func(s *Season) bool { return s.ID == id })
+}
+
+func (m *MemoryGlobalsStore) FindCurrentSeason() (*Season, *Error) {
+	return m.findSeason(func(s *Season) bool { return s.Current })
+}
+
+func (m *MemoryGlobalsStore) SaveSeason(s *Season) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.findSeasons(func(other *Season) bool { return other.ID != s.ID && other.Name == s.Name })) > 0 {
+		return &Error{Reason: errors.New(SEASON_EXISTS_ERROR), Code: http.StatusConflict}
+	}
+	m.seasons[s.ID] = toM(s)
+	return nil
+}
+
+func (m *MemoryGlobalsStore) findRegistrations(match func(reg *Registration) bool) []Registration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var registrations []Registration
+	for _, doc := range m.registrations {
+		var reg Registration
+		fromM(doc, &reg)
+		if match(&reg) {
+			registrations = append(registrations, reg)
+		}
+	}
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].ID.Hex() < registrations[j].ID.Hex() })
+	return registrations
+}
+
+func (m *MemoryGlobalsStore) ArchiveRegistration(reg *Registration) *Error {
+	existing := m.findRegistrations(func(other *Registration) bool {
+		return other.Season == reg.Season && other.User == reg.User
+	})
+	if len(existing) > 0 {
+		reg.ID = existing[0].ID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.registrations[reg.ID] = toM(reg)
+	return nil
+}
+
+func (m *MemoryGlobalsStore) FindRegistrations(season bson.ObjectID) ([]Registration, *Error) {
+	return m.findRegistrations(func(reg *Registration) bool { return reg.Season == season }), nil
+}
+
+func (m *MemoryGlobalsStore) FindUserRegistrations(user bson.ObjectID) ([]Registration, *Error) {
+	return m.findRegistrations(func(reg *Registration) bool { return reg.User == user }), nil
+}
+
+func (m *MemoryGlobalsStore) RemoveUserRegistrations(user bson.ObjectID) *Error {
+	for _, reg := range m.findRegistrations(func(reg *Registration) bool { return reg.User == user }) {
+		m.mu.Lock()
+		delete(m.registrations, reg.ID)
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+type MemoryCommitmentStore struct {
+	mu          sync.Mutex
+	commitments []Commitment
+}
+
+func NewMemoryCommitmentStore() *MemoryCommitmentStore {
+	return &MemoryCommitmentStore{}
+}
+
+func (m *MemoryCommitmentStore) FindAll() ([]Commitment, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var commitments []Commitment
+	for _, c := range m.commitments {
+		var copied Commitment
+		fromM(toM(c), &copied)
+		commitments = append(commitments, copied)
+	}
+	return commitments, nil
+}
+
+func (m *MemoryCommitmentStore) FindByName(name string) (*Commitment, *Error) {
+	commitments, _ := m.FindAll()
+	for i := range commitments {
+		if commitments[i].Name == name {
+			return &commitments[i], nil
+		}
+	}
+	return nil, &Error{Reason: errors.New(BAD_CHOICE_ERROR), Code: http.StatusNotFound}
+}
+
+func (m *MemoryCommitmentStore) Add(category, commitment string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.commitments {
+		c := &m.commitments[i]
+		if c.Name == category {
+			if !Contains(c.Commitments, commitment) {
+				c.Commitments = append(c.Commitments, commitment)
+			}
+			return nil
+		}
+	}
+	m.commitments = append(m.commitments, Commitment{ID: bson.NewObjectID(), Name: category, Commitments: []string{commitment}})
+	return nil
+}
+
+type MemoryFamilyStore struct {
+	mu    sync.Mutex
+	codes map[string]bool
+}
+
+func NewMemoryFamilyStore() *MemoryFamilyStore {
+	return &MemoryFamilyStore{codes: map[string]bool{}}
+}
+
+func (m *MemoryFamilyStore) Exists(code string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.codes[code]
+}
+
+func (m *MemoryFamilyStore) Create(code string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.codes[code] {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error creating family code: duplicate key %s\n", code)}
+	}
+	m.codes[code] = true
+	return nil
+}
+
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[bson.ObjectID]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[bson.ObjectID]Session{}}
+}
+
+func (m *MemorySessionStore) Create(s *Session) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *MemorySessionStore) FindByID(id bson.ObjectID) (*Session, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, &Error{Reason: errors.New(SESSION_INVALID_ERROR), Code: http.StatusUnauthorized}
+	}
+	return &s, nil
+}
+
+func (m *MemorySessionStore) Rotate(hash, newHash string) (*Session, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range m.sessions {
+		if s.TokenHash == hash && s.RevokedOn.IsZero() && s.ExpiresOn.After(now) {
+			s.TokenHash, s.PreviousHash = newHash, hash
+			s.LastUsed, s.ExpiresOn = now, now.Add(refreshTokenLifetime)
+			m.sessions[id] = s
+			return &s, nil
+		}
+	}
+
+	for id, s := range m.sessions {
+		if s.PreviousHash == hash && s.RevokedOn.IsZero() {
+			s.RevokedOn = now
+			m.sessions[id] = s
+			logger.WithField("method", "RotateSession").Warn("Refresh token reused, session revoked.")
+		}
+	}
+	return nil, &Error{Reason: errors.New(SESSION_INVALID_ERROR), Code: http.StatusUnauthorized}
+}
+
+func (m *MemorySessionStore) revoke(match func(s *Session) bool) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.RevokedOn.IsZero() && match(&s) {
+			s.RevokedOn = time.Now()
+			m.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Revoke(id bson.ObjectID) *Error {
+	return m.revoke(func(s *Session) bool { return s.ID == id })
+}
+
+func (m *MemorySessionStore) RevokeByHash(hash string) *Error {
+	return m.revoke(func(s *Session) bool { return s.TokenHash == hash })
+}
+
+func (m *MemorySessionStore) RevokeUser(user bson.ObjectID) *Error {
+	return m.revoke(func(s *Session) bool { return s.User == user })
+}
+
+func (m *MemorySessionStore) FindByUser(user bson.ObjectID) ([]Session, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []Session
+	for _, s := range m.sessions {
+		if s.User == user {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedOn.Before(sessions[j].CreatedOn) })
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) RemoveUser(user bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.User == user {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+type MemoryUserCodeStore struct {
+	mu    sync.Mutex
+	codes map[bson.ObjectID]UserCode
+}
+
+func NewMemoryUserCodeStore() *MemoryUserCodeStore {
+	return &MemoryUserCodeStore{codes: map[bson.ObjectID]UserCode{}}
+}
+
+func (m *MemoryUserCodeStore) Create(code *UserCode) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.codes[code.ID] = *code
+	return nil
+}
+
+func (m *MemoryUserCodeStore) Use(hash string, purposes ...string) (*UserCode, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, code := range m.codes {
+		if code.Hash == hash && Contains(purposes, code.Purpose) && code.UsedOn.IsZero() {
+			code.UsedOn = time.Now()
+			m.codes[id] = code
+			return &code, nil
+		}
+	}
+	return nil, &Error{Reason: errors.New(CODE_INVALID_ERROR), Code: http.StatusBadRequest}
+}
+
+func (m *MemoryUserCodeStore) Revoke(user bson.ObjectID, purpose string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, code := range m.codes {
+		if code.User == user && code.UsedOn.IsZero() && (purpose == "" || code.Purpose == purpose) {
+			code.UsedOn = time.Now()
+			m.codes[id] = code
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserCodeStore) RemoveStale(cutoff time.Time) (int, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for id, code := range m.codes {
+		if !code.UsedOn.IsZero() && code.UsedOn.Before(cutoff) || code.ExpiresOn.Before(cutoff) {
+			delete(m.codes, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (m *MemoryUserCodeStore) RemoveUser(user bson.ObjectID) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, code := range m.codes {
+		if code.User == user {
+			delete(m.codes, id)
+		}
+	}
+	return nil
+}
+
+type MemoryEmailTemplateStore struct {
+	mu        sync.Mutex
+	templates map[string]EmailTemplate
+}
+
+func NewMemoryEmailTemplateStore() *MemoryEmailTemplateStore {
+	return &MemoryEmailTemplateStore{templates: map[string]EmailTemplate{}}
+}
+
+func (m *MemoryEmailTemplateStore) FindAll() ([]EmailTemplate, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var templates []EmailTemplate
+	for _, t := range m.templates {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (m *MemoryEmailTemplateStore) FindByName(name string) (*EmailTemplate, *Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.templates[name]
+	if !ok {
+		return nil, &Error{Reason: errors.New(EMAIL_TEMPLATE_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	}
+	return &t, nil
+}
+
+func (m *MemoryEmailTemplateStore) Save(t *EmailTemplate) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.UpdatedOn = time.Now()
+	saved := *t
+	saved.Variables = nil
+	m.templates[t.Name] = saved
+	return nil
+}
+
+func (m *MemoryEmailTemplateStore) Remove(name string) *Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.templates, name)
+	return nil
+}
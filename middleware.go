@@ -1,11 +1,11 @@
 package main
 
 import (
+	stdcontext "context"
 	"errors"
 	"net/http"
 	"strings"
-
-	"gopkg.in/mgo.v2"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/dgrijalva/jwt-go"
@@ -21,7 +21,24 @@ func HeaderMiddleware() negroni.Handler {
 	})
 }
 
-func JWTMiddleware() negroni.Handler {
+// requestTimeout bounds reading a request and writing its response.
+const requestTimeout = 30 * time.Second
+
+// TimeoutMiddleware cancels the request's context after the timeout, which
+// stops its database queries once the server has given up on the response.
+// It must come before anything that stores values for the request, since
+// those are keyed by the request it replaces.
+func TimeoutMiddleware(timeout time.Duration) negroni.Handler {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		c, cancel := stdcontext.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next(w, r.WithContext(c))
+	})
+}
+
+// JWTMiddleware validates the access token, if any, and rejects tokens of
+// sessions that were logged out, see TokenRevoked.
+func JWTMiddleware(app *App) negroni.Handler {
 	ctx := logger.WithField("method", "JWTMiddleware")
 	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 		if h := r.Header.Get("Authorization"); h != "" {
@@ -35,6 +52,16 @@ func JWTMiddleware() negroni.Handler {
 					NotAllowed(w, r)
 					return
 				}
+
+				revoked, errM := app.WithContext(r.Context()).TokenRevoked(token)
+				if errM != nil {
+					HandleModelError(w, r, errM)
+					return
+				} else if revoked {
+					BR(w, r, errors.New(SESSION_INVALID_ERROR), http.StatusUnauthorized)
+					return
+				}
+
 				context.Set(r, "token", token)
 				next(w, r)
 			case *jwt.ValidationError:
@@ -57,15 +84,6 @@ func JWTMiddleware() negroni.Handler {
 		}
 	})
 }
-func DBMiddleware(session *mgo.Session) negroni.Handler {
-	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		s := session.Clone()
-		defer s.Close()
-		context.Set(r, "dbSession", s)
-		context.Set(r, "DB", s.DB(DBNAME))
-		next(w, r)
-	})
-}
 
 func ParseFormMiddleware() negroni.Handler {
 
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Migration changes stored data once. Migrations are applied in the order of
+// their versions and recorded in the migrations collection. An instance can
+// die between applying a migration and recording it, so Up has to leave data
+// that is already migrated alone.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(db mongoDB) error
+}
+
+// MigrationRecord marks a migration as applied.
+type MigrationRecord struct {
+	Version     int       `bson:"_id" json:"version"`
+	Description string    `bson:"description" json:"description"`
+	AppliedOn   time.Time `bson:"appliedOn" json:"appliedOn"`
+}
+
+// New migrations go at the end with the next version. Versions are never
+// reused, even if a migration is removed.
+var migrations = []Migration{
+	{1, "Set pending users to registered", migratePendingUsers},
+	{2, "Move Facebook and Google IDs into identities", migrateProviderIDs},
+	{3, "Remove plain-text user codes", migratePlainTextCodes},
+	{4, "Refer to organizations by ID", migrateOrganizationReferences},
+	{5, "Give every participant a scorecard", migrateScorecards},
+	{6, "Count participant IDs", migrateNextParticipantIDs},
+	{7, "Store e-mail addresses in lower case", migrateLowerCaseEmails},
+}
+
+// Only one instance migrates at a time. The lock outlives an instance that
+// dies while migrating by its lease, which has to be longer than any
+// migration takes.
+const (
+	migrationLockLease = 15 * time.Minute
+	migrationLockRetry = 5 * time.Second
+)
+
+// MIGRATE_MODES are the modes of the migrate command.
+var MIGRATE_MODES = []string{"up", "status", "dry-run"}
+
+// RunMigrations applies the pending migrations (up), lists every migration
+// and whether it is applied (status) or lists the migrations up would apply
+// (dry-run).
+func RunMigrations(db mongoDB, mode string) error {
+	ctx := logger.WithField("method", "RunMigrations")
+
+	switch mode {
+	case "up", "dry-run":
+		applied, err := Migrate(db, mode == "dry-run")
+		if err != nil {
+			return err
+		}
+
+		for _, m := range applied {
+			ctx.WithField("version", m.Version).WithField("dryRun", mode == "dry-run").Info(m.Description)
+		}
+		ctx.WithField("count", len(applied)).WithField("dryRun", mode == "dry-run").Info("*** Migrations complete. ***")
+	case "status":
+		records, err := FindAppliedMigrations(db)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			entry := ctx.WithField("version", m.Version)
+			if record, ok := records[m.Version]; ok {
+				entry = entry.WithField("appliedOn", record.AppliedOn.Format(time.RFC3339))
+			} else {
+				entry = entry.WithField("appliedOn", "pending")
+			}
+			entry.Info(m.Description)
+		}
+	default:
+		return fmt.Errorf("Unknown migrate mode %s, expected one of %v.", mode, MIGRATE_MODES)
+	}
+
+	return nil
+}
+
+// Migrate applies the pending migrations and returns them. On a dry run it
+// only returns them.
+func Migrate(db mongoDB, dryRun bool) ([]Migration, error) {
+	if dryRun {
+		return PendingMigrations(db)
+	}
+
+	owner, err := LockMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer UnlockMigrations(db, owner)
+
+	// Another instance may have applied them while we waited for the lock.
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range pending {
+		err = m.Up(db)
+		if err != nil {
+			return pending[:i], fmt.Errorf("Migration %d failed: %s\n", m.Version, err)
+		}
+
+		_, err = db.C("migrations").InsertOne(db.ctx, &MigrationRecord{Version: m.Version, Description: m.Description,
+			AppliedOn: time.Now()})
+		if err != nil {
+			return pending[:i], fmt.Errorf("Error recording migration %d: %s\n", m.Version, err)
+		}
+	}
+
+	return pending, nil
+}
+
+// PendingMigrations returns the migrations that are not applied yet, in order.
+func PendingMigrations(db mongoDB) ([]Migration, error) {
+	records, err := FindAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := records[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+func FindAppliedMigrations(db mongoDB) (map[int]MigrationRecord, error) {
+	var list []MigrationRecord
+	err := db.findAll("migrations", bson.M{}, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving migrations: %s\n", err)
+	}
+
+	records := map[int]MigrationRecord{}
+	for _, record := range list {
+		records[record.Version] = record
+	}
+	return records, nil
+}
+
+// LockMigrations waits until no other instance is migrating and takes the
+// lock. It returns the owner to unlock with.
+func LockMigrations(db mongoDB) (string, error) {
+	ctx := logger.WithField("method", "LockMigrations")
+
+	hostname, _ := os.Hostname()
+	owner := hostname + " " + RandToken()
+	for {
+		locked, err := TryLockMigrations(db, owner)
+		if err != nil || locked {
+			return owner, err
+		}
+
+		ctx.Info("Waiting for another instance to finish migrating.")
+		select {
+		case <-time.After(migrationLockRetry):
+		case <-db.ctx.Done():
+			return "", db.ctx.Err()
+		}
+	}
+}
+
+// TryLockMigrations takes the lock unless another owner holds it. The lock
+// is a single document, so taking it is one upsert: it either inserts the
+// document, takes over an expired one or fails on the existing one.
+func TryLockMigrations(db mongoDB, owner string) (bool, error) {
+	now := time.Now()
+	_, err := db.C("locks").UpdateOne(db.ctx, bson.M{"_id": "migrations", "expiresOn": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expiresOn": now.Add(migrationLockLease)}}, upsert)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error locking migrations: %s\n", err)
+	}
+
+	return true, nil
+}
+
+func UnlockMigrations(db mongoDB, owner string) error {
+	_, err := db.C("locks").DeleteOne(db.ctx, bson.M{"_id": "migrations", "owner": owner})
+	if err != nil {
+		return fmt.Errorf("Error unlocking migrations: %s\n", err)
+	}
+
+	return nil
+}
+
+// Pending was a status users had after signing up before registration was
+// reworked.
+func migratePendingUsers(db mongoDB) error {
+	_, err := db.C("users").UpdateMany(db.ctx, bson.M{"status": "pending"},
+		bson.M{"$set": bson.M{"status": REGISTERED.String()}})
+	return err
+}
+
+// Facebook and Google IDs used to be fields of the user.
+func migrateProviderIDs(db mongoDB) error {
+	for _, provider := range []string{"facebook", "google"} {
+		var legacy []bson.M
+		err := db.findAll("users", bson.M{provider: bson.M{"$exists": true}}, &legacy,
+			options.Find().SetProjection(bson.M{provider: 1}))
+		if err != nil {
+			return fmt.Errorf("Error retrieving %s users: %s\n", provider, err)
+		}
+
+		for _, u := range legacy {
+			identity := Identity{Provider: provider, Subject: fmt.Sprint(u[provider])}
+			_, err = db.C("users").UpdateOne(db.ctx, bson.M{"_id": u["_id"]},
+				bson.M{"$push": bson.M{"identities": identity}, "$unset": bson.M{provider: ""}})
+			if err != nil {
+				return fmt.Errorf("Error moving %s ID to identities: %s\n", provider, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Users were given plain-text codes before codes were hashed.
+func migratePlainTextCodes(db mongoDB) error {
+	_, err := db.C("users").UpdateMany(db.ctx, bson.M{"$or": []bson.M{
+		{"code": bson.M{"$exists": true}},
+		{"resetCode": bson.M{"$exists": true}},
+	}}, bson.M{"$unset": bson.M{"code": "", "resetCode": ""}})
+	return err
+}
+
+// Users used to refer to their organization by name. Users of organizations
+// that no longer exist are left without one.
+func migrateOrganizationReferences(db mongoDB) error {
+	var names []string
+	err := db.C("users").Distinct(db.ctx, "organization", bson.M{"organization": bson.M{"$type": "string"}}).Decode(&names)
+	if err != nil {
+		return fmt.Errorf("Error retrieving organization names of users: %s\n", err)
+	}
+
+	for _, name := range names {
+		var org Organization
+		update := bson.M{"$unset": bson.M{"organization": ""}}
+		err = db.C("organizations").FindOne(db.ctx, bson.M{"name": name}).Decode(&org)
+		if err == nil {
+			update = bson.M{"$set": bson.M{"organization": org.ID}}
+		} else if err != mongo.ErrNoDocuments {
+			return fmt.Errorf("Error retrieving organization %s: %s\n", name, err)
+		}
+
+		_, err = db.C("users").UpdateMany(db.ctx, bson.M{"organization": name}, update)
+		if err != nil {
+			return fmt.Errorf("Error updating users of organization %s: %s\n", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Participants registered before scorecards existed have none. Scorecards
+// are as long as the current season.
+func migrateScorecards(db mongoDB) error {
+	var users []User
+	err := db.findAll("users", bson.M{"status": REGISTERED.String(),
+		"participants": bson.M{"$elemMatch": bson.M{"scorecard": nil}}}, &users)
+	if err != nil {
+		return fmt.Errorf("Error retrieving registered users: %s\n", err)
+	}
+
+	app := NewMongoApp(db)
+	for _, user := range users {
+		for index := range user.Participants {
+			if user.Participants[index].Scorecard == nil {
+				user.Participants[index].Scorecard = GenerateScorecard()
+			}
+		}
+
+		errM := app.Users.Save(&user)
+		if errM != nil {
+			return errM.Reason
+		}
+	}
+
+	return nil
+}
+
+// Participant IDs used to follow the highest existing one, so the best guess
+// for users from before is the one after that.
+func migrateNextParticipantIDs(db mongoDB) error {
+	_, err := db.C("users").UpdateMany(db.ctx, bson.M{"nextParticipantId": bson.M{"$exists": false},
+		"participants.0": bson.M{"$exists": true}}, []bson.M{{"$set": bson.M{
+		"nextParticipantId": bson.M{"$add": []interface{}{bson.M{"$max": "$participants.id"}, 1}}}}})
+	return err
+}
+
+// Addresses used to be stored as they were typed. Users whose addresses only
+// differ in case have to be merged by hand first, since the migration cannot
+// tell which account to keep.
+func migrateLowerCaseEmails(db mongoDB) error {
+	cursor, err := db.C("users").Aggregate(db.ctx, []bson.M{
+		{"$group": bson.M{"_id": bson.M{"$toLower": "$email"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("Error looking for duplicate e-mail addresses: %s\n", err)
+	}
+
+	var duplicates []bson.M
+	err = cursor.All(db.ctx, &duplicates)
+	if err != nil {
+		return fmt.Errorf("Error looking for duplicate e-mail addresses: %s\n", err)
+	}
+	if len(duplicates) > 0 {
+		var addresses []string
+		for _, d := range duplicates {
+			addresses = append(addresses, fmt.Sprint(d["_id"]))
+		}
+		return fmt.Errorf("Several users share these e-mail addresses in different case: %s\n",
+			strings.Join(addresses, ", "))
+	}
+
+	_, err = db.C("users").UpdateMany(db.ctx, bson.M{"email": bson.M{"$regex": "[A-Z]"}},
+		[]bson.M{{"$set": bson.M{"email": bson.M{"$toLower": "$email"}}}})
+	if err != nil {
+		return fmt.Errorf("Error lowering e-mail addresses: %s\n", err)
+	}
+
+	// Bonus question answers are recorded by address.
+	_, err = db.C("questions").UpdateMany(db.ctx, bson.M{"respondents.user": bson.M{"$regex": "[A-Z]"}},
+		[]bson.M{{"$set": bson.M{"respondents": bson.M{"$map": bson.M{"input": "$respondents",
+			"in": bson.M{"$mergeObjects": []interface{}{"$$this", bson.M{"user": bson.M{"$toLower": "$$this.user"}}}}}}}}})
+	if err != nil {
+		return fmt.Errorf("Error lowering bonus question respondents: %s\n", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestMigrationVersionsIncrease(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Errorf("migration %d comes after %d", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+}
+
+func TestMigrateAppliesPendingMigrationsOnce(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	logger = logrus.New()
+
+	org := bson.NewObjectID()
+	db.C("organizations").InsertOne(db.ctx, bson.M{"_id": org, "name": "Sample Gym"})
+	db.C("users").InsertOne(db.ctx, bson.M{"_id": bson.NewObjectID(), "email": "jane@example.com",
+		"status": "pending", "organization": "Sample Gym"})
+	db.C("users").InsertOne(db.ctx, bson.M{"_id": bson.NewObjectID(), "email": "john@example.com",
+		"organization": "Nowhere"})
+	db.C("users").InsertOne(db.ctx, bson.M{"_id": bson.NewObjectID(), "email": "Jim@Example.com"})
+	db.C("questions").InsertOne(db.ctx, bson.M{"_id": bson.NewObjectID(),
+		"respondents": []bson.M{{"user": "Jim@Example.com", "answeredCorrectly": true}}})
+
+	pending, err := Migrate(db, true)
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatalf("expected every migration to be pending got %d: %v", len(pending), err)
+	}
+
+	applied, err := Migrate(db, false)
+	if err != nil || len(applied) != len(migrations) {
+		t.Fatalf("expected every migration to be applied got %d: %v", len(applied), err)
+	}
+
+	app := NewMongoApp(db)
+	jane, errM := app.Users.FindByEmail("jane@example.com")
+	if errM != nil || jane.Status != REGISTERED.String() || jane.Organization != org {
+		t.Errorf("expected user to be migrated got %+v", jane)
+	}
+	john, errM := app.Users.FindByEmail("john@example.com")
+	if errM != nil || !john.Organization.IsZero() {
+		t.Errorf("expected missing organization to be removed got %+v", john)
+	}
+
+	if jim, errM := app.Users.FindByEmail("jim@example.com"); errM != nil || jim.Email != "jim@example.com" {
+		t.Errorf("expected address to be stored in lower case got %+v", jim)
+	}
+	if questions, _ := app.Questions.FindByRespondent("jim@example.com"); len(questions) != 1 {
+		t.Errorf("expected bonus question answer to follow the address got %d", len(questions))
+	}
+
+	applied, err = Migrate(db, false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("expected nothing to be applied twice got %d: %v", len(applied), err)
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+
+	if locked, err := TryLockMigrations(db, "a"); err != nil || !locked {
+		t.Fatalf("expected lock to be taken: %v", err)
+	}
+	if locked, _ := TryLockMigrations(db, "b"); locked {
+		t.Errorf("expected lock to be held by its owner")
+	}
+
+	// A lock past its lease belonged to an instance that died.
+	db.C("locks").UpdateOne(db.ctx, bson.M{"_id": "migrations"}, bson.M{"$set": bson.M{"expiresOn": time.Now()}})
+	if locked, _ := TryLockMigrations(db, "b"); !locked {
+		t.Errorf("expected expired lock to be taken over")
+	}
+
+	UnlockMigrations(db, "a")
+	if locked, _ := TryLockMigrations(db, "c"); locked {
+		t.Errorf("expected only the owner to unlock")
+	}
+	UnlockMigrations(db, "b")
+	if locked, _ := TryLockMigrations(db, "c"); !locked {
+		t.Errorf("expected lock to be free after unlocking")
+	}
+}
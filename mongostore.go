@@ -0,0 +1,1088 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// mongoDB is a database together with the context its queries run in. The
+// client pools connections, so it is cheap to copy and share.
+type mongoDB struct {
+	*mongo.Database
+	ctx context.Context
+
+	// Transactions need a replica set or a sharded cluster.
+	transactions bool
+}
+
+func newMongoDB(database *mongo.Database) mongoDB {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	database.RunCommand(context.Background(), bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+
+	return mongoDB{Database: database, ctx: context.Background(), transactions: hello.SetName != "" || hello.Msg == "isdbgrid"}
+}
+
+func (db mongoDB) WithContext(ctx context.Context) mongoDB {
+	db.ctx = ctx
+	return db
+}
+
+func (db mongoDB) C(name string) *mongo.Collection {
+	return db.Collection(name)
+}
+
+// findAll decodes every document the filter matches into out.
+func (db mongoDB) findAll(collection string, filter interface{}, out interface{}, opts ...options.Lister[options.FindOptions]) error {
+	cursor, err := db.C(collection).Find(db.ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	return cursor.All(db.ctx, out)
+}
+
+// orderBy lists sort or index keys, descending for fields prefixed with a
+// minus.
+func orderBy(fields ...string) bson.D {
+	keys := bson.D{}
+	for _, field := range fields {
+		if field[0] == '-' {
+			keys = append(keys, bson.E{Key: field[1:], Value: -1})
+		} else {
+			keys = append(keys, bson.E{Key: field, Value: 1})
+		}
+	}
+	return keys
+}
+
+func sortBy(fields ...string) *options.FindOptionsBuilder {
+	return options.Find().SetSort(orderBy(fields...))
+}
+
+var upsert = options.UpdateOne().SetUpsert(true)
+
+var replaceOrInsert = options.Replace().SetUpsert(true)
+
+func (f UserFilter) query() bson.M {
+	query := bson.M{}
+	if !f.Organization.IsZero() {
+		query["organization"] = f.Organization
+	}
+	if len(f.Statuses) > 0 {
+		query["status"] = bson.M{"$in": f.Statuses}
+	}
+	if len(f.Roles) > 0 {
+		query["role"] = bson.M{"$in": f.Roles}
+	}
+	return query
+}
+
+var userNotFound = &Error{Reason: errors.New("User not found."), Internal: false, Code: http.StatusUnauthorized}
+
+type MongoUserStore struct {
+	mongoDB
+}
+
+func (m *MongoUserStore) FindByID(id bson.ObjectID) (*User, *Error) {
+	ctx := logger.WithField("method", "FindUserById").WithField("id", id)
+
+	user := &User{}
+	err := m.C("users").FindOne(m.ctx, bson.M{"_id": id}).Decode(user)
+	if err == mongo.ErrNoDocuments || user.ID.IsZero() {
+		ctx.WithError(err).Warn("User not found.")
+		return nil, userNotFound
+	} else if err != nil {
+		ctx.WithError(err).Error("Failed to query for user by id.")
+		return nil, &Error{Reason: fmt.Errorf("Mongo error: %s\n", err), Internal: true}
+	}
+
+	return user, nil
+}
+
+func (m *MongoUserStore) FindByEmail(email string) (*User, *Error) {
+	return m.findOne(bson.M{"email": NormalizeEmail(email)})
+}
+
+func (m *MongoUserStore) FindByProvider(provider, subject string) (*User, *Error) {
+	return m.findOne(bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}})
+}
+
+func (m *MongoUserStore) findOne(query bson.M) (*User, *Error) {
+	ctx := logger.WithField("method", "FindUserByQuery").WithField("query", query)
+
+	user := &User{}
+	err := m.C("users").FindOne(m.ctx, query).Decode(user)
+	if err == mongo.ErrNoDocuments || user.ID.IsZero() {
+		ctx.WithError(err).Warn("User not found.")
+		return nil, &Error{Reason: errors.New("No user found."), Internal: false, Code: http.StatusNotFound}
+	} else if err != nil {
+		ctx.WithError(err).Error("Failed to query for user.")
+		return nil, &Error{Reason: err, Internal: true}
+	}
+	return user, nil
+}
+
+func (m *MongoUserStore) FindByChallenge(hash string) (*User, *Error) {
+	var user User
+	err := m.C("users").FindOne(m.ctx, bson.M{"challenge": hash, "challengeExpires": bson.M{"$gt": time.Now()}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(CHALLENGE_INVALID_ERROR), Code: http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error finding login challenge: %s\n", err), Internal: true}
+	}
+
+	return &user, nil
+}
+
+func (m *MongoUserStore) Find(filter UserFilter) (users []User, errM *Error) {
+	err := m.findAll("users", filter.query(), &users, sortBy("lastName", "firstName"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving users from DB: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoUserStore) Each(filter UserFilter, fn func(u *User) error) error {
+	cursor, err := m.C("users").Find(m.ctx, filter.query(), sortBy("lastName", "firstName"))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	for cursor.Next(m.ctx) {
+		var u User
+		err = cursor.Decode(&u)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (m *MongoUserStore) Create(u *User) *Error {
+	ctx := logger.WithField("method", "CreateUser")
+
+	_, err := m.C("users").InsertOne(m.ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		ctx.WithError(err).WithField("user", u.Email).Warn("Failed to create user. User already exists.")
+		return &Error{Reason: errors.New("User already exists. Please log in instead."), Internal: false, Code: 409}
+	} else if err != nil {
+		return &Error{Reason: fmt.Errorf("Error creating user: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoUserStore) Save(u *User) *Error {
+	ctx := logger.WithField("method", "User_Save")
+
+	_, err := m.C("users").UpdateOne(m.ctx, bson.M{"_id": u.ID}, bson.M{"$set": u}, upsert)
+	if mongo.IsDuplicateKeyError(err) {
+		ctx.WithError(err).WithField("user", u.Email).Warn("Failed to create user. User already exists.")
+		return &Error{Internal: false, Reason: errors.New("That user already exists. Please login first."), Code: http.StatusConflict}
+	} else if err != nil {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error updating user: %s\n", err)}
+	}
+
+	return nil
+}
+
+func (m *MongoUserStore) Update(id bson.ObjectID, set interface{}, unset ...string) *Error {
+	update := bson.M{}
+	if set != nil {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, field := range unset {
+			fields[field] = ""
+		}
+		update["$unset"] = fields
+	}
+
+	result, err := m.C("users").UpdateOne(m.ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating user: %s\n", err), Internal: true}
+	} else if result.MatchedCount == 0 {
+		return userNotFound
+	}
+
+	return nil
+}
+
+func (m *MongoUserStore) Remove(id bson.ObjectID) *Error {
+	_, err := m.C("users").DeleteOne(m.ctx, bson.M{"_id": id})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing user: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoUserStore) MoveOrganization(from, to bson.ObjectID) *Error {
+	update := bson.M{"$set": bson.M{"organization": to}}
+	if to.IsZero() {
+		update = bson.M{"$unset": bson.M{"organization": ""}}
+	}
+
+	_, err := m.C("users").UpdateMany(m.ctx, bson.M{"organization": from}, update)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error moving users to new org: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// changed applies an update and reports whether the selector matched.
+func (m *MongoUserStore) changed(selector, update bson.M) (bool, error) {
+	result, err := m.C("users").UpdateOne(m.ctx, selector, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (m *MongoUserStore) UseTOTPStep(id bson.ObjectID, step int64) (bool, *Error) {
+	used, err := m.changed(bson.M{"_id": id, "totpLastStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totpLastStep": step}})
+	if err != nil {
+		return false, &Error{Reason: fmt.Errorf("Error checking two-factor code: %s\n", err), Internal: true}
+	}
+
+	return used, nil
+}
+
+func (m *MongoUserStore) UseBackupCode(id bson.ObjectID, hash string) (bool, *Error) {
+	used, err := m.changed(bson.M{"_id": id, "backupCodes": hash}, bson.M{"$pull": bson.M{"backupCodes": hash}})
+	if err != nil {
+		return false, &Error{Reason: fmt.Errorf("Error checking backup code: %s\n", err), Internal: true}
+	}
+
+	return used, nil
+}
+
+func (m *MongoUserStore) RemoveIdentity(id bson.ObjectID, provider string) (bool, *Error) {
+	// Checked in the update itself so two unlinks at once cannot both pass.
+	query := bson.M{"_id": id, "$or": []bson.M{
+		{"password": bson.M{"$exists": true, "$ne": ""}},
+		{"identities": bson.M{"$elemMatch": bson.M{"provider": bson.M{"$ne": provider}}}},
+	}}
+	removed, err := m.changed(query, bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}})
+	if err != nil {
+		return false, &Error{Reason: fmt.Errorf("Error unlinking identity: %s\n", err), Internal: true}
+	}
+
+	return removed, nil
+}
+
+func (m *MongoUserStore) AddParticipant(id bson.ObjectID, p *Participant) (bool, *Error) {
+	added, err := m.changed(bson.M{"_id": id, "participants.id": bson.M{"$ne": p.ID},
+		"nextParticipantId": bson.M{"$not": bson.M{"$gt": p.ID}}},
+		bson.M{"$push": bson.M{"participants": p}, "$set": bson.M{"nextParticipantId": p.ID + 1}})
+	if err != nil {
+		return false, &Error{Reason: fmt.Errorf("Error adding participant: %s\n", err), Internal: true}
+	}
+
+	return added, nil
+}
+
+func (m *MongoUserStore) UpdateParticipant(id bson.ObjectID, p *Participant) *Error {
+	found, err := m.changed(bson.M{"_id": id, "participants.id": p.ID}, bson.M{"$set": bson.M{
+		"participants.$.firstName":        p.FirstName,
+		"participants.$.lastName":         p.LastName,
+		"participants.$.ageRange":         p.AgeRange,
+		"participants.$.category":         p.Category,
+		"participants.$.commitment":       p.Commitment,
+		"participants.$.customCommitment": p.CustomCommitment,
+	}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating participant: %s\n", err), Internal: true}
+	} else if !found {
+		return &Error{Reason: errors.New(PARTICIPANT_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	}
+
+	return nil
+}
+
+func (m *MongoUserStore) RemoveParticipant(id bson.ObjectID, participant int) *Error {
+	_, err := m.changed(bson.M{"_id": id}, bson.M{"$pull": bson.M{"participants": bson.M{"id": participant}}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing participant: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// SetScorecardDay adjusts the points in the same update. The update only
+// matches when the day actually changes, so repeating a check-in never
+// counts it twice.
+func (m *MongoUserStore) SetScorecardDay(id bson.ObjectID, participant, day int, done bool) *Error {
+	path := fmt.Sprintf("scorecard.%d.%d", day/7, day%7)
+	value, delta, current := 0, -1, interface{}(1)
+	if done {
+		value, delta, current = 1, 1, bson.M{"$ne": 1}
+	}
+
+	selector := bson.M{
+		"_id":          id,
+		"participants": bson.M{"$elemMatch": bson.M{"id": participant, path: current}},
+	}
+	update := bson.M{
+		"$set": bson.M{"participants.$." + path: value},
+		"$inc": bson.M{"participants.$.points": delta},
+	}
+
+	_, err := m.changed(selector, update)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating scorecard: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// Leaderboard groups participants with an aggregation pipeline.
+func (m *MongoUserStore) Leaderboard(q LeaderboardQuery) (entries []LeaderboardEntry, errM *Error) {
+	visible := []bson.M{{"sharing": "everyone"}}
+	if q.Viewer != nil && !q.Viewer.Organization.IsZero() {
+		visible = append(visible, bson.M{
+			"sharing":      bson.M{"$in": []interface{}{"organization", "", nil}},
+			"organization": q.Viewer.Organization,
+		})
+	}
+
+	// Users refer to their organization by ID, leaderboards show its name.
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": REGISTERED.String(), "season": q.Season, "$or": visible}},
+		{"$lookup": bson.M{"from": "organizations", "localField": "organization", "foreignField": "_id",
+			"as": "organization"}},
+		{"$addFields": bson.M{"organization": bson.M{"$arrayElemAt": []interface{}{"$organization.name", 0}}}},
+		{"$unwind": "$participants"},
+	}
+
+	groupBy := leaderboards[q.Board]
+	if groupBy == nil {
+		// Only show first names and last initials of individuals.
+		pipeline = append(pipeline, bson.M{"$project": bson.M{
+			"_id": 0,
+			"name": bson.M{"$concat": []interface{}{
+				"$participants.firstName", " ", bson.M{"$substrCP": []interface{}{"$participants.lastName", 0, 1}}}},
+			"organization": "$organization",
+			"participants": bson.M{"$literal": 1},
+			"total":        "$participants.points",
+			"average":      "$participants.points",
+		}})
+	} else {
+		// Skip users that are not part of a group of this kind.
+		field := groupBy["name"].(string)[1:]
+
+		group := bson.M{
+			"_id":          groupBy,
+			"participants": bson.M{"$sum": 1},
+			"total":        bson.M{"$sum": "$participants.points"},
+			"average":      bson.M{"$avg": "$participants.points"},
+		}
+		name := "$_id.name"
+		if label, ok := leaderboardLabels[q.Board]; ok {
+			// The first member is the one who signed up first.
+			pipeline = append(pipeline, bson.M{"$sort": bson.M{"createdOn": 1}})
+			group["label"] = bson.M{"$first": label}
+			name = "$label"
+		}
+
+		pipeline = append(pipeline,
+			bson.M{"$match": bson.M{field: bson.M{"$nin": []interface{}{"", nil}}}},
+			bson.M{"$group": group},
+			bson.M{"$project": bson.M{
+				"_id":          0,
+				"name":         name,
+				"organization": "$_id.organization",
+				"participants": 1,
+				"total":        1,
+				"average":      1,
+			}},
+		)
+	}
+
+	pipeline = append(pipeline,
+		bson.M{"$sort": bson.D{{Key: q.SortBy, Value: -1}, {Key: "name", Value: 1}}},
+		bson.M{"$limit": q.Limit},
+	)
+
+	cursor, err := m.C("users").Aggregate(m.ctx, pipeline)
+	if err == nil {
+		err = cursor.All(m.ctx, &entries)
+	}
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error computing leaderboard: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+type MongoOrganizationStore struct {
+	mongoDB
+}
+
+func (m *MongoOrganizationStore) FindAll() (organizations []Organization, errM *Error) {
+	err := m.findAll("organizations", bson.M{"needsApproval": bson.M{"$ne": true}}, &organizations)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving organizations from DB: %s", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoOrganizationStore) FindByID(id bson.ObjectID) (*Organization, *Error) {
+	return m.findOne(bson.M{"_id": id})
+}
+
+func (m *MongoOrganizationStore) FindByName(name string) (*Organization, *Error) {
+	return m.findOne(bson.M{"name": name})
+}
+
+func (m *MongoOrganizationStore) findOne(query bson.M) (*Organization, *Error) {
+	org := &Organization{}
+	err := m.C("organizations").FindOne(m.ctx, query).Decode(org)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(ORGANIZATION_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving organization: %s\n", err), Internal: true}
+	}
+
+	return org, nil
+}
+
+func (m *MongoOrganizationStore) FindRequests() (organizations []Organization, errM *Error) {
+	err := m.findAll("organizations", bson.M{"needsApproval": true}, &organizations, sortBy("requestedOn"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving organization requests: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoOrganizationStore) FindRequest(id bson.ObjectID) (*Organization, *Error) {
+	org := &Organization{}
+	err := m.C("organizations").FindOne(m.ctx, bson.M{"_id": id, "needsApproval": true}).Decode(org)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(ORGANIZATION_REQUEST_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving organization request: %s\n", err), Internal: true}
+	}
+
+	return org, nil
+}
+
+func (m *MongoOrganizationStore) Create(name string, needsApproval bool) *Error {
+	_, err := m.C("organizations").InsertOne(m.ctx, bson.M{"_id": bson.NewObjectID(), "name": name, "needsApproval": needsApproval})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return &Error{Reason: fmt.Errorf("Error creating new org: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoOrganizationStore) Request(name, email string) *Error {
+	_, err := m.C("organizations").UpdateOne(m.ctx, bson.M{"name": name}, bson.M{
+		"$setOnInsert": bson.M{"_id": bson.NewObjectID(), "needsApproval": true, "requestedOn": time.Now()},
+		"$addToSet":    bson.M{"requesters": email},
+	}, upsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error creating organization request: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// Approve drops the requesters so their addresses are not published.
+func (m *MongoOrganizationStore) Approve(id bson.ObjectID) *Error {
+	_, err := m.C("organizations").UpdateOne(m.ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"needsApproval": false},
+		"$unset": bson.M{"requesters": "", "requestedOn": ""},
+	})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error approving organization: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoOrganizationStore) Import(name, timeZone string) *Error {
+	set := bson.M{"needsApproval": false}
+	if timeZone != "" {
+		set["timeZone"] = timeZone
+	}
+	_, err := m.C("organizations").UpdateOne(m.ctx, bson.M{"name": name},
+		bson.M{"$set": set, "$setOnInsert": bson.M{"_id": bson.NewObjectID()}}, upsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error importing org: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoOrganizationStore) Save(org *Organization) *Error {
+	_, err := m.C("organizations").ReplaceOne(m.ctx, bson.M{"_id": org.ID}, org, replaceOrInsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating org: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoOrganizationStore) Rename(id bson.ObjectID, name string) *Error {
+	result, err := m.C("organizations").UpdateOne(m.ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"name": name}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating merged org name: %s\n", err), Internal: true}
+	} else if result.MatchedCount == 0 {
+		return &Error{Reason: errors.New(ORGANIZATION_ERROR), Code: http.StatusNotFound}
+	}
+
+	return nil
+}
+
+func (m *MongoOrganizationStore) Remove(id bson.ObjectID) *Error {
+	_, err := m.C("organizations").DeleteOne(m.ctx, bson.M{"_id": id})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error deleting org: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoNewsStore struct {
+	mongoDB
+}
+
+func (m *MongoNewsStore) FindPublished(adminNews bool) ([]News, *Error) {
+	query := bson.M{"published": true}
+	if !adminNews {
+		query["adminOnly"] = false
+	}
+	return m.find(query)
+}
+
+func (m *MongoNewsStore) FindAll() ([]News, *Error) {
+	return m.find(bson.M{})
+}
+
+func (m *MongoNewsStore) find(query bson.M) (news []News, errM *Error) {
+	err := m.findAll("news", query, &news)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving news: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoNewsStore) FindByID(id bson.ObjectID) (*News, *Error) {
+	news := &News{}
+	err := m.C("news").FindOne(m.ctx, bson.M{"_id": id}).Decode(news)
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving news item: %s\n", err), Internal: true}
+	}
+
+	return news, nil
+}
+
+func (m *MongoNewsStore) Save(n *News) *Error {
+	_, err := m.C("news").UpdateOne(m.ctx, bson.M{"_id": n.ID}, bson.M{"$set": n}, upsert)
+	if err != nil {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error saving news: %s\n", err)}
+	}
+
+	return nil
+}
+
+func (m *MongoNewsStore) Remove(id bson.ObjectID) *Error {
+	_, err := m.C("news").DeleteOne(m.ctx, bson.M{"_id": id})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing news item: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoQuestionStore struct {
+	mongoDB
+}
+
+func (m *MongoQuestionStore) FindEnabled(season bson.ObjectID) (*Question, *Error) {
+	q := &Question{}
+	err := m.C("questions").FindOne(m.ctx, bson.M{"enabled": true, "season": season}).Decode(q)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving enabled question: %s\n", err)}
+	}
+
+	return q, nil
+}
+
+func (m *MongoQuestionStore) FindByID(id bson.ObjectID) (*Question, *Error) {
+	q := &Question{}
+	err := m.C("questions").FindOne(m.ctx, bson.M{"_id": id}).Decode(q)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New("Question not found."), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving question: %s\n", err), Internal: true}
+	}
+
+	return q, nil
+}
+
+func (m *MongoQuestionStore) FindAll() ([]Question, *Error) {
+	return m.find(bson.M{})
+}
+
+func (m *MongoQuestionStore) FindBySeason(season bson.ObjectID) ([]Question, *Error) {
+	return m.find(bson.M{"season": season})
+}
+
+func (m *MongoQuestionStore) FindByRespondent(email string) ([]Question, *Error) {
+	return m.find(bson.M{"respondents.user": email})
+}
+
+func (m *MongoQuestionStore) find(query bson.M) (q []Question, errM *Error) {
+	err := m.findAll("questions", query, &q)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving questions: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoQuestionStore) Save(q *Question) *Error {
+	_, err := m.C("questions").UpdateOne(m.ctx, bson.M{"_id": q.ID}, bson.M{"$set": q}, upsert)
+	if err != nil {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error saving question: %s\n", err)}
+	}
+
+	return nil
+}
+
+func (m *MongoQuestionStore) Remove(id bson.ObjectID) *Error {
+	_, err := m.C("questions").DeleteOne(m.ctx, bson.M{"_id": id})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing question: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoQuestionStore) Enable(id bson.ObjectID) *Error {
+	result, err := m.C("questions").UpdateOne(m.ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"enabled": true}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error enabling question: %s\n", err), Internal: true}
+	} else if result.MatchedCount == 0 {
+		return &Error{Reason: errors.New("Question not found."), Code: http.StatusNotFound}
+	}
+
+	return nil
+}
+
+func (m *MongoQuestionStore) RenameRespondent(old, email string) *Error {
+	_, err := m.C("questions").UpdateMany(m.ctx, bson.M{"respondents.user": old}, bson.M{"$set": bson.M{"respondents.$.user": email}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error moving bonus question answers: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoFAQStore struct {
+	mongoDB
+}
+
+func (m *MongoFAQStore) FindAll() (faqs []FAQ, errM *Error) {
+	err := m.findAll("faqs", bson.M{}, &faqs)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving faqs: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoFAQStore) Save(f *FAQ) *Error {
+	_, err := m.C("faqs").UpdateOne(m.ctx, bson.M{"_id": f.ID}, bson.M{"$set": f}, upsert)
+	if err != nil {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error saving faq: %s\n", err)}
+	}
+
+	return nil
+}
+
+func (m *MongoFAQStore) Update(f *FAQ) *Error {
+	result, err := m.C("faqs").ReplaceOne(m.ctx, bson.M{"_id": f.ID}, f)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating faq: %s\n", err), Internal: true}
+	} else if result.MatchedCount == 0 {
+		return &Error{Reason: errors.New("The faq you are trying to update does not exist."), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoFAQStore) Remove(id bson.ObjectID) *Error {
+	_, err := m.C("faqs").DeleteOne(m.ctx, bson.M{"_id": id})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing FAQ: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoGlobalsStore struct {
+	mongoDB
+}
+
+func (m *MongoGlobalsStore) FindSeasons() (seasons []Season, errM *Error) {
+	err := m.findAll("seasons", bson.M{}, &seasons, sortBy("-challengeStart"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving seasons: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoGlobalsStore) FindSeasonByID(id bson.ObjectID) (*Season, *Error) {
+	return m.findSeason(bson.M{"_id": id})
+}
+
+func (m *MongoGlobalsStore) FindCurrentSeason() (*Season, *Error) {
+	return m.findSeason(bson.M{"current": true})
+}
+
+func (m *MongoGlobalsStore) findSeason(query bson.M) (*Season, *Error) {
+	season := &Season{}
+	err := m.C("seasons").FindOne(m.ctx, query).Decode(season)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(SEASON_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving season: %s\n", err), Internal: true}
+	}
+
+	return season, nil
+}
+
+// SaveSeason replaces the whole document so that settings switched off are
+// not lost to omitempty.
+func (m *MongoGlobalsStore) SaveSeason(s *Season) *Error {
+	_, err := m.C("seasons").ReplaceOne(m.ctx, bson.M{"_id": s.ID}, s, replaceOrInsert)
+	if mongo.IsDuplicateKeyError(err) {
+		return &Error{Reason: errors.New(SEASON_EXISTS_ERROR), Code: http.StatusConflict}
+	} else if err != nil {
+		return &Error{Reason: fmt.Errorf("Error saving season: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoGlobalsStore) ArchiveRegistration(reg *Registration) *Error {
+	c := m.C("registrations")
+	selector := bson.M{"season": reg.Season, "user": reg.User}
+
+	// Keep the ID of a previous archive so that archiving twice is harmless.
+	var existing Registration
+	if c.FindOne(m.ctx, selector).Decode(&existing) == nil {
+		reg.ID = existing.ID
+	}
+
+	_, err := c.ReplaceOne(m.ctx, selector, reg, replaceOrInsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error archiving registration: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoGlobalsStore) FindRegistrations(season bson.ObjectID) ([]Registration, *Error) {
+	return m.findRegistrations(bson.M{"season": season})
+}
+
+func (m *MongoGlobalsStore) FindUserRegistrations(user bson.ObjectID) ([]Registration, *Error) {
+	return m.findRegistrations(bson.M{"user": user})
+}
+
+func (m *MongoGlobalsStore) findRegistrations(query bson.M) (registrations []Registration, errM *Error) {
+	err := m.findAll("registrations", query, &registrations)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving registrations: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoGlobalsStore) RemoveUserRegistrations(user bson.ObjectID) *Error {
+	_, err := m.C("registrations").DeleteMany(m.ctx, bson.M{"user": user})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing user's registrations: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoCommitmentStore struct {
+	mongoDB
+}
+
+func (m *MongoCommitmentStore) FindAll() (commitments []Commitment, errM *Error) {
+	err := m.findAll("commitments", bson.M{}, &commitments)
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving commitments from DB: %s", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoCommitmentStore) FindByName(name string) (*Commitment, *Error) {
+	commitment := &Commitment{}
+	err := m.C("commitments").FindOne(m.ctx, bson.M{"name": name}).Decode(commitment)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(BAD_CHOICE_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving commitment: %s\n", err), Internal: true}
+	}
+
+	return commitment, nil
+}
+
+func (m *MongoCommitmentStore) Add(category, commitment string) *Error {
+	_, err := m.C("commitments").UpdateOne(m.ctx, bson.M{"name": category},
+		bson.M{"$addToSet": bson.M{"commitments": commitment}}, upsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error adding commitment: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoFamilyStore struct {
+	mongoDB
+}
+
+func (m *MongoFamilyStore) Exists(code string) bool {
+	count, _ := m.C("families").CountDocuments(m.ctx, bson.M{"code": code}, options.Count().SetLimit(1))
+	return count > 0
+}
+
+func (m *MongoFamilyStore) Create(code string) *Error {
+	_, err := m.C("families").InsertOne(m.ctx, &Family{ID: bson.NewObjectID(), Code: code})
+	if err != nil {
+		return &Error{Internal: true, Reason: fmt.Errorf("Error creating family code: %s\n", err)}
+	}
+
+	return nil
+}
+
+type MongoSessionStore struct {
+	mongoDB
+}
+
+func (m *MongoSessionStore) Create(s *Session) *Error {
+	_, err := m.C("sessions").InsertOne(m.ctx, s)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error creating session: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoSessionStore) FindByID(id bson.ObjectID) (*Session, *Error) {
+	var session Session
+	err := m.C("sessions").FindOne(m.ctx, bson.M{"_id": id}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(SESSION_INVALID_ERROR), Code: http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving session: %s\n", err), Internal: true}
+	}
+
+	return &session, nil
+}
+
+func (m *MongoSessionStore) Rotate(hash, newHash string) (*Session, *Error) {
+	ctx := logger.WithField("method", "RotateSession")
+	c := m.C("sessions")
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"tokenHash": newHash, "previousHash": hash,
+		"lastUsed": now, "expiresOn": now.Add(refreshTokenLifetime)}}
+
+	var session Session
+	err := c.FindOneAndUpdate(m.ctx, bson.M{"tokenHash": hash, "revokedOn": bson.M{"$exists": false},
+		"expiresOn": bson.M{"$gt": now}}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		result, err := c.UpdateMany(m.ctx, bson.M{"previousHash": hash, "revokedOn": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"revokedOn": now}})
+		if err == nil && result.ModifiedCount > 0 {
+			ctx.Warn("Refresh token reused, session revoked.")
+		}
+		return nil, &Error{Reason: errors.New(SESSION_INVALID_ERROR), Code: http.StatusUnauthorized}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error refreshing session: %s\n", err), Internal: true}
+	}
+
+	return &session, nil
+}
+
+func (m *MongoSessionStore) Revoke(id bson.ObjectID) *Error {
+	return m.revoke(bson.M{"_id": id})
+}
+
+func (m *MongoSessionStore) RevokeByHash(hash string) *Error {
+	return m.revoke(bson.M{"tokenHash": hash})
+}
+
+func (m *MongoSessionStore) RevokeUser(user bson.ObjectID) *Error {
+	return m.revoke(bson.M{"user": user})
+}
+
+func (m *MongoSessionStore) revoke(query bson.M) *Error {
+	query["revokedOn"] = bson.M{"$exists": false}
+	_, err := m.C("sessions").UpdateMany(m.ctx, query, bson.M{"$set": bson.M{"revokedOn": time.Now()}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error revoking session: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoSessionStore) FindByUser(user bson.ObjectID) (sessions []Session, errM *Error) {
+	err := m.findAll("sessions", bson.M{"user": user}, &sessions, sortBy("createdOn"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving sessions: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoSessionStore) RemoveUser(user bson.ObjectID) *Error {
+	_, err := m.C("sessions").DeleteMany(m.ctx, bson.M{"user": user})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing user's sessions: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoUserCodeStore struct {
+	mongoDB
+}
+
+func (m *MongoUserCodeStore) Create(code *UserCode) *Error {
+	_, err := m.C("user_codes").InsertOne(m.ctx, code)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error storing user code: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoUserCodeStore) Use(hash string, purposes ...string) (*UserCode, *Error) {
+	var code UserCode
+	err := m.C("user_codes").FindOneAndUpdate(m.ctx, bson.M{"hash": hash, "purpose": bson.M{"$in": purposes},
+		"usedOn": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"usedOn": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&code)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(CODE_INVALID_ERROR), Code: http.StatusBadRequest}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error using user code: %s\n", err), Internal: true}
+	}
+
+	return &code, nil
+}
+
+func (m *MongoUserCodeStore) Revoke(user bson.ObjectID, purpose string) *Error {
+	query := bson.M{"user": user, "usedOn": bson.M{"$exists": false}}
+	if purpose != "" {
+		query["purpose"] = purpose
+	}
+
+	_, err := m.C("user_codes").UpdateMany(m.ctx, query, bson.M{"$set": bson.M{"usedOn": time.Now()}})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error revoking user codes: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoUserCodeStore) RemoveStale(cutoff time.Time) (int, *Error) {
+	result, err := m.C("user_codes").DeleteMany(m.ctx, bson.M{"$or": []bson.M{
+		{"usedOn": bson.M{"$lt": cutoff}},
+		{"expiresOn": bson.M{"$lt": cutoff}},
+	}})
+	if err != nil {
+		return 0, &Error{Reason: fmt.Errorf("Error removing stale user codes: %s\n", err), Internal: true}
+	}
+
+	return int(result.DeletedCount), nil
+}
+
+func (m *MongoUserCodeStore) RemoveUser(user bson.ObjectID) *Error {
+	_, err := m.C("user_codes").DeleteMany(m.ctx, bson.M{"user": user})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing user's user_codes: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+type MongoEmailTemplateStore struct {
+	mongoDB
+}
+
+func (m *MongoEmailTemplateStore) FindAll() (templates []EmailTemplate, errM *Error) {
+	err := m.findAll("email_templates", bson.M{}, &templates, sortBy("name"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving e-mail templates: %s\n", err), Internal: true}
+	}
+
+	return
+}
+
+func (m *MongoEmailTemplateStore) FindByName(name string) (*EmailTemplate, *Error) {
+	var t EmailTemplate
+	err := m.C("email_templates").FindOne(m.ctx, bson.M{"name": name}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, &Error{Reason: errors.New(EMAIL_TEMPLATE_NOT_FOUND_ERROR), Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error retrieving e-mail template: %s\n", err), Internal: true}
+	}
+
+	return &t, nil
+}
+
+func (m *MongoEmailTemplateStore) Save(t *EmailTemplate) *Error {
+	t.UpdatedOn = time.Now()
+	_, err := m.C("email_templates").ReplaceOne(m.ctx, bson.M{"_id": t.ID}, t, replaceOrInsert)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error saving e-mail template: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+func (m *MongoEmailTemplateStore) Remove(name string) *Error {
+	_, err := m.C("email_templates").DeleteOne(m.ctx, bson.M{"name": name})
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error removing e-mail template: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
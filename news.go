@@ -3,18 +3,16 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type News struct {
-	ID          bson.ObjectId `bson:"_id" json:"id"`
+	ID          bson.ObjectID `bson:"_id" json:"id"`
 	Subject     string        `bson:"subject" json:"subject"`
 	Body        string        `bson:"body" json:"body"`
 	Published   bool          `bson:"published" json:"published,omitempty"`
@@ -22,21 +20,20 @@ type News struct {
 	AdminOnly   bool          `bson:"adminOnly" json:"adminOnly,omitempty"`
 }
 
-func FetchNews(w http.ResponseWriter, r *http.Request) {
+func (app *App) FetchNews(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
 	getAdminNews := strings.Contains(user.Role, "admin")
-	news, errM := FindPublishedNews(db, getAdminNews)
+	news, errM := app.News.FindPublished(getAdminNews)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -46,13 +43,8 @@ func FetchNews(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func ListNews(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
-	db := GetDB(w, r)
-	news, errM := FindAllNews(db)
+func (app *App) ListNews(w http.ResponseWriter, r *http.Request) {
+	news, errM := app.News.FindAll()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -62,11 +54,7 @@ func ListNews(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func AddNews(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
+func (app *App) AddNews(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var news News
 	err := decoder.Decode(&news)
@@ -91,10 +79,9 @@ func AddNews(w http.ResponseWriter, r *http.Request) {
 		news.PublishDate = time.Now()
 	}
 
-	news.ID = bson.NewObjectId()
+	news.ID = bson.NewObjectID()
 
-	db := GetDB(w, r)
-	errM := news.Save(db)
+	errM := app.News.Save(&news)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -104,32 +91,30 @@ func AddNews(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DeleteNews(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
+func (app *App) DeleteNews(w http.ResponseWriter, r *http.Request) {
+	newsID := ObjectIDHex(mux.Vars(r)["id"])
+
+	news, errM := app.News.FindByID(newsID)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
-	newsID := bson.ObjectIdHex(mux.Vars(r)["id"])
-
-	db := GetDB(w, r)
-	errM := RemoveNews(db, newsID)
+	errM = app.News.Remove(newsID)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	AuditChange(r, newsID.Hex(), news, nil)
+
 	ServeJSON(w, r, &Response{"status": "News item deleted."}, http.StatusOK)
 }
 
-func PublishNews(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
+func (app *App) PublishNews(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
 
-	id := bson.ObjectIdHex(mux.Vars(r)["id"])
-
-	db := GetDB(w, r)
-	n, errM := FindNewsByID(db, id)
+	n, errM := app.News.FindByID(id)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -137,7 +122,7 @@ func PublishNews(w http.ResponseWriter, r *http.Request) {
 
 	n.Published = true
 	n.PublishDate = time.Now()
-	errM = n.Save(db)
+	errM = app.News.Save(n)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -146,22 +131,17 @@ func PublishNews(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "News item published."}, http.StatusOK)
 }
 
-func UnpublishNews(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
-	id := bson.ObjectIdHex(mux.Vars(r)["id"])
+func (app *App) UnpublishNews(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
 
-	db := GetDB(w, r)
-	n, errM := FindNewsByID(db, id)
+	n, errM := app.News.FindByID(id)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
 	n.Published = false
-	errM = n.Save(db)
+	errM = app.News.Save(n)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -169,59 +149,3 @@ func UnpublishNews(w http.ResponseWriter, r *http.Request) {
 
 	ServeJSON(w, r, &Response{"status": "News item unpublished."}, http.StatusOK)
 }
-
-func (n *News) Save(db *mgo.Database) (errM *Error) {
-	c := db.C("news")
-	_, err := c.UpsertId(n.ID, bson.M{"$set": n})
-	if err != nil {
-		errM = &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Error saving news: %s\n", err))}
-		return
-	}
-
-	return
-}
-
-func FindPublishedNews(db *mgo.Database, getAdminNews bool) (news []News, errM *Error) {
-	query := bson.M{"published": true}
-	if !getAdminNews {
-		query["adminOnly"] = false
-	}
-	return FindNewsByQuery(db, query)
-}
-
-func FindAllNews(db *mgo.Database) (news []News, errM *Error) {
-	return FindNewsByQuery(db, nil)
-}
-
-func FindNewsByQuery(db *mgo.Database, query bson.M) (news []News, errM *Error) {
-	c := db.C("news")
-	err := c.Find(query).All(&news)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving news: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
-
-func FindNewsByID(db *mgo.Database, id bson.ObjectId) (news *News, errM *Error) {
-	c := db.C("news")
-	err := c.FindId(id).One(&news)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving news item: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
-
-func RemoveNews(db *mgo.Database, id bson.ObjectId) (errM *Error) {
-	c := db.C("news")
-	err := c.RemoveId(id)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error removing news item: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
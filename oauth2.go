@@ -5,396 +5,204 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
-	"strconv"
+	"net/mail"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/google/go-querystring/query"
-	"github.com/parnurzeal/gorequest"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-type OAuth2Params struct {
-	Code         string `json:"code" url:"code"`
-	ClientId     string `json:"client_id" url:"client_id"`
-	ClientSecret string `json:"client_secret" url:"client_secret"`
-	RedirectUri  string `json:"redirect_uri" url:"redirect_uri"`
-	GrantType    string `json:"grant_type,omitempty" url:"grant_type,omitempty"`
-}
-
-type accessTokenData struct {
-	AccessToken string `json:"access_token" url:"access_token"`
-	TokenType   string `json:"token_type" url:"token_type"`
-	ExpiresIn   int    `json:"expires_in" url:"expires_in"`
-}
+// GetProviders lists the login providers and what clients need to start a
+// login with them.
+func GetProviders(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "GetProviders")
 
-func (f *OAuth2Params) LoadFromHTTPRequest(r *http.Request) {
-	type requestData struct {
-		Code        string `json:"code"`
-		ClientId    string `json:"clientId"`
-		RedirectUri string `json:"redirectUri"`
+	names := make([]string, 0, len(PROVIDERS))
+	for name := range PROVIDERS {
+		names = append(names, name)
 	}
-	decoder := json.NewDecoder(r.Body)
+	sort.Strings(names)
 
-	var data requestData
-	err := decoder.Decode(&data)
-
-	if err != nil {
-		panic(err)
+	providers := make([]*Response, 0, len(names))
+	for _, name := range names {
+		endpoints, err := PROVIDERS[name].Endpoints()
+		if err != nil {
+			ctx.WithError(err).WithField("provider", name).Error("Failed to discover login provider.")
+			continue
+		}
+		providers = append(providers, endpoints)
 	}
-	f.Code = data.Code
-	f.ClientId = data.ClientId
-	f.RedirectUri = data.RedirectUri
-}
 
-func newFBParams() *OAuth2Params {
-	return &OAuth2Params{
-		ClientSecret: config.FACEBOOK_SECRET,
-	}
+	b, _ := json.Marshal(providers)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func newGoogleParams() *OAuth2Params {
-	return &OAuth2Params{
-		ClientSecret: config.GOOGLE_SECRET,
-		GrantType:    "authorization_code",
-	}
-}
+// LoginWithProvider finishes a login with an OpenID Connect provider. It links
+// the provider to the logged in user, or logs in, links or creates the user
+// the provider vouches for.
+func (app *App) LoginWithProvider(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "LoginWithProvider")
 
-func LoginWithFacebook(w http.ResponseWriter, r *http.Request) {
-	ctx := logger.WithField("method", "LoginWithFacebook")
-	apiUrl := "https://graph.facebook.com"
-	accessTokenPath := "/v2.5/oauth/access_token"
-	graphApiPath := "/v2.5/me"
-
-	// Step 1. Exchange authorization code for access token.
-	fbparams := newFBParams()
-	fbparams.LoadFromHTTPRequest(r)
-
-	v, _ := query.Values(fbparams)
-	u, _ := url.ParseRequestURI(apiUrl)
-	u.Path = accessTokenPath
-	u.RawQuery = v.Encode()
-	urlStr := fmt.Sprintf("%v", u)
-
-	res, body, _ := gorequest.New().Get(urlStr).End()
-
-	if res.StatusCode != 200 {
-		var errorData map[string]interface{}
-		json.Unmarshal([]byte(body), &errorData)
-		ctx.WithField("err", errorData).Error("Failed to authenticate with Facebook.")
-		ServeJSON(w, r, &Response{
-			"message": errorData["error"].(map[string]interface{})["message"],
-		}, 500)
+	name := mux.Vars(r)["provider"]
+	provider, ok := PROVIDERS[name]
+	if !ok {
+		BR(w, r, errors.New(PROVIDER_UNKNOWN_ERROR), http.StatusNotFound)
 		return
 	}
-	// Step 2. Retrieve profile information about the current user.
-	var atData accessTokenData
-	err := json.Unmarshal([]byte(body), &atData)
-	if err != nil {
-		ctx.WithError(err).Error("Failed to unmarshal facebook profile data.")
-		ISR(w, r, errors.New(fmt.Sprintf("Error reading profile data from Facebook: %s\n", err)))
+
+	var message struct {
+		Code        string `json:"code"`
+		RedirectURI string `json:"redirectUri"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil || message.Code == "" {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
 		return
 	}
 
-	v, _ = query.Values(atData)
-
-	u, _ = url.ParseRequestURI(apiUrl)
-	u.Path = graphApiPath
-	u.RawQuery = v.Encode() + "&fields=id,first_name, last_name ,email"
-	urlStr = fmt.Sprintf("%v", u)
-
-	resProfile, body, _ := gorequest.New().Get(urlStr).End()
-
-	var profileData map[string]interface{}
-	err = json.Unmarshal([]byte(body), &profileData)
-
-	if resProfile.StatusCode != 200 {
-		ctx.WithField("response", resProfile).
-			Error("Received a non-200 response when requesting profile data from facebook.")
-		ServeJSON(w, r, &Response{
-			"message": profileData["error"].(map[string]interface{})["message"],
-		}, 500)
+	claims, err := provider.Exchange(message.Code, message.RedirectURI)
+	if err != nil {
+		ctx.WithError(err).WithField("provider", name).Warn("Login with provider failed.")
+		BR(w, r, errors.New(PROVIDER_LOGIN_ERROR), http.StatusUnauthorized)
 		return
 	}
 
-	db := GetDB(w, r)
+	var user *User
+	var errM *Error
 	if IsTokenSet(r) {
-		// Step 3a. Link user accounts.
-		existingUser, errM := FindUserByProvider(db, "facebook", profileData["id"].(string))
-		if existingUser != nil {
-			ServeJSON(w, r, &Response{
-				"message": "There is already a Facebook account that belongs to you",
-			}, 409)
-			return
-		}
-
-		if errM != nil && errM.Reason != mgo.ErrNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		tokenData := GetToken(w, r)
-		user, errM := FindUserById(db, bson.ObjectIdHex(tokenData.ID))
-		if user == nil {
-			ServeJSON(w, r, &Response{
-				"message": "User not found",
-			}, 400)
-			return
-		}
-
-		if errM != nil && errM.Reason != mgo.ErrNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		user.Facebook = profileData["id"].(string)
-		if user.Picture == "" {
-			user.Picture = "https://graph.facebook.com/v2.5/" + profileData["id"].(string) + "/picture?type=large"
-		}
-
-		errM = user.Save(db)
-		if errM != nil {
-			HandleModelError(w, r, errM)
-			return
-		}
-		ctx.WithField("user", user.Email).Info("Facebook user signed in.")
-
-		SetToken(w, r, user)
+		user, errM = app.LinkProvider(GetToken(w, r), name, claims)
 	} else {
-		// Step 3b. Create a new user account or return an existing one.
-		existingUser, errM := FindUserByProvider(db, "facebook", profileData["id"].(string))
-		if errM != nil && errM.Code != http.StatusNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		if existingUser != nil {
-			ctx.WithField("user", existingUser.Email).Info("User logged in with Facebook.")
-			SetToken(w, r, existingUser)
-			return
-		}
-
-		// Make sure we have the user's e-mail or error out.
-		if profileData["email"] == nil {
-			BR(w, r, errors.New("You cannot sign up without sharing your email with NHC."), http.StatusNotAcceptable)
-			return
-		}
-
-		// If this user already exists w/ a different provider , just add the facebook data and save.
-		existingUser, errM = FindUserByEmail(db, profileData["email"].(string))
-		if errM != nil && errM.Code != http.StatusNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		if existingUser != nil {
-			existingUser.Facebook = profileData["id"].(string)
-
-			if existingUser.Picture == "" {
-				existingUser.Picture = "https://graph.facebook.com/v2.5/" + profileData["id"].(string) + "/picture?type=large"
-			}
-
-			errM := existingUser.Save(db)
-			if errM != nil {
-				HandleModelError(w, r, errM)
-				return
-			}
-			ctx.WithField("user", existingUser.Email).Info("Existing user updated with facebook profile data.")
-
-			SetToken(w, r, existingUser)
-			return
-		}
-
-		// Create user with his facebook id
-		user := NewUser()
-		user.FirstName = profileData["first_name"].(string)
-		user.LastName = profileData["last_name"].(string)
-		user.Facebook = profileData["id"].(string)
-		user.Email = profileData["email"].(string)
-		user.Picture = "https://graph.facebook.com/v2.5/" + profileData["id"].(string) + "/picture?type=large"
-		user.Role = USER.String()
-		user.Status = UNREGISTERED.String()
-		user.CreatedOn = time.Now()
-		errM = user.Save(db)
-		if errM != nil {
-			HandleModelError(w, r, errM)
-			return
-		}
+		user, errM = app.FindOrCreateProviderUser(name, claims)
+	}
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
 
-		ctx.WithField("user", user.Email).Info("Facebook user created.")
+	ctx.WithField("user", user.Email).WithField("provider", name).Info("User logged in with provider.")
 
-		SetToken(w, r, user)
-	}
+	app.SetToken(w, r, user)
 }
 
-func LoginWithGoogle(w http.ResponseWriter, r *http.Request) {
-	ctx := logger.WithField("method", "LoginWithGoogle")
+// LinkProvider adds the provider's account to the logged in user.
+func (app *App) LinkProvider(tokenData *TokenData, provider string, claims *OIDCClaims) (*User, *Error) {
+	_, errM := app.Users.FindByProvider(provider, claims.Subject)
+	if errM == nil {
+		return nil, &Error{Reason: fmt.Errorf(PROVIDER_LINKED_ERROR, strings.Title(provider)), Code: http.StatusConflict}
+	} else if errM.Code != http.StatusNotFound {
+		return nil, errM
+	}
 
-	accessTokenUrl := "https://accounts.google.com/o/oauth2/token"
-	peopleApiUrl := "https://www.googleapis.com"
-	peopleApiPath := "/plus/v1/people/me/openIdConnect"
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		return nil, errM
+	}
 
-	// Step 1. Exchange authorization code for access token.
-	googleParams := newGoogleParams()
-	googleParams.LoadFromHTTPRequest(r)
+	if user.HasIdentity(provider) {
+		return nil, &Error{Reason: fmt.Errorf(IDENTITY_EXISTS_ERROR, strings.Title(provider)), Code: http.StatusConflict}
+	}
 
-	v, _ := query.Values(googleParams)
+	user.AddIdentity(provider, claims)
+	errM = app.Users.Save(user)
+	if errM != nil {
+		return nil, errM
+	}
 
-	res, body, _ := gorequest.New().Post(accessTokenUrl).
-		Send(v.Encode()).
-		Type("form").
-		End()
+	return user, nil
+}
 
-	if res.StatusCode != 200 {
-		var errorData map[string]interface{}
-		json.Unmarshal([]byte(body), &errorData)
-		ctx.WithField("err", errorData).Error("Failed to authenticate with Google.")
-		ServeJSON(w, r, &Response{
-			"message": errorData["error"].(string),
-		}, 500)
-		return
+// FindOrCreateProviderUser returns the user with the provider's account. A
+// user with the same e-mail address gets the account linked if the provider
+// has verified the address; otherwise a new user is created. An unconfirmed
+// user may have been signed up by someone else, so it loses its password and
+// other logins first.
+func (app *App) FindOrCreateProviderUser(provider string, claims *OIDCClaims) (*User, *Error) {
+	user, errM := app.Users.FindByProvider(provider, claims.Subject)
+	if errM == nil {
+		return user, nil
+	} else if errM.Code != http.StatusNotFound {
+		return nil, errM
 	}
-	// Step 2. Retrieve profile information about the current user.
-	var atData accessTokenData
-	err := json.Unmarshal([]byte(body), &atData)
+
+	// Make sure we have the user's e-mail or error out.
+	address, err := mail.ParseAddress(claims.Email)
 	if err != nil {
-		ISR(w, r, errors.New(fmt.Sprintf("Error reading profile data from Google: %s\n", err)))
-		return
+		return nil, &Error{Reason: errors.New(PROVIDER_EMAIL_ERROR), Code: http.StatusNotAcceptable}
 	}
+	claims.Email = NormalizeEmail(address.Address)
 
-	qs, _ := query.Values(atData)
-
-	u, _ := url.ParseRequestURI(peopleApiUrl)
-	u.Path = peopleApiPath
-	u.RawQuery = qs.Encode()
-	urlStr := fmt.Sprintf("%v", u)
-
-	resProfile, body, _ := gorequest.New().Get(urlStr).End()
-
-	var profileData map[string]interface{}
-	err = json.Unmarshal([]byte(body), &profileData)
-	if resProfile.StatusCode != 200 {
-		ctx.WithField("response", resProfile).
-			Error("Received a non-200 response when requesting profile data from google.")
-		ServeJSON(w, r, &Response{
-			"message": profileData["error"].(map[string]interface{})["message"],
-		}, 500)
-		return
+	user, errM = app.Users.FindByEmail(claims.Email)
+	if errM != nil && errM.Code != http.StatusNotFound {
+		return nil, errM
 	}
 
-	db := GetDB(w, r)
-	if IsTokenSet(r) {
-		// Step 3a. Link user accounts.
-		existingUser, errM := FindUserByProvider(db, "google", profileData["sub"].(string))
-		if existingUser != nil {
-			ServeJSON(w, r, &Response{
-				"message": "There is already a Google account that belongs to you",
-			}, 409)
-			return
-		}
-
-		if errM != nil && errM.Reason != mgo.ErrNotFound {
-			HandleModelError(w, r, errM)
-			return
+	if user != nil {
+		// Anyone can claim an address they do not own with some providers.
+		if !claims.EmailVerified {
+			return nil, &Error{Reason: fmt.Errorf(PROVIDER_UNVERIFIED_ERROR, strings.Title(provider)), Code: http.StatusConflict}
 		}
 
-		tokenData := GetToken(w, r)
-		user, errM := FindUserById(db, bson.ObjectIdHex(tokenData.ID))
-		if user == nil {
-			ServeJSON(w, r, &Response{
-				"message": "User not found",
-			}, 400)
-			return
-		}
-
-		if errM != nil && errM.Reason != mgo.ErrNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		user.Google = profileData["sub"].(string)
-		if user.Picture == "" {
-			user.Picture = strings.Replace(profileData["picture"].(string), "sz=50", "sz=200", -1)
+		if user.Status == UNCONFIRMED.String() {
+			user, errM = app.ClaimUnconfirmedUser(user)
+			if errM != nil {
+				return nil, errM
+			}
 		}
 
-		errM = user.Save(db)
+		user.AddIdentity(provider, claims)
+		errM = app.Users.Save(user)
 		if errM != nil {
-			HandleModelError(w, r, errM)
-			return
+			return nil, errM
 		}
+		return user, nil
+	}
 
-		ctx.WithField("user", user.Email).Info("Google user signed in.")
-
-		SetToken(w, r, user)
-
+	user = NewUser()
+	user.FirstName = claims.GivenName
+	user.LastName = claims.FamilyName
+	user.Email = claims.Email
+	user.Picture = claims.Picture
+	user.Role = USER.String()
+	user.CreatedOn = time.Now()
+	user.AddIdentity(provider, claims)
+	if claims.EmailVerified {
+		user.Status = UNREGISTERED.String()
 	} else {
-		// Step 3b. Create a new user account or return an existing one.
-		existingUser, errM := FindUserByProvider(db, "google", profileData["sub"].(string))
-		if errM != nil && errM.Code != http.StatusNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		if existingUser != nil {
-			ctx.WithField("user", existingUser.Email).Info("User logged in with Google.")
-			SetToken(w, r, existingUser)
-			return
-		}
-
-		// If this user already exists w/ a different provider , just add the google data and save.
-		existingUser, errM = FindUserByEmail(db, profileData["email"].(string))
-		if errM != nil && errM.Code != http.StatusNotFound {
-			HandleModelError(w, r, errM)
-			return
-		}
-
-		if existingUser != nil {
-			existingUser.Google = profileData["sub"].(string)
-
-			if existingUser.Picture == "" {
-				existingUser.Picture = strings.Replace(profileData["picture"].(string), "sz=50", "sz=200", -1)
-			}
+		user.Status = UNCONFIRMED.String()
+	}
 
-			errM := existingUser.Save(db)
-			if errM != nil {
-				HandleModelError(w, r, errM)
-				return
-			}
-			ctx.WithField("user", existingUser.Email).Info("Existing user updated with google profile data.")
+	errM = app.Users.Save(user)
+	if errM != nil {
+		return nil, errM
+	}
 
-			SetToken(w, r, existingUser)
-			return
-		}
+	if !claims.EmailVerified {
+		app.SendVerificationMail(user)
+	}
 
-		// Create user with his google id
-		user := NewUser()
-		user.FirstName = profileData["given_name"].(string)
-		user.LastName = profileData["family_name"].(string)
-		user.Google = profileData["sub"].(string)
-		user.Email = profileData["email"].(string)
-		user.Picture = strings.Replace(profileData["picture"].(string), "sz=50", "sz=200", -1)
-		user.Role = USER.String()
-		user.CreatedOn = time.Now()
-		if b, err := strconv.ParseBool(profileData["email_verified"].(string)); err == nil && b {
-			user.Status = UNREGISTERED.String()
-		} else {
-			user.Status = UNCONFIRMED.String()
-		}
+	return user, nil
+}
 
-		errM = user.Save(db)
-		if errM != nil {
-			HandleModelError(w, r, errM)
-			return
-		}
+func NewClient() *http.Client {
+	return &http.Client{Timeout: 5 * time.Second}
+}
 
-		ctx.WithField("user", user.Email).Info("Google user created")
+// ClaimUnconfirmedUser hands an unconfirmed user to the owner of its address,
+// whom a provider has just verified. Whatever the person who signed up set to
+// log in with is removed and their sessions are logged out.
+func (app *App) ClaimUnconfirmedUser(u *User) (*User, *Error) {
+	errM := app.Users.Update(u.ID, bson.M{"status": UNREGISTERED.String()}, "password", "identities",
+		"totpEnabled", "totpSecret", "totpPendingSecret", "totpLastStep", "backupCodes", "challenge", "challengeExpires")
+	if errM != nil {
+		return nil, errM
+	}
 
-		SetToken(w, r, user)
+	errM = app.RevokeUserSessions(u)
+	if errM != nil {
+		return nil, errM
 	}
-}
 
-func NewClient() *http.Client {
-	return &http.Client{Timeout: 5 * time.Second}
+	return app.Users.FindByID(u.ID)
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// PROVIDERS are the login providers users can sign in with, by name.
+var PROVIDERS = map[string]*OIDCProvider{}
+
+// Unknown signing keys trigger a JWKS refresh at most this often.
+const jwksRefreshInterval = time.Minute
+
+// OIDCProviderConfig describes an OpenID Connect provider. Endpoints are
+// discovered from the issuer unless they are set here.
+type OIDCProviderConfig struct {
+	Name                  string   `json:"name"`
+	Issuer                string   `json:"issuer"`
+	ClientID              string   `json:"clientId"`
+	ClientSecret          string   `json:"clientSecret"`
+	Scopes                []string `json:"scopes,omitempty"`
+	AuthorizationEndpoint string   `json:"authorizationEndpoint,omitempty"`
+	TokenEndpoint         string   `json:"tokenEndpoint,omitempty"`
+	JWKSURI               string   `json:"jwksUri,omitempty"`
+	UserInfoEndpoint      string   `json:"userInfoEndpoint,omitempty"`
+
+	// Some providers only hand out verified e-mail addresses but do not say so.
+	TrustEmail bool `json:"trustEmail,omitempty"`
+}
+
+// OIDCClaims is what a provider tells us about the user.
+type OIDCClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"-"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Picture       string `json:"picture"`
+}
+
+type OIDCProvider struct {
+	OIDCProviderConfig
+
+	client *http.Client
+
+	mu          sync.Mutex
+	discovered  bool
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(config OIDCProviderConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{OIDCProviderConfig: config, client: NewClient()}
+}
+
+// LoadProviders sets up the providers in OIDC_PROVIDERS, a JSON list of
+// provider configs, along with Google and Facebook when their client IDs are set.
+func LoadProviders() error {
+	var configs []OIDCProviderConfig
+
+	if id := os.Getenv("GOOGLE_CLIENT_ID"); id != "" {
+		configs = append(configs, OIDCProviderConfig{Name: "google", Issuer: "https://accounts.google.com",
+			ClientID: id, ClientSecret: config.GOOGLE_SECRET})
+	}
+
+	if id := os.Getenv("FACEBOOK_CLIENT_ID"); id != "" {
+		// Facebook publishes keys but no token endpoint, and only shares
+		// confirmed e-mail addresses.
+		configs = append(configs, OIDCProviderConfig{Name: "facebook", Issuer: "https://www.facebook.com",
+			ClientID: id, ClientSecret: config.FACEBOOK_SECRET,
+			TokenEndpoint: "https://graph.facebook.com/v19.0/oauth/access_token",
+			Scopes:        []string{"openid", "email", "public_profile"}, TrustEmail: true})
+	}
+
+	if s := os.Getenv("OIDC_PROVIDERS"); s != "" {
+		var extra []OIDCProviderConfig
+		err := json.Unmarshal([]byte(s), &extra)
+		if err != nil {
+			return fmt.Errorf("Error reading OIDC_PROVIDERS: %s", err)
+		}
+		configs = append(configs, extra...)
+	}
+
+	for _, c := range configs {
+		if c.Name == "" || c.Issuer == "" || c.ClientID == "" {
+			return fmt.Errorf("Provider %q needs a name, an issuer and a client ID.", c.Name)
+		}
+		PROVIDERS[c.Name] = NewOIDCProvider(c)
+	}
+
+	return nil
+}
+
+// discover fills in the endpoints that were not configured from the
+// issuer's discovery document.
+func (p *OIDCProvider) discover() error {
+	if p.discovered || (p.AuthorizationEndpoint != "" && p.TokenEndpoint != "" && p.JWKSURI != "") {
+		p.discovered = true
+		return nil
+	}
+
+	var metadata struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &metadata)
+	if err != nil {
+		return fmt.Errorf("Error discovering %s: %s", p.Name, err)
+	}
+
+	if metadata.Issuer != p.Issuer {
+		return fmt.Errorf("Provider %s reports issuer %s", p.Name, metadata.Issuer)
+	}
+
+	if p.AuthorizationEndpoint == "" {
+		p.AuthorizationEndpoint = metadata.AuthorizationEndpoint
+	}
+	if p.TokenEndpoint == "" {
+		p.TokenEndpoint = metadata.TokenEndpoint
+	}
+	if p.JWKSURI == "" {
+		p.JWKSURI = metadata.JWKSURI
+	}
+	if p.UserInfoEndpoint == "" {
+		p.UserInfoEndpoint = metadata.UserInfoEndpoint
+	}
+
+	if p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return fmt.Errorf("Provider %s has no token endpoint or keys", p.Name)
+	}
+
+	p.discovered = true
+	return nil
+}
+
+// Endpoints returns the discovered configuration, for clients that start
+// the login.
+func (p *OIDCProvider) Endpoints() (*Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{"name": p.Name, "clientId": p.ClientID, "authorizationEndpoint": p.AuthorizationEndpoint,
+		"scopes": p.Scopes}, nil
+}
+
+// Exchange trades an authorization code for the user's verified claims.
+func (p *OIDCProvider) Exchange(code string, redirectURI string) (*OIDCClaims, error) {
+	p.mu.Lock()
+	err := p.discover()
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	res, err := p.client.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("Error requesting token from %s: %s", p.Name, err)
+	}
+	defer res.Body.Close()
+
+	var tokens struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if res.StatusCode != http.StatusOK || err != nil {
+		return nil, fmt.Errorf("%s refused the authorization code (%d): %s %s", p.Name, res.StatusCode,
+			tokens.Error, tokens.ErrorDescription)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%s did not return an ID token", p.Name)
+	}
+
+	claims, err := p.Verify(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill in what the ID token left out from the user info endpoint.
+	if (claims.Email == "" || claims.GivenName == "") && p.UserInfoEndpoint != "" && tokens.AccessToken != "" {
+		var info map[string]interface{}
+		err = p.getJSON(p.UserInfoEndpoint, tokens.AccessToken, &info)
+		if err == nil && info["sub"] == claims.Subject {
+			claims.fill(info)
+		}
+	}
+
+	if p.TrustEmail && claims.Email != "" {
+		claims.EmailVerified = true
+	}
+
+	return claims, nil
+}
+
+// Verify checks an ID token's signature, issuer, audience and expiry.
+func (p *OIDCProvider) Verify(idToken string) (*OIDCClaims, error) {
+	token, err := jwt.Parse(idToken, func(t *jwt.Token) (interface{}, error) {
+		// Only accept the provider's RSA keys, never a key picked by the token.
+		if alg, _ := t.Header["alg"].(string); alg != "RS256" {
+			return nil, fmt.Errorf("Unexpected signing method: %s", alg)
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.key(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("Invalid ID token from %s: %v", p.Name, err)
+	}
+
+	if iss, _ := token.Claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("ID token from %s has issuer %s", p.Name, iss)
+	}
+
+	if !audienceContains(token.Claims["aud"], p.ClientID) {
+		return nil, fmt.Errorf("ID token from %s is for another client", p.Name)
+	}
+
+	if _, ok := token.Claims["exp"].(float64); !ok {
+		return nil, fmt.Errorf("ID token from %s does not expire", p.Name)
+	}
+
+	claims := &OIDCClaims{}
+	claims.fill(token.Claims)
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token from %s has no subject", p.Name)
+	}
+
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *OIDCClaims) fill(claims map[string]interface{}) {
+	str := func(name string, into *string) {
+		if s, ok := claims[name].(string); ok && *into == "" {
+			*into = s
+		}
+	}
+	str("sub", &c.Subject)
+	str("email", &c.Email)
+	str("given_name", &c.GivenName)
+	str("family_name", &c.FamilyName)
+	str("picture", &c.Picture)
+
+	// Some providers send email_verified as a string.
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		c.EmailVerified = c.EmailVerified || v
+	case string:
+		c.EmailVerified = c.EmailVerified || v == "true"
+	}
+}
+
+// key returns the provider's signing key with the given ID, fetching the
+// key set again if it is not known yet.
+func (p *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.findKey(kid)
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err := p.getJSON(p.JWKSURI, "", &set)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching keys of %s: %s", p.Name, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	key, ok = p.findKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// findKey looks up a key by ID. Tokens without an ID can only use the sole key.
+func (p *OIDCProvider) findKey(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *OIDCProvider) getJSON(url string, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// fakeOIDCServer is a provider that accepts the code "good" and signs ID
+// tokens with the claims in idClaims.
+type fakeOIDCServer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	idClaims map[string]interface{}
+}
+
+func newFakeOIDCServer(t *testing.T) *fakeOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeOIDCServer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.New(jwt.SigningMethodRS256)
+		token.Header["kid"] = "test"
+		token.Claims = f.idClaims
+		signed, err := token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": signed})
+	})
+	f.Server = httptest.NewServer(mux)
+
+	return f
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	server := newFakeOIDCServer(t)
+	defer server.Close()
+
+	provider := NewOIDCProvider(OIDCProviderConfig{Name: "fake", Issuer: server.URL,
+		ClientID: "nhc", ClientSecret: "secret"})
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            server.URL,
+			"aud":            "nhc",
+			"sub":            "1234",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"email":          "jane@example.com",
+			"email_verified": true,
+			"given_name":     "Jane",
+		}
+	}
+
+	server.idClaims = validClaims()
+	claims, err := provider.Exchange("good", "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("expected exchange to succeed got %s", err)
+	}
+	if claims.Subject != "1234" || claims.Email != "jane@example.com" || !claims.EmailVerified || claims.GivenName != "Jane" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err = provider.Exchange("bad", "http://localhost/callback"); err == nil {
+		t.Errorf("expected a refused code to fail")
+	}
+
+	cases := map[string]func(map[string]interface{}){
+		"another audience": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"another issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"expired":          func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":        func(c map[string]interface{}) { delete(c, "exp") },
+		"no subject":       func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, change := range cases {
+		server.idClaims = validClaims()
+		change(server.idClaims)
+		if _, err = provider.Exchange("good", "http://localhost/callback"); err == nil {
+			t.Errorf("%s: expected ID token to be rejected", name)
+		}
+	}
+}
@@ -5,33 +5,24 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Organization struct {
-	ID            bson.ObjectId `bson:"_id" json:"id"`
+	ID            bson.ObjectID `bson:"_id" json:"id"`
 	Name          string        `bson:"name" json:"name"`
 	NeedsApproval bool          `bson:"needsApproval" json:"needsApproval"`
+	TimeZone      string        `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
+	Requesters    []string      `bson:"requesters,omitempty" json:"requesters,omitempty"`
+	RequestedOn   time.Time     `bson:"requestedOn,omitempty" json:"requestedOn,omitempty"`
 }
 
-func OrganizationExists(db *mgo.Database, org string) bool {
-	ctx := logger.WithField("method", "OrganizationExists")
-	c := db.C("organizations")
-	count, _ := c.Find(bson.M{"name": org}).Limit(1).Count()
-	if count > 0 {
-		return true
-	} else {
-		ctx.WithField("org", org).Warn("Organization not found.")
-		return false
-	}
-}
-
-func GetOrganizations(w http.ResponseWriter, r *http.Request) {
-	db := GetDB(w, r)
-	organizations, errM := FindOrganizations(db)
+func (app *App) GetOrganizations(w http.ResponseWriter, r *http.Request) {
+	organizations, errM := app.Organizations.FindAll()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -44,11 +35,7 @@ func GetOrganizations(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func AddOrganization(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, GLOBAL_ADMIN.String()) {
-		return
-	}
-
+func (app *App) AddOrganization(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var org Organization
 	err := decoder.Decode(&org)
@@ -57,8 +44,7 @@ func AddOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	errM := CreateOrg(db, org.Name, false)
+	errM := app.Organizations.Create(org.Name, false)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -67,12 +53,8 @@ func AddOrganization(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "Organization added."}, http.StatusOK)
 }
 
-func EditOrganization(w http.ResponseWriter, r *http.Request) {
+func (app *App) EditOrganization(w http.ResponseWriter, r *http.Request) {
 	// Perform authz check.
-	if !IsAuthorized(w, r, GLOBAL_ADMIN.String()) {
-		return
-	}
-
 	decoder := json.NewDecoder(r.Body)
 	var org Organization
 	err := decoder.Decode(&org)
@@ -81,38 +63,51 @@ func EditOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	errM := UpdateOrganization(db, org)
+	if org.TimeZone != "" {
+		if _, err := time.LoadLocation(org.TimeZone); err != nil {
+			BR(w, r, errors.New(TIMEZONE_ERROR), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, errM := app.Organizations.FindByID(org.ID)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	errM = app.UpdateOrganization(org)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	AuditChange(r, org.ID.Hex(), before, org)
+
 	ServeJSON(w, r, &Response{"status": "Organization updated."}, http.StatusOK)
 }
 
-func DeleteOrganization(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, GLOBAL_ADMIN.String()) {
+func (app *App) DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	orgID := ObjectIDHex(mux.Vars(r)["id"])
+
+	org, errM := app.Organizations.FindByID(orgID)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
-	orgID := bson.ObjectIdHex(mux.Vars(r)["id"])
-
-	db := GetDB(w, r)
-	errM := RemoveOrganization(db, orgID)
+	errM = app.RemoveOrganization(orgID)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	AuditChange(r, orgID.Hex(), org, nil)
+
 	ServeJSON(w, r, &Response{"status": "Organization deleted."}, http.StatusOK)
 }
 
-func MergeOrganizations(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, GLOBAL_ADMIN.String()) {
-		return
-	}
-
+func (app *App) MergeOrganizations(w http.ResponseWriter, r *http.Request) {
 	type MergeData struct {
 		Organizations []Organization `json:"organizations"`
 		NewName       string         `json:"newName"`
@@ -128,117 +123,263 @@ func MergeOrganizations(w http.ResponseWriter, r *http.Request) {
 
 	if len(mergeData.Organizations) < 1 {
 		BR(w, r, errors.New("Merge organizations request missing organizations."), http.StatusBadRequest)
+		return
 	}
 
-	db := GetDB(w, r)
-	errM := MergeOrganizationsInDB(db, mergeData.Organizations, mergeData.NewName)
+	errM := app.MergeOrgs(mergeData.Organizations, mergeData.NewName)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	var merged []string
+	for _, org := range mergeData.Organizations {
+		merged = append(merged, org.Name)
+	}
+	AuditChange(r, mergeData.NewName, Response{"organizations": merged}, Response{"organizations": []string{mergeData.NewName}})
+
 	ServeJSON(w, r, &Response{"status": "Organizations successfully merged."}, http.StatusOK)
 }
 
-func FindOrganizations(db *mgo.Database) (organizations []Organization, errM *Error) {
-	c := db.C("organizations")
-	err := c.Find(nil).All(&organizations)
+func (app *App) RequestOrganization(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var org Organization
+	err := decoder.Decode(&org)
 	if err != nil {
-		errM = &Error{
-			Reason:   errors.New(fmt.Sprintf("Error retrieving organizations from DB: %s", err)),
-			Internal: true}
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if org.Name == "" {
+		BR(w, r, errors.New(MISSING_FIELDS_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if HasProfanity(org.Name) {
+		BR(w, r, errors.New(PROFANITY_ERROR), http.StatusBadRequest)
 		return
 	}
 
-	return
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	errM = app.CreateOrgRequest(org.Name, user.Email)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Your organization has been submitted for approval."}, http.StatusOK)
 }
 
-func CreateOrg(db *mgo.Database, org string, needsApproval bool) *Error {
-	c := db.C("organizations")
-	err := c.Insert(bson.M{"_id": bson.NewObjectId(), "name": org, "needsApproval": needsApproval})
-	if err != nil && !mgo.IsDup(err) {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error creating new org: %s\n", err)), Internal: true}
+func (app *App) GetOrganizationRequests(w http.ResponseWriter, r *http.Request) {
+	organizations, errM := app.Organizations.FindRequests()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
 
-	return nil
+	b, _ := json.Marshal(organizations)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func UpdateOrganization(db *mgo.Database, org Organization) *Error {
-	c := db.C("organizations")
+func (app *App) ApproveOrganization(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
 
-	// Get old Org so we can propagate change to users that signed up already.
-	var oldOrg Organization
-	err := c.FindId(org.ID).One(&oldOrg)
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("The organization you are trying to update does not exist: %s\n", err)), Internal: true}
+	org, errM := app.Organizations.FindRequest(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
 
-	// Update org.
-	_, err = c.UpsertId(org.ID, org)
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error updating org: %s\n", err)), Internal: true}
+	errM = app.Organizations.Approve(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
 
-	// Propagate change to users.
-	uC := db.C("users")
-	_, err = uC.UpdateAll(bson.M{"organization": oldOrg.Name}, bson.M{"$set": bson.M{"organization": org.Name}})
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error updating users with new org: %s\n", err)), Internal: true}
+	app.SendOrganizationRequestMail(org.Requesters, org.Name, "approved", "")
+
+	ServeJSON(w, r, &Response{"status": "Organization approved."}, http.StatusOK)
+}
+
+func (app *App) RejectOrganization(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	org, errM := app.Organizations.FindRequest(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
 	}
 
-	return nil
+	// Users that registered with the rejected organization are left without one.
+	errM = app.RemoveOrganization(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	app.SendOrganizationRequestMail(org.Requesters, org.Name, "rejected", "")
+
+	ServeJSON(w, r, &Response{"status": "Organization rejected."}, http.StatusOK)
 }
 
-func RemoveOrganization(db *mgo.Database, id bson.ObjectId) *Error {
-	c := db.C("organizations")
+func (app *App) MergeOrganizationRequest(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
 
-	// Get old Org so we can propagate change to users that signed up already.
-	var oldOrg Organization
-	err := c.FindId(id).One(&oldOrg)
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("The organization you are trying to delete does not exist: %s\n", err)), Internal: true}
+	type MergeData struct {
+		Organization bson.ObjectID `json:"organization"`
 	}
 
-	// Remove organization.
-	err = c.RemoveId(id)
+	decoder := json.NewDecoder(r.Body)
+	var mergeData MergeData
+	err := decoder.Decode(&mergeData)
 	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error deleting org: %s\n", err)), Internal: true}
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
 	}
 
-	// Propagate change to users.
-	uC := db.C("users")
-	_, err = uC.UpdateAll(bson.M{"organization": oldOrg.Name}, bson.M{"$unset": bson.M{"organization": ""}})
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error updating users with new org: %s\n", err)), Internal: true}
+	org, errM := app.Organizations.FindRequest(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	target, errM := app.Organizations.FindByID(mergeData.Organization)
+	if errM != nil || target.NeedsApproval {
+		BR(w, r, errors.New(ORGANIZATION_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	// The existing organization comes first so it keeps its name and ID.
+	errM = app.MergeOrgs([]Organization{*target, *org}, target.Name)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	app.SendOrganizationRequestMail(org.Requesters, org.Name, "merged", target.Name)
+
+	ServeJSON(w, r, &Response{"status": "Organization merged."}, http.StatusOK)
+}
+
+// CreateOrgRequest proposes a new organization on behalf of a user. Asking
+// for an organization somebody else already proposed adds the user to the
+// list of people told about the outcome.
+func (app *App) CreateOrgRequest(name string, email string) *Error {
+	org, errM := app.Organizations.FindByName(name)
+	if errM != nil && errM.Internal {
+		return errM
+	}
+
+	if org != nil && !org.NeedsApproval {
+		return &Error{Reason: errors.New("That organization already exists, please select it from the available options."),
+			Code: http.StatusConflict}
 	}
 
-	return nil
+	return app.Organizations.Request(name, email)
 }
 
-func MergeOrganizationsInDB(db *mgo.Database, orgs []Organization, name string) *Error {
-	c := db.C("organizations")
+// UpdateOrganization saves an organization. Users refer to it by ID, so a new
+// name needs no changes to them.
+func (app *App) UpdateOrganization(org Organization) *Error {
+	_, errM := app.Organizations.FindByID(org.ID)
+	if errM != nil {
+		return &Error{Reason: errors.New(fmt.Sprintf("The organization you are trying to update does not exist: %s\n", errM.Reason)), Internal: true}
+	}
+
+	return app.Organizations.Save(&org)
+}
 
-	for index, org := range orgs {
-		// Update existing users.
-		uC := db.C("users")
-		_, err := uC.UpdateAll(bson.M{"organization": org.Name}, bson.M{"$set": bson.M{"organization": name}})
-		if err != nil {
-			return &Error{Reason: errors.New(fmt.Sprintf("Error updating users with merged org: %s\n", err)), Internal: true}
+// RemoveOrganization leaves the users of an organization without one, then
+// removes it.
+func (app *App) RemoveOrganization(id bson.ObjectID) *Error {
+	_, errM := app.Organizations.FindByID(id)
+	if errM != nil {
+		return &Error{Reason: errors.New(fmt.Sprintf("The organization you are trying to delete does not exist: %s\n", errM.Reason)), Internal: true}
+	}
+
+	return app.Atomically(func(app *App) *Error {
+		errM := app.Users.MoveOrganization(id, bson.ObjectID{})
+		if errM != nil {
+			return errM
 		}
 
-		if index == 0 {
-			// Update first org.
-			err = c.UpdateId(org.ID, bson.M{"$set": bson.M{"name": name}})
-			if err != nil {
-				return &Error{Reason: errors.New(fmt.Sprintf("Error updating merged org name: %s\n", err)), Internal: true}
+		return app.Organizations.Remove(id)
+	})
+}
+
+// MergeOrgs moves the users of all organizations to the first one, removes
+// the others and renames the first one. Users are moved before their
+// organization is removed, so a merge that fails halfway can be run again.
+// Every organization has to exist and be given once, or the merge could
+// remove the one it merges into.
+func (app *App) MergeOrgs(orgs []Organization, name string) *Error {
+	if strings.TrimSpace(name) == "" {
+		return &Error{Reason: errors.New(MERGE_NAME_ERROR), Code: http.StatusBadRequest}
+	}
+
+	seen := map[bson.ObjectID]bool{}
+	for _, org := range orgs {
+		if seen[org.ID] {
+			return &Error{Reason: errors.New(MERGE_DUPLICATE_ERROR), Code: http.StatusBadRequest}
+		}
+		seen[org.ID] = true
+
+		_, errM := app.Organizations.FindByID(org.ID)
+		if errM != nil {
+			return errM
+		}
+	}
+
+	target := orgs[0].ID
+
+	return app.Atomically(func(app *App) *Error {
+		for _, org := range orgs[1:] {
+			errM := app.Users.MoveOrganization(org.ID, target)
+			if errM != nil {
+				return errM
 			}
-		} else {
-			// Delete remaining orgs.
-			err = c.RemoveId(org.ID)
-			if err != nil {
-				return &Error{Reason: errors.New(fmt.Sprintf("Error deleting org: %s\n", err)), Internal: true}
+
+			errM = app.Organizations.Remove(org.ID)
+			if errM != nil {
+				return errM
 			}
 		}
+
+		// Renaming comes last, since the name may be one of the removed ones.
+		return app.Organizations.Rename(target, name)
+	})
+}
+
+// OrganizationNames maps organization IDs to names, for places that show
+// users' organizations to people.
+type OrganizationNames map[bson.ObjectID]string
+
+// FindOrganizationNames returns the names of approved and requested
+// organizations.
+func (app *App) FindOrganizationNames() (OrganizationNames, *Error) {
+	organizations, errM := app.Organizations.FindAll()
+	if errM != nil {
+		return nil, errM
+	}
+
+	requests, errM := app.Organizations.FindRequests()
+	if errM != nil {
+		return nil, errM
+	}
+
+	names := OrganizationNames{}
+	for _, org := range append(organizations, requests...) {
+		names[org.ID] = org.Name
 	}
-	return nil
+	return names, nil
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Outbox message states. Messages that run out of attempts end up failed,
+// which is the dead-letter state; an admin can put them back in the queue.
+const (
+	OUTBOX_QUEUED  = "queued"
+	OUTBOX_SENDING = "sending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_FAILED  = "failed"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxSendInterval = 250 * time.Millisecond
+	outboxLease        = 5 * time.Minute
+	outboxMaxBackoff   = time.Hour
+)
+
+// OUTBOX is the queue every outgoing e-mail goes through.
+var OUTBOX *Outbox
+
+type OutboxMessage struct {
+	ID          bson.ObjectID `bson:"_id" json:"id"`
+	Campaign    bson.ObjectID `bson:"campaign,omitempty" json:"campaign,omitempty"`
+	Recipient   string        `bson:"recipient" json:"recipient"`
+	Subject     string        `bson:"subject" json:"subject"`
+	Body        string        `bson:"body" json:"-"`
+	Text        string        `bson:"text,omitempty" json:"-"`
+	Status      string        `bson:"status" json:"status"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	NextAttempt time.Time     `bson:"nextAttempt" json:"nextAttempt"`
+	LockedUntil time.Time     `bson:"lockedUntil,omitempty" json:"-"`
+	LastError   string        `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedOn   time.Time     `bson:"createdOn" json:"createdOn"`
+	SentOn      time.Time     `bson:"sentOn,omitempty" json:"sentOn,omitempty"`
+}
+
+// Campaign groups the messages of one bulk e-mail sent by an admin.
+type Campaign struct {
+	ID         bson.ObjectID  `bson:"_id" json:"id"`
+	Subject    string         `bson:"subject" json:"subject"`
+	Sender     string         `bson:"sender" json:"sender"`
+	Recipients int            `bson:"recipients" json:"recipients"`
+	CreatedOn  time.Time      `bson:"createdOn" json:"createdOn"`
+	Progress   map[string]int `bson:"-" json:"progress"`
+}
+
+// Outbox stores outgoing mail in Mongo and delivers it from a pool of
+// background workers, so queued mail survives restarts.
+type Outbox struct {
+	db mongoDB
+}
+
+func NewOutbox(db mongoDB) *Outbox {
+	return &Outbox{db: db}
+}
+
+func (app *App) GetCampaigns(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	db, errM := app.DB()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// Org admins only see their own campaigns.
+	query := bson.M{}
+	if user.Scope(MESSAGES_SEND) != GLOBAL_SCOPE {
+		query["sender"] = user.Email
+	}
+
+	campaigns, errM := FindCampaigns(db, query)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(campaigns)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+func (app *App) RetryCampaign(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	db, errM := app.DB()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	retried, errM := RequeueFailedMessages(db, id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": fmt.Sprintf("%d messages queued again.", retried)}, http.StatusOK)
+}
+
+// Enqueue stores messages so the workers pick them up.
+func (o *Outbox) Enqueue(messages ...OutboxMessage) *Error {
+	return EnqueueMessages(o.db, messages...)
+}
+
+// Start launches the delivery workers.
+func (o *Outbox) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go o.work(i)
+	}
+}
+
+func (o *Outbox) work(worker int) {
+	ctx := logger.WithField("method", "Outbox_work").WithField("worker", worker)
+
+	for {
+		message, err := ClaimMessage(o.db)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				ctx.WithError(err).Error("Failed to claim outgoing mail.")
+			}
+			time.Sleep(outboxPollInterval)
+			continue
+		}
+
+		err = DeliverMail(message.Recipient, message.Subject, message.Body, message.Text)
+		errM := CompleteMessage(o.db, message, err)
+		if errM != nil {
+			ctx.WithError(errM.Reason).WithField("message", message.ID.Hex()).Error("Failed to update outgoing mail.")
+		}
+
+		// Pace the workers so the SMTP server does not throttle us.
+		time.Sleep(outboxSendInterval)
+	}
+}
+
+func EnqueueMessages(db mongoDB, messages ...OutboxMessage) *Error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var documents []interface{}
+	now := time.Now()
+	for _, message := range messages {
+		message.ID = bson.NewObjectID()
+		message.Status = OUTBOX_QUEUED
+		message.NextAttempt = now
+		message.CreatedOn = now
+		documents = append(documents, message)
+	}
+
+	_, err := db.C("outbox").InsertMany(db.ctx, documents, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error queueing mail: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// ClaimMessage takes the next message that is due, including messages whose
+// worker died while sending them, and leases it to the caller.
+func ClaimMessage(db mongoDB) (*OutboxMessage, error) {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{"status": OUTBOX_SENDING, "lockedUntil": now.Add(outboxLease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+
+	var message OutboxMessage
+	err := db.C("outbox").FindOneAndUpdate(db.ctx, bson.M{"$or": []bson.M{
+		{"status": OUTBOX_QUEUED, "nextAttempt": bson.M{"$lte": now}},
+		{"status": OUTBOX_SENDING, "lockedUntil": bson.M{"$lt": now}},
+	}}, update, options.FindOneAndUpdate().SetSort(orderBy("nextAttempt")).SetReturnDocument(options.After)).Decode(&message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// CompleteMessage records the outcome of a delivery attempt. Failed attempts
+// are retried with exponential backoff until maxRetries is reached. Only the
+// lease the message was claimed with is completed: once it runs out, another
+// worker may have claimed the message and owns the outcome.
+func CompleteMessage(db mongoDB, message *OutboxMessage, sendErr error) *Error {
+	ctx := logger.WithField("method", "CompleteMessage")
+
+	var update bson.M
+	if sendErr == nil {
+		update = bson.M{"$set": bson.M{"status": OUTBOX_SENT, "sentOn": time.Now()},
+			"$unset": bson.M{"lockedUntil": "", "lastError": ""}}
+		ctx.WithField("recipient", message.Recipient).WithField("subject", message.Subject).Info("Successfully sent mail.")
+	} else if message.Attempts >= maxRetries {
+		update = bson.M{"$set": bson.M{"status": OUTBOX_FAILED, "lastError": sendErr.Error()},
+			"$unset": bson.M{"lockedUntil": ""}}
+		ctx.WithError(sendErr).WithField("recipient", message.Recipient).Error("Giving up sending mail.")
+	} else {
+		update = bson.M{"$set": bson.M{"status": OUTBOX_QUEUED, "lastError": sendErr.Error(),
+			"nextAttempt": time.Now().Add(OutboxBackoff(message.Attempts))},
+			"$unset": bson.M{"lockedUntil": ""}}
+		ctx.WithError(sendErr).WithField("recipient", message.Recipient).Warn("Error sending mail, will retry.")
+	}
+
+	result, err := db.C("outbox").UpdateOne(db.ctx, bson.M{"_id": message.ID, "status": OUTBOX_SENDING,
+		"lockedUntil": message.LockedUntil}, update)
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error updating outgoing mail: %s\n", err), Internal: true}
+	} else if result.MatchedCount == 0 {
+		return &Error{Reason: errors.New("Lease on outgoing mail ran out before it was completed."), Internal: true}
+	}
+
+	return nil
+}
+
+// OutboxBackoff returns how long to wait before the next attempt: one minute
+// after the first failure, doubling each time up to an hour.
+func OutboxBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// CreateCampaign records a bulk e-mail and queues one message per recipient.
+func CreateCampaign(db mongoDB, sender *User, subject string, body string, recipients []string) (*Campaign, *Error) {
+	campaign := &Campaign{
+		ID:         bson.NewObjectID(),
+		Subject:    subject,
+		Sender:     sender.Email,
+		Recipients: len(recipients),
+		CreatedOn:  time.Now(),
+	}
+
+	_, err := db.C("campaigns").InsertOne(db.ctx, campaign)
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error saving campaign: %s\n", err), Internal: true}
+	}
+
+	var messages []OutboxMessage
+	for _, recipient := range recipients {
+		messages = append(messages, OutboxMessage{Campaign: campaign.ID, Recipient: recipient,
+			Subject: subject, Body: body})
+	}
+
+	errM := EnqueueMessages(db, messages...)
+	if errM != nil {
+		return nil, errM
+	}
+
+	return campaign, nil
+}
+
+// FindCampaigns returns campaigns, newest first, with how many of their
+// messages are in each state.
+func FindCampaigns(db mongoDB, query bson.M) (campaigns []Campaign, errM *Error) {
+	err := db.findAll("campaigns", query, &campaigns, sortBy("-createdOn"))
+	if err != nil {
+		errM = &Error{Reason: fmt.Errorf("Error retrieving campaigns: %s\n", err), Internal: true}
+		return
+	}
+
+	for i := range campaigns {
+		campaigns[i].Progress, errM = CampaignProgress(db, campaigns[i].ID)
+		if errM != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func CampaignProgress(db mongoDB, id bson.ObjectID) (map[string]int, *Error) {
+	var counts []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+
+	cursor, err := db.C("outbox").Aggregate(db.ctx, []bson.M{
+		{"$match": bson.M{"campaign": id}},
+		{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}},
+	})
+	if err == nil {
+		err = cursor.All(db.ctx, &counts)
+	}
+	if err != nil {
+		return nil, &Error{Reason: fmt.Errorf("Error counting campaign messages: %s\n", err), Internal: true}
+	}
+
+	// Messages being sent right now still count as queued.
+	progress := map[string]int{OUTBOX_QUEUED: 0, OUTBOX_SENT: 0, OUTBOX_FAILED: 0}
+	for _, count := range counts {
+		if count.Status == OUTBOX_SENDING {
+			progress[OUTBOX_QUEUED] += count.Count
+		} else {
+			progress[count.Status] += count.Count
+		}
+	}
+
+	return progress, nil
+}
+
+// RequeueFailedMessages gives the failed messages of a campaign a fresh set of attempts.
+func RequeueFailedMessages(db mongoDB, campaign bson.ObjectID) (int, *Error) {
+	result, err := db.C("outbox").UpdateMany(db.ctx, bson.M{"campaign": campaign, "status": OUTBOX_FAILED}, bson.M{
+		"$set":   bson.M{"status": OUTBOX_QUEUED, "attempts": 0, "nextAttempt": time.Now()},
+		"$unset": bson.M{"lastError": ""},
+	})
+	if err != nil {
+		return 0, &Error{Reason: fmt.Errorf("Error retrying campaign: %s\n", err), Internal: true}
+	}
+
+	if result.MatchedCount == 0 {
+		count, _ := db.C("campaigns").CountDocuments(db.ctx, bson.M{"_id": campaign})
+		if count == 0 {
+			return 0, &Error{Reason: errors.New("Campaign not found."), Code: http.StatusNotFound}
+		}
+	}
+
+	return int(result.ModifiedCount), nil
+}
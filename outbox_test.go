@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 20: time.Hour} {
+		if backoff := OutboxBackoff(attempts); backoff != expected {
+			t.Errorf("attempt %d: expected %s got %s", attempts, expected, backoff)
+		}
+	}
+}
+
+func TestOutboxRetriesAndDeadLetters(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	logger = logrus.New()
+
+	campaign, errM := CreateCampaign(db, &User{Email: "admin@example.com"}, "News", "Hello",
+		[]string{"jane@example.com", "john@example.com"})
+	if errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	first, err := ClaimMessage(db)
+	if err != nil || first.Status != OUTBOX_SENDING || first.Attempts != 1 || first.LockedUntil.IsZero() {
+		t.Fatalf("expected message to be leased got %+v: %v", first, err)
+	}
+
+	// A failed attempt waits for its backoff, so the other message is next.
+	if errM := CompleteMessage(db, first, errors.New("connection refused")); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	second, err := ClaimMessage(db)
+	if err != nil || second.ID == first.ID {
+		t.Fatalf("expected the other message to be claimed got %+v: %v", second, err)
+	}
+	if errM := CompleteMessage(db, second, nil); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+	if _, err := ClaimMessage(db); err != mongo.ErrNoDocuments {
+		t.Errorf("expected nothing to be due got %v", err)
+	}
+
+	// The last attempt moves the message to the failed state.
+	db.C("outbox").UpdateOne(db.ctx, bson.M{"_id": first.ID}, bson.M{"$set": bson.M{
+		"attempts": maxRetries - 1, "nextAttempt": time.Now().Add(-time.Second)}})
+	last, err := ClaimMessage(db)
+	if err != nil || last.ID != first.ID {
+		t.Fatalf("expected the retried message to be claimed got %+v: %v", last, err)
+	}
+	if errM := CompleteMessage(db, last, errors.New("connection refused")); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	progress, errM := CampaignProgress(db, campaign.ID)
+	if errM != nil || progress[OUTBOX_SENT] != 1 || progress[OUTBOX_FAILED] != 1 || progress[OUTBOX_QUEUED] != 0 {
+		t.Errorf("expected one sent and one failed message got %v: %v", progress, errM)
+	}
+
+	retried, errM := RequeueFailedMessages(db, campaign.ID)
+	if errM != nil || retried != 1 {
+		t.Fatalf("expected one message to be queued again got %d: %v", retried, errM)
+	}
+	requeued, err := ClaimMessage(db)
+	if err != nil || requeued.ID != first.ID || requeued.Attempts != 1 {
+		t.Errorf("expected the failed message to start over got %+v: %v", requeued, err)
+	}
+
+	if _, errM := RequeueFailedMessages(db, bson.NewObjectID()); errM == nil {
+		t.Errorf("expected unknown campaign to be rejected")
+	}
+}
+
+func TestOutboxLeaseExpires(t *testing.T) {
+	db := testDB(t)
+	defer db.Client().Disconnect(db.ctx)
+	logger = logrus.New()
+
+	EnqueueMessages(db, OutboxMessage{Recipient: "jane@example.com", Subject: "Hello", Body: "Hello"})
+	slow, err := ClaimMessage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker that outlives its lease loses the message to another one.
+	db.C("outbox").UpdateOne(db.ctx, bson.M{"_id": slow.ID}, bson.M{"$set": bson.M{"lockedUntil": time.Now().Add(-time.Second)}})
+	fast, err := ClaimMessage(db)
+	if err != nil || fast.ID != slow.ID || fast.Attempts != 2 {
+		t.Fatalf("expected expired lease to be claimed again got %+v: %v", fast, err)
+	}
+
+	if errM := CompleteMessage(db, slow, nil); errM == nil {
+		t.Errorf("expected the expired lease not to complete the message")
+	}
+	if errM := CompleteMessage(db, fast, errors.New("connection refused")); errM != nil {
+		t.Fatal(errM.Reason)
+	}
+
+	var stored OutboxMessage
+	db.C("outbox").FindOne(db.ctx, bson.M{"_id": fast.ID}).Decode(&stored)
+	if stored.Status != OUTBOX_QUEUED || stored.LastError == "" {
+		t.Errorf("expected the current lease's outcome to be kept got %+v", stored)
+	}
+}
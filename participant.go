@@ -5,10 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/gorilla/mux"
 )
 
 type Participant struct {
@@ -23,12 +23,21 @@ type Participant struct {
 	Points           int     `bson:"points" json:"points"`
 }
 
-func GetParticipants(w http.ResponseWriter, r *http.Request) {
+type ParticipantValidation struct {
+	FirstName  []string `json:"firstName,omitempty"`
+	LastName   []string `json:"lastName,omitempty"`
+	AgeRange   []string `json:"ageRange,omitempty"`
+	Category   []string `json:"category,omitempty"`
+	Commitment []string `json:"commitment,omitempty"`
+}
+
+const maxParticipantAge = 120
+
+func (app *App) GetParticipants(w http.ResponseWriter, r *http.Request) {
 	if IsTokenSet(r) {
 		tokenData := GetToken(w, r)
-		db := GetDB(w, r)
 
-		user, errM := GetUserFromToken(db, tokenData)
+		user, errM := app.GetUserFromToken(tokenData)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
@@ -45,24 +54,155 @@ func GetParticipants(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func GetParticipantsAdmin(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "admin") {
+func (app *App) AddParticipant(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var participant Participant
+	err := decoder.Decode(&participant)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.Status != REGISTERED.String() {
+		BR(w, r, errors.New("You must register before adding participants."), http.StatusForbidden)
+		return
+	}
+
+	if !app.ServeParticipantValidation(w, r, &participant) {
+		return
+	}
+
+	errM = app.CreateParticipant(user, &participant)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
+	b, _ := json.Marshal(participant)
+	parse := &Response{}
+	json.Unmarshal(b, parse)
+	ServeJSON(w, r, parse, http.StatusOK)
+}
+
+func (app *App) EditParticipant(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	decoder := json.NewDecoder(r.Body)
+	var participant Participant
+	err := decoder.Decode(&participant)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	participants, errM := FindParticipants(db, user)
+	if user.FindParticipant(participant.ID) == nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	if !app.ServeParticipantValidation(w, r, &participant) {
+		return
+	}
+
+	errM = app.Users.UpdateParticipant(user.ID, &participant)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Participant updated."}, http.StatusOK)
+}
+
+func (app *App) DeleteParticipant(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.FindParticipant(id) == nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	if len(user.Participants) == 1 {
+		BR(w, r, errors.New("You need at least one participant to stay registered."), http.StatusBadRequest)
+		return
+	}
+
+	errM = app.Users.RemoveParticipant(user.ID, id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Participant deleted."}, http.StatusOK)
+}
+
+// ServeParticipantValidation validates a participant and, if it is invalid,
+// serves the validation errors. It reports whether the participant is valid.
+func (app *App) ServeParticipantValidation(w http.ResponseWriter, r *http.Request, p *Participant) bool {
+	validation, errM := app.ValidateParticipant(p)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return false
+	}
+
+	if !validation.IsValid() {
+		b, _ := json.Marshal(validation)
+		parse := &Response{}
+		json.Unmarshal(b, parse)
+		ServeJSON(w, r, parse, http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (app *App) GetParticipantsAdmin(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	participants, errM := app.FindParticipants(user)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -72,15 +212,20 @@ func GetParticipantsAdmin(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func UpdateScorecard(w http.ResponseWriter, r *http.Request) {
+func (app *App) UpdateScorecard(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
+	if !GLOBALS.ScorecardEnabled {
+		BR(w, r, errors.New(SCORECARD_DISABLED_ERROR), http.StatusForbidden)
+		return
+	}
+
 	type ScorecardData struct {
-		ID        int     `bson:"id", json:"id"`
-		Scorecard [][]int `bson:"scorecard", json:"scorecard"`
+		ID        int     `bson:"id" json:"id"`
+		Scorecard [][]int `bson:"scorecard" json:"scorecard"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -91,32 +236,50 @@ func UpdateScorecard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	// Validate scorecard and update points.
-	currentDay := time.Now().YearDay() - GLOBALS.ChallengeStart.YearDay()
+	participant := user.FindParticipant(scorecardData.ID)
+	if participant == nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	if !ScorecardFits(scorecardData.Scorecard) {
+		BR(w, r, errors.New(SCORECARD_SHAPE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	// Validate scorecard and update points. Future days and days after the
+	// challenge are cleared and locked days keep whatever they were before.
+	today, _ := GLOBALS.DayIndex(CalendarDate(time.Now().In(app.UserLocation(user))))
 	points := 0
 	for i, week := range scorecardData.Scorecard {
 		for j, day := range week {
-			if i*7+j > currentDay {
-				scorecardData.Scorecard[i][j], day = 0, 0
+			index := i*7 + j
+			if index > today || index >= GLOBALS.ChallengeLength {
+				day = 0
+			} else if GLOBALS.DayIsLocked(index, today) {
+				day = 0
+				if i < len(participant.Scorecard) && j < len(participant.Scorecard[i]) {
+					day = participant.Scorecard[i][j]
+				}
 			} else if day > 0 {
-				scorecardData.Scorecard[i][j], day = 1, 1
+				day = 1
 			} else {
-				scorecardData.Scorecard[i][j], day = 0, 0
+				day = 0
 			}
+			scorecardData.Scorecard[i][j] = day
 			points += day
 		}
 	}
-	user.Participants[scorecardData.ID].Points = points
+	participant.Points = points
 
-	user.Participants[scorecardData.ID].Scorecard = scorecardData.Scorecard
-	errM = user.Save(db)
+	participant.Scorecard = scorecardData.Scorecard
+	errM = app.Users.Save(user)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -125,6 +288,95 @@ func UpdateScorecard(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "Scorecard updated successfully."}, http.StatusOK)
 }
 
+// CheckIn marks or unmarks a single day on a participant's scorecard. The
+// date is judged in the user's time zone and only today and past days that
+// are not locked yet can be changed.
+func (app *App) CheckIn(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	if !GLOBALS.ScorecardEnabled {
+		BR(w, r, errors.New(SCORECARD_DISABLED_ERROR), http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	type CheckinData struct {
+		Date string `json:"date"`
+		Done bool   `json:"done"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var checkinData CheckinData
+	err = decoder.Decode(&checkinData)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", checkinData.Date)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.FindParticipant(id) == nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	day, ok := GLOBALS.DayIndex(date)
+	if !ok {
+		BR(w, r, errors.New(CHECKIN_DATE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	today, _ := GLOBALS.DayIndex(CalendarDate(time.Now().In(app.UserLocation(user))))
+	if day > today {
+		BR(w, r, errors.New(CHECKIN_FUTURE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if GLOBALS.DayIsLocked(day, today) {
+		BR(w, r, errors.New(CHECKIN_LOCKED_ERROR), http.StatusForbidden)
+		return
+	}
+
+	errM = app.Users.SetScorecardDay(user.ID, id, day, checkinData.Done)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	user, errM = app.Users.FindByID(user.ID)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// The participant may have been removed in the meantime.
+	participant := user.FindParticipant(id)
+	if participant == nil {
+		BR(w, r, errors.New(PARTICIPANT_NOT_FOUND_ERROR), http.StatusNotFound)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Check-in saved.", "points": participant.Points}, http.StatusOK)
+}
+
 func GenerateScorecard() (scorecard [][]int) {
 	length := GLOBALS.ChallengeLength
 
@@ -139,21 +391,35 @@ func GenerateScorecard() (scorecard [][]int) {
 	return
 }
 
-func FindParticipants(db *mgo.Database, u *User) (participants []Participant, errM *Error) {
-	c := db.C("users")
+// ScorecardFits reports whether a scorecard has the weeks and days of the
+// ones GenerateScorecard makes, so every cell is a day of the challenge. The
+// empty last week of a challenge of whole weeks may be left out.
+func ScorecardFits(scorecard [][]int) bool {
+	expected := GenerateScorecard()
+	if n := len(expected); len(scorecard) == n-1 && len(expected[n-1]) == 0 {
+		expected = expected[:n-1]
+	}
 
-	var users []User
-	query := bson.M{"status": "registered"}
+	if len(scorecard) != len(expected) {
+		return false
+	}
+	for i := range expected {
+		if len(scorecard[i]) != len(expected[i]) {
+			return false
+		}
+	}
+	return true
+}
 
-	// Org admins only see their own participants.
-	if !(u.Role == GLOBAL_ADMIN.String() || u.Role == GLOBAL_SUPER_ADMIN.String()) {
-		query["organization"] = u.Organization
+func (app *App) FindParticipants(u *User) (participants []Participant, errM *Error) {
+	filter, ok := ParticipantsQuery(u)
+	if !ok {
+		return
 	}
 
 	// Get all the users.
-	err := c.Find(query).All(&users)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving registered users: %s\n", err)), Internal: true}
+	users, errM := app.Users.Find(filter)
+	if errM != nil {
 		return
 	}
 
@@ -164,3 +430,120 @@ func FindParticipants(db *mgo.Database, u *User) (participants []Participant, er
 
 	return
 }
+
+// ParticipantsQuery selects the registered users whose participants u may
+// see. Org admins only see their own participants.
+func ParticipantsQuery(u *User) (UserFilter, bool) {
+	filter := UserFilter{Statuses: []string{REGISTERED.String()}}
+
+	switch u.Scope(PARTICIPANTS_VIEW) {
+	case GLOBAL_SCOPE:
+		return filter, true
+	case ORG_SCOPE:
+		if u.Organization.IsZero() {
+			return filter, false
+		}
+		filter.Organization = u.Organization
+		return filter, true
+	}
+	return filter, false
+}
+
+// UserLocation returns the time zone a user's check-ins are judged in.
+func (app *App) UserLocation(u *User) *time.Location {
+	var orgZone string
+	if !u.Organization.IsZero() {
+		if org, errM := app.Organizations.FindByID(u.Organization); errM == nil {
+			orgZone = org.TimeZone
+		}
+	}
+
+	return GLOBALS.Location(u.TimeZone, orgZone)
+}
+
+// ValidateParticipant checks a participant the same way registration does.
+func (app *App) ValidateParticipant(p *Participant) (validation ParticipantValidation, errM *Error) {
+	if p.FirstName == "" {
+		validation.FirstName = append(validation.FirstName, REQUIRED_ERROR)
+	} else if HasProfanity(p.FirstName) {
+		validation.FirstName = append(validation.FirstName, PROFANITY_ERROR)
+	}
+
+	if HasProfanity(p.LastName) {
+		validation.LastName = append(validation.LastName, PROFANITY_ERROR)
+	}
+
+	if p.AgeRange[0] < 0 || p.AgeRange[1] < p.AgeRange[0] || p.AgeRange[1] > maxParticipantAge {
+		validation.AgeRange = append(validation.AgeRange, BAD_CHOICE_ERROR)
+	}
+
+	if p.Category == "" {
+		validation.Category = append(validation.Category, REQUIRED_ERROR)
+		return
+	}
+
+	commitment, errM := app.Commitments.FindByName(p.Category)
+	if errM != nil {
+		if errM.Internal {
+			return
+		}
+		errM = nil
+		validation.Category = append(validation.Category, BAD_CHOICE_ERROR)
+		return
+	}
+
+	// Custom commitments are free text, everything else has to be picked from the category.
+	if p.Commitment == "" {
+		validation.Commitment = append(validation.Commitment, REQUIRED_ERROR)
+	} else if p.CustomCommitment {
+		if HasProfanity(p.Commitment) {
+			validation.Commitment = append(validation.Commitment, PROFANITY_ERROR)
+		}
+	} else if !Contains(commitment.Commitments, p.Commitment) {
+		validation.Commitment = append(validation.Commitment, BAD_CHOICE_ERROR)
+	}
+
+	return
+}
+
+func (v *ParticipantValidation) IsValid() bool {
+	return len(v.FirstName) == 0 && len(v.LastName) == 0 && len(v.AgeRange) == 0 &&
+		len(v.Category) == 0 && len(v.Commitment) == 0
+}
+
+// CreateParticipant adds a participant with a fresh scorecard to a user. The
+// participant gets the user's next participant ID, or the next ID after the
+// existing participants for users from before there was one. The push only
+// succeeds if no other request claimed that ID in the meantime.
+func (app *App) CreateParticipant(u *User, p *Participant) *Error {
+	p.Points = 0
+	p.Scorecard = GenerateScorecard()
+
+	for retry := 0; retry < maxRetries; retry++ {
+		p.ID = u.NextParticipantID
+		for _, existing := range u.Participants {
+			if existing.ID >= p.ID {
+				p.ID = existing.ID + 1
+			}
+		}
+
+		added, errM := app.Users.AddParticipant(u.ID, p)
+		if errM != nil {
+			return errM
+		} else if added {
+			u.Participants = append(u.Participants, *p)
+			u.NextParticipantID = p.ID + 1
+			return nil
+		}
+
+		// Someone else added a participant first, so reload and try the next ID.
+		fresh, errM := app.Users.FindByID(u.ID)
+		if errM != nil {
+			return errM
+		}
+		u.Participants = fresh.Participants
+		u.NextParticipantID = fresh.NextParticipantID
+	}
+
+	return &Error{Reason: errors.New("Error adding participant: too many concurrent changes."), Internal: true}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Permission names something a role is allowed to do. Permissions that apply
+// to users of one organization or to everyone come in two scoped variants,
+// see Org and All.
+type Permission string
+
+const (
+	NEWS_WRITE            Permission = "news:write"
+	FAQ_WRITE             Permission = "faq:write"
+	QUESTIONS_WRITE       Permission = "questions:write"
+	GLOBALS_WRITE         Permission = "globals:write"
+	SEASONS_WRITE         Permission = "seasons:write"
+	ORGANIZATIONS_WRITE   Permission = "organizations:write"
+	EMAIL_TEMPLATES_WRITE Permission = "email-templates:write"
+	AUDIT_READ            Permission = "audit:read"
+	MESSAGES_RETRY        Permission = "messages:retry"
+	USERS_EDIT_ROLES      Permission = "users:edit:roles"
+	DATA_IMPORT           Permission = "data:import"
+
+	// Scoped permissions.
+	USERS_VIEW        Permission = "users:view"
+	USERS_EDIT        Permission = "users:edit"
+	PARTICIPANTS_VIEW Permission = "participants:view"
+	MESSAGES_SEND     Permission = "messages:send"
+)
+
+// Org is the variant of a scoped permission limited to the user's own organization.
+func (p Permission) Org() Permission {
+	return p + ":org"
+}
+
+// All is the variant of a scoped permission that covers every user.
+func (p Permission) All() Permission {
+	return p + ":all"
+}
+
+// The permissions each role adds to those of the roles below it.
+var rolePermissions = map[Role][]Permission{
+	USER: nil,
+	ORG_ADMIN: {
+		USERS_VIEW.Org(),
+		USERS_EDIT.Org(),
+		PARTICIPANTS_VIEW.Org(),
+		MESSAGES_SEND.Org(),
+	},
+	ORG_SUPER_ADMIN: nil,
+	GLOBAL_ADMIN: {
+		NEWS_WRITE,
+		FAQ_WRITE,
+		QUESTIONS_WRITE,
+		GLOBALS_WRITE,
+		SEASONS_WRITE,
+		ORGANIZATIONS_WRITE,
+		EMAIL_TEMPLATES_WRITE,
+		AUDIT_READ,
+		MESSAGES_RETRY,
+		USERS_EDIT_ROLES,
+		DATA_IMPORT,
+		USERS_VIEW.All(),
+		USERS_EDIT.All(),
+		PARTICIPANTS_VIEW.All(),
+		MESSAGES_SEND.All(),
+	},
+	GLOBAL_SUPER_ADMIN: nil,
+}
+
+// Scope says which users a permission reaches.
+type Scope int
+
+const (
+	NO_SCOPE Scope = iota
+	ORG_SCOPE
+	GLOBAL_SCOPE
+)
+
+// ParseRole maps a stored role name back to its Role.
+func ParseRole(s string) (Role, bool) {
+	for i, name := range roles {
+		if name == s {
+			return Role(i), true
+		}
+	}
+	return USER, false
+}
+
+// Has reports whether the role, or a role below it, was granted p exactly.
+func (role Role) Has(p Permission) bool {
+	for r := USER; r <= role; r++ {
+		for _, granted := range rolePermissions[r] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Scope returns how far p reaches for the role. Unscoped permissions are
+// either global or not granted.
+func (role Role) Scope(p Permission) Scope {
+	if role.Has(p) || role.Has(p.All()) {
+		return GLOBAL_SCOPE
+	}
+	if role.Has(p.Org()) {
+		return ORG_SCOPE
+	}
+	return NO_SCOPE
+}
+
+// Scope returns how far p reaches for the user. Unknown roles have no permissions.
+func (u *User) Scope(p Permission) Scope {
+	role, ok := ParseRole(u.Role)
+	if !ok {
+		return NO_SCOPE
+	}
+	return role.Scope(p)
+}
+
+func (u *User) Can(p Permission) bool {
+	return u.Scope(p) != NO_SCOPE
+}
+
+// CanAccess reports whether the user may use p on a user of the given organization.
+func (u *User) CanAccess(p Permission, organization bson.ObjectID) bool {
+	switch u.Scope(p) {
+	case GLOBAL_SCOPE:
+		return true
+	case ORG_SCOPE:
+		return !u.Organization.IsZero() && u.Organization == organization
+	default:
+		return false
+	}
+}
+
+// Outranks reports whether the user's role is above the other user's role.
+func (u *User) Outranks(other *User) bool {
+	mine, _ := ParseRole(u.Role)
+	theirs, _ := ParseRole(other.Role)
+	return mine > theirs
+}
+
+// Guard is a handler that only runs for users with a permission, in any scope.
+type Guard struct {
+	app        *App
+	Permission Permission
+	Handler    AppHandlerFunc
+}
+
+func (app *App) Require(p Permission, h AppHandlerFunc) *Guard {
+	return &Guard{app: app, Permission: p, Handler: h}
+}
+
+func (g *Guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app := g.app.WithContext(r.Context())
+	if !app.IsAuthorized(w, r, g.Permission) {
+		return
+	}
+	g.Handler(app, w, r)
+}
+
+func (app *App) IsAuthorized(w http.ResponseWriter, r *http.Request, p Permission) bool {
+	if !IsTokenSet(r) {
+		BR(w, r, errors.New(MISSING_TOKEN_ERROR), http.StatusUnauthorized)
+		return false
+	}
+
+	user, errM := app.GetUserFromToken(GetToken(w, r))
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return false
+	}
+
+	if !user.Can(p) {
+		BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
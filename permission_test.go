@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Every admin route, the permission it requires and the lowest role that has it.
+var adminRoutes = []struct {
+	method     string
+	path       string
+	permission Permission
+	minRole    Role
+}{
+	{"POST", "/api/globals", GLOBALS_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/seasons", SEASONS_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/seasons", SEASONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/seasons/{id}", SEASONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/seasons/{id}/current", SEASONS_WRITE, GLOBAL_ADMIN},
+	{"GET", "/api/admin/seasons/{id}/registrations", SEASONS_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/organizations/requests", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/organizations/requests/{id}/approve", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/organizations/requests/{id}/reject", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/organizations/requests/{id}/merge", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/organizations", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/organizations", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"DELETE", "/api/admin/organizations/{id}", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/organizations/merge", ORGANIZATIONS_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/user", USERS_VIEW, ORG_ADMIN},
+	{"PUT", "/api/admin/user", USERS_EDIT, ORG_ADMIN},
+	{"GET", "/api/admin/export/users", USERS_VIEW, ORG_ADMIN},
+	{"GET", "/api/admin/export/participants", PARTICIPANTS_VIEW, ORG_ADMIN},
+	{"POST", "/api/admin/import/{kind}", DATA_IMPORT, GLOBAL_ADMIN},
+
+	{"POST", "/api/admin/message", MESSAGES_SEND, ORG_ADMIN},
+	{"GET", "/api/admin/message", MESSAGES_SEND, ORG_ADMIN},
+	{"PUT", "/api/admin/message/{id}/retry", MESSAGES_RETRY, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/audit", AUDIT_READ, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/email-templates", EMAIL_TEMPLATES_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/email-templates", EMAIL_TEMPLATES_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/email-templates/{name}", EMAIL_TEMPLATES_WRITE, GLOBAL_ADMIN},
+	{"DELETE", "/api/admin/email-templates/{name}", EMAIL_TEMPLATES_WRITE, GLOBAL_ADMIN},
+	{"GET", "/api/admin/email-templates/{name}/preview", EMAIL_TEMPLATES_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/news", NEWS_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/news", NEWS_WRITE, GLOBAL_ADMIN},
+	{"DELETE", "/api/admin/news/{id}", NEWS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/news/{id}/publish", NEWS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/news/{id}/unpublish", NEWS_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/bonus-question", QUESTIONS_WRITE, GLOBAL_ADMIN},
+	{"POST", "/api/admin/bonus-question", QUESTIONS_WRITE, GLOBAL_ADMIN},
+	{"DELETE", "/api/admin/bonus-question/{id}", QUESTIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/bonus-question/{id}/enable", QUESTIONS_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/bonus-question/disable", QUESTIONS_WRITE, GLOBAL_ADMIN},
+
+	{"GET", "/api/admin/participant", PARTICIPANTS_VIEW, ORG_ADMIN},
+
+	{"POST", "/api/admin/faq", FAQ_WRITE, GLOBAL_ADMIN},
+	{"PUT", "/api/admin/faq", FAQ_WRITE, GLOBAL_ADMIN},
+	{"DELETE", "/api/admin/faq/{id}", FAQ_WRITE, GLOBAL_ADMIN},
+}
+
+func samplePath(path string) string {
+	path = strings.Replace(path, "{id}", "58a1e5f2c2a4f1b2c3d4e5f6", -1)
+	return strings.Replace(path, "{name}", VERIFICATION_TEMPLATE, -1)
+}
+
+func TestAdminRoutesAreGuarded(t *testing.T) {
+	logger = logrus.New()
+	router := NewRouter(NewMemoryApp())
+
+	// Every guarded route, and every admin route, has to be in the table.
+	var guarded int
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+
+		_, isGuard := route.GetHandler().(*Guard)
+		if isGuard {
+			guarded++
+		} else if strings.HasPrefix(path, "/api/admin") {
+			t.Errorf("admin route %s has no permission guard", path)
+		}
+		return nil
+	})
+
+	if guarded != len(adminRoutes) {
+		t.Errorf("expected %d guarded routes got %d, update adminRoutes", len(adminRoutes), guarded)
+	}
+
+	for _, tc := range adminRoutes {
+		req, _ := http.NewRequest(tc.method, samplePath(tc.path), nil)
+
+		var match mux.RouteMatch
+		if !router.Match(req, &match) {
+			t.Errorf("%s %s: no route", tc.method, tc.path)
+			continue
+		}
+
+		guard, ok := match.Handler.(*Guard)
+		if !ok {
+			t.Errorf("%s %s: route has no permission guard", tc.method, tc.path)
+			continue
+		}
+
+		if guard.Permission != tc.permission {
+			t.Errorf("%s %s: expected permission %s got %s", tc.method, tc.path, tc.permission, guard.Permission)
+		}
+
+		for role := USER; role <= GLOBAL_SUPER_ADMIN; role++ {
+			allowed := role.Scope(tc.permission) != NO_SCOPE
+			if allowed != (role >= tc.minRole) {
+				t.Errorf("%s %s: expected %s allowed to be %t", tc.method, tc.path, role, role >= tc.minRole)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected status 401 without a token got %d", tc.method, tc.path, w.Code)
+		}
+	}
+}
+
+func TestPermissionScopes(t *testing.T) {
+	gym, otherGym := bson.NewObjectID(), bson.NewObjectID()
+	orgAdmin := &User{Role: ORG_ADMIN.String(), Organization: gym}
+	globalAdmin := &User{Role: GLOBAL_ADMIN.String()}
+
+	cases := []struct {
+		user         *User
+		permission   Permission
+		organization bson.ObjectID
+		allowed      bool
+	}{
+		{orgAdmin, USERS_EDIT, gym, true},
+		{orgAdmin, USERS_EDIT, otherGym, false},
+		{orgAdmin, USERS_EDIT, bson.ObjectID{}, false},
+		{orgAdmin, USERS_EDIT_ROLES, gym, false},
+		{globalAdmin, USERS_EDIT, otherGym, true},
+		{&User{Role: USER.String(), Organization: gym}, USERS_EDIT, gym, false},
+		{&User{Role: "admin"}, USERS_VIEW, bson.ObjectID{}, false},
+	}
+
+	for _, tc := range cases {
+		if got := tc.user.CanAccess(tc.permission, tc.organization); got != tc.allowed {
+			t.Errorf("%s %s on %s: expected %t got %t", tc.user.Role, tc.permission, tc.organization, tc.allowed, got)
+		}
+	}
+
+	if !(&User{Role: GLOBAL_SUPER_ADMIN.String()}).Outranks(globalAdmin) || globalAdmin.Outranks(globalAdmin) {
+		t.Errorf("expected roles to be ordered")
+	}
+}
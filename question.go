@@ -3,36 +3,34 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Question struct {
-	ID            bson.ObjectId `bson:"_id" json:"id"`
+	ID            bson.ObjectID `bson:"_id" json:"id"`
 	Text          string        `bson:"text" json:"text"`
 	Answers       []string      `bson:"answers" json:"answers"`
 	CorrectAnswer string        `bson:"correctAnswer" json:"correctAnswer,omitempty"`
 	Enabled       bool          `bson:"enabled" json:"enabled,omitempty"`
 	Respondents   []Respondent  `bson:"respondents" json:"respondents,omitempyty"`
+	Season        bson.ObjectID `bson:"season,omitempty" json:"season,omitempty"`
 }
 
 type Respondent struct {
-	User              string `bson:"user", json:"user"`
+	User              string `bson:"user" json:"user"`
 	AnsweredCorrectly bool   `bson:"answeredCorrectly,omitempty" json:"answeredCorrectly,omitempty"`
 }
 
-func FetchQuestion(w http.ResponseWriter, r *http.Request) {
+func (app *App) FetchQuestion(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -48,7 +46,7 @@ func FetchQuestion(w http.ResponseWriter, r *http.Request) {
 
 	userQuestion := &UserQuestion{}
 
-	question, errM := FindEnabledQuestion(db)
+	question, errM := app.Questions.FindEnabled(SEASON.ID)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -69,14 +67,13 @@ func FetchQuestion(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func AnswerQuestion(w http.ResponseWriter, r *http.Request) {
+func (app *App) AnswerQuestion(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -94,7 +91,7 @@ func AnswerQuestion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	question, errM := FindEnabledQuestion(db)
+	question, errM := app.Questions.FindEnabled(SEASON.ID)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -114,7 +111,7 @@ func AnswerQuestion(w http.ResponseWriter, r *http.Request) {
 
 	question.Respondents = append(question.Respondents, Respondent{User: user.Email,
 		AnsweredCorrectly: answeredCorrectly})
-	errM = question.Save(db)
+	errM = app.Questions.Save(question)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -130,13 +127,14 @@ func AnswerQuestion(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": response}, http.StatusOK)
 }
 
-func GetQuestions(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
+func (app *App) GetQuestions(w http.ResponseWriter, r *http.Request) {
+	// Questions of past seasons can be requested with ?season=<id>.
+	season := SEASON.ID
+	if s := r.Form.Get("season"); s != "" {
+		season = ObjectIDHex(s)
 	}
 
-	db := GetDB(w, r)
-	questions, errM := FindAllQuestions(db)
+	questions, errM := app.Questions.FindBySeason(season)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -146,11 +144,7 @@ func GetQuestions(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func CreateQuestion(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
+func (app *App) CreateQuestion(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var question Question
 	err := decoder.Decode(&question)
@@ -178,9 +172,9 @@ func CreateQuestion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save question
-	db := GetDB(w, r)
-	question.ID = bson.NewObjectId()
-	errM := question.Save(db)
+	question.ID = bson.NewObjectID()
+	question.Season = SEASON.ID
+	errM := app.Questions.Save(&question)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -189,38 +183,36 @@ func CreateQuestion(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "Question successfully created."}, http.StatusOK)
 }
 
-func DeleteQuestion(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
+func (app *App) DeleteQuestion(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	question, errM := app.Questions.FindByID(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
 		return
 	}
 
-	id := bson.ObjectIdHex(mux.Vars(r)["id"])
-
-	db := GetDB(w, r)
-	errM := RemoveQuestion(db, id)
+	errM = app.Questions.Remove(id)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	AuditChange(r, id.Hex(), question, nil)
+
 	ServeJSON(w, r, &Response{"status": "Question deleted."}, http.StatusOK)
 }
 
-func EnableQuestion(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
-	id := bson.ObjectIdHex(mux.Vars(r)["id"])
+func (app *App) EnableQuestion(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
 
-	db := GetDB(w, r)
-	errM := DisableAllQuestions(db)
+	errM := app.DisableAllQuestions()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	errM = UpdateEnabledQuestion(db, id)
+	errM = app.Questions.Enable(id)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -229,13 +221,8 @@ func EnableQuestion(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "Question enabled."}, http.StatusOK)
 }
 
-func DisableQuestion(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "global_admin") {
-		return
-	}
-
-	db := GetDB(w, r)
-	errM := DisableAllQuestions(db)
+func (app *App) DisableQuestion(w http.ResponseWriter, r *http.Request) {
+	errM := app.DisableAllQuestions()
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -244,17 +231,6 @@ func DisableQuestion(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "Question disabled."}, http.StatusOK)
 }
 
-func (q *Question) Save(db *mgo.Database) *Error {
-	c := db.C("questions")
-	_, err := c.UpsertId(q.ID, bson.M{"$set": q})
-	if err != nil {
-		return &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Error saving question: %s\n",
-			err))}
-	}
-
-	return nil
-}
-
 func (q *Question) AnsweredBy(u *User) bool {
 	for _, respondent := range q.Respondents {
 		if u.Email == respondent.User {
@@ -264,52 +240,15 @@ func (q *Question) AnsweredBy(u *User) bool {
 	return false
 }
 
-func FindEnabledQuestion(db *mgo.Database) (q *Question, errM *Error) {
-	c := db.C("questions")
-	err := c.Find(bson.M{"enabled": true}).One(&q)
-	if err == mgo.ErrNotFound {
-		return nil, nil
-	} else if err != nil {
-		errM = &Error{Reason: fmt.Errorf("Error retrieving enabled question: %s\n", err)}
-		return
-	}
-
-	return
-}
-
-func FindAllQuestions(db *mgo.Database) (q []Question, errM *Error) {
-	c := db.C("questions")
-	err := c.Find(nil).All(&q)
-	if err == mgo.ErrNotFound {
-		return []Question{}, nil
-	} else if err != nil {
-		errM = &Error{Reason: fmt.Errorf("Error retrieving questions: %s\n", err)}
-		return
-	}
-
-	return
-}
-
-func RemoveQuestion(db *mgo.Database, id bson.ObjectId) (errM *Error) {
-	c := db.C("questions")
-	err := c.RemoveId(id)
-	if err != nil {
-		errM = &Error{Reason: errors.New(fmt.Sprintf("Error removing question: %s\n", err)), Internal: true}
-		return
-	}
-
-	return
-}
-
-func DisableAllQuestions(db *mgo.Database) *Error {
-	questions, errM := FindAllQuestions(db)
+func (app *App) DisableAllQuestions() *Error {
+	questions, errM := app.Questions.FindAll()
 	if errM != nil {
 		return errM
 	}
 
 	for _, question := range questions {
 		question.Enabled = false
-		errM = question.Save(db)
+		errM = app.Questions.Save(&question)
 		if errM != nil {
 			return errM
 		}
@@ -317,13 +256,3 @@ func DisableAllQuestions(db *mgo.Database) *Error {
 
 	return nil
 }
-
-func UpdateEnabledQuestion(db *mgo.Database, id bson.ObjectId) *Error {
-	c := db.C("questions")
-	err := c.UpdateId(id, bson.M{"$set": bson.M{"enabled": true}})
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Error enabling question: %s\n", err))}
-	}
-
-	return nil
-}
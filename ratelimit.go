@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+	lockoutDuration    = 15 * time.Minute
+)
+
+// maxLimitedBody caps the body of a rate limited request, which is read
+// before anyone is authenticated. Logins and sign ups are far smaller.
+const maxLimitedBody = 64 << 10
+
+// LIMITER keeps the counters for rate limits and login failures.
+var LIMITER RateLimiter
+
+// RateLimiter counts hits per key in fixed windows. Implementations shared by
+// several API instances must keep their counters outside the process.
+type RateLimiter interface {
+	// Hit records a hit and returns how many hits the key has had in the
+	// current window, including this one, and when the window ends.
+	Hit(key string, window time.Duration) (int, time.Time, error)
+	Reset(key string) error
+}
+
+// RateLimit allows Limit requests per Window, counted separately for each
+// client IP and each e-mail address.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+var rateLimits = map[string]RateLimit{
+	"POST /auth/login":           {Limit: 10, Window: 15 * time.Minute},
+	"POST /auth/signup":          {Limit: 5, Window: time.Hour},
+	"POST /auth/password/forgot": {Limit: 3, Window: time.Hour},
+	"GET /auth/verify":           {Limit: 3, Window: time.Hour},
+	"POST /auth/2fa/verify":      {Limit: 10, Window: 15 * time.Minute},
+	"POST /auth/2fa/enable":      {Limit: 10, Window: 15 * time.Minute},
+	"PUT /api/user/password":     {Limit: 10, Window: 15 * time.Minute},
+	"PUT /api/user/email":        {Limit: 5, Window: time.Hour},
+	"DELETE /api/user":           {Limit: 10, Window: 15 * time.Minute},
+	"GET /api/user/export":       {Limit: 3, Window: 24 * time.Hour},
+}
+
+// IPs get more room than single accounts, since people share them.
+const ipRateLimitFactor = 3
+
+// NewRateLimiter builds the limiter named by RATE_LIMIT_STORE: "mongo" (the
+// default) or "memory", which only works with a single API instance.
+func NewRateLimiter(db mongoDB) (RateLimiter, error) {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "mongo":
+		return &MongoRateLimiter{db: db}, nil
+	case "memory":
+		return NewMemoryRateLimiter(), nil
+	default:
+		return nil, fmt.Errorf("Unknown rate limit store: %s", store)
+	}
+}
+
+// RateLimitMiddleware rejects requests to the limited auth routes once the
+// client IP or the e-mail address they are about has used up its limit.
+func RateLimitMiddleware(limiter RateLimiter) negroni.Handler {
+	ctx := logger.WithField("method", "RateLimitMiddleware")
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := r.Method + " " + strings.TrimSuffix(r.URL.Path, "/")
+		limit, ok := rateLimits[route]
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		keys := []string{"ip:" + ClientIP(r)}
+		limits := []int{limit.Limit * ipRateLimitFactor}
+		if account := RateLimitAccount(w, r); account != "" {
+			keys = append(keys, account)
+			limits = append(limits, limit.Limit)
+		}
+
+		for i, key := range keys {
+			count, resets, err := limiter.Hit(route+" "+key, limit.Window)
+			if err != nil {
+				// Better to let people in than to lock everyone out.
+				ctx.WithError(err).Error("Failed to check rate limit.")
+				break
+			}
+
+			if count > limits[i] {
+				w.Header().Set("Retry-After", strconv.Itoa(int(resets.Sub(time.Now()).Seconds())+1))
+				BR(w, r, errors.New(RATE_LIMITED_ERROR), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next(w, r)
+	})
+}
+
+// RateLimitAccount returns the account a limited request is about: the
+// e-mail address in its body, or the user of its token. Bodies over
+// maxLimitedBody are cut off, so the handler fails to parse them.
+func RateLimitAccount(w http.ResponseWriter, r *http.Request) string {
+	if r.Body != nil && r.Method != "GET" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLimitedBody))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			var message struct {
+				Email string `json:"email"`
+			}
+			if json.Unmarshal(body, &message) == nil && message.Email != "" {
+				return "email:" + NormalizeEmail(message.Email)
+			}
+		}
+	}
+
+	if token, ok := context.GetOk(r, "token"); ok {
+		if id, ok := token.(*jwt.Token).Claims["ID"].(string); ok {
+			return "user:" + id
+		}
+	}
+
+	return ""
+}
+
+// ClientIP returns the address the request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RecordLoginFailure counts a wrong password and locks the account once
+// there have been too many in a row.
+func (app *App) RecordLoginFailure(u *User) {
+	ctx := logger.WithField("method", "RecordLoginFailure")
+	if LIMITER == nil {
+		return
+	}
+
+	key := "login-failure " + u.ID.Hex()
+	count, _, err := LIMITER.Hit(key, loginFailureWindow)
+	if err != nil {
+		ctx.WithError(err).Error("Failed to count login failure.")
+		return
+	}
+
+	if count >= maxLoginFailures {
+		errM := app.LockUser(u, time.Now().Add(lockoutDuration))
+		if errM != nil {
+			ctx.WithError(errM.Reason).WithField("user", u.Email).Error("Failed to lock account.")
+			return
+		}
+		LIMITER.Reset(key)
+		ctx.WithField("user", u.Email).Warn("Account locked after repeated login failures.")
+	}
+}
+
+// ResetLoginFailures forgets earlier wrong passwords after a successful login.
+func ResetLoginFailures(u *User) {
+	if LIMITER == nil {
+		return
+	}
+	LIMITER.Reset("login-failure " + u.ID.Hex())
+}
+
+func (app *App) LockUser(u *User, until time.Time) *Error {
+	errM := app.Users.Update(u.ID, bson.M{"lockedUntil": until})
+	if errM != nil {
+		return errM
+	}
+	u.LockedUntil = until
+
+	return nil
+}
+
+// MongoRateLimiter keeps one document per key and window, which Mongo
+// removes once the window is over.
+type MongoRateLimiter struct {
+	db mongoDB
+}
+
+func (m *MongoRateLimiter) Hit(key string, window time.Duration) (int, time.Time, error) {
+	start := time.Now().Truncate(window)
+	resets := start.Add(window)
+
+	var counter struct {
+		Count int `bson:"count"`
+	}
+	err := m.db.C("rate_limits").FindOneAndUpdate(m.db.ctx,
+		bson.M{"_id": key + " " + strconv.FormatInt(start.Unix(), 10)},
+		bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"key": key, "expiresOn": resets}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
+	if err != nil {
+		return 0, resets, err
+	}
+
+	return counter.Count, resets, nil
+}
+
+func (m *MongoRateLimiter) Reset(key string) error {
+	_, err := m.db.C("rate_limits").DeleteMany(m.db.ctx, bson.M{"key": key})
+	return err
+}
+
+type memoryCounter struct {
+	count  int
+	resets time.Time
+}
+
+type MemoryRateLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*memoryCounter
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{counters: make(map[string]*memoryCounter)}
+}
+
+func (m *MemoryRateLimiter) Hit(key string, window time.Duration) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	counter, ok := m.counters[key]
+	if !ok || !now.Before(counter.resets) {
+		// Drop expired counters now and then so the map does not grow forever.
+		if !ok && len(m.counters) > 10000 {
+			for k, c := range m.counters {
+				if !now.Before(c.resets) {
+					delete(m.counters, k)
+				}
+			}
+		}
+
+		counter = &memoryCounter{resets: now.Truncate(window).Add(window)}
+		m.counters[key] = counter
+	}
+
+	counter.count++
+
+	return counter.count, counter.resets, nil
+}
+
+func (m *MemoryRateLimiter) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.counters, key)
+
+	return nil
+}
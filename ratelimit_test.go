@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	logger = logrus.New()
+	limit := rateLimits["POST /auth/password/forgot"].Limit
+	middleware := RateLimitMiddleware(NewMemoryRateLimiter())
+
+	forgot := func(email, ip string) int {
+		r, _ := http.NewRequest("POST", "/auth/password/forgot", strings.NewReader(`{"email":"`+email+`"}`))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Code
+	}
+
+	for i := 0; i < limit; i++ {
+		if code := forgot("jane@example.com", "10.0.0.1"); code != http.StatusOK {
+			t.Fatalf("expected request %d to pass got %d", i+1, code)
+		}
+	}
+
+	// The address is used up, even from somewhere else.
+	if code := forgot("JANE@example.com", "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 for the same e-mail got %d", code)
+	}
+
+	if code := forgot("john@example.com", "10.0.0.1"); code != http.StatusOK {
+		t.Errorf("expected another e-mail to pass got %d", code)
+	}
+
+	// Keep going from one IP with fresh addresses until the IP runs out too.
+	for i := 0; i < limit*ipRateLimitFactor; i++ {
+		forgot("user"+string(rune('a'+i))+"@example.com", "10.0.0.3")
+	}
+	if code := forgot("last@example.com", "10.0.0.3"); code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 for the same IP got %d", code)
+	}
+}
+
+func TestRateLimitAccountCapsBody(t *testing.T) {
+	big := `{"email":"jane@example.com","padding":"` + strings.Repeat("x", maxLimitedBody) + `"}`
+	r, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(big))
+	if account := RateLimitAccount(httptest.NewRecorder(), r); account != "" {
+		t.Errorf("expected a body over the cap to name no account got %q", account)
+	}
+
+	r, _ = http.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"Jane <JANE@example.com>"}`))
+	if account := RateLimitAccount(httptest.NewRecorder(), r); account != "email:jane@example.com" {
+		t.Errorf("expected the bare address in lower case got %q", account)
+	}
+}
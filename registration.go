@@ -6,15 +6,15 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
-func RegisterUser(w http.ResponseWriter, r *http.Request) {
+func (app *App) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	ctx := logger.WithField("method", "RegisterUser")
 	if IsTokenSet(r) {
 		tokenData := GetToken(w, r)
-		db := GetDB(w, r)
 
-		user, errM := GetUserFromToken(db, tokenData)
+		user, errM := app.GetUserFromToken(tokenData)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
@@ -31,16 +31,22 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !GLOBALS.RegistrationIsOpen(time.Now()) {
+			BR(w, r, errors.New("Registration is closed for this season."), http.StatusForbidden)
+			return
+		}
+
 		type RegistrationData struct {
-			Organization string        `json:"organization"`
-			Team         string        `json:"team"`
-			Comment      string        `json:"comment"`
-			Referral     string        `json:"referral"`
-			Donation     string        `json:"donation"`
-			Sharing      string        `json:"sharing"`
-			Participants []Participant `json:"participants"`
-			Family       bool          `json:"family"`
-			FamilyCode   string        `json:"familyCode"`
+			Organization        string        `json:"organization"`
+			Team                string        `json:"team"`
+			Comment             string        `json:"comment"`
+			Referral            string        `json:"referral"`
+			Donation            string        `json:"donation"`
+			Sharing             string        `json:"sharing"`
+			Participants        []Participant `json:"participants"`
+			Family              bool          `json:"family"`
+			FamilyCode          string        `json:"familyCode"`
+			ProposeOrganization bool          `json:"proposeOrganization"`
 		}
 
 		decoder := json.NewDecoder(r.Body)
@@ -54,20 +60,14 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 
 		// Validate all data.
 		type RegistrationValidation struct {
-			Organization []string `json:"organization,omitempty"`
-			Team         []string `json:"team,omitempty"`
-			Comment      []string `json:"comment,omitempty"`
-			Referral     []string `json:"referral,omitempty"`
-			Donation     []string `json:"donation,omitempty"`
-			Sharing      []string `json:"sharing,omitempty"`
-			Participants []struct {
-				FirstName  []string `json:firstName,omitempty"`
-				LastName   []string `json:lastName,omitempty"`
-				AgeRange   []string `json:ageRange,omitempty"`
-				Category   []string `json:category,omitempty"`
-				Commitment []string `json:commitment,omitempty"`
-			} `json:"participants"`
-			FamilyCode []string `json:"familyCode,omitempty"`
+			Organization []string                `json:"organization,omitempty"`
+			Team         []string                `json:"team,omitempty"`
+			Comment      []string                `json:"comment,omitempty"`
+			Referral     []string                `json:"referral,omitempty"`
+			Donation     []string                `json:"donation,omitempty"`
+			Sharing      []string                `json:"sharing,omitempty"`
+			Participants []ParticipantValidation `json:"participants"`
+			FamilyCode   []string                `json:"familyCode,omitempty"`
 		}
 
 		// Assume form is valid and set this to false if needed.
@@ -98,6 +98,19 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 			formIsValid = false
 		}
 
+		// Validate each participant.
+		for index := range registrationData.Participants {
+			validation, errM := app.ValidateParticipant(&registrationData.Participants[index])
+			if errM != nil {
+				HandleModelError(w, r, errM)
+				return
+			}
+			registrationValidation.Participants = append(registrationValidation.Participants, validation)
+			if !validation.IsValid() {
+				formIsValid = false
+			}
+		}
+
 		// Ensure that donation is a valid selection.
 		if registrationData.Donation == "" {
 			registrationValidation.Donation = append(registrationValidation.Donation, REQUIRED_ERROR)
@@ -119,15 +132,27 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		// }
 
 		// Ensure family code exists.
-		if registrationData.FamilyCode != "" && !FamilyExists(db, strings.ToUpper(registrationData.FamilyCode)) {
+		if registrationData.FamilyCode != "" && !app.Families.Exists(strings.ToUpper(registrationData.FamilyCode)) {
 			registrationValidation.FamilyCode = append(registrationValidation.FamilyCode, FAMILY_ERROR)
 			formIsValid = false
 		}
 
-		// Ensure Organization exists.
-		if registrationData.Organization != "" && !OrganizationExists(db, registrationData.Organization) {
-			registrationValidation.Organization = append(registrationValidation.Organization, ORGANIZATION_ERROR)
-			formIsValid = false
+		// Ensure Organization exists or has been proposed for approval. It is
+		// picked by name, since proposals do not have an ID yet.
+		var proposeOrganization bool
+		var org *Organization
+		if registrationData.Organization != "" {
+			org, errM = app.Organizations.FindByName(registrationData.Organization)
+			if errM != nil && errM.Internal {
+				HandleModelError(w, r, errM)
+				return
+			}
+
+			if org == nil && !registrationData.ProposeOrganization {
+				registrationValidation.Organization = append(registrationValidation.Organization, ORGANIZATION_ERROR)
+				formIsValid = false
+			}
+			proposeOrganization = org == nil || org.NeedsApproval
 		}
 
 		// At this point, if we have any validation issues, return the validation struct.
@@ -143,8 +168,24 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if proposeOrganization {
+			errM = app.CreateOrgRequest(registrationData.Organization, user.Email)
+			if errM != nil {
+				HandleModelError(w, r, errM)
+				return
+			}
+
+			org, errM = app.Organizations.FindByName(registrationData.Organization)
+			if errM != nil {
+				HandleModelError(w, r, errM)
+				return
+			}
+		}
+
 		// Save all data.
-		user.Organization = registrationData.Organization
+		if org != nil {
+			user.Organization = org.ID
+		}
 		user.Team = registrationData.Team
 		user.Comment = registrationData.Comment
 		user.Referral = registrationData.Referral
@@ -154,7 +195,7 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 
 		// Generate family code if needed.
 		if registrationData.Family && registrationData.FamilyCode == "" {
-			familyCode, errM := GenerateFamilyCode(db, user)
+			familyCode, errM := app.GenerateFamilyCode(user)
 			if errM != nil {
 				HandleModelError(w, r, errM)
 				return
@@ -165,23 +206,26 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Create ID for each participant. Set points and create empty scorecard.
+		// IDs are never reused, so they stay valid when participants are removed later.
 		for key, _ := range user.Participants {
 			user.Participants[key].ID = key
 			user.Participants[key].Points = 0
 			user.Participants[key].Scorecard = GenerateScorecard()
 		}
+		user.NextParticipantID = len(user.Participants)
 
-		// Change user status appropriately.
+		// Change user status appropriately and tie the registration to the current season.
 		user.Status = REGISTERED.String()
+		user.Season = SEASON.ID
 
-		errM = user.Save(db)
+		errM = app.Users.Save(user)
 		if errM != nil {
 			HandleModelError(w, r, errM)
 			return
 		}
 
 		// Send confirmation e-mail.
-		go SendRegistrationConfirmation(user)
+		app.SendRegistrationConfirmation(user)
 		ctx.WithField("user", user.Email).Info("User successfully registered.")
 
 		ServeJSON(w, r, &Response{"message": "Registration complete."}, http.StatusOK)
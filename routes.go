@@ -0,0 +1,113 @@
+package main
+
+import "github.com/gorilla/mux"
+
+// NewRouter registers every route of the API. Admin routes declare the
+// permission they need with Require.
+func NewRouter(app *App) *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/globals", GetGlobals).Methods("GET")
+	api.Handle("/globals", app.Require(GLOBALS_WRITE, (*App).SaveGlobals)).Methods("POST")
+
+	api.Handle("/admin/seasons", app.Require(SEASONS_WRITE, (*App).GetSeasons)).Methods("GET")
+	api.Handle("/admin/seasons", app.Require(SEASONS_WRITE, (*App).AddSeason)).Methods("POST")
+	api.Handle("/admin/seasons/{id}", app.Require(SEASONS_WRITE, (*App).EditSeason)).Methods("PUT")
+	api.Handle("/admin/seasons/{id}/current", app.Require(SEASONS_WRITE, (*App).SwitchSeason)).Methods("PUT")
+	api.Handle("/admin/seasons/{id}/registrations", app.Require(SEASONS_WRITE, (*App).GetSeasonRegistrations)).Methods("GET")
+
+	api.HandleFunc("/commitments", app.Bind((*App).GetCommitments)).Methods("GET")
+
+	api.HandleFunc("/organizations", app.Bind((*App).GetOrganizations)).Methods("GET")
+	api.HandleFunc("/organizations/requests", app.Bind((*App).RequestOrganization)).Methods("POST")
+	api.Handle("/admin/organizations/requests", app.Require(ORGANIZATIONS_WRITE, (*App).GetOrganizationRequests)).Methods("GET")
+	api.Handle("/admin/organizations/requests/{id}/approve", app.Require(ORGANIZATIONS_WRITE, (*App).ApproveOrganization)).Methods("PUT")
+	api.Handle("/admin/organizations/requests/{id}/reject", app.Require(ORGANIZATIONS_WRITE, (*App).RejectOrganization)).Methods("PUT")
+	api.Handle("/admin/organizations/requests/{id}/merge", app.Require(ORGANIZATIONS_WRITE, (*App).MergeOrganizationRequest)).Methods("PUT")
+	api.Handle("/admin/organizations", app.Require(ORGANIZATIONS_WRITE, (*App).AddOrganization)).Methods("POST")
+	api.Handle("/admin/organizations", app.Require(ORGANIZATIONS_WRITE, (*App).EditOrganization)).Methods("PUT")
+	api.Handle("/admin/organizations/{id}", app.Require(ORGANIZATIONS_WRITE, (*App).DeleteOrganization)).Methods("DELETE")
+	api.Handle("/admin/organizations/merge", app.Require(ORGANIZATIONS_WRITE, (*App).MergeOrganizations)).Methods("POST")
+
+	api.HandleFunc("/registration", app.Bind((*App).RegisterUser)).Methods("POST")
+
+	api.HandleFunc("/user", app.Bind((*App).UpdateSelf)).Methods("PUT")
+	api.HandleFunc("/user", app.Bind((*App).DeleteSelf)).Methods("DELETE")
+	api.HandleFunc("/user/email", app.Bind((*App).RequestEmailChange)).Methods("PUT")
+	api.HandleFunc("/user/password", app.Bind((*App).ChangeOwnPassword)).Methods("PUT")
+	api.HandleFunc("/user/export", app.Bind((*App).RequestExport)).Methods("GET")
+	api.HandleFunc("/user/export/{id}", app.Bind((*App).DownloadExport)).Methods("GET")
+	api.HandleFunc("/user/identities", app.Bind((*App).GetIdentities)).Methods("GET")
+	api.HandleFunc("/user/identities/{provider}", app.Bind((*App).UnlinkIdentity)).Methods("DELETE")
+	api.HandleFunc("/user/password", app.Bind((*App).SetPassword)).Methods("POST")
+	api.Handle("/admin/user", app.Require(USERS_VIEW, (*App).GetUsers)).Methods("GET")
+	api.Handle("/admin/user", app.Require(USERS_EDIT, (*App).EditUser)).Methods("PUT")
+	api.Handle("/admin/export/users", app.Require(USERS_VIEW, (*App).ExportUsers)).Methods("GET")
+	api.Handle("/admin/export/participants", app.Require(PARTICIPANTS_VIEW, (*App).ExportParticipants)).Methods("GET")
+	api.Handle("/admin/import/{kind}", app.Require(DATA_IMPORT, (*App).ImportData)).Methods("POST")
+
+	api.Handle("/admin/message", app.Require(MESSAGES_SEND, (*App).SendMessage)).Methods("POST")
+	api.Handle("/admin/message", app.Require(MESSAGES_SEND, (*App).GetCampaigns)).Methods("GET")
+	api.Handle("/admin/message/{id}/retry", app.Require(MESSAGES_RETRY, (*App).RetryCampaign)).Methods("PUT")
+
+	api.Handle("/admin/audit", app.Require(AUDIT_READ, (*App).GetAuditLog)).Methods("GET")
+
+	api.Handle("/admin/email-templates", app.Require(EMAIL_TEMPLATES_WRITE, (*App).GetEmailTemplates)).Methods("GET")
+	api.Handle("/admin/email-templates", app.Require(EMAIL_TEMPLATES_WRITE, (*App).AddEmailTemplate)).Methods("POST")
+	api.Handle("/admin/email-templates/{name}", app.Require(EMAIL_TEMPLATES_WRITE, (*App).EditEmailTemplate)).Methods("PUT")
+	api.Handle("/admin/email-templates/{name}", app.Require(EMAIL_TEMPLATES_WRITE, (*App).DeleteEmailTemplate)).Methods("DELETE")
+	api.Handle("/admin/email-templates/{name}/preview", app.Require(EMAIL_TEMPLATES_WRITE, (*App).PreviewEmailTemplate)).Methods("GET", "POST")
+
+	api.HandleFunc("/news", app.Bind((*App).FetchNews)).Methods("GET")
+	api.Handle("/admin/news", app.Require(NEWS_WRITE, (*App).ListNews)).Methods("GET")
+	api.Handle("/admin/news", app.Require(NEWS_WRITE, (*App).AddNews)).Methods("POST")
+	api.Handle("/admin/news/{id}", app.Require(NEWS_WRITE, (*App).DeleteNews)).Methods("DELETE")
+	api.Handle("/admin/news/{id}/publish", app.Require(NEWS_WRITE, (*App).PublishNews)).Methods("PUT")
+	api.Handle("/admin/news/{id}/unpublish", app.Require(NEWS_WRITE, (*App).UnpublishNews)).Methods("PUT")
+
+	api.HandleFunc("/bonus-question", app.Bind((*App).FetchQuestion)).Methods("GET")
+	api.HandleFunc("/bonus-question", app.Bind((*App).AnswerQuestion)).Methods("POST")
+	api.Handle("/admin/bonus-question", app.Require(QUESTIONS_WRITE, (*App).GetQuestions)).Methods("GET")
+	api.Handle("/admin/bonus-question", app.Require(QUESTIONS_WRITE, (*App).CreateQuestion)).Methods("POST")
+	api.Handle("/admin/bonus-question/{id}", app.Require(QUESTIONS_WRITE, (*App).DeleteQuestion)).Methods("DELETE")
+	api.Handle("/admin/bonus-question/{id}/enable", app.Require(QUESTIONS_WRITE, (*App).EnableQuestion)).Methods("PUT")
+	api.Handle("/admin/bonus-question/disable", app.Require(QUESTIONS_WRITE, (*App).DisableQuestion)).Methods("PUT")
+
+	api.HandleFunc("/participant", app.Bind((*App).GetParticipants)).Methods("GET")
+	api.HandleFunc("/participant", app.Bind((*App).AddParticipant)).Methods("POST")
+	api.HandleFunc("/participant", app.Bind((*App).EditParticipant)).Methods("PUT")
+	api.HandleFunc("/participant/{id}", app.Bind((*App).DeleteParticipant)).Methods("DELETE")
+	api.HandleFunc("/participant/scorecard", app.Bind((*App).UpdateScorecard)).Methods("PUT")
+	api.HandleFunc("/participant/{id}/checkin", app.Bind((*App).CheckIn)).Methods("POST")
+	api.Handle("/admin/participant", app.Require(PARTICIPANTS_VIEW, (*App).GetParticipantsAdmin)).Methods("GET")
+
+	api.HandleFunc("/leaderboard/{board}", app.Bind((*App).GetLeaderboard)).Methods("GET")
+
+	api.HandleFunc("/faq", app.Bind((*App).GetFaqs)).Methods("GET")
+	api.Handle("/admin/faq", app.Require(FAQ_WRITE, (*App).AddFaq)).Methods("POST")
+	api.Handle("/admin/faq", app.Require(FAQ_WRITE, (*App).EditFaq)).Methods("PUT")
+	api.Handle("/admin/faq/{id}", app.Require(FAQ_WRITE, (*App).DeleteFaq)).Methods("DELETE")
+
+	authAPI := router.PathPrefix("/auth").Subrouter()
+	authAPI.HandleFunc("/", app.Bind((*App).GetAuthStatus)).Methods("GET")
+	authAPI.HandleFunc("/login", app.Bind((*App).Login)).Methods("POST")
+	authAPI.HandleFunc("/refresh", app.Bind((*App).RefreshToken)).Methods("POST")
+	authAPI.HandleFunc("/2fa/setup", app.Bind((*App).SetupTwoFactor)).Methods("POST")
+	authAPI.HandleFunc("/2fa/enable", app.Bind((*App).EnableTwoFactor)).Methods("POST")
+	authAPI.HandleFunc("/2fa/verify", app.Bind((*App).VerifyTwoFactor)).Methods("POST")
+	authAPI.HandleFunc("/2fa/disable", app.Bind((*App).DisableTwoFactor)).Methods("POST")
+	authAPI.HandleFunc("/2fa/backup-codes", app.Bind((*App).RegenerateBackupCodes)).Methods("POST")
+	authAPI.HandleFunc("/logout", app.Bind((*App).Logout)).Methods("POST")
+	authAPI.HandleFunc("/logout/all", app.Bind((*App).LogoutAll)).Methods("POST")
+	authAPI.HandleFunc("/signup", app.Bind((*App).SignUp)).Methods("POST")
+	authAPI.HandleFunc("/verify", app.Bind((*App).Verify)).Methods("POST")
+	authAPI.HandleFunc("/verify", app.Bind((*App).ResendVerify)).Methods("GET")
+	authAPI.HandleFunc("/password/forgot", app.Bind((*App).ForgotPassword)).Methods("POST")
+	authAPI.HandleFunc("/password/reset", app.Bind((*App).ResetPassword)).Methods("POST")
+	authAPI.HandleFunc("/providers", GetProviders).Methods("GET")
+	// Has to come last so it does not shadow the routes above.
+	authAPI.HandleFunc("/{provider}", app.Bind((*App).LoginWithProvider)).Methods("POST")
+
+	return router
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Season is a single run of the challenge with its own dates and settings.
+// Exactly one season is current at a time and GLOBALS always points at the
+// settings of the current season.
+type Season struct {
+	ID        bson.ObjectID `bson:"_id" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Current   bool          `bson:"current" json:"current"`
+	CreatedOn time.Time     `bson:"createdOn,omitempty" json:"createdOn,omitempty"`
+	Globals   `bson:",inline"`
+}
+
+// Registration is the archived copy of a user's registration for a season
+// that is no longer current.
+type Registration struct {
+	ID           bson.ObjectID `bson:"_id" json:"id"`
+	Season       bson.ObjectID `bson:"season" json:"season"`
+	User         bson.ObjectID `bson:"user" json:"-"`
+	Email        string        `bson:"email" json:"email"`
+	FirstName    string        `bson:"firstName,omitempty" json:"firstName,omitempty"`
+	LastName     string        `bson:"lastName,omitempty" json:"lastName,omitempty"`
+	Family       string        `bson:"family,omitempty" json:"family,omitempty"`
+	Organization string        `bson:"organization,omitempty" json:"organization,omitempty"`
+	Team         string        `bson:"team,omitempty" json:"team,omitempty"`
+	Sharing      string        `bson:"sharing,omitempty" json:"sharing,omitempty"`
+	Comment      string        `bson:"comment,omitempty" json:"comment,omitempty"`
+	Referral     string        `bson:"referral,omitempty" json:"referral,omitempty"`
+	Donation     string        `bson:"donation,omitempty" json:"donation,omitempty"`
+	Participants []Participant `bson:"participants,omitempty" json:"participants,omitempty"`
+}
+
+func (app *App) GetSeasons(w http.ResponseWriter, r *http.Request) {
+	seasons, errM := app.Globals.FindSeasons()
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(seasons)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+func (app *App) AddSeason(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var season Season
+	err := decoder.Decode(&season)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if season.Name == "" {
+		BR(w, r, errors.New(MISSING_FIELDS_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if errM := season.Validate(); errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// New seasons only become current when an admin switches to them.
+	season.ID = bson.NewObjectID()
+	season.Current = false
+	season.CreatedOn = time.Now()
+	season.ChallengeLength = season.ChallengeDays()
+
+	errM := app.Globals.SaveSeason(&season)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Season created.", "id": season.ID.Hex()}, http.StatusOK)
+}
+
+// EditSeason changes the name and settings the request sends. Settings it
+// leaves out are kept.
+func (app *App) EditSeason(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	stored, errM := app.Globals.FindSeasonByID(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// Decoding over a copy of the stored season only replaces what was sent.
+	season := *stored
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&season)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+	season.ID, season.Current, season.CreatedOn = stored.ID, stored.Current, stored.CreatedOn
+
+	if season.Name == "" {
+		BR(w, r, errors.New(MISSING_FIELDS_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if errM := season.Validate(); errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+	season.ChallengeLength = season.ChallengeDays()
+
+	errM = app.Globals.SaveSeason(&season)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if season.Current {
+		SEASON = &season
+		GLOBALS = &SEASON.Globals
+	}
+
+	ServeJSON(w, r, &Response{"status": "Season updated."}, http.StatusOK)
+}
+
+func (app *App) SwitchSeason(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	season, errM := app.SetCurrentSeason(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	SEASON = season
+	GLOBALS = &SEASON.Globals
+
+	ServeJSON(w, r, &Response{"status": fmt.Sprintf("%s is now the current season.", season.Name)},
+		http.StatusOK)
+}
+
+func (app *App) GetSeasonRegistrations(w http.ResponseWriter, r *http.Request) {
+	id := ObjectIDHex(mux.Vars(r)["id"])
+
+	season, errM := app.Globals.FindSeasonByID(id)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	registrations, errM := app.FindRegistrations(season)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	b, _ := json.Marshal(registrations)
+	ServeJSONArray(w, r, string(b), http.StatusOK)
+}
+
+// EnsureCurrentSeason returns the current season. Databases that predate
+// seasons have their single globals document converted into the first season
+// and existing registrations and questions are assigned to it.
+func EnsureCurrentSeason(db mongoDB) (*Season, error) {
+	ctx := logger.WithField("method", "EnsureCurrentSeason")
+
+	count, err := db.C("seasons").CountDocuments(db.ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("Error counting seasons: %s\n", err)
+	}
+
+	if count == 0 {
+		globals, err := FindGlobals(db)
+		if err != nil {
+			return nil, err
+		}
+
+		season := &Season{
+			ID:        bson.NewObjectID(),
+			Name:      fmt.Sprintf("NHC %d", globals.ChallengeStart.Year()),
+			Current:   true,
+			CreatedOn: time.Now(),
+			Globals:   *globals,
+		}
+		_, err = db.C("seasons").InsertOne(db.ctx, season)
+		if err != nil {
+			return nil, fmt.Errorf("Error saving season: %s\n", err)
+		}
+
+		_, err = db.C("users").UpdateMany(db.ctx, bson.M{"status": REGISTERED.String()},
+			bson.M{"$set": bson.M{"season": season.ID}})
+		if err != nil {
+			return nil, fmt.Errorf("Error assigning users to season: %s\n", err)
+		}
+
+		_, err = db.C("questions").UpdateMany(db.ctx, bson.M{"season": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"season": season.ID}})
+		if err != nil {
+			return nil, fmt.Errorf("Error assigning questions to season: %s\n", err)
+		}
+
+		ctx.WithField("season", season.Name).Info("Converted globals into the first season.")
+	}
+
+	season := &Season{}
+	err = db.C("seasons").FindOne(db.ctx, bson.M{"current": true}).Decode(season)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving current season from database: %s\n", err)
+	}
+
+	return season, nil
+}
+
+// SetCurrentSeason archives the registrations of the current season, resets
+// registered users and makes the given season current. Without transactions
+// a switch that fails halfway can be run again: archived users are no longer
+// registered, archiving twice is harmless, and a switch with no current
+// season only makes the given one current.
+func (app *App) SetCurrentSeason(id bson.ObjectID) (*Season, *Error) {
+	var season *Season
+	errM := app.Atomically(func(app *App) *Error {
+		var errM *Error
+		season, errM = app.Globals.FindSeasonByID(id)
+		if errM != nil {
+			return errM
+		}
+
+		if season.Current {
+			return nil
+		}
+
+		current, errM := app.Globals.FindCurrentSeason()
+		if errM != nil && errM.Internal {
+			return errM
+		}
+
+		if current != nil {
+			errM = app.ArchiveRegistrations(current)
+			if errM != nil {
+				return errM
+			}
+
+			current.Current = false
+			errM = app.Globals.SaveSeason(current)
+			if errM != nil {
+				return errM
+			}
+		}
+
+		season.Current = true
+		return app.Globals.SaveSeason(season)
+	})
+	if errM != nil {
+		return nil, errM
+	}
+
+	return season, nil
+}
+
+// ArchiveRegistrations copies every registration of the given season into
+// the registrations collection and sets those users back to unregistered.
+func (app *App) ArchiveRegistrations(season *Season) *Error {
+	ctx := logger.WithField("method", "ArchiveRegistrations")
+
+	users, errM := app.Users.Find(UserFilter{Statuses: []string{REGISTERED.String()}})
+	if errM != nil {
+		return errM
+	}
+
+	organizations, errM := app.FindOrganizationNames()
+	if errM != nil {
+		return errM
+	}
+
+	for _, user := range users {
+		errM = app.Globals.ArchiveRegistration(NewRegistration(&user, season.ID, organizations))
+		if errM != nil {
+			return errM
+		}
+
+		errM = app.Users.Update(user.ID, bson.M{"status": UNREGISTERED.String()}, "participants", "season")
+		if errM != nil {
+			return errM
+		}
+	}
+
+	ctx.WithField("season", season.Name).WithField("count", len(users)).Info("Archived registrations.")
+
+	return nil
+}
+
+// FindRegistrations returns the registrations of a season. The current
+// season is read from the users themselves, older seasons from the archive.
+func (app *App) FindRegistrations(season *Season) ([]Registration, *Error) {
+	if season.Current {
+		users, errM := app.Users.Find(UserFilter{Statuses: []string{REGISTERED.String()}})
+		if errM != nil {
+			return nil, errM
+		}
+
+		organizations, errM := app.FindOrganizationNames()
+		if errM != nil {
+			return nil, errM
+		}
+
+		var registrations []Registration
+		for _, user := range users {
+			registrations = append(registrations, *NewRegistration(&user, season.ID, organizations))
+		}
+		return registrations, nil
+	}
+
+	return app.Globals.FindRegistrations(season.ID)
+}
+
+// NewRegistration copies a user's registration. The archive keeps the name of
+// the user's organization, which outlives the organization itself.
+func NewRegistration(u *User, season bson.ObjectID, organizations OrganizationNames) *Registration {
+	return &Registration{
+		ID:           bson.NewObjectID(),
+		Season:       season,
+		User:         u.ID,
+		Email:        u.Email,
+		FirstName:    u.FirstName,
+		LastName:     u.LastName,
+		Family:       u.Family,
+		Organization: organizations[u.Organization],
+		Team:         u.Team,
+		Sharing:      u.Sharing,
+		Comment:      u.Comment,
+		Referral:     u.Referral,
+		Donation:     u.Donation,
+		Participants: u.Participants,
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestEditSeasonKeepsSettingsLeftOut(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin(GLOBAL_ADMIN)
+
+	start := time.Date(2027, time.January, 4, 0, 0, 0, 0, time.UTC)
+	var created struct {
+		ID string `json:"id"`
+	}
+	code := s.do("POST", "/api/admin/seasons", admin, Response{"name": "NHC 2027", "challengeStart": start,
+		"challengeEnd": start.AddDate(0, 0, 27), "timeZone": "UTC", "checkinGraceDays": 2}, &created)
+	if code != http.StatusOK {
+		t.Fatalf("create: expected status 200 got %d", code)
+	}
+
+	if code := s.do("PUT", "/api/admin/seasons/"+created.ID, admin, Response{"welcomeMessage": "Welcome!"}, nil); code != http.StatusOK {
+		t.Fatalf("edit: expected status 200 got %d", code)
+	}
+	season, _ := s.app.Globals.FindSeasonByID(ObjectIDHex(created.ID))
+	if season.WelcomeMessage != "Welcome!" || season.ChallengeLength != 28 || season.TimeZone != "UTC" ||
+		season.CheckinGraceDays != 2 || season.Name != "NHC 2027" {
+		t.Errorf("expected only the welcome message to change got %+v", season)
+	}
+
+	for _, body := range []Response{
+		{"challengeEnd": start.AddDate(0, 0, -1)},
+		{"timeZone": "Mars/Olympus"},
+		{"name": ""},
+	} {
+		if code := s.do("PUT", "/api/admin/seasons/"+created.ID, admin, body, nil); code != http.StatusBadRequest {
+			t.Errorf("expected edit %v to be rejected got %d", body, code)
+		}
+	}
+	if season, _ := s.app.Globals.FindSeasonByID(ObjectIDHex(created.ID)); season.ChallengeLength != 28 {
+		t.Errorf("expected rejected edits to keep the season got %+v", season)
+	}
+
+	code = s.do("POST", "/api/globals", admin, Response{"challengeStart": start, "challengeEnd": start.AddDate(0, 0, -1)}, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected globals ending before they start to be rejected got %d", code)
+	}
+}
+
+func TestSwitchSeasonArchivesRegistrations(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin(GLOBAL_ADMIN)
+	old := SEASON
+
+	s.signUp("jane@example.com")
+	jane, _ := s.app.Users.FindByEmail("jane@example.com")
+	s.app.Users.Update(jane.ID, bson.M{"status": REGISTERED.String(), "season": old.ID,
+		"participants": []Participant{{ID: 0, FirstName: "Jane", Commitment: "Eat greens", Category: "Food"}}})
+
+	start := CalendarDate(time.Now()).AddDate(0, 1, 0)
+	next := &Season{ID: bson.NewObjectID(), Name: "Next Season", Globals: Globals{ChallengeStart: start,
+		ChallengeEnd: start.AddDate(0, 0, 27), ChallengeLength: 28}}
+	s.app.Globals.SaveSeason(next)
+
+	if code := s.do("PUT", "/api/admin/seasons/"+next.ID.Hex()+"/current", admin, nil, nil); code != http.StatusOK {
+		t.Fatalf("switch: expected status 200 got %d", code)
+	}
+	if SEASON.ID != next.ID {
+		t.Errorf("expected the new season to be loaded got %s", SEASON.Name)
+	}
+
+	seasons, _ := s.app.Globals.FindSeasons()
+	for _, season := range seasons {
+		if season.Current != (season.ID == next.ID) {
+			t.Errorf("expected only the new season to be current got %+v", season)
+		}
+	}
+
+	jane, _ = s.app.Users.FindByEmail("jane@example.com")
+	if jane.Status != UNREGISTERED.String() || len(jane.Participants) != 0 {
+		t.Errorf("expected user to be reset got %+v", jane)
+	}
+
+	registrations, _ := s.app.Globals.FindRegistrations(old.ID)
+	if len(registrations) != 1 || registrations[0].Email != "jane@example.com" {
+		t.Errorf("expected one archived registration got %+v", registrations)
+	}
+
+	// A switch that stopped before the new season became current is run
+	// again without archiving anything twice.
+	next.Current = false
+	s.app.Globals.SaveSeason(next)
+	old.Current = true
+	s.app.Globals.SaveSeason(old)
+	if _, errM := s.app.SetCurrentSeason(next.ID); errM != nil {
+		t.Fatalf("expected switch to be run again: %v", errM.Reason)
+	}
+	if registrations, _ := s.app.Globals.FindRegistrations(old.ID); len(registrations) != 1 {
+		t.Errorf("expected no registrations to be archived twice got %d", len(registrations))
+	}
+	if current, _ := s.app.Globals.FindCurrentSeason(); current == nil || current.ID != next.ID {
+		t.Errorf("expected the new season to be current got %+v", current)
+	}
+}
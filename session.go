@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// Session is a login on one device. The client holds a refresh token for it,
+// which is replaced every time it is used; only hashes are stored.
+type Session struct {
+	ID           bson.ObjectID `bson:"_id" json:"id"`
+	User         bson.ObjectID `bson:"user" json:"-"`
+	TokenHash    string        `bson:"tokenHash" json:"-"`
+	PreviousHash string        `bson:"previousHash,omitempty" json:"-"`
+	UserAgent    string        `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	CreatedOn    time.Time     `bson:"createdOn" json:"createdOn"`
+	LastUsed     time.Time     `bson:"lastUsed" json:"lastUsed"`
+	ExpiresOn    time.Time     `bson:"expiresOn" json:"expiresOn"`
+	RevokedOn    time.Time     `bson:"revokedOn,omitempty" json:"revokedOn,omitempty"`
+}
+
+func (app *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "RefreshToken")
+
+	type Message struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var message Message
+	err := decoder.Decode(&message)
+	if err != nil || message.RefreshToken == "" {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	session, refreshToken, errM := app.RotateSession(message.RefreshToken)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	user, errM := app.Users.FindByID(session.User)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	accessToken, err := NewAccessToken(user, session)
+	if err != nil {
+		ISR(w, r, err)
+		return
+	}
+
+	ctx.WithField("user", user.Email).Debug("Session refreshed.")
+
+	ServeJSON(w, r, &Response{"token": accessToken, "refreshToken": refreshToken,
+		"expiresIn": int(accessTokenLifetime.Seconds())}, http.StatusOK)
+}
+
+// Logout ends the session of the access token used, or of the refresh token
+// in the body when the access token has already expired.
+func (app *App) Logout(w http.ResponseWriter, r *http.Request) {
+	type Message struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	var message Message
+	json.NewDecoder(r.Body).Decode(&message)
+
+	var errM *Error
+	if message.RefreshToken != "" {
+		errM = app.Sessions.RevokeByHash(HashToken(message.RefreshToken))
+	} else if IsTokenSet(r) {
+		tokenData := GetToken(w, r)
+		if !IsObjectIDHex(tokenData.Session) {
+			BR(w, r, errors.New(SESSION_INVALID_ERROR), http.StatusBadRequest)
+			return
+		}
+		errM = app.Sessions.Revoke(ObjectIDHex(tokenData.Session))
+	} else {
+		BR(w, r, errors.New(MISSING_TOKEN_ERROR), http.StatusUnauthorized)
+		return
+	}
+
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Logged out."}, http.StatusOK)
+}
+
+// LogoutAll ends every session of the user and invalidates all access tokens
+// issued so far.
+func (app *App) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	errM = app.RevokeUserSessions(user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Logged out of all sessions."}, http.StatusOK)
+}
+
+// NewAccessToken signs a short-lived token for a session.
+func NewAccessToken(user *User, session *Session) (string, error) {
+	t := jwt.New(jwt.GetSigningMethod("RS256"))
+	t.Claims["ID"] = user.ID.Hex()
+	t.Claims["sid"] = session.ID.Hex()
+	t.Claims["iat"] = time.Now().Unix()
+	t.Claims["exp"] = time.Now().Add(accessTokenLifetime).Unix()
+
+	return t.SignedString(signKey)
+}
+
+// CreateSession starts a session and returns its first refresh token.
+func (app *App) CreateSession(user *User, userAgent string) (*Session, string, *Error) {
+	token := RandToken()
+	now := time.Now()
+	session := &Session{
+		ID:        bson.NewObjectID(),
+		User:      user.ID,
+		TokenHash: HashToken(token),
+		UserAgent: userAgent,
+		CreatedOn: now,
+		LastUsed:  now,
+		ExpiresOn: now.Add(refreshTokenLifetime),
+	}
+
+	errM := app.Sessions.Create(session)
+	if errM != nil {
+		return nil, "", errM
+	}
+
+	return session, token, nil
+}
+
+// RotateSession swaps a refresh token for a new one. A refresh token that has
+// already been swapped means it was stolen, so the whole session is revoked.
+func (app *App) RotateSession(token string) (*Session, string, *Error) {
+	newToken := RandToken()
+	session, errM := app.Sessions.Rotate(HashToken(token), HashToken(newToken))
+	if errM != nil {
+		return nil, "", errM
+	}
+
+	// Sessions older than a logout of all sessions are no longer valid.
+	user, errM := app.Users.FindByID(session.User)
+	if errM != nil {
+		return nil, "", errM
+	}
+	if session.CreatedOn.Before(user.TokensValidAfter) {
+		return nil, "", &Error{Reason: errors.New(SESSION_INVALID_ERROR), Code: http.StatusUnauthorized}
+	}
+
+	return session, newToken, nil
+}
+
+// RevokeUserSessions logs a user out everywhere. Access tokens issued before
+// now are rejected from here on.
+func (app *App) RevokeUserSessions(u *User) *Error {
+	now := time.Now()
+
+	errM := app.Users.Update(u.ID, bson.M{"tokensValidAfter": now})
+	if errM != nil {
+		return errM
+	}
+	u.TokensValidAfter = now
+
+	return app.Sessions.RevokeUser(u.ID)
+}
+
+// TokenRevoked reports whether an access token belongs to a session that was
+// logged out, or was issued before its user last logged out of all sessions.
+func (app *App) TokenRevoked(token *jwt.Token) (bool, *Error) {
+	id, ok := token.Claims["ID"].(string)
+	if !ok || !IsObjectIDHex(id) {
+		return true, nil
+	}
+
+	sid, ok := token.Claims["sid"].(string)
+	if !ok || !IsObjectIDHex(sid) {
+		return true, nil
+	}
+
+	session, errM := app.Sessions.FindByID(ObjectIDHex(sid))
+	if errM != nil && !errM.Internal {
+		return true, nil
+	} else if errM != nil {
+		return false, errM
+	} else if !session.RevokedOn.IsZero() {
+		return true, nil
+	}
+
+	iat, _ := token.Claims["iat"].(float64)
+
+	user, errM := app.Users.FindByID(ObjectIDHex(id))
+	if errM != nil && !errM.Internal {
+		return true, nil
+	} else if errM != nil {
+		return false, errM
+	}
+
+	return int64(iat) < user.TokensValidAfter.Unix(), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
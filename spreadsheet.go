@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SheetWriter streams rows of a spreadsheet. Integers are written as numbers,
+// anything else as text.
+type SheetWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+// Spreadsheet formats offered by the admin exports.
+var sheetFormats = map[string]struct {
+	ContentType string
+	New         func(w io.Writer, name string) (SheetWriter, error)
+}{
+	"csv":  {"text/csv; charset=utf-8", NewCSVSheet},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", NewXLSXSheet},
+}
+
+type csvSheet struct {
+	w *csv.Writer
+}
+
+func NewCSVSheet(w io.Writer, name string) (SheetWriter, error) {
+	return &csvSheet{w: csv.NewWriter(w)}, nil
+}
+
+func (s *csvSheet) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = fmt.Sprint(value)
+
+		// Keep spreadsheet programs from running user input as a formula.
+		if _, ok := value.(string); ok && record[i] != "" && strings.ContainsRune("=+-@", rune(record[i][0])) {
+			record[i] = "'" + record[i]
+		}
+	}
+	return s.w.Write(record)
+}
+
+func (s *csvSheet) Close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// xlsxSheet writes a workbook with a single sheet. The sheet is the last part
+// of the archive, so rows go straight to the output.
+type xlsxSheet struct {
+	archive *zip.Writer
+	sheet   *bufio.Writer
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+
+func NewXLSXSheet(w io.Writer, name string) (SheetWriter, error) {
+	var escapedName bytes.Buffer
+	xml.EscapeText(&escapedName, []byte(name))
+
+	archive := zip.NewWriter(w)
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, escapedName.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(f, part.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := bufio.NewWriter(f)
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	return &xlsxSheet{archive: archive, sheet: sheet}, nil
+}
+
+func (s *xlsxSheet) WriteRow(values []interface{}) error {
+	s.sheet.WriteString("<row>")
+	for _, value := range values {
+		switch v := value.(type) {
+		case int:
+			fmt.Fprintf(s.sheet, `<c><v>%d</v></c>`, v)
+		default:
+			s.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(s.sheet, []byte(fmt.Sprint(v)))
+			s.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := s.sheet.WriteString("</row>")
+	return err
+}
+
+func (s *xlsxSheet) Close() error {
+	s.sheet.WriteString("</sheetData></worksheet>")
+	err := s.sheet.Flush()
+	if err != nil {
+		return err
+	}
+	return s.archive.Close()
+}
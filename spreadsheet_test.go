@@ -0,0 +1,57 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCSVSheetEscapesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	sheet, _ := NewCSVSheet(&buf, "Users")
+	sheet.WriteRow([]interface{}{"=HYPERLINK(\"x\")", "Jane", -3})
+	if err := sheet.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); got != "\"'=HYPERLINK(\"\"x\"\")\",Jane,-3\n" {
+		t.Errorf("expected formula to be escaped got %q", got)
+	}
+}
+
+func TestXLSXSheet(t *testing.T) {
+	var buf bytes.Buffer
+	sheet, err := NewXLSXSheet(&buf, "Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet.WriteRow([]interface{}{"Name", "Points"})
+	sheet.WriteRow([]interface{}{"Jane & John", 12})
+	if err = sheet.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data string
+	for _, f := range archive.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			b, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			data = string(b)
+		}
+	}
+	if len(archive.File) != 5 || data == "" {
+		t.Fatalf("expected a workbook with one sheet got %d parts", len(archive.File))
+	}
+
+	if !strings.Contains(data, "Jane &amp; John") || !strings.Contains(data, "<c><v>12</v></c>") {
+		t.Errorf("expected escaped text and numeric cell got %s", data)
+	}
+}
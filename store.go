@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// App holds the stores handlers read and write through. Handlers are methods
+// on it, so tests can serve the API from memory with NewMemoryApp.
+type App struct {
+	Users          UserStore
+	Organizations  OrganizationStore
+	News           NewsStore
+	Questions      QuestionStore
+	FAQs           FAQStore
+	Globals        GlobalsStore
+	Commitments    CommitmentStore
+	Families       FamilyStore
+	Sessions       SessionStore
+	UserCodes      UserCodeStore
+	EmailTemplates EmailTemplateStore
+
+	// The audit log, outbox, campaigns and data exports have no stores and
+	// are used through DB. It is empty for an App in memory.
+	db mongoDB
+}
+
+// NewMongoApp keeps everything in the given database. Its queries run in the
+// database's context until the App is bound to a request with WithContext.
+func NewMongoApp(db mongoDB) *App {
+	return &App{
+		Users:          &MongoUserStore{db},
+		Organizations:  &MongoOrganizationStore{db},
+		News:           &MongoNewsStore{db},
+		Questions:      &MongoQuestionStore{db},
+		FAQs:           &MongoFAQStore{db},
+		Globals:        &MongoGlobalsStore{db},
+		Commitments:    &MongoCommitmentStore{db},
+		Families:       &MongoFamilyStore{db},
+		Sessions:       &MongoSessionStore{db},
+		UserCodes:      &MongoUserCodeStore{db},
+		EmailTemplates: &MongoEmailTemplateStore{db},
+		db:             db,
+	}
+}
+
+// NewMemoryApp keeps everything in memory. It is meant for tests.
+func NewMemoryApp() *App {
+	organizations := NewMemoryOrganizationStore()
+	return &App{
+		Users:          NewMemoryUserStore(organizations),
+		Organizations:  organizations,
+		News:           NewMemoryNewsStore(),
+		Questions:      NewMemoryQuestionStore(),
+		FAQs:           NewMemoryFAQStore(),
+		Globals:        NewMemoryGlobalsStore(),
+		Commitments:    NewMemoryCommitmentStore(),
+		Families:       NewMemoryFamilyStore(),
+		Sessions:       NewMemorySessionStore(),
+		UserCodes:      NewMemoryUserCodeStore(),
+		EmailTemplates: NewMemoryEmailTemplateStore(),
+	}
+}
+
+// WithContext returns a copy of the App whose queries are cancelled with ctx.
+// An App in memory has nothing to cancel and is returned as is.
+func (app *App) WithContext(ctx context.Context) *App {
+	if app.db.Database == nil {
+		return app
+	}
+
+	return NewMongoApp(app.db.WithContext(ctx))
+}
+
+// AppHandlerFunc is a handler method of App, taken as (*App).Method so the App
+// can be bound to each request.
+type AppHandlerFunc func(app *App, w http.ResponseWriter, r *http.Request)
+
+// Bind serves an App handler with the App bound to the request's context, so
+// its queries stop when the request times out or the client goes away.
+func (app *App) Bind(h AppHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(app.WithContext(r.Context()), w, r)
+	}
+}
+
+// Atomically runs fn in a transaction if the database supports them, and as is
+// otherwise. fn gets an App bound to the transaction. Since that may not be
+// one, fn has to order its writes so that running it again after a failure
+// finishes the job.
+func (app *App) Atomically(fn func(app *App) *Error) *Error {
+	if !app.db.transactions {
+		return fn(app)
+	}
+
+	session, err := app.db.Client().StartSession()
+	if err != nil {
+		return &Error{Reason: fmt.Errorf("Error starting transaction: %s\n", err), Internal: true}
+	}
+	defer session.EndSession(app.db.ctx)
+
+	// The transaction is retried on transient errors, so errM is that of the
+	// last attempt.
+	var errM *Error
+	_, err = session.WithTransaction(app.db.ctx, func(ctx context.Context) (interface{}, error) {
+		errM = fn(app.WithContext(ctx))
+		if errM != nil {
+			return nil, errM.Reason
+		}
+		return nil, nil
+	})
+	if errM != nil {
+		return errM
+	} else if err != nil {
+		return &Error{Reason: fmt.Errorf("Error committing transaction: %s\n", err), Internal: true}
+	}
+
+	return nil
+}
+
+// DB returns the database, for the features that have no store. An App in
+// memory has no database.
+func (app *App) DB() (mongoDB, *Error) {
+	if app.db.Database == nil {
+		return mongoDB{}, &Error{Reason: errors.New(NO_DATABASE_ERROR), Code: http.StatusNotImplemented}
+	}
+
+	return app.db, nil
+}
+
+// UserFilter selects users. Empty fields match every user.
+type UserFilter struct {
+	Organization bson.ObjectID
+	Statuses     []string
+	Roles        []string
+}
+
+func (f UserFilter) Matches(u *User) bool {
+	return (f.Organization.IsZero() || u.Organization == f.Organization) &&
+		(len(f.Statuses) == 0 || Contains(f.Statuses, u.Status)) &&
+		(len(f.Roles) == 0 || Contains(f.Roles, u.Role))
+}
+
+// LeaderboardQuery picks a leaderboard of a season and how it is cut.
+// Viewer is nil for anonymous visitors.
+type LeaderboardQuery struct {
+	Season bson.ObjectID
+	Viewer *User
+	Board  string
+	SortBy string
+	Limit  int
+}
+
+type UserStore interface {
+	FindByID(id bson.ObjectID) (*User, *Error)
+	FindByEmail(email string) (*User, *Error)
+	FindByProvider(provider, subject string) (*User, *Error)
+	// FindByChallenge returns the user with an unexpired login challenge.
+	FindByChallenge(hash string) (*User, *Error)
+	Find(filter UserFilter) ([]User, *Error)
+	// Each calls fn for every user the filter selects, sorted by name, and
+	// stops at the first error.
+	Each(filter UserFilter, fn func(u *User) error) error
+	// Create adds a new user and fails with a conflict if the address is taken.
+	Create(u *User) *Error
+	// Save writes the fields of the user that are set, adding the user if needed.
+	Save(u *User) *Error
+	// Update sets and unsets top-level fields. set may be a struct or bson.M.
+	Update(id bson.ObjectID, set interface{}, unset ...string) *Error
+	Remove(id bson.ObjectID) *Error
+	// MoveOrganization moves the users of an organization to another one, or
+	// leaves them without one if to is the zero ID.
+	MoveOrganization(from, to bson.ObjectID) *Error
+	// UseTOTPStep records a TOTP time step. It reports false if the step, or
+	// a later one, was used before.
+	UseTOTPStep(id bson.ObjectID, step int64) (bool, *Error)
+	// UseBackupCode removes a backup code and reports false if there was none.
+	UseBackupCode(id bson.ObjectID, hash string) (bool, *Error)
+	// RemoveIdentity unlinks a provider. It reports false if the user would
+	// be left without a way to log in.
+	RemoveIdentity(id bson.ObjectID, provider string) (bool, *Error)
+	// AddParticipant adds a participant and moves the user's next participant
+	// ID past it. It reports false if the ID is taken or below the next one.
+	AddParticipant(id bson.ObjectID, p *Participant) (bool, *Error)
+	UpdateParticipant(id bson.ObjectID, p *Participant) *Error
+	RemoveParticipant(id bson.ObjectID, participant int) *Error
+	// SetScorecardDay marks or unmarks a day and adjusts the participant's
+	// points, unless the day already is as asked.
+	SetScorecardDay(id bson.ObjectID, participant, day int, done bool) *Error
+	Leaderboard(q LeaderboardQuery) ([]LeaderboardEntry, *Error)
+}
+
+type OrganizationStore interface {
+	// FindAll returns the approved organizations.
+	FindAll() ([]Organization, *Error)
+	FindByID(id bson.ObjectID) (*Organization, *Error)
+	FindByName(name string) (*Organization, *Error)
+	// FindRequests returns the organizations waiting for approval, oldest first.
+	FindRequests() ([]Organization, *Error)
+	FindRequest(id bson.ObjectID) (*Organization, *Error)
+	// Create adds an organization unless one with the name exists.
+	Create(name string, needsApproval bool) *Error
+	// Request proposes an organization, or adds the requester to a proposal.
+	Request(name, email string) *Error
+	Approve(id bson.ObjectID) *Error
+	// Import adds or approves an organization and sets its time zone, if given.
+	Import(name, timeZone string) *Error
+	// Save replaces an organization.
+	Save(org *Organization) *Error
+	Rename(id bson.ObjectID, name string) *Error
+	// Remove removes an organization. Removing one that is gone is no error.
+	Remove(id bson.ObjectID) *Error
+}
+
+type NewsStore interface {
+	// FindPublished returns published news, including news for admins if asked.
+	FindPublished(adminNews bool) ([]News, *Error)
+	FindAll() ([]News, *Error)
+	FindByID(id bson.ObjectID) (*News, *Error)
+	Save(n *News) *Error
+	Remove(id bson.ObjectID) *Error
+}
+
+type QuestionStore interface {
+	// FindEnabled returns the question enabled in the season, or nil.
+	FindEnabled(season bson.ObjectID) (*Question, *Error)
+	FindByID(id bson.ObjectID) (*Question, *Error)
+	FindAll() ([]Question, *Error)
+	FindBySeason(season bson.ObjectID) ([]Question, *Error)
+	FindByRespondent(email string) ([]Question, *Error)
+	Save(q *Question) *Error
+	Remove(id bson.ObjectID) *Error
+	Enable(id bson.ObjectID) *Error
+	// RenameRespondent moves answers recorded for one address to another.
+	RenameRespondent(old, email string) *Error
+}
+
+type FAQStore interface {
+	FindAll() ([]FAQ, *Error)
+	Save(f *FAQ) *Error
+	// Update replaces an existing FAQ.
+	Update(f *FAQ) *Error
+	Remove(id bson.ObjectID) *Error
+}
+
+// GlobalsStore keeps the seasons, whose settings are the globals, and the
+// registrations archived when a season ends.
+type GlobalsStore interface {
+	// FindSeasons returns every season, latest first.
+	FindSeasons() ([]Season, *Error)
+	FindSeasonByID(id bson.ObjectID) (*Season, *Error)
+	FindCurrentSeason() (*Season, *Error)
+	// SaveSeason replaces a season, adding it if needed.
+	SaveSeason(s *Season) *Error
+	// ArchiveRegistration stores a registration, replacing an earlier
+	// archive of the same user and season.
+	ArchiveRegistration(reg *Registration) *Error
+	FindRegistrations(season bson.ObjectID) ([]Registration, *Error)
+	FindUserRegistrations(user bson.ObjectID) ([]Registration, *Error)
+	RemoveUserRegistrations(user bson.ObjectID) *Error
+}
+
+type CommitmentStore interface {
+	FindAll() ([]Commitment, *Error)
+	FindByName(name string) (*Commitment, *Error)
+	// Add adds a commitment to a category, creating the category if needed.
+	Add(category, commitment string) *Error
+}
+
+type FamilyStore interface {
+	Exists(code string) bool
+	Create(code string) *Error
+}
+
+type SessionStore interface {
+	Create(s *Session) *Error
+	FindByID(id bson.ObjectID) (*Session, *Error)
+	// Rotate swaps the refresh token hash of a live session for a new one.
+	// A hash that was swapped before revokes the session it belonged to.
+	Rotate(hash, newHash string) (*Session, *Error)
+	Revoke(id bson.ObjectID) *Error
+	RevokeByHash(hash string) *Error
+	RevokeUser(user bson.ObjectID) *Error
+	FindByUser(user bson.ObjectID) ([]Session, *Error)
+	RemoveUser(user bson.ObjectID) *Error
+}
+
+type UserCodeStore interface {
+	Create(code *UserCode) *Error
+	// Use marks an unused code for one of the purposes as used and returns it.
+	Use(hash string, purposes ...string) (*UserCode, *Error)
+	// Revoke marks the user's unused codes for the purpose, or for every
+	// purpose if it is empty, as used.
+	Revoke(user bson.ObjectID, purpose string) *Error
+	// RemoveStale removes codes used or expired before the cutoff.
+	RemoveStale(cutoff time.Time) (int, *Error)
+	RemoveUser(user bson.ObjectID) *Error
+}
+
+type EmailTemplateStore interface {
+	// FindAll returns the stored templates sorted by name.
+	FindAll() ([]EmailTemplate, *Error)
+	FindByName(name string) (*EmailTemplate, *Error)
+	Save(t *EmailTemplate) *Error
+	Remove(name string) *Error
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	totpIssuer        = "Nutrition Habit Challenge"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	backupCodeCount   = 10
+	challengeLifetime = 5 * time.Minute
+)
+
+// RequireAdminTwoFactor forces global admins to enroll before they get a
+// session. It is set from REQUIRE_ADMIN_2FA.
+var RequireAdminTwoFactor bool
+
+type TwoFactorMessage struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// SetupTwoFactor starts enrollment with a new secret that only takes effect
+// once a code for it is confirmed with EnableTwoFactor.
+func (app *App) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	message, ok := decodeTwoFactorMessage(w, r)
+	if !ok {
+		return
+	}
+
+	user, errM := app.TwoFactorUser(w, r, message.Challenge)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.TOTPEnabled {
+		BR(w, r, errors.New(TWO_FACTOR_ENABLED_ERROR), http.StatusConflict)
+		return
+	}
+
+	secret := NewTOTPSecret()
+	errM = app.Users.Update(user.ID, bson.M{"totpPendingSecret": secret})
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"secret": secret, "uri": TOTPURI(secret, user.Email)}, http.StatusOK)
+}
+
+// EnableTwoFactor confirms enrollment and hands out backup codes. Users who
+// enroll from a login challenge also get their session.
+func (app *App) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := logger.WithField("method", "EnableTwoFactor")
+
+	message, ok := decodeTwoFactorMessage(w, r)
+	if !ok {
+		return
+	}
+
+	user, errM := app.TwoFactorUser(w, r, message.Challenge)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if user.TOTPPendingSecret == "" {
+		BR(w, r, errors.New(TWO_FACTOR_SETUP_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	step, ok := ValidateTOTP(user.TOTPPendingSecret, message.Code, time.Now())
+	if !ok {
+		BR(w, r, errors.New(TWO_FACTOR_CODE_ERROR), http.StatusUnauthorized)
+		return
+	}
+
+	codes, errM := app.EnableUserTwoFactor(user, step)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ctx.WithField("user", user.Email).Info("User enabled two-factor authentication.")
+
+	if message.Challenge == "" {
+		ServeJSON(w, r, &Response{"backupCodes": codes}, http.StatusOK)
+		return
+	}
+
+	response, errM := app.StartSession(r, user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+	(*response)["backupCodes"] = codes
+
+	ServeJSON(w, r, response, http.StatusOK)
+}
+
+// VerifyTwoFactor completes a login with a TOTP or backup code.
+func (app *App) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	message, ok := decodeTwoFactorMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if message.Challenge == "" {
+		BR(w, r, errors.New(MISSING_FIELDS_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	user, errM := app.Users.FindByChallenge(HashToken(message.Challenge))
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		BR(w, r, errors.New(TWO_FACTOR_SETUP_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if time.Now().Before(user.LockedUntil) {
+		BR(w, r, errors.New(ACCOUNT_LOCKED_ERROR), http.StatusLocked)
+		return
+	}
+
+	errM = app.CheckTwoFactorCode(user, message.Code)
+	if errM != nil {
+		app.RecordLoginFailure(user)
+		HandleModelError(w, r, errM)
+		return
+	}
+	ResetLoginFailures(user)
+
+	response, errM := app.StartSession(r, user)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, response, http.StatusOK)
+}
+
+func (app *App) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	message, ok := decodeTwoFactorMessage(w, r)
+	if !ok {
+		return
+	}
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		BR(w, r, errors.New(TWO_FACTOR_SETUP_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	if user.TwoFactorRequired() {
+		BR(w, r, errors.New(TWO_FACTOR_REQUIRED_ERROR), http.StatusForbidden)
+		return
+	}
+
+	errM = app.CheckTwoFactorCode(user, message.Code)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	errM = app.Users.Update(user.ID, nil, "totpEnabled", "totpSecret", "totpPendingSecret", "totpLastStep",
+		"backupCodes")
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"status": "Two-factor authentication disabled."}, http.StatusOK)
+}
+
+// RegenerateBackupCodes replaces all backup codes of the user.
+func (app *App) RegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	message, ok := decodeTwoFactorMessage(w, r)
+	if !ok {
+		return
+	}
+
+	tokenData := GetToken(w, r)
+	if tokenData == nil {
+		return
+	}
+
+	user, errM := app.GetUserFromToken(tokenData)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		BR(w, r, errors.New(TWO_FACTOR_SETUP_ERROR), http.StatusBadRequest)
+		return
+	}
+
+	errM = app.CheckTwoFactorCode(user, message.Code)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	codes, hashes := NewBackupCodes()
+	errM = app.Users.Update(user.ID, bson.M{"backupCodes": hashes})
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	ServeJSON(w, r, &Response{"backupCodes": codes}, http.StatusOK)
+}
+
+func decodeTwoFactorMessage(w http.ResponseWriter, r *http.Request) (*TwoFactorMessage, bool) {
+	var message TwoFactorMessage
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil {
+		BR(w, r, errors.New(PARSE_ERROR), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &message, true
+}
+
+// TwoFactorUser returns the user enrolling, identified either by a login
+// challenge or, for users who are already logged in, by their token.
+func (app *App) TwoFactorUser(w http.ResponseWriter, r *http.Request, challenge string) (*User, *Error) {
+	if challenge != "" {
+		return app.Users.FindByChallenge(HashToken(challenge))
+	}
+
+	if !IsTokenSet(r) {
+		return nil, &Error{Reason: errors.New(MISSING_TOKEN_ERROR), Code: http.StatusUnauthorized}
+	}
+
+	return app.GetUserFromToken(GetToken(w, r))
+}
+
+// TwoFactorRequired reports whether the user may not get a session without 2FA.
+func (u *User) TwoFactorRequired() bool {
+	return RequireAdminTwoFactor && (u.Role == GLOBAL_ADMIN.String() || u.Role == GLOBAL_SUPER_ADMIN.String())
+}
+
+// CreateChallenge stores a short-lived token that stands in for the user
+// until they pass the second factor.
+func (app *App) CreateChallenge(u *User) (string, *Error) {
+	challenge := RandToken()
+	errM := app.Users.Update(u.ID, bson.M{"challenge": HashToken(challenge),
+		"challengeExpires": time.Now().Add(challengeLifetime)})
+	if errM != nil {
+		return "", errM
+	}
+
+	return challenge, nil
+}
+
+// EnableUserTwoFactor makes the pending secret the user's secret and returns
+// a fresh set of backup codes.
+func (app *App) EnableUserTwoFactor(u *User, step int64) ([]string, *Error) {
+	codes, hashes := NewBackupCodes()
+	errM := app.Users.Update(u.ID, bson.M{"totpEnabled": true, "totpSecret": u.TOTPPendingSecret,
+		"totpLastStep": step, "backupCodes": hashes}, "totpPendingSecret")
+	if errM != nil {
+		return nil, errM
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPSecret = u.TOTPPendingSecret
+	u.TOTPPendingSecret = ""
+
+	return codes, nil
+}
+
+// CheckTwoFactorCode accepts a current TOTP code or an unused backup code.
+// Each code works only once.
+func (app *App) CheckTwoFactorCode(u *User, code string) *Error {
+	var used bool
+	var errM *Error
+	if step, ok := ValidateTOTP(u.TOTPSecret, code, time.Now()); ok {
+		used, errM = app.Users.UseTOTPStep(u.ID, step)
+	} else {
+		used, errM = app.Users.UseBackupCode(u.ID, HashToken(NormalizeBackupCode(code)))
+	}
+	if errM != nil {
+		return errM
+	}
+
+	if !used {
+		return &Error{Reason: errors.New(TWO_FACTOR_CODE_ERROR), Code: http.StatusUnauthorized}
+	}
+
+	return nil
+}
+
+// NewBackupCodes returns codes to show the user once and the hashes to store.
+func NewBackupCodes() (codes []string, hashes []string) {
+	for i := 0; i < backupCodeCount; i++ {
+		code := RandToken()[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, HashToken(code))
+	}
+	return
+}
+
+func NormalizeBackupCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+func NewTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// TOTPURI is the provisioning URI authenticator apps read from a QR code.
+func TOTPURI(secret string, email string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", fmt.Sprint(totpDigits))
+
+	label := strings.Replace(url.QueryEscape(totpIssuer+":"+email), "+", "%20", -1)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPCode computes the RFC 6238 code for a time step.
+func TOTPCode(key []byte, step int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// ValidateTOTP checks a code against the steps around t and returns the step
+// it matched, so callers can refuse to accept it again.
+func ValidateTOTP(secret string, code string, t time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	code = strings.TrimSpace(code)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := t.Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(key, step, totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
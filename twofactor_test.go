@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vector, truncated to six digits.
+	key := []byte("12345678901234567890")
+	if code := TOTPCode(key, 59/totpPeriod, 8); code != "94287082" {
+		t.Errorf("expected 94287082 got %s", code)
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	now := time.Unix(59, 0)
+
+	if step, ok := ValidateTOTP(secret, "287082", now); !ok || step != 1 {
+		t.Errorf("expected code to match step 1 got %d, %t", step, ok)
+	}
+
+	// One step either side is allowed for clock drift, but no further.
+	if _, ok := ValidateTOTP(secret, "287082", now.Add(totpPeriod*time.Second)); !ok {
+		t.Errorf("expected code from the previous step to be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, "287082", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Errorf("expected stale code to be rejected")
+	}
+}
+
+func TestTwoFactorCodesAreSingleUse(t *testing.T) {
+	s := newTestServer(t)
+	token := s.signUp("jane@example.com")
+
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	if code := s.do("POST", "/auth/2fa/setup", token, Response{}, &setup); code != http.StatusOK {
+		t.Fatalf("setup: expected status 200 got %d", code)
+	}
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(setup.Secret)
+	step := time.Now().Unix() / totpPeriod
+
+	var enabled struct {
+		BackupCodes []string `json:"backupCodes"`
+	}
+	if code := s.do("POST", "/auth/2fa/enable", token, Response{"code": TOTPCode(key, step, totpDigits)}, &enabled); code != http.StatusOK {
+		t.Fatalf("enable: expected status 200 got %d", code)
+	}
+
+	// verify logs in again and completes the challenge with the code.
+	verify := func(code string) int {
+		var login struct {
+			Challenge string `json:"challenge"`
+		}
+		s.do("POST", "/auth/login", "", Response{"email": "jane@example.com", "password": "secret"}, &login)
+		return s.do("POST", "/auth/2fa/verify", "", Response{"challenge": login.Challenge, "code": code}, nil)
+	}
+
+	backup := enabled.BackupCodes[0]
+	if code := verify(backup); code != http.StatusOK {
+		t.Fatalf("expected backup code to be accepted got %d", code)
+	}
+	if code := verify(backup); code == http.StatusOK {
+		t.Errorf("expected used backup code to be rejected")
+	}
+	user, _ := s.app.Users.FindByEmail("jane@example.com")
+	if len(user.BackupCodes) != backupCodeCount-1 {
+		t.Errorf("expected %d backup codes left got %d", backupCodeCount-1, len(user.BackupCodes))
+	}
+
+	next := TOTPCode(key, step+1, totpDigits)
+	if code := verify(next); code != http.StatusOK {
+		t.Fatalf("expected TOTP code to be accepted got %d", code)
+	}
+	if code := verify(next); code == http.StatusOK {
+		t.Errorf("expected replayed TOTP step to be rejected")
+	}
+}
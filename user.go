@@ -3,47 +3,72 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/mail"
+	"strings"
 	"time"
 
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type User struct {
-	ID           bson.ObjectId `bson:"_id" json:"-"`
+	ID           bson.ObjectID `bson:"_id" json:"-"`
 	Email        string        `bson:"email" json:"email"`
 	Password     string        `bson:"password,omitempty" json:"-"`
 	FirstName    string        `bson:"firstName,omitempty" json:"firstName,omitempty"`
 	LastName     string        `bson:"lastName,omitempty" json:"lastName,omitempty"`
 	Family       string        `bson:"family,omitempty" json:"family,omitempty"`
-	Organization string        `bson:"organization,omitempty" json:"organization,omitempty"`
+	Organization bson.ObjectID `bson:"organization,omitempty" json:"organization,omitzero"`
 	Team         string        `bson:"team,omitempty" json:"team,omitempty"`
 	Sharing      string        `bson:"sharing,omitempty" json:"sharing,omitempty"`
+	TimeZone     string        `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
 	Comment      string        `bson:"comment,omitempty" json:"comment,omitempty"`
 	Referral     string        `bson:"referral,omitempty" json:"referral,omitempty"`
 	Donation     string        `bson:"donation,omitempty" json:"donation,omitempty"`
 	Picture      string        `bson:"picture,omitempty" json:"picture,omitempty"`
-	Facebook     string        `bson:"facebook,omitempty" json:"facebook,omitempty"`
-	Google       string        `bson:"google,omitempty" json:"google,omitempty"`
+	Identities   []Identity    `bson:"identities,omitempty" json:"identities,omitempty"`
 	Role         string        `bson:"role,omitempty" json:"role,omitempty"`
 	Status       string        `bson:"status,omitempty" json:"status,omitempty"`
 	Participants []Participant `bson:"participants,omitempty" json:"participants,omitempty"`
-	ResetCode    string        `bson:"resetCode,omitempty" json:"-"`
-	Code         string        `bson:"code,omitempty" json:"-"`
+	Season       bson.ObjectID `bson:"season,omitempty" json:"season,omitempty"`
 	CreatedOn    time.Time     `bson:"createdOn,omitempty" json:"createdOn,omitempty"`
 	LastLogin    time.Time     `bson:"lastLogin,omitempty" json:"lastLogin,omitempty"`
+
+	// Participants added later get IDs from here on, so IDs of removed
+	// participants are not handed out again.
+	NextParticipantID int `bson:"nextParticipantId,omitempty" json:"-"`
+
+	// Access tokens issued before this are rejected.
+	TokensValidAfter time.Time `bson:"tokensValidAfter,omitempty" json:"-"`
+	// Set after too many failed logins; the user cannot log in until then.
+	LockedUntil time.Time `bson:"lockedUntil,omitempty" json:"lockedUntil,omitempty"`
+
+	// Two-factor authentication. Backup codes are stored hashed.
+	TOTPEnabled       bool      `bson:"totpEnabled,omitempty" json:"twoFactorEnabled,omitempty"`
+	TOTPSecret        string    `bson:"totpSecret,omitempty" json:"-"`
+	TOTPPendingSecret string    `bson:"totpPendingSecret,omitempty" json:"-"`
+	TOTPLastStep      int64     `bson:"totpLastStep,omitempty" json:"-"`
+	BackupCodes       []string  `bson:"backupCodes,omitempty" json:"-"`
+	Challenge         string    `bson:"challenge,omitempty" json:"-"`
+	ChallengeExpires  time.Time `bson:"challengeExpires,omitempty" json:"-"`
+}
+
+// Identity is an account with a login provider that the user can log in with.
+type Identity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedOn time.Time `bson:"linkedOn,omitempty" json:"linkedOn,omitempty"`
 }
 
 type LimitedUser struct {
-	ID           bson.ObjectId `bson:"_id" json:"-"`
+	ID           bson.ObjectID `bson:"_id" json:"-"`
 	Email        string        `bson:"email" json:"email"`
 	FirstName    string        `bson:"firstName,omitempty" json:"firstName,omitempty"`
 	LastName     string        `bson:"lastName,omitempty" json:"lastName,omitempty"`
 	Family       string        `bson:"family,omitempty" json:"family,omitempty"`
-	Organization string        `bson:"organization,omitempty" json:"organization,omitempty"`
+	Organization bson.ObjectID `bson:"organization,omitempty" json:"organization,omitzero"`
 	Team         string        `bson:"team,omitempty" json:"team,omitempty"`
 	Comment      string        `bson:"comment,omitempty" json:"comment,omitempty"`
 	Referral     string        `bson:"referral,omitempty" json:"referral,omitempty"`
@@ -53,33 +78,33 @@ type LimitedUser struct {
 }
 
 type UserEditData struct {
-	Email        string `bson:"email" json:"email"`
-	FirstName    string `bson:"firstName,omitempty" json:"firstName,omitempty"`
-	LastName     string `bson:"lastName,omitempty" json:"lastName,omitempty"`
-	Family       string `bson:"family,omitempty" json:"family,omitempty"`
-	Organization string `bson:"organization,omitempty" json:"organization,omitempty"`
-	Team         string `bson:"team,omitempty" json:"team,omitempty"`
-	Role         string `bson:"role,omitempty" json:"role,omitempty"`
-	Status       string `bson:"status,omitempty" json:"status,omitempty"`
+	Email        string        `bson:"email" json:"email"`
+	FirstName    string        `bson:"firstName,omitempty" json:"firstName,omitempty"`
+	LastName     string        `bson:"lastName,omitempty" json:"lastName,omitempty"`
+	Family       string        `bson:"family,omitempty" json:"family,omitempty"`
+	Organization bson.ObjectID `bson:"organization,omitempty" json:"organization,omitzero"`
+	Team         string        `bson:"team,omitempty" json:"team,omitempty"`
+	Role         string        `bson:"role,omitempty" json:"role,omitempty"`
+	Status       string        `bson:"status,omitempty" json:"status,omitempty"`
 }
 
-func UpdateSelf(w http.ResponseWriter, r *http.Request) {
+func (app *App) UpdateSelf(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
 	type UserUpdateData struct {
-		FirstName    string `json:"firstName,omitempty"`
-		LastName     string `json:"lastName,omitempty"`
-		Organization string `json:"organization,omitempty"`
+		FirstName    string        `json:"firstName,omitempty"`
+		LastName     string        `json:"lastName,omitempty"`
+		Organization bson.ObjectID `json:"organization,omitzero"`
+		TimeZone     string        `json:"timeZone,omitempty"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -98,13 +123,25 @@ func UpdateSelf(w http.ResponseWriter, r *http.Request) {
 		user.LastName = userUpdateData.LastName
 	}
 
+	if userUpdateData.TimeZone != "" {
+		if _, err := time.LoadLocation(userUpdateData.TimeZone); err != nil {
+			BR(w, r, errors.New(TIMEZONE_ERROR), http.StatusBadRequest)
+			return
+		}
+		user.TimeZone = userUpdateData.TimeZone
+	}
+
 	// Changing your organization resets your role to user.
-	if userUpdateData.Organization != "" {
+	if !userUpdateData.Organization.IsZero() {
+		if _, errM := app.Organizations.FindByID(userUpdateData.Organization); errM != nil {
+			BR(w, r, errors.New(ORGANIZATION_ERROR), http.StatusBadRequest)
+			return
+		}
 		user.Organization = userUpdateData.Organization
 		user.Role = USER.String()
 	}
 
-	errM = user.Save(db)
+	errM = app.Users.Save(user)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -113,24 +150,19 @@ func UpdateSelf(w http.ResponseWriter, r *http.Request) {
 	ServeJSON(w, r, &Response{"status": "User profile updated successfully."}, http.StatusOK)
 }
 
-func GetUsers(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "admin") {
-		return
-	}
-
+func (app *App) GetUsers(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	user, errM := GetUserFromToken(db, tokenData)
+	user, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
-	users, errM := FindLimitedUsers(db, user)
+	users, errM := app.FindLimitedUsers(user)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -140,18 +172,13 @@ func GetUsers(w http.ResponseWriter, r *http.Request) {
 	ServeJSONArray(w, r, string(b), http.StatusOK)
 }
 
-func EditUser(w http.ResponseWriter, r *http.Request) {
-	if !IsAuthorized(w, r, "admin") {
-		return
-	}
-
+func (app *App) EditUser(w http.ResponseWriter, r *http.Request) {
 	tokenData := GetToken(w, r)
 	if tokenData == nil {
 		return
 	}
 
-	db := GetDB(w, r)
-	callingUser, errM := GetUserFromToken(db, tokenData)
+	callingUser, errM := app.GetUserFromToken(tokenData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
@@ -166,207 +193,203 @@ func EditUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only global admins can change a user's role or status.
-	if callingUser.Role != GLOBAL_ADMIN.String() && callingUser.Role != GLOBAL_SUPER_ADMIN.String() {
+	if !callingUser.Can(USERS_EDIT_ROLES) {
 		userEditData.Role = ""
 		userEditData.Status = ""
 	}
 
-	errM = UpdateUser(db, &userEditData)
+	if userEditData.Role != "" {
+		role, ok := ParseRole(userEditData.Role)
+		if !ok {
+			BR(w, r, errors.New(BAD_CHOICE_ERROR), http.StatusBadRequest)
+			return
+		}
+
+		// Nobody can hand out a role above their own, themselves included.
+		if mine, _ := ParseRole(callingUser.Role); role > mine {
+			BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
+			return
+		}
+	}
+
+	if !userEditData.Organization.IsZero() {
+		if _, errM := app.Organizations.FindByID(userEditData.Organization); errM != nil {
+			BR(w, r, errors.New(ORGANIZATION_ERROR), http.StatusBadRequest)
+			return
+		}
+
+		// Org admins cannot move users into another organization.
+		if !callingUser.CanAccess(USERS_EDIT, userEditData.Organization) {
+			BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
+			return
+		}
+	}
+
+	before, errM := app.Users.FindByEmail(userEditData.Email)
+	if errM != nil {
+		HandleModelError(w, r, errM)
+		return
+	}
+
+	// Org admins can only edit users of their own organization, and nobody
+	// can edit a user that outranks them.
+	if !callingUser.CanAccess(USERS_EDIT, before.Organization) || before.Outranks(callingUser) {
+		BR(w, r, errors.New(FORBIDDEN_ERROR), http.StatusForbidden)
+		return
+	}
+
+	errM = app.Users.Update(before.ID, &userEditData)
 	if errM != nil {
 		HandleModelError(w, r, errM)
 		return
 	}
 
+	after, _ := app.Users.FindByEmail(userEditData.Email)
+	AuditChange(r, userEditData.Email, before, after)
+
+	// A user whose role or status changed has to log in again to pick it up.
+	if after != nil && (after.Role != before.Role || after.Status != before.Status) {
+		errM = app.RevokeUserSessions(after)
+		if errM != nil {
+			HandleModelError(w, r, errM)
+			return
+		}
+	}
+
 	ServeJSON(w, r, &Response{"status": "User successfully updated."}, http.StatusOK)
 }
 
-func (u *User) Save(db *mgo.Database) (errM *Error) {
-	ctx := logger.WithField("method", "User_Save")
-
-	uC := db.C("users")
-	_, err := uC.UpsertId(u.ID, bson.M{"$set": u})
-	if err != nil {
-		if mgo.IsDup(err) {
-			ctx.WithError(err).WithField("user", u.Email).Warn("Failed to create user. User already exists.")
-			errM = &Error{Internal: false, Reason: errors.New("That user already exists. Please login first."), Code: http.StatusConflict}
-		} else {
-			errM = &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Error updating user: %s\n", err))}
+// FindParticipant returns the user's participant with the given ID, or nil.
+func (u *User) FindParticipant(id int) *Participant {
+	for i := range u.Participants {
+		if u.Participants[i].ID == id {
+			return &u.Participants[i]
 		}
-		return
 	}
+	return nil
+}
 
+func NewUser() (u *User) {
+	u = &User{}
+	u.ID = bson.NewObjectID()
 	return
 }
 
-func (u *User) Verify(db *mgo.Database) (errM *Error) {
-	uC := db.C("users")
-	u.Status = UNREGISTERED.String()
-	errM = u.Save(db)
-	if errM != nil {
+func (app *App) FindLimitedUsers(u *User) (users []LimitedUser, errM *Error) {
+	filter, ok := LimitedUsersQuery(u)
+	if !ok {
 		return
 	}
 
-	update := bson.M{"$unset": bson.M{"code": ""}}
-	err := uC.UpdateId(u.ID, update)
-	if err != nil {
-		errM = &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Failed to remove user's code: %s\n", err))}
+	all, errM := app.Users.Find(filter)
+	if errM != nil {
 		return
 	}
 
-	return
-}
+	for _, user := range all {
+		users = append(users, LimitedUser{ID: user.ID, Email: user.Email, FirstName: user.FirstName,
+			LastName: user.LastName, Family: user.Family, Organization: user.Organization, Team: user.Team,
+			Comment: user.Comment, Referral: user.Referral, Role: user.Role, Status: user.Status,
+			LastLogin: user.LastLogin})
+	}
 
-func NewUser() (u *User) {
-	u = &User{}
-	u.ID = bson.NewObjectId()
 	return
 }
 
-func FindLimitedUsers(db *mgo.Database, u *User) (users []LimitedUser, errM *Error) {
-	c := db.C("users")
-
-	// If user is global admin, return all users. Otherwise just users in the user's org.
-	if u.Role == GLOBAL_ADMIN.String() || u.Role == GLOBAL_SUPER_ADMIN.String() {
-		err := c.Find(nil).All(&users)
-		if err != nil {
-			errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving users from DB: %s", err)), Internal: true}
-			return
-		}
-	} else {
-		err := c.Find(bson.M{"organization": u.Organization}).All(&users)
-		if err != nil {
-			errM = &Error{Reason: errors.New(fmt.Sprintf("Error retrieving users from DB: %s", err)), Internal: true}
-			return
+// LimitedUsersQuery selects the users u may see: everyone for global admins,
+// otherwise just users in the user's org. It reports false if there are none.
+func LimitedUsersQuery(u *User) (UserFilter, bool) {
+	switch u.Scope(USERS_VIEW) {
+	case GLOBAL_SCOPE:
+		return UserFilter{}, true
+	case ORG_SCOPE:
+		if u.Organization.IsZero() {
+			return UserFilter{}, false
 		}
+		return UserFilter{Organization: u.Organization}, true
 	}
-
-	return
+	return UserFilter{}, false
 }
 
-func CreateUser(db *mgo.Database, u *User) *Error {
-	ctx := logger.WithField("method", "CreateUser")
+// NormalizeEmail returns the bare address of an e-mail in lower case, so
+// "Jane <JANE@example.com>" is jane@example.com. Users are stored and looked
+// up by it. Invalid addresses are only lowered.
+func NormalizeEmail(email string) string {
+	if address, err := mail.ParseAddress(email); err == nil {
+		email = address.Address
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
 
-	uC := db.C("users")
+func (app *App) CreateUser(u *User) *Error {
+	u.Email = NormalizeEmail(u.Email)
 	pwHash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return &Error{Reason: errors.New("Couldn't hash password."), Internal: true}
 	}
 	u.Password = string(pwHash)
-	u.ID = bson.NewObjectId()
+	u.ID = bson.NewObjectID()
 	u.CreatedOn = time.Now()
 	u.LastLogin = time.Now()
-	err = uC.Insert(u)
-	if mgo.IsDup(err) {
-		ctx.WithError(err).WithField("user", u.Email).Warn("Failed to create user. User already exists.")
-		return &Error{Reason: errors.New("User already exists. Please log in instead."), Internal: false, Code: 409}
-	}
-	return nil
+	return app.Users.Create(u)
 }
 
-func AuthUser(db *mgo.Database, email, password string) (*User, *Error) {
+func (app *App) AuthUser(email, password string) (*User, *Error) {
 	ctx := logger.WithField("method", "AuthUser")
 
-	uC := db.C("users")
-	user := &User{}
-	err := uC.Find(bson.M{"email": email}).One(user)
-
-	if err == mgo.ErrNotFound || user.ID == "" {
-		ctx.WithError(err).WithField("email", email).Warn("User autentication failed because user does not exist.")
+	user, errM := app.Users.FindByEmail(email)
+	if errM != nil && !errM.Internal {
+		ctx.WithField("email", email).Warn("User autentication failed because user does not exist.")
 		return nil, &Error{Reason: errors.New("User wasn't found on our servers"), Internal: false}
-	} else if err != nil {
+	} else if errM != nil {
+		return nil, errM
+	}
 
-		return nil, &Error{Reason: err, Internal: true}
+	if time.Now().Before(user.LockedUntil) {
+		ctx.WithField("email", email).Warn("User authentication failed because the account is locked.")
+		return nil, &Error{Reason: errors.New(ACCOUNT_LOCKED_ERROR), Code: http.StatusLocked}
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
 		ctx.WithError(err).WithField("email", email).Warn("User authentication failed due to bad password.")
+		app.RecordLoginFailure(user)
 		return nil, &Error{Reason: errors.New("Incorrect password"), Internal: false, Code: http.StatusUnauthorized}
 	}
 
-	return user, nil
-}
+	ResetLoginFailures(user)
 
-func FindUserByQuery(db *mgo.Database, query bson.M) (*User, *Error) {
-	ctx := logger.WithField("method", "FindUserByQuery").WithField("query", query)
-
-	uC := db.C("users")
-	user := &User{}
-	err := uC.Find(query).One(user)
-	if err == mgo.ErrNotFound || user.ID == "" {
-		ctx.WithError(err).Warn("User not found.")
-		return nil, &Error{Reason: errors.New("No user found."), Internal: false, Code: http.StatusNotFound}
-	} else if err != nil {
-		ctx.WithError(err).Error("Failed to query for user.")
-		return nil, &Error{Reason: err, Internal: true}
-	}
 	return user, nil
 }
 
-func FindUserById(db *mgo.Database, id bson.ObjectId) (*User, *Error) {
-	ctx := logger.WithField("method", "FindUserById").WithField("id", id)
-
-	uC := db.C("users")
-	user := &User{}
-	err := uC.FindId(id).One(user)
-
-	if err == mgo.ErrNotFound || user.ID == "" {
-		ctx.WithError(err).Warn("User not found.")
-		return nil, &Error{Reason: errors.New("User not found."), Internal: false, Code: http.StatusUnauthorized}
-	} else if err != nil {
-		ctx.WithError(err).Error("Failed to query for user by id.")
-		return nil, &Error{Reason: fmt.Errorf("mGo error: %s\n", err), Internal: true}
+// AddIdentity links the provider's account to the user, filling in the
+// picture if the user has none.
+func (u *User) AddIdentity(provider string, claims *OIDCClaims) {
+	u.Identities = append(u.Identities, Identity{Provider: provider, Subject: claims.Subject,
+		Email: claims.Email, LinkedOn: time.Now()})
+	if u.Picture == "" {
+		u.Picture = claims.Picture
 	}
-
-	return user, nil
 }
 
-func FindUserByProvider(db *mgo.Database, provider, sub string) (*User, *Error) {
-	return FindUserByQuery(db, bson.M{provider: sub})
-}
-
-func FindUserByCode(db *mgo.Database, code string) (*User, *Error) {
-	return FindUserByQuery(db, bson.M{"code": code})
-}
-
-func FindUserByResetCode(db *mgo.Database, code string) (*User, *Error) {
-	return FindUserByQuery(db, bson.M{"resetCode": code})
-}
-
-func FindUserByEmail(db *mgo.Database, email string) (*User, *Error) {
-	return FindUserByQuery(db, bson.M{"email": email})
-}
-
-func ChangePassword(db *mgo.Database, u *User, password string) (errM *Error) {
-	c := db.C("users")
+func (app *App) ChangePassword(u *User, password string) (errM *Error) {
 	pwHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return &Error{Reason: errors.New("Couldn't hash password."), Internal: true}
 	}
 	u.Password = string(pwHash)
-	u.ResetCode = ""
 
-	errM = u.Save(db)
+	errM = app.Users.Save(u)
 	if errM != nil {
 		return errM
 	}
 
-	update := bson.M{"$unset": bson.M{"resetCode": ""}}
-	err = c.UpdateId(u.ID, update)
-	if err != nil {
-		errM = &Error{Internal: true, Reason: errors.New(fmt.Sprintf("Failed to remove user's reset code: %s\n", err))}
-		return
-	}
-
-	return
-}
-
-func UpdateUser(db *mgo.Database, u *UserEditData) *Error {
-	c := db.C("users")
-	err := c.Update(bson.M{"email": u.Email}, bson.M{"$set": u})
-	if err != nil {
-		return &Error{Reason: errors.New(fmt.Sprintf("Failed to update user: %s", err)), Internal: true}
+	// A new password also lifts a lockout.
+	errM = app.Users.Update(u.ID, nil, "lockedUntil")
+	if errM != nil {
+		return errM
 	}
 
-	return nil
+	// Reset links sent before the change must not work afterwards.
+	return app.UserCodes.Revoke(u.ID, RESET_PURPOSE)
 }
@@ -5,8 +5,47 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// What a code sent to a user can be used for.
+const (
+	VERIFY_PURPOSE = "verify"
+	RESET_PURPOSE  = "reset"
+	EMAIL_PURPOSE  = "email"
 )
 
+// How long codes stay valid, see CODE_TTL_VERIFY and CODE_TTL_RESET.
+var codeTTLs = map[string]time.Duration{
+	VERIFY_PURPOSE: 48 * time.Hour,
+	RESET_PURPOSE:  time.Hour,
+	EMAIL_PURPOSE:  48 * time.Hour,
+}
+
+// Used and expired codes are kept this long so people following an old link
+// are told it expired instead of that it never existed.
+const (
+	codeRetention       = 7 * 24 * time.Hour
+	codeCleanupInterval = time.Hour
+)
+
+// UserCode is a single-use code e-mailed to a user. Only its hash is stored.
+type UserCode struct {
+	ID        bson.ObjectID `bson:"_id"`
+	User      bson.ObjectID `bson:"user"`
+	Purpose   string        `bson:"purpose"`
+	Hash      string        `bson:"hash"`
+	CreatedOn time.Time     `bson:"createdOn"`
+	ExpiresOn time.Time     `bson:"expiresOn"`
+	UsedOn    time.Time     `bson:"usedOn,omitempty"`
+
+	// The address an e-mail change switches to.
+	Email string `bson:"email,omitempty"`
+}
+
 // Generate a confirmation code for a user.
 func GenerateConfirmationCode() (code string, errM *Error) {
 	c := 32
@@ -21,3 +60,77 @@ func GenerateConfirmationCode() (code string, errM *Error) {
 
 	return
 }
+
+// IssueUserCode creates a code for the purpose and returns it in plain text.
+// Codes issued earlier for the same purpose stop working.
+func (app *App) IssueUserCode(u *User, purpose string) (string, *Error) {
+	return app.issueUserCode(&UserCode{User: u.ID, Purpose: purpose})
+}
+
+// IssueEmailChangeCode creates a code that switches the user to a new address.
+func (app *App) IssueEmailChangeCode(u *User, email string) (string, *Error) {
+	return app.issueUserCode(&UserCode{User: u.ID, Purpose: EMAIL_PURPOSE, Email: email})
+}
+
+func (app *App) issueUserCode(userCode *UserCode) (string, *Error) {
+	code, errM := GenerateConfirmationCode()
+	if errM != nil {
+		return "", errM
+	}
+
+	errM = app.UserCodes.Revoke(userCode.User, userCode.Purpose)
+	if errM != nil {
+		return "", errM
+	}
+
+	now := time.Now()
+	userCode.ID = bson.NewObjectID()
+	userCode.Hash = HashToken(code)
+	userCode.CreatedOn = now
+	userCode.ExpiresOn = now.Add(codeTTLs[userCode.Purpose])
+	errM = app.UserCodes.Create(userCode)
+	if errM != nil {
+		return "", errM
+	}
+
+	return code, nil
+}
+
+// UseUserCode spends a code issued for one of the purposes and returns the
+// user it was issued to, along with the code.
+func (app *App) UseUserCode(code string, purposes ...string) (*User, *UserCode, *Error) {
+	userCode, errM := app.UserCodes.Use(HashToken(code), purposes...)
+	if errM != nil {
+		return nil, nil, errM
+	}
+
+	if !time.Now().Before(userCode.ExpiresOn) {
+		return nil, nil, &Error{Reason: errors.New(CODE_EXPIRED_ERROR), Code: http.StatusGone}
+	}
+
+	user, errM := app.Users.FindByID(userCode.User)
+	if errM != nil {
+		return nil, nil, errM
+	}
+
+	return user, userCode, nil
+}
+
+// StartUserCodeCleanup removes stale codes now and then for as long as the
+// server runs.
+func StartUserCodeCleanup(app *App) {
+	ctx := logger.WithField("method", "StartUserCodeCleanup")
+
+	go func() {
+		for {
+			removed, errM := app.UserCodes.RemoveStale(time.Now().Add(-codeRetention))
+			if errM != nil {
+				ctx.WithError(errM.Reason).Error("Failed to clean up user codes.")
+			} else if removed > 0 {
+				ctx.WithField("removed", removed).Info("Removed stale user codes.")
+			}
+
+			time.Sleep(codeCleanupInterval)
+		}
+	}()
+}
@@ -9,8 +9,7 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Error struct {
@@ -24,9 +23,10 @@ type Response map[string]interface{}
 type ResponseArray []map[string]interface{}
 
 type TokenData struct {
-	ID  string
-	Iat float64
-	Exp float64
+	ID      string
+	Iat     float64
+	Exp     float64
+	Session string
 }
 
 func RandToken() string {
@@ -87,15 +87,6 @@ func ServeJSONArray(w http.ResponseWriter, r *http.Request, json string, code in
 	fmt.Fprint(w, json)
 }
 
-func GetDB(w http.ResponseWriter, r *http.Request) *mgo.Database {
-	db, ok := context.GetOk(r, "DB")
-	if !ok {
-		ISR(w, r, errors.New("Couldn't obtain DB"))
-		return nil
-	}
-	return db.(*mgo.Database)
-}
-
 func GetToken(w http.ResponseWriter, r *http.Request) *TokenData {
 	token, ok := context.GetOk(r, "token")
 	if !ok {
@@ -104,7 +95,8 @@ func GetToken(w http.ResponseWriter, r *http.Request) *TokenData {
 	}
 
 	tokenData := token.(*jwt.Token).Claims
-	return &TokenData{tokenData["ID"].(string), tokenData["iat"].(float64), tokenData["exp"].(float64)}
+	session, _ := tokenData["sid"].(string)
+	return &TokenData{tokenData["ID"].(string), tokenData["iat"].(float64), tokenData["exp"].(float64), session}
 }
 
 func IsTokenSet(r *http.Request) bool {
@@ -112,8 +104,20 @@ func IsTokenSet(r *http.Request) bool {
 	return ok
 }
 
-func GetUserFromToken(db *mgo.Database, tokenData *TokenData) (*User, *Error) {
-	return FindUserById(db, bson.ObjectIdHex(tokenData.ID))
+func (app *App) GetUserFromToken(tokenData *TokenData) (*User, *Error) {
+	return app.Users.FindByID(ObjectIDHex(tokenData.ID))
+}
+
+// ObjectIDHex reads an ID from a URL or token. Anything that is not an ID
+// becomes the zero ID, which matches nothing.
+func ObjectIDHex(s string) bson.ObjectID {
+	id, _ := bson.ObjectIDFromHex(s)
+	return id
+}
+
+func IsObjectIDHex(s string) bool {
+	_, err := bson.ObjectIDFromHex(s)
+	return err == nil
 }
 
 func Contains(slice []string, element string) bool {